@@ -0,0 +1,226 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package apmqueuetest provides helpers to test the production and
+// consumption of model.Batch against an in-memory Kafka cluster.
+package apmqueuetest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/kafka"
+)
+
+// ConsumeTimeout bounds the time the helpers wait for the events to be
+// consumed.
+const ConsumeTimeout = 10 * time.Second
+
+// groupSeq makes the consumer groups of ConsumeEvents unique.
+var groupSeq atomic.Int64
+
+// NewKafkaCluster returns a single broker in-memory Kafka cluster with the
+// topics created, which is closed when the test finishes.
+func NewKafkaCluster(t testing.TB, partitions int32, topics ...string) *kfake.Cluster {
+	t.Helper()
+	opts := []kfake.Opt{kfake.NumBrokers(1)}
+	if len(topics) > 0 {
+		opts = append(opts, kfake.SeedTopics(partitions, topics...))
+	}
+	cluster, err := kfake.NewCluster(opts...)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+// SuffixTopics returns the topics with the suffix appended, so the tests
+// which share a cluster don't consume each other's events.
+func SuffixTopics(suffix string, topics ...string) []string {
+	suffixed := make([]string, len(topics))
+	for i, topic := range topics {
+		suffixed[i] = topic + suffix
+	}
+	return suffixed
+}
+
+// ProvisionKafka creates the topics with the number of partitions in the
+// cluster the brokers belong to. The topics are deleted when the test
+// finishes.
+func ProvisionKafka(t testing.TB, brokers []string, partitions int32, topics ...string) {
+	t.Helper()
+	admin := newAdminClient(t, brokers)
+	ctx, cancel := context.WithTimeout(context.Background(), ConsumeTimeout)
+	defer cancel()
+	resp, err := admin.CreateTopics(ctx, partitions, 1, nil, topics...)
+	require.NoError(t, err)
+	for _, topic := range topics {
+		require.NoError(t, resp[topic].Err, "failed to create topic %s", topic)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ConsumeTimeout)
+		defer cancel()
+		newAdminClient(t, brokers).DeleteTopics(ctx, topics...)
+	})
+}
+
+func newAdminClient(t testing.TB, brokers []string) *kadm.Client {
+	t.Helper()
+	client, err := kgo.NewClient(kgo.SeedBrokers(brokers...))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	return kadm.NewClient(client)
+}
+
+// NewKafkaProducer returns a kafka.Producer for the config, which is closed
+// when the test finishes. The Logger defaults to a test logger.
+func NewKafkaProducer(t testing.TB, cfg kafka.ProducerConfig) *kafka.Producer {
+	t.Helper()
+	if cfg.Logger == nil {
+		cfg.Logger = zaptest.NewLogger(t)
+	}
+	producer, err := kafka.NewProducer(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+	return producer
+}
+
+// NewKafkaConsumer returns a kafka.Consumer for the config, which is closed
+// when the test finishes. The Logger defaults to a test logger.
+func NewKafkaConsumer(t testing.TB, cfg kafka.ConsumerConfig) *kafka.Consumer {
+	t.Helper()
+	if cfg.Logger == nil {
+		cfg.Logger = zaptest.NewLogger(t)
+	}
+	consumer, err := kafka.NewConsumer(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	return consumer
+}
+
+// ConsumeEvents consumes n events from the start of the topics, with a new
+// consumer group, and returns them in the order they were processed. The
+// test fails if the events aren't consumed within ConsumeTimeout.
+func ConsumeEvents(t testing.TB, brokers []string, n int, topics ...string) model.Batch {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), ConsumeTimeout)
+	defer cancel()
+	var mu sync.Mutex
+	var events model.Batch
+	consumer := NewKafkaConsumer(t, kafka.ConsumerConfig{
+		Brokers: brokers,
+		Topics:  topics,
+		GroupID: fmt.Sprintf("apmqueuetest-%d", groupSeq.Add(1)),
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, *b...)
+			if len(events) >= n {
+				cancel()
+			}
+			return nil
+		}),
+	})
+	consumer.Run(ctx)
+	mu.Lock()
+	defer mu.Unlock()
+	require.GreaterOrEqual(t, len(events), n,
+		"timed out consuming %d events, got %d", n, len(events),
+	)
+	return events
+}
+
+// AssertConsumed asserts that the expected events, in any order, are
+// consumed from the topics.
+func AssertConsumed(t testing.TB, brokers []string, expected model.Batch, topics ...string) bool {
+	t.Helper()
+	return assert.ElementsMatch(t, expected, ConsumeEvents(t, brokers, len(expected), topics...))
+}
+
+// NewKafkaLoopback wires a kafka.Producer and a kafka.Consumer to a new
+// in-memory Kafka cluster, and returns a function which produces an event
+// and returns the time elapsed until it's consumed. The function must not be
+// called concurrently. The consumer has joined its group once
+// NewKafkaLoopback returns, so the measured latencies don't include it.
+func NewKafkaLoopback(t testing.TB) func(context.Context) (time.Duration, error) {
+	t.Helper()
+	const topic = "loopback"
+	brokers := NewKafkaCluster(t, 1, topic).ListenAddrs()
+	producer := NewKafkaProducer(t, kafka.ProducerConfig{
+		Brokers: brokers,
+		Topic:   topic,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	consumed := make(chan string, 1)
+	consumer := NewKafkaConsumer(t, kafka.ConsumerConfig{
+		Brokers: brokers,
+		Topics:  []string{topic},
+		GroupID: fmt.Sprintf("apmqueuetest-%d", groupSeq.Add(1)),
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				select {
+				case consumed <- event.Trace.ID:
+				case <-ctx.Done():
+				}
+			}
+			return nil
+		}),
+	})
+	// Registered after the consumer cleanup, so Run returns before the
+	// consumer is closed.
+	t.Cleanup(cancel)
+	go consumer.Run(ctx)
+
+	var seq int
+	roundTrip := func(ctx context.Context) (time.Duration, error) {
+		seq++
+		id := strconv.Itoa(seq)
+		start := time.Now()
+		batch := model.Batch{{Trace: model.Trace{ID: id}}}
+		if err := producer.ProcessBatch(ctx, &batch); err != nil {
+			return 0, err
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case consumedID := <-consumed:
+				if consumedID == id {
+					return time.Since(start), nil
+				}
+			}
+		}
+	}
+	// Wait for the consumer to join the group.
+	warmup, cancelWarmup := context.WithTimeout(ctx, ConsumeTimeout)
+	defer cancelWarmup()
+	_, err := roundTrip(warmup)
+	require.NoError(t, err, "loopback event not consumed")
+	return roundTrip
+}
@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmqueuetest_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/apmqueuetest"
+	"github.com/elastic/apm-queue/kafka"
+)
+
+func TestProduceConsume(t *testing.T) {
+	cluster := apmqueuetest.NewKafkaCluster(t, 1)
+	brokers := cluster.ListenAddrs()
+	topics := apmqueuetest.SuffixTopics("-"+t.Name(), "traces", "logs")
+	apmqueuetest.ProvisionKafka(t, brokers, 2, topics...)
+
+	var expected model.Batch
+	for _, topic := range topics {
+		producer := apmqueuetest.NewKafkaProducer(t, kafka.ProducerConfig{
+			Brokers: brokers,
+			Topic:   topic,
+		})
+		batch := model.Batch{
+			{Trace: model.Trace{ID: topic}, Message: "first"},
+			{Trace: model.Trace{ID: topic}, Message: "second"},
+		}
+		require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+		expected = append(expected, batch...)
+	}
+	apmqueuetest.AssertConsumed(t, brokers, expected, topics...)
+}
+
+func TestSuffixTopics(t *testing.T) {
+	require.Equal(t, []string{"a-1", "b-1"}, apmqueuetest.SuffixTopics("-1", "a", "b"))
+}
+
+func TestKafkaLoopback(t *testing.T) {
+	roundTrip := apmqueuetest.NewKafkaLoopback(t)
+	ctx, cancel := context.WithTimeout(context.Background(), apmqueuetest.ConsumeTimeout)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		latency, err := roundTrip(ctx)
+		require.NoError(t, err)
+		require.Greater(t, latency, time.Duration(0))
+	}
+}
+
+func BenchmarkKafkaLoopback(b *testing.B) {
+	roundTrip := apmqueuetest.NewKafkaLoopback(b)
+	ctx := context.Background()
+	latencies := make([]time.Duration, 0, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		latency, err := roundTrip(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		latencies = append(latencies, latency)
+	}
+	b.StopTimer()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) float64 {
+		return float64(latencies[int(p*float64(len(latencies)-1))].Nanoseconds())
+	}
+	b.ReportMetric(percentile(0.5), "p50-ns")
+	b.ReportMetric(percentile(0.99), "p99-ns")
+}
@@ -0,0 +1,189 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// CoalescingProducerConfig holds the configuration for the
+// CoalescingProducer.
+type CoalescingProducerConfig struct {
+	// MaxEvents is the number of buffered events which triggers a flush.
+	MaxEvents int
+	// FlushInterval is the maximum time events stay buffered before they're
+	// flushed to the inner producer.
+	FlushInterval time.Duration
+	// OnFlushError, when set, is called with the errors returned by the
+	// inner producer for the flushes triggered by FlushInterval.
+	OnFlushError func(err error)
+
+	// clock is used for the periodic flushes, defaults to the system clock
+	// and is only overridden in tests.
+	clock clock
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg CoalescingProducerConfig) Validate() error {
+	var errs []error
+	if cfg.MaxEvents <= 0 {
+		errs = append(errs, errors.New("apmqueue: max events must be greater than 0"))
+	}
+	if cfg.FlushInterval <= 0 {
+		errs = append(errs, errors.New("apmqueue: flush interval must be greater than 0"))
+	}
+	return errors.Join(errs...)
+}
+
+// CoalescingProducer wraps a Producer, accumulating the events from multiple
+// ProcessBatch calls and flushing them to the inner producer in larger
+// batches, once MaxEvents are buffered or FlushInterval elapses.
+//
+// Events are grouped by the project in the ProcessBatch context, which is
+// set in the context of the flushes. ProcessBatch returns once the events
+// are buffered, unless they trigger a flush.
+//
+// The errors of a flush are returned to its caller, the one whose events
+// reached MaxEvents, Flush or CloseContext, or passed to OnFlushError for
+// the FlushInterval ones, even though the flushed events may have been
+// buffered by other calls. The events which fail to flush are dropped.
+type CoalescingProducer struct {
+	inner Producer
+	cfg   CoalescingProducerConfig
+
+	mu       sync.Mutex
+	buffered int
+	// batches holds the buffered events keyed by project, events without a
+	// project are keyed by the empty string.
+	batches map[string]model.Batch
+
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// NewCoalescingProducer returns a new CoalescingProducer wrapping inner.
+func NewCoalescingProducer(inner Producer, cfg CoalescingProducerConfig) (*CoalescingProducer, error) {
+	if inner == nil {
+		return nil, errors.New("apmqueue: inner producer must be set")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.clock = clockOrDefault(cfg.clock)
+	p := &CoalescingProducer{
+		inner:   inner,
+		cfg:     cfg,
+		batches: make(map[string]model.Batch),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go p.flushPeriodically()
+	return p, nil
+}
+
+// ProcessBatch buffers the events in the batch, flushing the buffered
+// events to the inner producer once MaxEvents are buffered.
+func (p *CoalescingProducer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
+	project, _ := queuecontext.ProjectFromContext(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closed:
+		return errors.New("producer closed")
+	default:
+	}
+	p.batches[project] = append(p.batches[project], *batch...)
+	p.buffered += len(*batch)
+	if p.buffered < p.cfg.MaxEvents {
+		return nil
+	}
+	return p.flush(ctx)
+}
+
+// Flush flushes the buffered events to the inner producer.
+func (p *CoalescingProducer) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.flush(ctx)
+}
+
+// flush must be called with the mutex held.
+func (p *CoalescingProducer) flush(ctx context.Context) error {
+	var errs []error
+	for project, batch := range p.batches {
+		flushCtx := ctx
+		if project != "" {
+			flushCtx = queuecontext.WithProject(ctx, project)
+		}
+		if err := p.inner.ProcessBatch(flushCtx, &batch); err != nil {
+			errs = append(errs, err)
+		}
+		delete(p.batches, project)
+	}
+	p.buffered = 0
+	return errors.Join(errs...)
+}
+
+func (p *CoalescingProducer) flushPeriodically() {
+	defer close(p.done)
+	ticks, stop := p.cfg.clock.NewTicker(p.cfg.FlushInterval)
+	defer stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticks:
+			if err := p.Flush(context.Background()); err != nil && p.cfg.OnFlushError != nil {
+				p.cfg.OnFlushError(err)
+			}
+		}
+	}
+}
+
+// Healthy returns the health of the inner producer.
+func (p *CoalescingProducer) Healthy() error {
+	return p.inner.Healthy()
+}
+
+// Close flushes the buffered events and closes the inner producer.
+func (p *CoalescingProducer) Close() error {
+	return p.CloseContext(context.Background())
+}
+
+// CloseContext flushes the buffered events with the context and closes the
+// inner producer. The buffered events are dropped when the flush fails, and
+// its error is returned.
+func (p *CoalescingProducer) CloseContext(ctx context.Context) error {
+	p.mu.Lock()
+	select {
+	case <-p.closed:
+		p.mu.Unlock()
+		return errors.New("apmqueue: producer already closed")
+	default:
+	}
+	close(p.closed)
+	p.mu.Unlock()
+	<-p.done
+	return errors.Join(p.Flush(ctx), p.inner.Close())
+}
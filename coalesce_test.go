@@ -0,0 +1,187 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+type recordingProducer struct {
+	mu      sync.Mutex
+	batches []model.Batch
+	// projects holds the project of each batch.
+	projects []string
+	closed   bool
+	// err, when set, is returned by ProcessBatch.
+	err error
+}
+
+func (p *recordingProducer) ProcessBatch(ctx context.Context, b *model.Batch) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	project, _ := queuecontext.ProjectFromContext(ctx)
+	p.batches = append(p.batches, append(model.Batch(nil), *b...))
+	p.projects = append(p.projects, project)
+	return p.err
+}
+
+func (p *recordingProducer) Healthy() error { return nil }
+
+func (p *recordingProducer) Close() error {
+	p.closed = true
+	return nil
+}
+
+func (p *recordingProducer) sizes() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sizes := make([]int, 0, len(p.batches))
+	for _, b := range p.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func TestCoalescingProducerConfigValidate(t *testing.T) {
+	assert.EqualError(t, CoalescingProducerConfig{}.Validate(),
+		"apmqueue: max events must be greater than 0\n"+
+			"apmqueue: flush interval must be greater than 0",
+	)
+	_, err := NewCoalescingProducer(nil, CoalescingProducerConfig{})
+	assert.EqualError(t, err, "apmqueue: inner producer must be set")
+}
+
+func TestCoalescingProducerMaxEvents(t *testing.T) {
+	inner := &recordingProducer{}
+	producer, err := NewCoalescingProducer(inner, CoalescingProducerConfig{
+		MaxEvents:     10,
+		FlushInterval: time.Hour,
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for i := 0; i < 95; i++ {
+		require.NoError(t, producer.ProcessBatch(ctx, &model.Batch{{}}))
+	}
+	assert.Equal(t, []int{10, 10, 10, 10, 10, 10, 10, 10, 10}, inner.sizes())
+
+	// The remaining events are flushed on close.
+	require.NoError(t, producer.Close())
+	assert.Equal(t, []int{10, 10, 10, 10, 10, 10, 10, 10, 10, 5}, inner.sizes())
+	assert.True(t, inner.closed)
+	assert.EqualError(t, producer.ProcessBatch(ctx, &model.Batch{{}}), "producer closed")
+}
+
+func TestCoalescingProducerFlushInterval(t *testing.T) {
+	inner := &recordingProducer{}
+	producer, err := NewCoalescingProducer(inner, CoalescingProducerConfig{
+		MaxEvents:     100,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, producer.ProcessBatch(context.Background(), &model.Batch{{}}))
+	}
+	assert.Eventually(t, func() bool {
+		sizes := inner.sizes()
+		return len(sizes) == 1 && sizes[0] == 3
+	}, time.Second, time.Millisecond)
+}
+
+// fakeClock is a clock whose tickers only tick when ticked.
+type fakeClock struct {
+	ticks chan time.Time
+}
+
+func (c fakeClock) NewTicker(time.Duration) (<-chan time.Time, func()) {
+	return c.ticks, func() {}
+}
+
+func TestCoalescingProducerFlushIntervalClock(t *testing.T) {
+	inner := &recordingProducer{err: errors.New("boom")}
+	clock := fakeClock{ticks: make(chan time.Time)}
+	flushErrs := make(chan error, 1)
+	producer, err := NewCoalescingProducer(inner, CoalescingProducerConfig{
+		MaxEvents:     100,
+		FlushInterval: time.Hour,
+		OnFlushError:  func(err error) { flushErrs <- err },
+		clock:         clock,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, producer.ProcessBatch(context.Background(), &model.Batch{{}}))
+	}
+	assert.Empty(t, inner.sizes())
+	// The buffered events are flushed on the tick, long before FlushInterval.
+	clock.ticks <- time.Now()
+	assert.EqualError(t, <-flushErrs, "boom")
+	assert.Equal(t, []int{3}, inner.sizes())
+}
+
+func TestCoalescingProducerProjects(t *testing.T) {
+	inner := &recordingProducer{}
+	producer, err := NewCoalescingProducer(inner, CoalescingProducerConfig{
+		MaxEvents:     4,
+		FlushInterval: time.Hour,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx := context.Background()
+	for _, project := range []string{"a", "b", "a", ""} {
+		projectCtx := ctx
+		if project != "" {
+			projectCtx = queuecontext.WithProject(ctx, project)
+		}
+		require.NoError(t, producer.ProcessBatch(projectCtx, &model.Batch{{}}))
+	}
+	assert.ElementsMatch(t, []int{2, 1, 1}, inner.sizes())
+	assert.ElementsMatch(t, []string{"a", "b", ""}, inner.projects)
+}
+
+func TestCoalescingProducerClose(t *testing.T) {
+	inner := &recordingProducer{err: errors.New("flush failed")}
+	p, err := NewCoalescingProducer(inner, CoalescingProducerConfig{
+		MaxEvents: 10, FlushInterval: time.Hour,
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.ProcessBatch(context.Background(), &model.Batch{{}}))
+
+	// The error of the final flush is returned, and the events are dropped.
+	assert.ErrorIs(t, p.Close(), inner.err)
+	assert.Equal(t, []int{1}, inner.sizes())
+	assert.True(t, inner.closed)
+	assert.Error(t, p.ProcessBatch(context.Background(), &model.Batch{{}}))
+	// Closing again returns an error, rather than panicking.
+	assert.EqualError(t, p.Close(), "apmqueue: producer already closed")
+	assert.Equal(t, []int{1}, inner.sizes())
+}
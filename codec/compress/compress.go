@@ -0,0 +1,137 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package compress provides a codec which compresses the encoded events.
+//
+// The compressed payloads are prefixed with a one byte marker identifying the
+// algorithm, so records written with different algorithms, or by producers
+// which don't compress at all, can be decoded by the same consumer.
+package compress
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/elastic/apm-data/model"
+)
+
+const (
+	// None prefixes the payloads with the None marker, without compressing
+	// them.
+	None Algorithm = iota
+	// Zstd compresses the payloads with zstd.
+	Zstd
+)
+
+// Algorithm is the compression algorithm, which is also the marker byte
+// prefixed to the payloads.
+type Algorithm byte
+
+func (a Algorithm) String() string {
+	switch a {
+	case None:
+		return "none"
+	case Zstd:
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// Codec is the inner codec whose output is compressed.
+type Codec interface {
+	Encode(model.APMEvent) ([]byte, error)
+	Decode([]byte, *model.APMEvent) error
+}
+
+// Compress compresses the events encoded by the inner codec, and decompresses
+// them before they are decoded by the inner codec.
+//
+// Decode detects the algorithm of each payload from its marker. Payloads
+// which don't start with a known marker are considered to be written by a
+// producer which doesn't compress and are decoded by the inner codec as is.
+// This relies on the inner codec output never starting with a marker byte,
+// which holds for JSON.
+type Compress struct {
+	algorithm Algorithm
+	inner     Codec
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+}
+
+// New returns a new Compress codec, which compresses the encoded events with
+// the algorithm.
+func New(algorithm Algorithm, inner Codec) (*Compress, error) {
+	if inner == nil {
+		return nil, errors.New("compress: inner codec must be set")
+	}
+	if algorithm > Zstd {
+		return nil, fmt.Errorf("compress: unknown algorithm %d", algorithm)
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, fmt.Errorf("compress: failed to create zstd encoder: %w", err)
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, fmt.Errorf("compress: failed to create zstd decoder: %w", err)
+	}
+	return &Compress{
+		algorithm: algorithm,
+		inner:     inner,
+		encoder:   encoder,
+		decoder:   decoder,
+	}, nil
+}
+
+// Encode encodes the event with the inner codec and compresses the result,
+// prefixed with the algorithm marker.
+func (c *Compress) Encode(event model.APMEvent) ([]byte, error) {
+	encoded, err := c.inner.Encode(event)
+	if err != nil {
+		return nil, err
+	}
+	switch c.algorithm {
+	case Zstd:
+		return c.encoder.EncodeAll(encoded, []byte{byte(Zstd)}), nil
+	default:
+		return append([]byte{byte(None)}, encoded...), nil
+	}
+}
+
+// Decode decompresses the data according to its marker and decodes the
+// result with the inner codec.
+func (c *Compress) Decode(data []byte, event *model.APMEvent) error {
+	if len(data) == 0 {
+		return c.inner.Decode(data, event)
+	}
+	switch Algorithm(data[0]) {
+	case None:
+		return c.inner.Decode(data[1:], event)
+	case Zstd:
+		decompressed, err := c.decoder.DecodeAll(data[1:], nil)
+		if err != nil {
+			return fmt.Errorf("compress: failed to decompress zstd: %w", err)
+		}
+		return c.inner.Decode(decompressed, event)
+	default:
+		// Not written by a Compress codec.
+		return c.inner.Decode(data, event)
+	}
+}
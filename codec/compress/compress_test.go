@@ -0,0 +1,87 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package compress
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New(Zstd, nil)
+	assert.EqualError(t, err, "compress: inner codec must be set")
+	_, err = New(100, json.JSON{})
+	assert.EqualError(t, err, "compress: unknown algorithm 100")
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	event := model.APMEvent{Message: strings.Repeat("message ", 100)}
+	for _, algorithm := range []Algorithm{None, Zstd} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			codec, err := New(algorithm, json.JSON{})
+			require.NoError(t, err)
+			encoded, err := codec.Encode(event)
+			require.NoError(t, err)
+			assert.Equal(t, byte(algorithm), encoded[0])
+
+			var decoded model.APMEvent
+			require.NoError(t, codec.Decode(encoded, &decoded))
+			assert.Equal(t, event, decoded)
+		})
+	}
+}
+
+func TestCompressMixed(t *testing.T) {
+	zstdCodec, err := New(Zstd, json.JSON{})
+	require.NoError(t, err)
+	noneCodec, err := New(None, json.JSON{})
+	require.NoError(t, err)
+
+	var records [][]byte
+	var expected []model.APMEvent
+	for i, codec := range []Codec{zstdCodec, json.JSON{}, noneCodec, zstdCodec, json.JSON{}} {
+		event := model.APMEvent{Message: strings.Repeat("m", i+1)}
+		encoded, err := codec.Encode(event)
+		require.NoError(t, err)
+		records = append(records, encoded)
+		expected = append(expected, event)
+	}
+
+	// A single codec decodes the records of all the producers.
+	var decoded []model.APMEvent
+	for _, record := range records {
+		var event model.APMEvent
+		require.NoError(t, zstdCodec.Decode(record, &event))
+		decoded = append(decoded, event)
+	}
+	assert.Equal(t, expected, decoded)
+}
+
+func TestCompressCorrupted(t *testing.T) {
+	codec, err := New(Zstd, json.JSON{})
+	require.NoError(t, err)
+	var event model.APMEvent
+	err = codec.Decode([]byte{byte(Zstd), 1, 2, 3}, &event)
+	assert.ErrorContains(t, err, "compress: failed to decompress zstd")
+}
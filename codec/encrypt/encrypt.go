@@ -0,0 +1,88 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package encrypt provides a codec which encrypts the encoded events with
+// AES-GCM.
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// Codec is the inner codec whose output is encrypted.
+type Codec interface {
+	Encode(model.APMEvent) ([]byte, error)
+	Decode([]byte, *model.APMEvent) error
+}
+
+// Encrypt encrypts the events encoded by the inner codec with AES-GCM, and
+// decrypts them before they are decoded by the inner codec. The random nonce
+// is prepended to the ciphertext.
+type Encrypt struct {
+	aead  cipher.AEAD
+	inner Codec
+}
+
+// New returns a new Encrypt codec. The key must be 16, 24 or 32 bytes long,
+// to select AES-128, AES-192 or AES-256.
+func New(key []byte, inner Codec) (*Encrypt, error) {
+	if inner == nil {
+		return nil, errors.New("encrypt: inner codec must be set")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: invalid key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: failed to create cipher: %w", err)
+	}
+	return &Encrypt{aead: aead, inner: inner}, nil
+}
+
+// Encode encodes the event with the inner codec and encrypts the result.
+func (e *Encrypt) Encode(event model.APMEvent) ([]byte, error) {
+	plaintext, err := e.inner.Encode(event)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(plaintext)+e.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("encrypt: failed to generate nonce: %w", err)
+	}
+	return e.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decode decrypts the data and decodes the result with the inner codec.
+func (e *Encrypt) Decode(data []byte, event *model.APMEvent) error {
+	if len(data) < e.aead.NonceSize() {
+		return errors.New("encrypt: ciphertext too short")
+	}
+	nonce, ciphertext := data[:e.aead.NonceSize()], data[e.aead.NonceSize():]
+	plaintext, err := e.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return fmt.Errorf("encrypt: failed to decrypt: %w", err)
+	}
+	return e.inner.Decode(plaintext, event)
+}
@@ -0,0 +1,75 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package encrypt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func newCodec(t testing.TB) *Encrypt {
+	t.Helper()
+	codec, err := New(bytes.Repeat([]byte("k"), 32), json.JSON{})
+	require.NoError(t, err)
+	return codec
+}
+
+func TestNew(t *testing.T) {
+	_, err := New([]byte("short"), json.JSON{})
+	assert.EqualError(t, err, "encrypt: invalid key: crypto/aes: invalid key size 5")
+	_, err = New(bytes.Repeat([]byte("k"), 16), nil)
+	assert.EqualError(t, err, "encrypt: inner codec must be set")
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	codec := newCodec(t)
+	event := model.APMEvent{Trace: model.Trace{ID: "trace_id"}}
+	encoded, err := codec.Encode(event)
+	require.NoError(t, err)
+	assert.NotContains(t, string(encoded), "trace_id")
+
+	// The nonce is random, encoding the same event twice differs.
+	again, err := codec.Encode(event)
+	require.NoError(t, err)
+	assert.NotEqual(t, encoded, again)
+
+	var decoded model.APMEvent
+	require.NoError(t, codec.Decode(encoded, &decoded))
+	assert.Equal(t, event, decoded)
+}
+
+func TestEncryptTampered(t *testing.T) {
+	codec := newCodec(t)
+	encoded, err := codec.Encode(model.APMEvent{Trace: model.Trace{ID: "trace_id"}})
+	require.NoError(t, err)
+	encoded[len(encoded)-1] ^= 0xff
+
+	var decoded model.APMEvent
+	assert.EqualError(t, codec.Decode(encoded, &decoded),
+		"encrypt: failed to decrypt: cipher: message authentication failed",
+	)
+	assert.EqualError(t, codec.Decode(encoded[:4], &decoded),
+		"encrypt: ciphertext too short",
+	)
+}
@@ -0,0 +1,114 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package envelope provides a codec which wraps the encoded events in a
+// protobuf google.protobuf.Any envelope, tagged with the type URL of the
+// payload.
+//
+// The envelope lets a topic carry heterogeneous payloads: consumers can read
+// the type URL of each record with TypeURL, without decoding its payload, and
+// dispatch the record to the codec of its type.
+package envelope
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// APMEventTypeURL is the type URL of the envelopes holding a model.APMEvent.
+const APMEventTypeURL = "type.elastic.co/elastic.apm.v1.APMEvent"
+
+// ErrUnexpectedType is returned by Decode for the envelopes whose type URL
+// isn't the one of the codec.
+var ErrUnexpectedType = errors.New("envelope: unexpected payload type")
+
+// Codec is the inner codec which encodes the payload of the envelopes.
+type Codec interface {
+	Encode(model.APMEvent) ([]byte, error)
+	Decode([]byte, *model.APMEvent) error
+}
+
+// Envelope wraps the events encoded by the inner codec in an envelope tagged
+// with the type URL, and unwraps them before they are decoded by the inner
+// codec.
+type Envelope struct {
+	typeURL string
+	inner   Codec
+}
+
+// New returns a new Envelope codec, which tags the events encoded by the
+// inner codec with APMEventTypeURL.
+func New(inner Codec) (*Envelope, error) {
+	return NewWithTypeURL(APMEventTypeURL, inner)
+}
+
+// NewWithTypeURL returns a new Envelope codec, which tags the events encoded
+// by the inner codec with the type URL, such as to version the payloads.
+func NewWithTypeURL(typeURL string, inner Codec) (*Envelope, error) {
+	if inner == nil {
+		return nil, errors.New("envelope: inner codec must be set")
+	}
+	if typeURL == "" {
+		return nil, errors.New("envelope: type URL must be set")
+	}
+	return &Envelope{typeURL: typeURL, inner: inner}, nil
+}
+
+// Encode encodes the event with the inner codec and wraps the result in an
+// envelope.
+func (e *Envelope) Encode(event model.APMEvent) ([]byte, error) {
+	payload, err := e.inner.Encode(event)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&anypb.Any{TypeUrl: e.typeURL, Value: payload})
+}
+
+// Decode unwraps the envelope and decodes its payload with the inner codec.
+// It returns an error wrapping ErrUnexpectedType when the envelope type URL
+// isn't the codec one.
+func (e *Envelope) Decode(data []byte, event *model.APMEvent) error {
+	typeURL, payload, err := Unwrap(data)
+	if err != nil {
+		return err
+	}
+	if typeURL != e.typeURL {
+		return fmt.Errorf("%w %q", ErrUnexpectedType, typeURL)
+	}
+	return e.inner.Decode(payload, event)
+}
+
+// Unwrap returns the type URL and the payload of the envelope, without
+// decoding the payload.
+func Unwrap(data []byte) (typeURL string, payload []byte, err error) {
+	var envelope anypb.Any
+	if err := proto.Unmarshal(data, &envelope); err != nil {
+		return "", nil, fmt.Errorf("envelope: failed to unmarshal: %w", err)
+	}
+	return envelope.TypeUrl, envelope.Value, nil
+}
+
+// TypeURL returns the type URL of the envelope, without decoding its payload.
+func TypeURL(data []byte) (string, error) {
+	typeURL, _, err := Unwrap(data)
+	return typeURL, err
+}
@@ -0,0 +1,74 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package envelope
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New(nil)
+	assert.EqualError(t, err, "envelope: inner codec must be set")
+	_, err = NewWithTypeURL("", json.JSON{})
+	assert.EqualError(t, err, "envelope: type URL must be set")
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	codec, err := New(json.JSON{})
+	require.NoError(t, err)
+	event := model.APMEvent{Trace: model.Trace{ID: "trace"}, Message: "message"}
+	encoded, err := codec.Encode(event)
+	require.NoError(t, err)
+
+	// The type URL is read without decoding the payload.
+	typeURL, err := TypeURL(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, APMEventTypeURL, typeURL)
+	_, payload, err := Unwrap(encoded)
+	require.NoError(t, err)
+	inner, err := json.JSON{}.Encode(event)
+	require.NoError(t, err)
+	assert.Equal(t, inner, payload)
+
+	var decoded model.APMEvent
+	require.NoError(t, codec.Decode(encoded, &decoded))
+	assert.Equal(t, event, decoded)
+}
+
+func TestEnvelopeUnexpectedType(t *testing.T) {
+	v2, err := NewWithTypeURL("type.elastic.co/elastic.apm.v2.APMEvent", json.JSON{})
+	require.NoError(t, err)
+	encoded, err := v2.Encode(model.APMEvent{})
+	require.NoError(t, err)
+
+	codec, err := New(json.JSON{})
+	require.NoError(t, err)
+	var decoded model.APMEvent
+	err = codec.Decode(encoded, &decoded)
+	assert.ErrorIs(t, err, ErrUnexpectedType)
+	assert.EqualError(t, err, `envelope: unexpected payload type "type.elastic.co/elastic.apm.v2.APMEvent"`)
+
+	_, err = TypeURL([]byte("not an envelope"))
+	assert.ErrorContains(t, err, "envelope: failed to unmarshal")
+}
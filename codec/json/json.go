@@ -0,0 +1,88 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package json provides a JSON codec for model.APMEvent.
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// JSON encodes and decodes model.APMEvent as JSON.
+type JSON struct{}
+
+// CodecName returns "json".
+func (JSON) CodecName() string {
+	return "json"
+}
+
+// Encode encodes the event as JSON.
+func (JSON) Encode(event model.APMEvent) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+// Decode decodes the JSON encoded data into the event.
+func (JSON) Decode(data []byte, event *model.APMEvent) error {
+	return json.Unmarshal(data, event)
+}
+
+// Lines encodes model.APMEvent as JSON, like JSON, and decodes the records
+// holding multiple events, either as JSON lines or as a JSON array of events.
+type Lines struct{}
+
+// CodecName returns "json", since the single events are encoded as JSON.
+func (Lines) CodecName() string {
+	return "json"
+}
+
+// Encode encodes the event as JSON.
+func (Lines) Encode(event model.APMEvent) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+// Decode decodes the JSON encoded data into the event.
+func (Lines) Decode(data []byte, event *model.APMEvent) error {
+	return json.Unmarshal(data, event)
+}
+
+// DecodeBatch decodes the JSON lines, or the JSON array of events, encoded
+// in data, appending the events to the batch.
+func (Lines) DecodeBatch(data []byte, batch *model.Batch) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var events model.Batch
+		if err := json.Unmarshal(trimmed, &events); err != nil {
+			return err
+		}
+		*batch = append(*batch, events...)
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var event model.APMEvent
+		if err := dec.Decode(&event); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		*batch = append(*batch, event)
+	}
+}
@@ -0,0 +1,271 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package schemaregistry provides a client which fetches and caches the
+// schemas registered in a Confluent compatible schema registry, for the
+// codecs which encode the events with registered schemas.
+package schemaregistry
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the number of schemas cached when CacheSize isn't set.
+const DefaultCacheSize = 1000
+
+// Config holds the configuration of the schema registry Client.
+type Config struct {
+	// URL of the schema registry.
+	URL string
+	// HTTPClient used to issue the requests, defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// CacheSize is the maximum number of cached schemas, the least recently
+	// used schemas are evicted once it's exceeded. Defaults to
+	// DefaultCacheSize.
+	CacheSize int
+	// CacheTTL, when set, is the time after which the cached schemas are
+	// fetched again. By default, cached schemas don't expire.
+	CacheTTL time.Duration
+	// Timeout, when set, bounds each request to the schema registry, so an
+	// unresponsive registry fails with ErrRegistryUnavailable instead of
+	// blocking until the context is done.
+	Timeout time.Duration
+	// Fallback defines how schemas are served while the schema registry is
+	// unavailable, defaults to FallbackFailFast.
+	Fallback FallbackPolicy
+}
+
+// FallbackPolicy defines how the Client serves schemas when the schema
+// registry is unavailable.
+type FallbackPolicy uint8
+
+const (
+	// FallbackFailFast fails the schemas which aren't cached, or whose
+	// cache entry expired, with ErrRegistryUnavailable.
+	FallbackFailFast FallbackPolicy = iota
+	// FallbackStaleCache serves the expired cached schemas until the schema
+	// registry is available again, so the events encoded with known schemas
+	// are still produced. Schemas which were never cached fail with
+	// ErrRegistryUnavailable.
+	FallbackStaleCache
+)
+
+// ErrRegistryUnavailable is returned, wrapped, when the schema registry
+// can't be reached, times out or fails with a server error.
+var ErrRegistryUnavailable = errors.New("schema registry unavailable")
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg Config) Validate() error {
+	var errs []error
+	if cfg.URL == "" {
+		errs = append(errs, errors.New("schemaregistry: url must be set"))
+	} else if _, err := url.Parse(cfg.URL); err != nil {
+		errs = append(errs, fmt.Errorf("schemaregistry: invalid url: %w", err))
+	}
+	if cfg.CacheSize < 0 {
+		errs = append(errs, errors.New("schemaregistry: cache size cannot be negative"))
+	}
+	if cfg.CacheTTL < 0 {
+		errs = append(errs, errors.New("schemaregistry: cache ttl cannot be negative"))
+	}
+	if cfg.Timeout < 0 {
+		errs = append(errs, errors.New("schemaregistry: timeout cannot be negative"))
+	}
+	if cfg.Fallback > FallbackStaleCache {
+		errs = append(errs, errors.New("schemaregistry: unknown fallback policy"))
+	}
+	return errors.Join(errs...)
+}
+
+// Schema is a schema registered in the schema registry.
+type Schema struct {
+	// ID of the schema.
+	ID int
+	// Type of the schema, AVRO when empty.
+	Type string `json:"schemaType"`
+	// Schema definition.
+	Schema string `json:"schema"`
+}
+
+// CacheStats holds the schema cache counters.
+type CacheStats struct {
+	// Hits is the number of schemas served from the cache.
+	Hits int64
+	// Misses is the number of schemas fetched from the schema registry,
+	// because they weren't cached or had expired.
+	Misses int64
+	// Evictions is the number of schemas evicted from the cache to stay
+	// within CacheSize.
+	Evictions int64
+	// Stale is the number of expired schemas served from the cache while
+	// the schema registry was unavailable.
+	Stale int64
+}
+
+// Client fetches schemas from the schema registry, caching them by ID.
+type Client struct {
+	cfg Config
+	now func() time.Time
+
+	mu      sync.Mutex
+	stats   CacheStats
+	lru     *list.List
+	entries map[int]*list.Element
+}
+
+type cacheEntry struct {
+	schema  Schema
+	fetched time.Time
+}
+
+// New returns a new schema registry Client.
+func New(cfg Config) (*Client, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = DefaultCacheSize
+	}
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+	return &Client{
+		cfg:     cfg,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[int]*list.Element),
+	}, nil
+}
+
+// Schema returns the schema with the ID, fetching it from the schema registry
+// unless it's cached. When the registry is unavailable, the error wraps
+// ErrRegistryUnavailable, unless an expired schema is served as configured
+// by Fallback.
+func (c *Client) Schema(ctx context.Context, id int) (Schema, error) {
+	cached, expired, ok := c.cached(id)
+	if ok && !expired {
+		return cached, nil
+	}
+	schema, err := c.fetch(ctx, id)
+	if err != nil {
+		if ok && c.cfg.Fallback == FallbackStaleCache && errors.Is(err, ErrRegistryUnavailable) {
+			c.mu.Lock()
+			c.stats.Stale++
+			c.mu.Unlock()
+			return cached, nil
+		}
+		return Schema{}, err
+	}
+	c.store(schema)
+	return schema, nil
+}
+
+// Stats returns the schema cache counters.
+func (c *Client) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// cached returns the cached schema with the ID, and whether it expired.
+// Expired schemas are kept until they're fetched again or evicted, so they
+// can be served while the schema registry is unavailable.
+func (c *Client) cached(id int) (schema Schema, expired, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[id]
+	if !ok {
+		c.stats.Misses++
+		return Schema{}, false, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	c.lru.MoveToFront(elem)
+	if c.cfg.CacheTTL > 0 && c.now().Sub(entry.fetched) >= c.cfg.CacheTTL {
+		c.stats.Misses++
+		return entry.schema, true, true
+	}
+	c.stats.Hits++
+	return entry.schema, false, true
+}
+
+func (c *Client) store(schema Schema) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[schema.ID]; ok {
+		// Expired, or fetched concurrently.
+		elem.Value = &cacheEntry{schema: schema, fetched: c.now()}
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[schema.ID] = c.lru.PushFront(&cacheEntry{schema: schema, fetched: c.now()})
+	for c.lru.Len() > c.cfg.CacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).schema.ID)
+		c.stats.Evictions++
+	}
+}
+
+func (c *Client) fetch(ctx context.Context, id int) (Schema, error) {
+	reqCtx := ctx
+	if c.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, c.cfg.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet,
+		fmt.Sprintf("%s/schemas/ids/%d", c.cfg.URL, id), nil,
+	)
+	if err != nil {
+		return Schema{}, err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The caller gave up, the registry may be available.
+			return Schema{}, fmt.Errorf("schemaregistry: failed to fetch schema %d: %w", id, err)
+		}
+		return Schema{}, fmt.Errorf("schemaregistry: failed to fetch schema %d: %w: %w",
+			id, ErrRegistryUnavailable, err,
+		)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return Schema{}, fmt.Errorf("schemaregistry: failed to fetch schema %d: %w: %s",
+			id, ErrRegistryUnavailable, resp.Status,
+		)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Schema{}, fmt.Errorf("schemaregistry: failed to fetch schema %d: %s", id, resp.Status)
+	}
+	schema := Schema{ID: id}
+	if err := json.NewDecoder(resp.Body).Decode(&schema); err != nil {
+		return Schema{}, fmt.Errorf("schemaregistry: failed to decode schema %d: %w", id, err)
+	}
+	return schema, nil
+}
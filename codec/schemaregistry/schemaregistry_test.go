@@ -0,0 +1,177 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package schemaregistry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRegistry returns a schema registry serving a schema for any positive ID,
+// and the counter of the requests it received.
+func newRegistry(t testing.TB) (*httptest.Server, *atomic.Int64) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var id int
+		if _, err := fmt.Sscanf(r.URL.Path, "/schemas/ids/%d", &id); err != nil || id <= 0 {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"schema":"{\"type\":\"record\",\"name\":\"r%d\"}"}`, id)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.EqualError(t, Config{CacheSize: -1, CacheTTL: -1, Timeout: -1, Fallback: 100}.Validate(),
+		"schemaregistry: url must be set\n"+
+			"schemaregistry: cache size cannot be negative\n"+
+			"schemaregistry: cache ttl cannot be negative\n"+
+			"schemaregistry: timeout cannot be negative\n"+
+			"schemaregistry: unknown fallback policy",
+	)
+}
+
+func TestClientSchema(t *testing.T) {
+	srv, requests := newRegistry(t)
+	client, err := New(Config{URL: srv.URL})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	schema, err := client.Schema(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, Schema{ID: 1, Schema: `{"type":"record","name":"r1"}`}, schema)
+	cached, err := client.Schema(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, schema, cached)
+	assert.Equal(t, int64(1), requests.Load())
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1}, client.Stats())
+
+	_, err = client.Schema(ctx, -1)
+	assert.EqualError(t, err, "schemaregistry: failed to fetch schema -1: 404 Not Found")
+}
+
+func TestClientCacheEvictions(t *testing.T) {
+	srv, requests := newRegistry(t)
+	client, err := New(Config{URL: srv.URL, CacheSize: 2})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for _, id := range []int{1, 2, 1, 3} {
+		_, err := client.Schema(ctx, id)
+		require.NoError(t, err)
+	}
+	// 2 was the least recently used schema when 3 was fetched.
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 3, Evictions: 1}, client.Stats())
+	_, err = client.Schema(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 4, Evictions: 2}, client.Stats())
+	assert.Equal(t, int64(4), requests.Load())
+}
+
+func TestClientCacheTTL(t *testing.T) {
+	srv, requests := newRegistry(t)
+	client, err := New(Config{URL: srv.URL, CacheTTL: time.Minute})
+	require.NoError(t, err)
+	now := time.Now()
+	client.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	_, err = client.Schema(ctx, 1)
+	require.NoError(t, err)
+	now = now.Add(30 * time.Second)
+	_, err = client.Schema(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1}, client.Stats())
+
+	now = now.Add(time.Minute)
+	_, err = client.Schema(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 2}, client.Stats())
+	assert.Equal(t, int64(2), requests.Load())
+}
+
+func TestClientRegistryUnavailable(t *testing.T) {
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			// Hang until the client gives up.
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, `{"schema":"{\"type\":\"string\"}"}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	for name, tc := range map[string]struct {
+		fallback FallbackPolicy
+		stale    bool
+	}{
+		"fail_fast":   {fallback: FallbackFailFast},
+		"stale_cache": {fallback: FallbackStaleCache, stale: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			down.Store(false)
+			client, err := New(Config{
+				URL:      srv.URL,
+				CacheTTL: time.Minute,
+				Timeout:  50 * time.Millisecond,
+				Fallback: tc.fallback,
+			})
+			require.NoError(t, err)
+			now := time.Now()
+			client.now = func() time.Time { return now }
+
+			ctx := context.Background()
+			schema, err := client.Schema(ctx, 1)
+			require.NoError(t, err)
+
+			down.Store(true)
+			now = now.Add(2 * time.Minute)
+			cached, err := client.Schema(ctx, 1)
+			if tc.stale {
+				require.NoError(t, err)
+				assert.Equal(t, schema, cached)
+				assert.Equal(t, int64(1), client.Stats().Stale)
+			} else {
+				assert.ErrorIs(t, err, ErrRegistryUnavailable)
+			}
+			// Schemas which were never cached can't be served.
+			_, err = client.Schema(ctx, 2)
+			assert.ErrorIs(t, err, ErrRegistryUnavailable)
+
+			// The caller's context being done doesn't mean the registry is
+			// unavailable.
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err = client.Schema(cancelled, 2)
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.NotErrorIs(t, err, ErrRegistryUnavailable)
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/kversion"
+)
+
+// franzGoModule is the module path of the franz-go Kafka client.
+const franzGoModule = "github.com/twmb/franz-go"
+
+// ClientVersion returns the version of the franz-go Kafka client the binary
+// was built with, or "unknown" when the build information isn't available.
+func ClientVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == franzGoModule {
+				return dep.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
+// APIVersions returns the Kafka API versions negotiated with the brokers by
+// the producer clients, including the ones of the compression overrides,
+// the lowest of them for each API. See apiVersions.
+func (p *Producer) APIVersions(ctx context.Context) (map[string]int16, error) {
+	var versions map[string]int16
+	for _, client := range p.clients() {
+		negotiated, err := apiVersions(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		if versions == nil {
+			versions = negotiated
+			continue
+		}
+		for api, version := range negotiated {
+			if lowest, ok := versions[api]; !ok || version < lowest {
+				versions[api] = version
+			}
+		}
+	}
+	return versions, nil
+}
+
+// APIVersions returns the Kafka API versions negotiated with the brokers.
+// See apiVersions.
+func (c *Consumer) APIVersions(ctx context.Context) (map[string]int16, error) {
+	return apiVersions(ctx, c.client)
+}
+
+// APIVersions returns the Kafka API versions negotiated with the brokers.
+// See apiVersions.
+func (c *DirectPartitionConsumer) APIVersions(ctx context.Context) (map[string]int16, error) {
+	return apiVersions(ctx, c.client)
+}
+
+// apiVersions returns the versions of the APIs supported by the client and
+// all the brokers, keyed by API name. Each version is the highest supported
+// by both the client and the broker supporting the lowest one.
+func apiVersions(ctx context.Context, client *kgo.Client) (map[string]int16, error) {
+	brokers, err := kadm.NewClient(client).ApiVersions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed to request api versions: %w", err)
+	}
+	supported := kversion.Stable()
+	var versions map[int16]int16
+	for _, broker := range brokers.Sorted() {
+		if broker.Err != nil {
+			return nil, fmt.Errorf("kafka: failed to request broker %d api versions: %w",
+				broker.NodeID, broker.Err,
+			)
+		}
+		negotiated := make(map[int16]int16)
+		broker.EachKeySorted(func(key, _, max int16) {
+			clientMax, ok := supported.LookupMaxKeyVersion(key)
+			if !ok {
+				return
+			}
+			if clientMax < max {
+				max = clientMax
+			}
+			if versions != nil {
+				v, ok := versions[key]
+				if !ok {
+					return // Not supported by a previous broker.
+				}
+				if v < max {
+					max = v
+				}
+			}
+			negotiated[key] = max
+		})
+		versions = negotiated
+	}
+	named := make(map[string]int16, len(versions))
+	for key, v := range versions {
+		named[kmsg.NameForKey(key)] = v
+	}
+	return named, nil
+}
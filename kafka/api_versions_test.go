@@ -0,0 +1,50 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestAPIVersions(t *testing.T) {
+	topic := "api-versions"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	versions, err := producer.APIVersions(context.Background())
+	require.NoError(t, err)
+	for _, api := range []string{"Produce", "Fetch", "Metadata", "ApiVersions"} {
+		assert.Contains(t, versions, api)
+	}
+	assert.GreaterOrEqual(t, versions["Produce"], int16(3))
+}
+
+func TestClientVersion(t *testing.T) {
+	assert.Regexp(t, `^v1\.`, ClientVersion())
+}
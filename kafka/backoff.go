@@ -0,0 +1,116 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// minRetryBackoff and maxRetryBackoff match the franz-go defaults.
+	minRetryBackoff = 250 * time.Millisecond
+	maxRetryBackoff = 2500 * time.Millisecond
+)
+
+// Backoff defines the time waited before retrying an operation. The
+// backoffs used for the client request retries may be called concurrently.
+type Backoff interface {
+	// Next returns the time to wait before the retry attempt, starting at
+	// 1 for the first retry.
+	Next(attempt int) time.Duration
+	// Reset resets any state kept by the backoff. It's called before each
+	// sequence of retries of the consumer operations.
+	Reset()
+}
+
+// ConstantBackoff waits the same time before every retry.
+type ConstantBackoff time.Duration
+
+// Next returns the constant backoff.
+func (b ConstantBackoff) Next(int) time.Duration { return time.Duration(b) }
+
+// Reset is a no-op.
+func (ConstantBackoff) Reset() {}
+
+// ExponentialBackoff doubles the time waited before each retry, starting at
+// Min and up to Max.
+type ExponentialBackoff struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// Next returns the exponential backoff for the attempt.
+func (b ExponentialBackoff) Next(attempt int) time.Duration {
+	backoff := b.Min
+	for i := 1; i < attempt && backoff < b.Max; i++ {
+		backoff *= 2
+	}
+	if backoff > b.Max {
+		backoff = b.Max
+	}
+	return backoff
+}
+
+// Reset is a no-op.
+func (ExponentialBackoff) Reset() {}
+
+// wait waits for the backoff of the attempt, returning false if the context
+// is done first. A nil backoff doesn't wait.
+func wait(ctx context.Context, b Backoff, attempt int) bool {
+	if b == nil {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(b.Next(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// validateJitterFraction returns an error if the jitter fraction is not
+// within [0, 1].
+func validateJitterFraction(f float64) error {
+	if f < 0 || f > 1 {
+		return errors.New("kafka: jitter fraction must be between 0 and 1")
+	}
+	return nil
+}
+
+// jitteredBackoff returns a retry backoff function which grows exponentially
+// from minRetryBackoff to maxRetryBackoff. Each backoff is reduced by a
+// random amount of up to jitter times its value, so a jitter of 1 results in
+// full jitter.
+func jitteredBackoff(jitter float64) func(attempt int) time.Duration {
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	exponential := ExponentialBackoff{Min: minRetryBackoff, Max: maxRetryBackoff}
+	return func(attempt int) time.Duration {
+		backoff := exponential.Next(attempt)
+		mu.Lock()
+		r := rng.Float64()
+		mu.Unlock()
+		return backoff - time.Duration(float64(backoff)*jitter*r)
+	}
+}
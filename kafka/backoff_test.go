@@ -0,0 +1,123 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestJitteredBackoff(t *testing.T) {
+	const jitter = 0.5
+	backoff := jitteredBackoff(jitter)
+	for attempt, base := range map[int]time.Duration{
+		1: 250 * time.Millisecond,
+		2: 500 * time.Millisecond,
+		3: time.Second,
+		4: 2 * time.Second,
+		5: 2500 * time.Millisecond,
+		9: 2500 * time.Millisecond,
+	} {
+		seen := make(map[time.Duration]struct{})
+		for i := 0; i < 20; i++ {
+			d := backoff(attempt)
+			assert.GreaterOrEqual(t, d, time.Duration(float64(base)*(1-jitter)), "attempt %d", attempt)
+			assert.LessOrEqual(t, d, base, "attempt %d", attempt)
+			seen[d] = struct{}{}
+		}
+		assert.Greater(t, len(seen), 1, "attempt %d backoffs are identical", attempt)
+	}
+}
+
+func TestConstantBackoff(t *testing.T) {
+	backoff := ConstantBackoff(time.Second)
+	for attempt := 1; attempt < 5; attempt++ {
+		assert.Equal(t, time.Second, backoff.Next(attempt))
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff{Min: 100 * time.Millisecond, Max: time.Second}
+	for attempt, expected := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		3:  400 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		10: time.Second,
+	} {
+		assert.Equal(t, expected, backoff.Next(attempt), "attempt %d", attempt)
+	}
+}
+
+// recordingBackoff records the attempts it's called for.
+type recordingBackoff struct {
+	mu       sync.Mutex
+	attempts []int
+}
+
+func (b *recordingBackoff) Next(attempt int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts = append(b.attempts, attempt)
+	return time.Millisecond
+}
+
+func (b *recordingBackoff) Reset() {}
+
+func TestProducerCustomBackoff(t *testing.T) {
+	topic := "custom-backoff"
+	cluster := newFakeCluster(t, 1, topic)
+	// Fail the first produce request by closing the connection.
+	var produced atomic.Int64
+	cluster.ControlKey(int16(kmsg.Produce), func(kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		if produced.Add(1) > 1 {
+			return nil, nil, false
+		}
+		return nil, errors.New("connection reset"), true
+	})
+	backoff := &recordingBackoff{}
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+		Backoff: backoff,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, producer.ProcessBatch(ctx, &model.Batch{{}}))
+	assert.Equal(t, int64(2), produced.Load())
+	backoff.mu.Lock()
+	defer backoff.mu.Unlock()
+	assert.Contains(t, backoff.attempts, 1)
+}
@@ -0,0 +1,58 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// brokerHook calls the broker connection callbacks of the configs.
+type brokerHook struct {
+	onConnect    func(addr string, err error)
+	onDisconnect func(addr string)
+}
+
+// newBrokerHook returns the hook for the callbacks, or nil if none is set.
+func newBrokerHook(onConnect func(string, error), onDisconnect func(string)) kgo.Hook {
+	if onConnect == nil && onDisconnect == nil {
+		return nil
+	}
+	return brokerHook{onConnect: onConnect, onDisconnect: onDisconnect}
+}
+
+// OnBrokerConnect implements kgo.HookBrokerConnect.
+func (h brokerHook) OnBrokerConnect(meta kgo.BrokerMetadata, _ time.Duration, _ net.Conn, err error) {
+	if h.onConnect != nil {
+		h.onConnect(brokerAddr(meta), err)
+	}
+}
+
+// OnBrokerDisconnect implements kgo.HookBrokerDisconnect.
+func (h brokerHook) OnBrokerDisconnect(meta kgo.BrokerMetadata, _ net.Conn) {
+	if h.onDisconnect != nil {
+		h.onDisconnect(brokerAddr(meta))
+	}
+}
+
+func brokerAddr(meta kgo.BrokerMetadata) string {
+	return net.JoinHostPort(meta.Host, strconv.Itoa(int(meta.Port)))
+}
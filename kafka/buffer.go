@@ -0,0 +1,65 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"sync/atomic"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// bufferTracker is a kgo hook which tracks the number and size of the records
+// that have been fetched but not yet processed.
+type bufferTracker struct {
+	records atomic.Int64
+	bytes   atomic.Int64
+}
+
+// OnFetchRecordBuffered implements kgo.HookFetchRecordBuffered.
+func (b *bufferTracker) OnFetchRecordBuffered(r *kgo.Record) {
+	b.records.Add(1)
+	b.bytes.Add(recordSize(r))
+}
+
+// OnFetchRecordUnbuffered implements kgo.HookFetchRecordUnbuffered. Polled
+// records are tracked until they are processed.
+func (b *bufferTracker) OnFetchRecordUnbuffered(r *kgo.Record, polled bool) {
+	if !polled {
+		b.records.Add(-1)
+		b.bytes.Add(-recordSize(r))
+	}
+}
+
+// processed stops tracking a polled record.
+func (b *bufferTracker) processed(r *kgo.Record) {
+	b.records.Add(-1)
+	b.bytes.Add(-recordSize(r))
+}
+
+// discarded stops tracking the polled records which won't be processed.
+func (b *bufferTracker) discarded(fetches kgo.Fetches) {
+	fetches.EachRecord(b.processed)
+}
+
+func recordSize(r *kgo.Record) int64 {
+	size := len(r.Key) + len(r.Value)
+	for _, h := range r.Headers {
+		size += len(h.Key) + len(h.Value)
+	}
+	return int64(size)
+}
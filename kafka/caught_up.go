@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"go.uber.org/zap"
+)
+
+// caughtUpInterval is the interval at which the consumer lag is checked
+// until the consumer has caught up.
+const caughtUpInterval = time.Second
+
+// notifyCaughtUp calls OnCaughtUp once the consumer has caught up, unless
+// the context is done first.
+func (c *Consumer) notifyCaughtUp(ctx context.Context) {
+	ticker := time.NewTicker(caughtUpInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		caughtUp, err := c.caughtUp(ctx)
+		if err != nil {
+			c.cfg.Logger.Warn("unable to compute the consumer lag", zap.Error(err))
+			continue
+		}
+		if caughtUp {
+			c.cfg.OnCaughtUp()
+			return
+		}
+	}
+}
+
+// caughtUp returns whether the lag of every partition assigned to the
+// consumer is at most CaughtUpLag. The consumer isn't caught up while the
+// group is rebalancing.
+func (c *Consumer) caughtUp(ctx context.Context) (bool, error) {
+	memberID, _ := c.client.GroupMetadata()
+	if memberID == "" {
+		return false, nil // Not joined yet.
+	}
+	lags, err := kadm.NewClient(c.client).Lag(ctx, c.cfg.GroupID)
+	if err != nil {
+		return false, fmt.Errorf("kafka: failed to compute lag: %w", err)
+	}
+	group, ok := lags[c.cfg.GroupID]
+	if !ok {
+		return false, nil
+	}
+	if err := group.Error(); err != nil {
+		return false, fmt.Errorf("kafka: failed to compute lag: %w", err)
+	}
+	if group.State != "Stable" {
+		return false, nil
+	}
+	var member bool
+	for _, m := range group.Members {
+		member = member || m.MemberID == memberID
+	}
+	if !member {
+		return false, nil
+	}
+	for _, partitions := range group.Lag {
+		for _, lag := range partitions {
+			if lag.Member == nil || lag.Member.MemberID != memberID {
+				continue
+			}
+			if lag.Err != nil {
+				return false, fmt.Errorf("kafka: failed to compute lag: %w", lag.Err)
+			}
+			if lag.Lag > c.cfg.CaughtUpLag {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
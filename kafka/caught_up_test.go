@@ -0,0 +1,79 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestConsumerOnCaughtUp(t *testing.T) {
+	topic := "caught-up"
+	cluster := newFakeCluster(t, 3, topic)
+	const backlog = 300
+	records := make([]*kgo.Record, backlog)
+	for i := range records {
+		event, err := json.Marshal(model.APMEvent{})
+		require.NoError(t, err)
+		records[i] = &kgo.Record{Topic: topic, Value: event}
+	}
+	produceRecords(t, cluster, records...)
+
+	var processed atomic.Int64
+	caughtUp := make(chan int64, 1)
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			// Slow down the processing, so the backlog takes a few lag
+			// checks to be drained.
+			time.Sleep(5 * time.Millisecond)
+			processed.Add(1)
+			return nil
+		}),
+		OnCaughtUp: func() { caughtUp <- processed.Load() },
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- consumer.Run(ctx) }()
+
+	select {
+	case n := <-caughtUp:
+		assert.Equal(t, int64(backlog), n)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the consumer to catch up")
+	}
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	require.NoError(t, consumer.Close())
+}
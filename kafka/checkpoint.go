@@ -0,0 +1,124 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"go.uber.org/zap"
+)
+
+// resumeTimeout bounds the time spent loading and committing the stored
+// offsets when the consumer is created with ResumeFromStore.
+const resumeTimeout = 10 * time.Second
+
+// OffsetStore stores the consumer offsets outside of Kafka, such as for
+// resuming the consumption on a different cluster. The offsets are keyed by
+// topic and partition, each offset being the next one to consume.
+type OffsetStore interface {
+	// SaveOffsets stores the offsets, replacing the stored ones.
+	SaveOffsets(ctx context.Context, offsets map[string]map[int32]int64) error
+	// LoadOffsets returns the stored offsets, or an empty map when none
+	// have been stored.
+	LoadOffsets(ctx context.Context) (map[string]map[int32]int64, error)
+}
+
+// Checkpoint saves the offsets committed by the consumer group to the
+// OffsetStore. The offsets of all the group members' partitions are saved,
+// not only the ones assigned to the consumer, since SaveOffsets replaces the
+// stored offsets and each member of the group checkpoints.
+func (c *Consumer) Checkpoint(ctx context.Context) error {
+	if c.cfg.OffsetStore == nil {
+		return errors.New("kafka: offset store must be set to checkpoint")
+	}
+	committed, err := kadm.NewClient(c.client).FetchOffsets(ctx, c.cfg.GroupID)
+	if err == nil {
+		err = committed.Error()
+	}
+	if err != nil {
+		return fmt.Errorf("kafka: failed to fetch the offsets to checkpoint: %w", err)
+	}
+	offsets := make(map[string]map[int32]int64)
+	committed.Each(func(o kadm.OffsetResponse) {
+		if o.At < 0 {
+			return
+		}
+		if offsets[o.Topic] == nil {
+			offsets[o.Topic] = make(map[int32]int64)
+		}
+		offsets[o.Topic][o.Partition] = o.At
+	})
+	if err := c.cfg.OffsetStore.SaveOffsets(ctx, offsets); err != nil {
+		return fmt.Errorf("kafka: failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// checkpointEvery calls Checkpoint every CheckpointInterval, until the
+// context is done.
+func (c *Consumer) checkpointEvery(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Checkpoint(ctx); err != nil {
+				c.cfg.Logger.Error("unable to checkpoint offsets", zap.Error(err))
+			}
+		}
+	}
+}
+
+// resumeFromStore commits the offsets loaded from the OffsetStore for the
+// consumer group, so the group resumes from them.
+func resumeFromStore(cfg ConsumerConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), resumeTimeout)
+	defer cancel()
+	offsets, err := cfg.OffsetStore.LoadOffsets(ctx)
+	if err != nil {
+		return fmt.Errorf("kafka: failed to load checkpoint: %w", err)
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+	var commit kadm.Offsets
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			commit.AddOffset(topic, partition, offset, -1)
+		}
+	}
+	client, err := newAdminClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	committed, err := kadm.NewClient(client).CommitOffsets(ctx, cfg.GroupID, commit)
+	if err == nil {
+		err = committed.Error()
+	}
+	if err != nil {
+		return fmt.Errorf("kafka: failed to commit checkpoint offsets: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// memoryOffsetStore is an in-memory OffsetStore.
+type memoryOffsetStore struct {
+	mu      sync.Mutex
+	offsets map[string]map[int32]int64
+}
+
+func (s *memoryOffsetStore) SaveOffsets(_ context.Context, offsets map[string]map[int32]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offsets = offsets
+	return nil
+}
+
+func (s *memoryOffsetStore) LoadOffsets(context.Context) (map[string]map[int32]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.offsets, nil
+}
+
+func TestConsumerCheckpointResume(t *testing.T) {
+	topic := "checkpoint"
+	cluster := newFakeCluster(t, 1, topic)
+	records := make([]*kgo.Record, 6)
+	for i := range records {
+		records[i] = &kgo.Record{Topic: topic, Value: []byte(`{"trace":{"id":"` + strconv.Itoa(i) + `"}}`)}
+	}
+	produceRecords(t, cluster, records...)
+	emulateEmptyGroupCommits(t, cluster)
+
+	store := new(memoryOffsetStore)
+	newConsumer := func(groupID string, resume bool, process func(string)) *Consumer {
+		consumer, err := NewConsumer(ConsumerConfig{
+			Brokers:         cluster.ListenAddrs(),
+			Topics:          []string{topic},
+			GroupID:         groupID,
+			Logger:          zaptest.NewLogger(t),
+			MaxRecords:      3,
+			OffsetStore:     store,
+			ResumeFromStore: resume,
+			Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+				process((*b)[0].Trace.ID)
+				return nil
+			}),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { consumer.Close() })
+		return consumer
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var processed []string
+	consumer := newConsumer("group", false, func(id string) {
+		processed = append(processed, id)
+	})
+	require.NoError(t, consumer.Run(ctx))
+	require.NoError(t, consumer.Checkpoint(ctx))
+	assert.Equal(t, map[string]map[int32]int64{topic: {0: 3}}, store.offsets)
+
+	// Simulate a crash, resuming on a fresh group from the checkpoint.
+	var resumed []string
+	consumer = newConsumer("fresh-group", true, func(id string) {
+		resumed = append(resumed, id)
+	})
+	require.NoError(t, consumer.Run(ctx))
+	assert.Equal(t, []string{"0", "1", "2"}, processed)
+	assert.Equal(t, []string{"3", "4", "5"}, resumed)
+
+	// Close checkpoints the offsets committed by the consumer.
+	require.NoError(t, consumer.Close())
+	assert.Equal(t, map[string]map[int32]int64{topic: {0: 6}}, store.offsets)
+}
+
+func TestConsumerCheckpointInterval(t *testing.T) {
+	topic := "checkpoint-interval"
+	cluster := newFakeCluster(t, 1, topic)
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: []byte(`{}`)})
+
+	store := new(memoryOffsetStore)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:            cluster.ListenAddrs(),
+		Topics:             []string{topic},
+		GroupID:            "group",
+		Logger:             zaptest.NewLogger(t),
+		OffsetStore:        store,
+		CheckpointInterval: 10 * time.Millisecond,
+		Processor:          model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	go consumer.Run(ctx)
+	assert.Eventually(t, func() bool {
+		offsets, _ := store.LoadOffsets(ctx)
+		return offsets[topic][0] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConsumerCheckpointGroup(t *testing.T) {
+	topic := "checkpoint-group"
+	cluster := newFakeCluster(t, 2, topic)
+	store := new(memoryOffsetStore)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	started := make(map[string]int)
+	var wg sync.WaitGroup
+	newConsumer := func(name string) *Consumer {
+		consumer, err := NewConsumer(ConsumerConfig{
+			Brokers:     cluster.ListenAddrs(),
+			Topics:      []string{topic},
+			GroupID:     "group",
+			Logger:      zaptest.NewLogger(t),
+			OffsetStore: store,
+			OnPartitionStart: func(context.Context, string, int32) {
+				mu.Lock()
+				defer mu.Unlock()
+				started[name]++
+			},
+			OnPartitionStop: func(context.Context, string, int32) {
+				mu.Lock()
+				defer mu.Unlock()
+				started[name]--
+			},
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+		})
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consumer.Run(ctx)
+		}()
+		return consumer
+	}
+	a, b := newConsumer("a"), newConsumer("b")
+	t.Cleanup(func() {
+		cancel()
+		a.Close()
+		b.Close()
+		wg.Wait()
+	})
+	// Each member consumes one of the partitions.
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return started["a"] == 1 && started["b"] == 1
+	}, 15*time.Second, 10*time.Millisecond)
+
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+	for partition := int32(0); partition < 2; partition++ {
+		for i := 0; i <= int(partition); i++ {
+			require.NoError(t, client.ProduceSync(ctx, &kgo.Record{
+				Topic: topic, Partition: partition, Value: []byte(`{}`),
+			}).FirstErr())
+		}
+	}
+	want := map[string]map[int32]int64{topic: {0: 1, 1: 2}}
+	assert.Eventually(t, func() bool {
+		offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "group")
+		if err != nil {
+			return false
+		}
+		at := func(partition int32) int64 {
+			o, _ := offsets.Lookup(topic, partition)
+			return o.At
+		}
+		return at(0) == 1 && at(1) == 2
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// The checkpoint of each member holds the offsets of the group, rather
+	// than overwriting the other member's ones.
+	for _, consumer := range []*Consumer{a, b} {
+		require.NoError(t, consumer.Checkpoint(ctx))
+		offsets, err := store.LoadOffsets(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, want, offsets)
+	}
+}
@@ -0,0 +1,356 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// The chunk headers set on the records holding a chunk of an event bigger
+// than ProducerConfig.ChunkSize. They share the "chunk." prefix, which isn't
+// used by any other header set by the producer.
+const (
+	// ChunkIDHeader holds the random ID shared by the chunks of an event.
+	ChunkIDHeader = "chunk.id"
+	// ChunkIndexHeader holds the zero-based index of the chunk.
+	ChunkIndexHeader = "chunk.index"
+	// ChunkCountHeader holds the number of chunks of the event.
+	ChunkCountHeader = "chunk.count"
+)
+
+// ErrChunkedRecordTooLarge is the decoding error of the chunked records
+// bigger than ConsumerConfig.MaxChunkedRecordBytes.
+var ErrChunkedRecordTooLarge = errors.New("kafka: chunked record exceeds the max chunked record bytes")
+
+// ErrChunkedRecordIncomplete is the decoding error of the chunked records
+// whose chunks didn't all arrive within ConsumerConfig.ChunkAssemblyTimeout
+// and ChunkAssemblyMaxGap.
+var ErrChunkedRecordIncomplete = errors.New("kafka: chunked record is incomplete")
+
+// chunkIDReader is the source of the random chunk IDs, only replaced in
+// tests.
+var chunkIDReader io.Reader = rand.Reader
+
+// chunkRecord splits the value of the record into chunks of up to ChunkSize
+// bytes, returning the records holding them in order, or the record itself
+// when its value fits in a chunk. The chunks share the record key, or their
+// ID when the record has none, so they're produced to the same partition.
+// An error is returned when the chunk ID can't be generated, since the
+// chunks of the concurrent records could then share it.
+func (p *Producer) chunkRecord(r *kgo.Record) ([]*kgo.Record, error) {
+	size := p.cfg.ChunkSize
+	if size <= 0 || len(r.Value) <= size {
+		return []*kgo.Record{r}, nil
+	}
+	var b [16]byte
+	if _, err := io.ReadFull(chunkIDReader, b[:]); err != nil {
+		return nil, fmt.Errorf("kafka: failed to generate the chunk ID: %w", err)
+	}
+	id := []byte(hex.EncodeToString(b[:]))
+	key := r.Key
+	if key == nil {
+		key = id
+	}
+	count := (len(r.Value) + size - 1) / size
+	chunks := make([]*kgo.Record, 0, count)
+	countValue := []byte(strconv.Itoa(count))
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(r.Value) {
+			end = len(r.Value)
+		}
+		// The headers are shared by the records of the batch.
+		headers := append(r.Headers[:len(r.Headers):len(r.Headers)],
+			kgo.RecordHeader{Key: ChunkIDHeader, Value: id},
+			kgo.RecordHeader{Key: ChunkIndexHeader, Value: []byte(strconv.Itoa(i))},
+			kgo.RecordHeader{Key: ChunkCountHeader, Value: countValue},
+		)
+		chunks = append(chunks, &kgo.Record{
+			Topic:   r.Topic,
+			Key:     key,
+			Value:   r.Value[i*size : end],
+			Headers: headers,
+			Context: r.Context,
+		})
+	}
+	return chunks, nil
+}
+
+// chunkRecords splits the oversized records into chunks, see chunkRecord.
+func (p *Producer) chunkRecords(records []*kgo.Record) ([]*kgo.Record, error) {
+	if p.cfg.ChunkSize <= 0 {
+		return records, nil
+	}
+	chunked := make([]*kgo.Record, 0, len(records))
+	for _, r := range records {
+		chunks, err := p.chunkRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		chunked = append(chunked, chunks...)
+	}
+	return chunked, nil
+}
+
+// chunkedResult returns the function resolving the result of each of the n
+// chunks of an event, which calls resolve once all of them are resolved,
+// with the first failed result, or the result of the last chunk.
+func chunkedResult(n int, resolve func(ProduceResult)) func(i int, result ProduceResult) {
+	if n == 1 {
+		return func(_ int, result ProduceResult) { resolve(result) }
+	}
+	var mu sync.Mutex
+	var failed *ProduceResult
+	var last ProduceResult
+	pending := n
+	return func(i int, result ProduceResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		if result.Err != nil && failed == nil {
+			failed = &result
+		}
+		if i == n-1 {
+			last = result
+		}
+		if pending--; pending > 0 {
+			return
+		}
+		if failed != nil {
+			last = *failed
+		}
+		resolve(last)
+	}
+}
+
+// chunkAssembler reassembles the values of the chunked records, per topic
+// partition, as their chunks are fetched. The incomplete assemblies expire
+// after timeout, or once a record more than maxGap offsets past their last
+// chunk is fetched, and are reported to expired, so they don't hold the
+// commits of their partition forever.
+type chunkAssembler struct {
+	maxBytes int
+	timeout  time.Duration
+	maxGap   int64
+	expired  func(topic string, partition int32, err error)
+	// assemblies holds the chunked records being reassembled, keyed by
+	// topic, partition and chunk ID.
+	assemblies map[string]map[int32]map[string]*chunkAssembly
+}
+
+type chunkAssembly struct {
+	// first and last are the offsets of the first and last added chunks.
+	first  int64
+	last   int64
+	chunks int
+	count  int
+	value  []byte
+	// started is when the first chunk was added.
+	started time.Time
+	// tooLarge is set once the value exceeds maxBytes, after which the
+	// chunks are discarded.
+	tooLarge bool
+}
+
+// chunkHeaders returns the chunk headers of the record, ok is false when the
+// record isn't a chunk.
+func chunkHeaders(r *kgo.Record) (id string, index, count int, ok bool, err error) {
+	var found int
+	for _, h := range r.Headers {
+		switch h.Key {
+		case ChunkIDHeader:
+			id = string(h.Value)
+		case ChunkIndexHeader:
+			index, err = strconv.Atoi(string(h.Value))
+		case ChunkCountHeader:
+			count, err = strconv.Atoi(string(h.Value))
+		default:
+			continue
+		}
+		if err != nil {
+			return "", 0, 0, true, fmt.Errorf("kafka: invalid chunk header %s: %w", h.Key, err)
+		}
+		found++
+	}
+	if found == 0 {
+		return "", 0, 0, false, nil
+	}
+	if found != 3 || index < 0 || index >= count {
+		return "", 0, 0, true, errors.New("kafka: invalid chunk headers")
+	}
+	return id, index, count, true, nil
+}
+
+// add adds the chunk to its assembly. It returns the reassembled value, and
+// the offset of the first chunk, once the last chunk is added, and complete
+// is false for the other chunks of the record. The assemblies of the
+// record's partition whose last chunk is more than maxGap offsets before the
+// record expire.
+func (a *chunkAssembler) add(r *kgo.Record, now time.Time) (value []byte, first int64, complete bool, err error) {
+	a.expireGap(r)
+	id, index, count, ok, err := chunkHeaders(r)
+	if !ok || err != nil {
+		return r.Value, r.Offset, true, err
+	}
+	if a.assemblies == nil {
+		a.assemblies = make(map[string]map[int32]map[string]*chunkAssembly)
+	}
+	partitions := a.assemblies[r.Topic]
+	if partitions == nil {
+		partitions = make(map[int32]map[string]*chunkAssembly)
+		a.assemblies[r.Topic] = partitions
+	}
+	assemblies := partitions[r.Partition]
+	if assemblies == nil {
+		assemblies = make(map[string]*chunkAssembly)
+		partitions[r.Partition] = assemblies
+	}
+	assembly := assemblies[id]
+	if index == 0 {
+		// The partition may be fetched again from the first chunk.
+		assembly = &chunkAssembly{first: r.Offset, count: count, started: now}
+		assemblies[id] = assembly
+	}
+	if assembly == nil || assembly.chunks != index {
+		delete(assemblies, id)
+		return nil, r.Offset, true, fmt.Errorf("kafka: chunk %d of %d of record %s is missing", index, count, id)
+	}
+	assembly.last = r.Offset
+	assembly.chunks++
+	if !assembly.tooLarge {
+		if a.maxBytes > 0 && len(assembly.value)+len(r.Value) > a.maxBytes {
+			assembly.tooLarge = true
+			assembly.value = nil
+		} else {
+			assembly.value = append(assembly.value, r.Value...)
+		}
+	}
+	if assembly.chunks < count {
+		return nil, assembly.first, false, nil
+	}
+	delete(assemblies, id)
+	if assembly.tooLarge {
+		return nil, assembly.first, true, ErrChunkedRecordTooLarge
+	}
+	return assembly.value, assembly.first, true, nil
+}
+
+// committable splits the processed records into the ones which can be
+// committed and the ones which are held, since their partition has a record
+// being reassembled from a lower offset.
+func (a *chunkAssembler) committable(pending []*kgo.Record) (commit, held []*kgo.Record) {
+	if len(a.assemblies) == 0 {
+		return pending, nil
+	}
+	for _, msg := range pending {
+		var hold bool
+		for _, assembly := range a.assemblies[msg.Topic][msg.Partition] {
+			if msg.Offset >= assembly.first {
+				hold = true
+				break
+			}
+		}
+		if hold {
+			held = append(held, msg)
+			continue
+		}
+		commit = append(commit, msg)
+	}
+	return commit, held
+}
+
+// expireGap expires the assemblies of the record's partition whose last
+// chunk is more than maxGap offsets before the record.
+func (a *chunkAssembler) expireGap(r *kgo.Record) {
+	if a.maxGap <= 0 {
+		return
+	}
+	assemblies := a.assemblies[r.Topic][r.Partition]
+	for id, assembly := range assemblies {
+		if r.Offset-assembly.last > a.maxGap {
+			delete(assemblies, id)
+			a.expire(r.Topic, r.Partition, id, assembly,
+				fmt.Sprintf("no chunk in the %d offsets following %d", a.maxGap, assembly.last),
+			)
+		}
+	}
+}
+
+// expireTimeout expires the assemblies started timeout or longer before now.
+func (a *chunkAssembler) expireTimeout(now time.Time) {
+	if a.timeout <= 0 {
+		return
+	}
+	for topic, partitions := range a.assemblies {
+		for partition, assemblies := range partitions {
+			for id, assembly := range assemblies {
+				if now.Sub(assembly.started) >= a.timeout {
+					delete(assemblies, id)
+					a.expire(topic, partition, id, assembly,
+						fmt.Sprintf("not reassembled within %s", a.timeout),
+					)
+				}
+			}
+		}
+	}
+}
+
+func (a *chunkAssembler) expire(topic string, partition int32, id string, assembly *chunkAssembly, reason string) {
+	if a.expired != nil {
+		a.expired(topic, partition, fmt.Errorf("%w: %d of %d chunks of record %s at offset %d, %s",
+			ErrChunkedRecordIncomplete, assembly.chunks, assembly.count, id, assembly.first, reason,
+		))
+	}
+}
+
+// next returns the time at which the next assembly expires, and false when
+// there's none.
+func (a *chunkAssembler) next() (time.Time, bool) {
+	var next time.Time
+	if a.timeout <= 0 {
+		return next, false
+	}
+	for _, partitions := range a.assemblies {
+		for _, assemblies := range partitions {
+			for _, assembly := range assemblies {
+				if t := assembly.started.Add(a.timeout); next.IsZero() || t.Before(next) {
+					next = t
+				}
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// revoke drops the assemblies of the revoked partitions, which are fetched
+// again from their first chunk by the partitions' next consumer.
+func (a *chunkAssembler) revoke(revoked map[string][]int32) {
+	for topic, partitions := range revoked {
+		for _, partition := range partitions {
+			delete(a.assemblies[topic], partition)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestChunkedRecords(t *testing.T) {
+	topic := "chunked-records"
+	cluster := newFakeCluster(t, 2, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:   cluster.ListenAddrs(),
+		Topic:     topic,
+		Logger:    zaptest.NewLogger(t),
+		ChunkSize: 256 << 10,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	large := strings.Repeat("large event ", 128<<10) // 1.5MiB
+	ctx := context.Background()
+	batch := model.Batch{
+		{Trace: model.Trace{ID: "1"}, Message: large},
+		{Trace: model.Trace{ID: "2"}},
+	}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	async := model.Batch{{Trace: model.Trace{ID: "3"}, Message: large}}
+	result, err := producer.ProcessBatchAsync(ctx, &async)[0].Wait(ctx)
+	require.NoError(t, err)
+	require.NoError(t, result.Err)
+
+	// The large events are produced as keyed chunks.
+	var chunks int
+	for _, record := range consumeRecords(t, cluster, topic, 15) {
+		if _, _, _, ok, _ := chunkHeaders(record); ok {
+			assert.LessOrEqual(t, len(record.Value), 256<<10)
+			assert.NotEmpty(t, record.Key)
+			chunks++
+		}
+	}
+	assert.Equal(t, 14, chunks)
+
+	processed := make(map[string]string)
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:    cluster.ListenAddrs(),
+		Topics:     []string{topic},
+		GroupID:    "group",
+		Logger:     zaptest.NewLogger(t),
+		MaxRecords: 3,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				processed[event.Trace.ID] = event.Message
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	require.NoError(t, consumer.Run(ctx))
+	require.NoError(t, consumer.Close())
+	assert.Equal(t, map[string]string{"1": large, "2": "", "3": large}, processed)
+}
+
+func TestChunkedRecordsIDError(t *testing.T) {
+	topic := "chunked-records-id-error"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:   cluster.ListenAddrs(),
+		Topic:     topic,
+		Logger:    zaptest.NewLogger(t),
+		ChunkSize: 1 << 10,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	errRead := errors.New("entropy exhausted")
+	defer func(r io.Reader) { chunkIDReader = r }(chunkIDReader)
+	chunkIDReader = iotest.ErrReader(errRead)
+
+	large := strings.Repeat("large event ", 1<<10)
+	ctx := context.Background()
+	batch := model.Batch{{Trace: model.Trace{ID: "1"}, Message: large}}
+	assert.ErrorIs(t, producer.ProcessBatch(ctx, &batch), errRead)
+	async := model.Batch{{Trace: model.Trace{ID: "2"}, Message: large}}
+	result, err := producer.ProcessBatchAsync(ctx, &async)[0].Wait(ctx)
+	require.NoError(t, err)
+	assert.ErrorIs(t, result.Err, errRead)
+
+	// Nothing is produced without a chunk ID.
+	offsets, err := kadm.NewClient(producer.client).ListEndOffsets(ctx, topic)
+	require.NoError(t, err)
+	end, _ := offsets.Lookup(topic, 0)
+	assert.Equal(t, int64(0), end.Offset)
+}
+
+// newChunk returns the record holding a chunk of the record with the ID.
+func newChunk(offset int64, id string, index, count int, value string) *kgo.Record {
+	return &kgo.Record{Offset: offset, Value: []byte(value), Headers: []kgo.RecordHeader{
+		{Key: ChunkIDHeader, Value: []byte(id)},
+		{Key: ChunkIndexHeader, Value: []byte(strconv.Itoa(index))},
+		{Key: ChunkCountHeader, Value: []byte(strconv.Itoa(count))},
+	}}
+}
+
+func TestChunkAssembler(t *testing.T) {
+	chunk := newChunk
+	a := chunkAssembler{maxBytes: 8}
+	_, first, complete, err := a.add(chunk(1, "a", 0, 2, "ab"), time.Time{})
+	require.NoError(t, err)
+	assert.False(t, complete)
+	assert.Equal(t, int64(1), first)
+
+	// The records following the first chunk are held until it completes.
+	commit, held := a.committable([]*kgo.Record{{Offset: 0}, {Offset: 1}, {Offset: 2}})
+	assert.Len(t, commit, 1)
+	assert.Len(t, held, 2)
+
+	value, first, complete, err := a.add(chunk(3, "a", 1, 2, "cd"), time.Time{})
+	require.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, int64(1), first)
+	assert.Equal(t, "abcd", string(value))
+	commit, _ = a.committable(held)
+	assert.Len(t, commit, 2)
+
+	_, _, complete, err = a.add(chunk(4, "b", 1, 2, "ef"), time.Time{})
+	assert.True(t, complete)
+	assert.EqualError(t, err, "kafka: chunk 1 of 2 of record b is missing")
+
+	a.add(chunk(5, "c", 0, 2, "01234"), time.Time{})
+	_, _, _, err = a.add(chunk(6, "c", 1, 2, "56789"), time.Time{})
+	assert.ErrorIs(t, err, ErrChunkedRecordTooLarge)
+
+	value, _, complete, err = a.add(&kgo.Record{Offset: 7, Value: []byte("unchunked")}, time.Time{})
+	require.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, "unchunked", string(value))
+}
+
+func TestChunkAssemblerExpire(t *testing.T) {
+	var expired []error
+	a := chunkAssembler{
+		timeout: time.Minute,
+		maxGap:  2,
+		expired: func(_ string, _ int32, err error) {
+			expired = append(expired, err)
+		},
+	}
+	now := time.Now()
+	all := []*kgo.Record{{Offset: 1}, {Offset: 2}, {Offset: 5}}
+
+	// The last chunk is missing, the assembly expires once a record more
+	// than maxGap offsets past the last chunk is fetched.
+	a.add(newChunk(1, "a", 0, 3, "ab"), now)
+	a.add(newChunk(2, "a", 1, 3, "cd"), now)
+	a.add(&kgo.Record{Offset: 4}, now)
+	assert.Empty(t, expired)
+	_, held := a.committable(all)
+	assert.Len(t, held, 3)
+	a.add(&kgo.Record{Offset: 5}, now)
+	require.Len(t, expired, 1)
+	assert.ErrorIs(t, expired[0], ErrChunkedRecordIncomplete)
+	assert.EqualError(t, expired[0], "kafka: chunked record is incomplete: 2 of 3 chunks of record a at offset 1, no chunk in the 2 offsets following 2")
+	commit, _ := a.committable(all)
+	assert.Len(t, commit, 3)
+
+	// The assembly expires after the timeout.
+	a.add(newChunk(6, "b", 0, 2, "ab"), now)
+	next, ok := a.next()
+	require.True(t, ok)
+	assert.Equal(t, now.Add(time.Minute), next)
+	a.expireTimeout(now.Add(30 * time.Second))
+	assert.Len(t, expired, 1)
+	a.expireTimeout(now.Add(time.Minute))
+	require.Len(t, expired, 2)
+	assert.ErrorIs(t, expired[1], ErrChunkedRecordIncomplete)
+	_, ok = a.next()
+	assert.False(t, ok)
+}
+
+func TestChunkAssemblerRevoke(t *testing.T) {
+	a := chunkAssembler{}
+	first := newChunk(1, "a", 0, 2, "ab")
+	first.Topic, first.Partition = "topic", 1
+	_, _, complete, err := a.add(first, time.Now())
+	require.NoError(t, err)
+	assert.False(t, complete)
+	pending := []*kgo.Record{{Topic: "topic", Partition: 1, Offset: 2}}
+	_, held := a.committable(pending)
+	assert.Len(t, held, 1)
+
+	// The revoked partition's assemblies are dropped, and its next
+	// consumer fetches them again from their first chunk.
+	a.revoke(map[string][]int32{"topic": {1}})
+	commit, _ := a.committable(pending)
+	assert.Len(t, commit, 1)
+	_, ok := a.next()
+	assert.False(t, ok)
+}
+
+func TestConsumerChunkMissing(t *testing.T) {
+	topic := "chunk-missing"
+	cluster := newFakeCluster(t, 1, topic)
+	// The last of the 3 chunks of the record failed to be produced.
+	var records []*kgo.Record
+	for i := 0; i < 2; i++ {
+		chunk := newChunk(0, "id", i, 3, "{}")
+		chunk.Topic = topic
+		records = append(records, chunk)
+	}
+	for i := 0; i < 2; i++ {
+		records = append(records, &kgo.Record{Topic: topic, Value: []byte(`{}`)})
+	}
+	produceRecords(t, cluster, records...)
+
+	var processed int
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:             cluster.ListenAddrs(),
+		Topics:              []string{topic},
+		GroupID:             "group",
+		Logger:              zaptest.NewLogger(t),
+		MaxRecords:          2,
+		ChunkAssemblyMaxGap: 1,
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			processed++
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, consumer.Run(ctx))
+	assert.Equal(t, 2, processed)
+
+	// The incomplete record doesn't hold the commits of its partition.
+	offsets, err := kadm.NewClient(consumer.client).FetchOffsets(ctx, "group")
+	require.NoError(t, err)
+	offset, ok := offsets.Lookup(topic, 0)
+	require.True(t, ok)
+	assert.Equal(t, int64(len(records)), offset.At)
+	require.NoError(t, consumer.Close())
+}
@@ -0,0 +1,64 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import "errors"
+
+// ErrCloseGraceExceeded is returned, wrapped in a *CloseError, when the
+// records being processed haven't been processed within the grace of
+// Consumer.CloseWithGrace.
+var ErrCloseGraceExceeded = errors.New("kafka: close grace exceeded with records in flight")
+
+// CloseError is returned by the Close methods when the producer or consumer
+// didn't shut down cleanly. It separates the failures to flush the pending
+// state from the closing of an already closed producer or consumer, so
+// either can be inspected without masking the other.
+type CloseError struct {
+	// Flush is the error flushing the buffered records, for producers, or
+	// committing the processed offsets, for consumers.
+	Flush error
+	// Closed is the error returned when the producer or consumer had
+	// already been closed, in which case nothing is flushed.
+	Closed error
+}
+
+// Error implements the error interface.
+func (e *CloseError) Error() string {
+	return errors.Join(e.Flush, e.Closed).Error()
+}
+
+// Unwrap returns the flush and closed errors, so errors.Is and errors.As
+// match either of them.
+func (e *CloseError) Unwrap() []error {
+	var errs []error
+	if e.Flush != nil {
+		errs = append(errs, e.Flush)
+	}
+	if e.Closed != nil {
+		errs = append(errs, e.Closed)
+	}
+	return errs
+}
+
+// closeError returns a *CloseError for the errors, or nil if both are nil.
+func closeError(flush, closed error) error {
+	if flush == nil && closed == nil {
+		return nil
+	}
+	return &CloseError{Flush: flush, Closed: closed}
+}
@@ -0,0 +1,47 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseError(t *testing.T) {
+	assert.NoError(t, closeError(nil, nil))
+
+	flushErr := errors.New("flush failed")
+	closedErr := errors.New("already closed")
+	err := closeError(flushErr, closedErr)
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, flushErr, closeErr.Flush)
+	assert.Equal(t, closedErr, closeErr.Closed)
+	// Both errors are reported and matched.
+	assert.EqualError(t, err, "flush failed\nalready closed")
+	assert.ErrorIs(t, err, flushErr)
+	assert.ErrorIs(t, err, closedErr)
+
+	err = closeError(flushErr, nil)
+	assert.EqualError(t, err, "flush failed")
+	assert.ErrorIs(t, err, flushErr)
+	assert.NotErrorIs(t, err, closedErr)
+}
@@ -0,0 +1,66 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// CodecHeader holds the name of the codec which encoded the record value,
+// set when ProducerConfig.StampCodec is set.
+const CodecHeader = "codec"
+
+// ErrCodecMismatch is returned for the records encoded with a codec other
+// than the consumer Decoder, when ConsumerConfig.VerifyCodec is set.
+var ErrCodecMismatch = errors.New("kafka: record encoded with a different codec")
+
+// NamedCodec is implemented by the Encoders and Decoders which can be
+// verified to be compatible with each other, by comparing their names.
+type NamedCodec interface {
+	// CodecName returns the name of the codec, which must be the same for
+	// the Encoder and Decoder of compatible codecs.
+	CodecName() string
+}
+
+// codecHeader returns the CodecHeader for the encoder.
+func codecHeader(encoder Encoder) kgo.RecordHeader {
+	return kgo.RecordHeader{
+		Key: CodecHeader, Value: []byte(encoder.(NamedCodec).CodecName()),
+	}
+}
+
+// verifyCodec returns an error wrapping ErrCodecMismatch when the record was
+// stamped with a codec other than the decoder. Records without CodecHeader
+// aren't verified.
+func verifyCodec(decoder Decoder, headers []kgo.RecordHeader) error {
+	for _, h := range headers {
+		if h.Key != CodecHeader {
+			continue
+		}
+		if name := decoder.(NamedCodec).CodecName(); string(h.Value) != name {
+			return fmt.Errorf("%w: encoded with %q, decoding with %q",
+				ErrCodecMismatch, h.Value, name,
+			)
+		}
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+// renamedCodec decodes JSON, under a name other than the JSON codec.
+type renamedCodec struct{ json.JSON }
+
+func (renamedCodec) CodecName() string { return "renamed" }
+
+func TestVerifyCodec(t *testing.T) {
+	topic := "verify-codec"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:    cluster.ListenAddrs(),
+		Topic:      topic,
+		Logger:     zap.NewNop(),
+		StampCodec: true,
+	})
+	require.NoError(t, err)
+	batch := model.Batch{{Trace: model.Trace{ID: "trace"}}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, producer.Close())
+
+	records := consumeRecords(t, cluster, topic, 1)
+	assert.NoError(t, verifyCodec(json.JSON{}, records[0].Headers))
+	assert.ErrorIs(t, verifyCodec(renamedCodec{}, records[0].Headers), ErrCodecMismatch)
+	assert.NoError(t, verifyCodec(renamedCodec{}, nil))
+
+	for _, verify := range []bool{false, true} {
+		core, logs := observer.New(zapcore.ErrorLevel)
+		var processed int
+		consumer, err := NewConsumer(ConsumerConfig{
+			Brokers:     cluster.ListenAddrs(),
+			Topics:      []string{topic},
+			GroupID:     fmt.Sprintf("group-%t", verify),
+			Logger:      zap.New(core),
+			Decoder:     renamedCodec{},
+			VerifyCodec: verify,
+			MaxRecords:  1,
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				processed++
+				return nil
+			}),
+		})
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		require.NoError(t, consumer.Run(ctx))
+		cancel()
+		require.NoError(t, consumer.Close())
+
+		if !verify {
+			assert.Equal(t, 1, processed)
+			continue
+		}
+		assert.Zero(t, processed)
+		entries := logs.FilterMessage("unable to decode the record into model.APMEvent").All()
+		require.Len(t, entries, 1)
+		assert.Contains(t, entries[0].ContextMap()["error"], ErrCodecMismatch.Error())
+	}
+}
+
+func TestVerifyCodecConfigValidate(t *testing.T) {
+	nop := model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil })
+	consumer := ConsumerConfig{
+		Brokers:     []string{"localhost:9092"},
+		Topics:      []string{"topic"},
+		GroupID:     "group",
+		Logger:      zap.NewNop(),
+		Processor:   nop,
+		VerifyCodec: true,
+	}
+	assert.NoError(t, consumer.Validate())
+	consumer.Decoder = unnamedCodec{}
+	assert.EqualError(t, consumer.Validate(), "kafka: decoder must implement NamedCodec to verify the codec")
+
+	producer := ProducerConfig{
+		Brokers:    []string{"localhost:9092"},
+		Topic:      "topic",
+		Logger:     zap.NewNop(),
+		StampCodec: true,
+	}
+	assert.NoError(t, producer.Validate())
+	producer.Encoder = unnamedCodec{}
+	assert.EqualError(t, producer.Validate(), "kafka: encoder must implement NamedCodec to stamp the codec")
+}
+
+// unnamedCodec doesn't implement NamedCodec.
+type unnamedCodec struct{}
+
+func (unnamedCodec) Encode(model.APMEvent) ([]byte, error) { return nil, errors.New("unimplemented") }
+
+func (unnamedCodec) Decode([]byte, *model.APMEvent) error { return errors.New("unimplemented") }
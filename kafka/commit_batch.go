@@ -0,0 +1,66 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import "time"
+
+// commitBatcher coalesces the offset commits of the processed records, as
+// configured by CommitInterval and CommitBatchRecords. A nil *commitBatcher
+// commits the records processed in every fetch.
+type commitBatcher struct {
+	interval time.Duration
+	records  int
+	// last is the time of the last commit.
+	last time.Time
+}
+
+// newCommitBatcher returns nil when commits aren't coalesced. The first
+// commit is due interval after now.
+func newCommitBatcher(interval time.Duration, records int, now time.Time) *commitBatcher {
+	if interval <= 0 {
+		return nil
+	}
+	return &commitBatcher{interval: interval, records: records, last: now}
+}
+
+// due reports whether the pending records have to be committed at now.
+func (b *commitBatcher) due(now time.Time, pending int) bool {
+	if b == nil {
+		return true
+	}
+	if b.records > 0 && pending >= b.records {
+		return true
+	}
+	return !now.Before(b.last.Add(b.interval))
+}
+
+// committed records that the pending records were committed at now.
+func (b *commitBatcher) committed(now time.Time) {
+	if b != nil {
+		b.last = now
+	}
+}
+
+// next returns the time at which the pending records have to be committed,
+// and false when there's none.
+func (b *commitBatcher) next(pending int) (time.Time, bool) {
+	if b == nil || pending == 0 {
+		return time.Time{}, false
+	}
+	return b.last.Add(b.interval), true
+}
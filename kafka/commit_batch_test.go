@@ -0,0 +1,308 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestConsumerCommitBatching(t *testing.T) {
+	const partitions, rounds, perRound = 4, 4, 50
+	for name, tc := range map[string]struct {
+		interval time.Duration
+		records  int
+		// individually produces the records one at a time, so they're
+		// fetched across multiple fetches.
+		individually bool
+	}{
+		// Each round of records is committed once its last record is
+		// processed, across all the partitions.
+		"batch_records": {interval: time.Hour, records: perRound, individually: true},
+		// The records are committed once the interval passes, even when
+		// no more records are fetched.
+		"interval": {interval: 200 * time.Millisecond},
+	} {
+		t.Run(name, func(t *testing.T) {
+			topic := "commit-batching"
+			cluster := newFakeCluster(t, partitions, topic)
+			var processed, commits atomic.Int64
+			consumer, err := NewConsumer(ConsumerConfig{
+				Brokers:            cluster.ListenAddrs(),
+				Topics:             []string{topic},
+				GroupID:            "group",
+				Logger:             zaptest.NewLogger(t),
+				CommitInterval:     tc.interval,
+				CommitBatchRecords: tc.records,
+				OnCommit: func(err error) {
+					assert.NoError(t, err)
+					commits.Add(1)
+				},
+				DisableSyncCommitOnClose: true,
+				Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+					processed.Add(1)
+					return nil
+				}),
+			})
+			require.NoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				consumer.Run(ctx)
+			}()
+			t.Cleanup(func() {
+				cancel()
+				consumer.Close()
+				wg.Wait()
+			})
+
+			for round := 1; round <= rounds; round++ {
+				var records []*kgo.Record
+				for i := 0; i < perRound; i++ {
+					event, err := json.Marshal(model.APMEvent{})
+					require.NoError(t, err)
+					records = append(records, &kgo.Record{
+						Topic: topic,
+						Key:   []byte(fmt.Sprint(round*perRound + i)),
+						Value: event,
+					})
+				}
+				if tc.individually {
+					for _, r := range records {
+						produceRecords(t, cluster, r)
+					}
+				} else {
+					produceRecords(t, cluster, records...)
+				}
+				assert.Eventually(t, func() bool {
+					return commits.Load() == int64(round)
+				}, 10*time.Second, 10*time.Millisecond)
+				assert.Equal(t, int64(round*perRound), processed.Load())
+			}
+			assert.Equal(t, int64(rounds), commits.Load())
+
+			offsets, err := kadm.NewClient(consumer.client).FetchOffsets(context.Background(), "group")
+			require.NoError(t, err)
+			var committed int64
+			offsets.Each(func(o kadm.OffsetResponse) { committed += o.At })
+			assert.Equal(t, int64(rounds*perRound), committed)
+		})
+	}
+}
+
+func TestConsumerCommitBatchingClock(t *testing.T) {
+	topic := "commit-batching-clock"
+	cluster := newFakeCluster(t, 1, topic)
+	clock := newFakeClock(time.Now())
+	var processed, commits atomic.Int64
+	cfg := ConsumerConfig{
+		Brokers:        cluster.ListenAddrs(),
+		Topics:         []string{topic},
+		GroupID:        "group",
+		Logger:         zaptest.NewLogger(t),
+		CommitInterval: time.Hour,
+		OnCommit: func(err error) {
+			assert.NoError(t, err)
+			commits.Add(1)
+		},
+		DisableSyncCommitOnClose: true,
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			processed.Add(1)
+			return nil
+		}),
+	}
+	cfg.withClock(clock)
+	consumer, err := NewConsumer(cfg)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		consumer.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		consumer.Close()
+		wg.Wait()
+	})
+
+	event, err := json.Marshal(model.APMEvent{})
+	require.NoError(t, err)
+	produce := func() {
+		produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+	}
+	produce()
+	assert.Eventually(t, func() bool {
+		return processed.Load() == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	// The interval is measured on the consumer clock, which hasn't moved.
+	produce()
+	assert.Eventually(t, func() bool {
+		return processed.Load() == 2
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Zero(t, commits.Load())
+
+	clock.Advance(time.Hour)
+	produce()
+	assert.Eventually(t, func() bool {
+		return commits.Load() == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(3), processed.Load())
+}
+
+func TestConsumerCommitBatchingRebalance(t *testing.T) {
+	const partitions, perPartition = 4, 2
+	topic := "commit-batching-rebalance"
+	cluster := newFakeCluster(t, partitions, topic)
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	produce := func(partitions ...int32) {
+		var records []*kgo.Record
+		for _, partition := range partitions {
+			for i := 0; i < perPartition; i++ {
+				event, err := json.Marshal(model.APMEvent{})
+				require.NoError(t, err)
+				records = append(records, &kgo.Record{
+					Topic: topic, Partition: partition, Value: event,
+				})
+			}
+		}
+		require.NoError(t, client.ProduceSync(context.Background(), records...).FirstErr())
+	}
+	committed := func() map[int32]int64 {
+		offsets, err := kadm.NewClient(client).FetchOffsets(context.Background(), "group")
+		require.NoError(t, err)
+		m := make(map[int32]int64)
+		offsets.Each(func(o kadm.OffsetResponse) { m[o.Partition] = o.At })
+		return m
+	}
+	produce(0, 1, 2, 3)
+
+	var mu sync.Mutex
+	var stopped []int32
+	processed := make(map[string]int)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	newConsumer := func(name string, interval time.Duration) *Consumer {
+		consumer, err := NewConsumer(ConsumerConfig{
+			Brokers:        cluster.ListenAddrs(),
+			Topics:         []string{topic},
+			GroupID:        "group",
+			Logger:         zaptest.NewLogger(t),
+			CommitInterval: interval,
+			OnPartitionStop: func(_ context.Context, _ string, partition int32) {
+				mu.Lock()
+				defer mu.Unlock()
+				if name == "a" {
+					stopped = append(stopped, partition)
+				}
+			},
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				mu.Lock()
+				defer mu.Unlock()
+				processed[name]++
+				return nil
+			}),
+		})
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consumer.Run(ctx)
+		}()
+		return consumer
+	}
+	processedBy := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return processed[name]
+	}
+
+	// a processes all the records without committing them.
+	a := newConsumer("a", time.Hour)
+	assert.Eventually(t, func() bool {
+		return processedBy("a") == partitions*perPartition
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Empty(t, committed())
+
+	// The partitions revoked from a when b joins are committed.
+	b := newConsumer("b", 0)
+	t.Cleanup(func() {
+		cancel()
+		a.Close()
+		b.Close()
+		wg.Wait()
+	})
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(stopped) == partitions/2
+	}, 15*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	moved := append([]int32(nil), stopped...)
+	mu.Unlock()
+	offsets := committed()
+	for _, partition := range moved {
+		assert.Equal(t, int64(perPartition), offsets[partition], partition)
+	}
+
+	// b consumes the moved partitions from the committed offsets, and a
+	// doesn't commit their stale offsets on close.
+	produce(moved...)
+	assert.Eventually(t, func() bool {
+		offsets := committed()
+		for _, partition := range moved {
+			if offsets[partition] != 2*perPartition {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, len(moved)*perPartition, processedBy("b"))
+	require.NoError(t, a.Close())
+	offsets = committed()
+	for partition := int32(0); partition < partitions; partition++ {
+		want := int64(perPartition)
+		for _, p := range moved {
+			if p == partition {
+				want = 2 * perPartition
+			}
+		}
+		assert.Equal(t, want, offsets[partition], partition)
+	}
+}
@@ -0,0 +1,114 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// defaultCompression is the codec of the client when Compression isn't set,
+// the franz-go default.
+const defaultCompression = "snappy"
+
+// compressionCodec returns the kgo compression codec with the name, which is
+// one of none, gzip, snappy, lz4 or zstd.
+func compressionCodec(name string) (kgo.CompressionCodec, bool) {
+	switch name {
+	case "none":
+		return kgo.NoCompression(), true
+	case "gzip":
+		return kgo.GzipCompression(), true
+	case "snappy":
+		return kgo.SnappyCompression(), true
+	case "lz4":
+		return kgo.Lz4Compression(), true
+	case "zstd":
+		return kgo.ZstdCompression(), true
+	}
+	return kgo.CompressionCodec{}, false
+}
+
+// compressionClient returns the client producing the records of the call.
+// The compression is set per client, so a client is created for each codec
+// overriding Compression through the queuecontext, on first use.
+func (p *Producer) compressionClient(ctx context.Context) (*kgo.Client, error) {
+	name, ok := queuecontext.CompressionFromContext(ctx)
+	configured := p.cfg.Compression
+	if configured == "" {
+		configured = defaultCompression
+	}
+	if !ok || name == "" || name == configured {
+		return p.client, nil
+	}
+	codec, ok := compressionCodec(name)
+	if !ok {
+		return nil, fmt.Errorf("kafka: unknown compression codec %q", name)
+	}
+	if p.cfg.DryRun {
+		// Nothing is sent to the brokers, nor compressed.
+		return p.client, nil
+	}
+	p.compressedMu.Lock()
+	defer p.compressedMu.Unlock()
+	if client, ok := p.compressed[name]; ok {
+		return client, nil
+	}
+	opts := append(p.opts[:len(p.opts):len(p.opts)], kgo.ProducerBatchCompression(codec))
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed to create the %s compression client: %w", name, err)
+	}
+	if p.compressed == nil {
+		p.compressed = make(map[string]*kgo.Client)
+	}
+	p.compressed[name] = client
+	return client, nil
+}
+
+// clients returns the client of the producer, followed by the clients
+// created for the compression overrides so far.
+func (p *Producer) clients() []*kgo.Client {
+	p.compressedMu.Lock()
+	defer p.compressedMu.Unlock()
+	clients := make([]*kgo.Client, 0, 1+len(p.compressed))
+	clients = append(clients, p.client)
+	for _, client := range p.compressed {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// closeCompressed flushes and closes the clients of the compression overrides.
+func (p *Producer) closeCompressed(ctx context.Context) error {
+	p.compressedMu.Lock()
+	defer p.compressedMu.Unlock()
+	var errs []error
+	for name, client := range p.compressed {
+		if err := client.Flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("kafka: failed to flush %s compressed records on close: %w", name, err))
+		}
+		client.Close()
+	}
+	return errors.Join(errs...)
+}
@@ -19,16 +19,25 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/plugin/kotel"
 	"github.com/twmb/franz-go/plugin/kzap"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
 	"github.com/elastic/apm-queue/queuecontext"
 )
 
@@ -40,6 +49,10 @@ type ConsumerConfig struct {
 	Topics []string
 	// GroupID to join as part of the consumer group.
 	GroupID string
+	// RequireExistingGroup, when set, makes NewConsumer fail with
+	// ErrGroupNotFound when the consumer group doesn't exist, instead of
+	// creating it by joining it.
+	RequireExistingGroup bool
 	// ClientID to use when connecting to Kafka. This is used for logging
 	// and client identification purposes.
 	ClientID string
@@ -47,10 +60,283 @@ type ConsumerConfig struct {
 	// useful since it shows up in Kafka metrics and logs.
 	Version string
 
+	// SASL mechanisms to authenticate with, in order of preference. The
+	// first mechanism is proposed in the SASL handshake; if the broker
+	// rejects it, the first of the remaining mechanisms that the broker
+	// advertises as supported is used instead.
+	SASL []sasl.Mechanism
+	// TLS, when set, makes the client connect to the brokers over TLS.
+	TLS *TLS
+	// JitterFraction is the fraction, between 0 and 1, by which the
+	// exponential retry backoff of the client requests is randomly reduced,
+	// so clients don't retry in lockstep. When zero, the franz-go default
+	// backoff is used.
+	JitterFraction float64
+	// Backoff, when set, defines the time waited before retrying the client
+	// requests, instead of the franz-go default backoff. It can't be used
+	// together with JitterFraction.
+	Backoff Backoff
+	// ConnReconnectBackoff, when its Max is set, spaces out the connection
+	// attempts to the brokers which failed to connect, such as after a
+	// broker restart. By default, brokers are dialed again right away.
+	ConnReconnectBackoff ReconnectBackoff
+	// TracerProvider is used to trace the consumed records, following the
+	// OTel messaging semantic conventions: a receive span covers each record
+	// from being fetched to being polled, and a child process span covers
+	// its processing, and is set in the context passed to the processor.
+	// Defaults to the global tracer provider.
+	TracerProvider trace.TracerProvider
+	// MeterProvider is used to create the consumer metrics, such as the
+	// consumer.messages.delay histogram, which records the time elapsed
+	// from the event Timestamp to its processing, and the
+	// apmqueue.consumer.records.processed and apmqueue.consumer.records.errors
+	// counters, by topic. Defaults to the global meter provider.
+	MeterProvider metric.MeterProvider
+
+	// OnBrokerConnect, when set, is called with the broker address and the
+	// dial error, if any, every time a connection to a broker is attempted.
+	OnBrokerConnect func(addr string, err error)
+	// OnBrokerDisconnect, when set, is called with the broker address every
+	// time a connection to a broker is closed.
+	OnBrokerDisconnect func(addr string)
+
 	// Logger to use for any errors.
 	Logger *zap.Logger
-	// Processor that will be used to process each event individually.
+	// Decoder decodes the record values into events, defaults to JSON.
+	Decoder Decoder
+	// PreDecodeFilter, when set, is called with each raw record before it
+	// is decoded. The records for which it returns false are committed
+	// without being decoded or processed.
+	PreDecodeFilter func(RawRecord) bool
+	// ConsumeInterceptors, when set, are called in order with each record
+	// before PreDecodeFilter, such as for auditing or redaction, and can
+	// modify or skip it.
+	ConsumeInterceptors []ConsumeInterceptor
+	// VerifyCodec, when set, verifies the CodecHeader of the records, if
+	// any, matches the Decoder name. The mismatching records fail to decode
+	// with an error wrapping ErrCodecMismatch. The Decoder must implement
+	// NamedCodec.
+	VerifyCodec bool
+	// MaxChunkedRecordBytes, when set, bounds the size of the records
+	// reassembled from the chunks produced with ProducerConfig.ChunkSize.
+	// The chunks of the bigger records are discarded as they're fetched,
+	// and the records fail to decode with ErrChunkedRecordTooLarge. The
+	// chunks are reassembled before decoding for all the processors but
+	// StreamProcessor, which receives them as they were produced.
+	MaxChunkedRecordBytes int
+	// ChunkAssemblyTimeout bounds how long the chunks of a record are
+	// reassembled for, from the fetch of its first chunk, defaults to 1m.
+	// ChunkAssemblyMaxGap bounds the offsets between consecutive chunks of
+	// a record, defaults to 10000. The records whose chunks don't all arrive
+	// within these bounds, such as when a chunk failed to be produced, are
+	// reported as failing to decode with ErrChunkedRecordIncomplete, so the
+	// offsets of their partition can be committed again.
+	ChunkAssemblyTimeout time.Duration
+	ChunkAssemblyMaxGap  int64
+	// HeaderEnricher, when set, is called with each event decoded from a
+	// record and the record headers, keyed by header key, before the event
+	// is processed, such as to copy a tenant header into an event field.
+	// It's called concurrently when DecodeConcurrency is greater than 1.
+	HeaderEnricher func(*model.APMEvent, map[string][]byte)
+	// DecodeConcurrency, when greater than 1, is the number of goroutines
+	// which decode the records of each fetch before they're processed, in
+	// order. By default, records are decoded serially.
+	DecodeConcurrency int
+	// PooledDecode, when set, decodes the records into batches whose
+	// backing arrays are reused from a pool across fetches, instead of
+	// allocating a batch for every record. Only the batch allocations are
+	// saved: the events are zeroed once processed, and the values they
+	// reference are allocated anew by the Decoder. The events passed to the
+	// processors are then only valid during the call, the processors must
+	// copy what they retain.
+	PooledDecode bool
+	// Processor that will be used to process the events of the records.
+	// Unless ProcessorRouter or Processors is set, it's called with a batch
+	// holding the event of a single record, or its events when the Decoder
+	// is a BatchDecoder. Otherwise, the events of the records fetched
+	// together which fall back to it are delivered in a single batch, like
+	// the routed ones, but they're committed even when it fails. The
+	// processors are never called with an empty batch: the records which
+	// are skipped, fail to decode or hold no events aren't delivered. The
+	// processors must not retain the batch, nor its events when
+	// PooledDecode is set.
 	Processor model.BatchProcessor
+	// ProcessorRouter, when set, selects the processor for each record
+	// based on its headers, returning it with the name of its route. The
+	// records routed to the same route are delivered together, so each
+	// route must always select the same processor. When it returns a nil
+	// processor, Processor is used.
+	ProcessorRouter func(headers map[string][]byte) (route string, processor model.BatchProcessor)
+	// Processors holds the processors for the records of each topic, keyed
+	// by topic. Records of unmapped topics, or for which ProcessorRouter
+	// doesn't return a processor, are processed by Processor.
+	//
+	// The events of the records fetched together are delivered to each
+	// processor selected by ProcessorRouter or Processors in a single batch.
+	// Unlike with Processor, the records are only committed once their
+	// processor succeeds: when it fails, all the records of the batch are
+	// retried, the partitions of its records being fetched again from their
+	// first record in the batch, so the records of those partitions which
+	// followed it are redelivered, even when routed to other processors.
+	Processors map[string]model.BatchProcessor
+	// StreamProcessor, when set, processes the raw records one at a time,
+	// instead of the processors above, which can't be set together with
+	// it. The offset of each record is committed as soon as it is processed
+	// and the records which fail are redelivered.
+	StreamProcessor StreamProcessor
+	// StreamRetryBackoff defines the time waited before redelivering a
+	// record which failed to be processed by the StreamProcessor, for each
+	// of its consecutive failed attempts. Run returns, without redelivering
+	// it, once its context is done. Defaults to an exponential backoff from
+	// 100ms up to 5s.
+	StreamRetryBackoff Backoff
+	// EnrichedProcessor, when set, processes the events decoded from each
+	// fetch in a single call, together with the metadata of their records,
+	// instead of the processors above, which can't be set together with it.
+	// Like with Processor, the records are committed even when it fails.
+	EnrichedProcessor EnrichedProcessor
+	// DisableSyncCommitOnClose disables the blocking commit of the processed
+	// offsets that Close issues before closing the client. By default, Close
+	// commits synchronously so the offsets of the last processed records
+	// aren't lost when the periodic commit couldn't complete.
+	DisableSyncCommitOnClose bool
+	// CommitRetry configures the retries of the offset commits which fail
+	// with retriable errors. By default, failed commits aren't retried.
+	CommitRetry CommitRetry
+	// OnCommit, when set, is called with the result of each offset commit
+	// issued after the fetched records are processed, once any retries are
+	// exhausted.
+	OnCommit func(err error)
+	// CommitInterval, when set, coalesces the offset commits: instead of
+	// committing after every fetch, the offsets of the records processed
+	// across fetches and partitions are committed together once
+	// CommitInterval has passed since the last commit. It reduces the commit
+	// requests under high throughput, at the cost of redelivering the records
+	// processed since the last commit when the consumer crashes. Close still
+	// commits the processed records, unless DisableSyncCommitOnClose is set,
+	// and the records of the partitions revoked in a rebalance are committed
+	// before the partitions are reassigned, while those of the lost
+	// partitions are dropped. It can't be set together with StreamProcessor.
+	CommitInterval time.Duration
+	// CommitBatchRecords, when set together with CommitInterval, commits the
+	// processed records before CommitInterval passes once that many records
+	// are pending.
+	CommitBatchRecords int
+	// OnPartitionStart and OnPartitionStop, when set, are called once for
+	// each partition assigned to and revoked from the consumer, such as to
+	// set up and tear down per-partition processor state. A partition is
+	// stopped when it's revoked or lost in a rebalance, and when the
+	// consumer is closed. The hooks are called from the rebalance, which
+	// they block, and may run while the records already fetched for the
+	// partition are processed.
+	OnPartitionStart func(ctx context.Context, topic string, partition int32)
+	OnPartitionStop  func(ctx context.Context, topic string, partition int32)
+	// OnFetchError, when set, is called with each partition error returned
+	// by the fetches once the consumer has handled them, including the
+	// unknown topic or partition errors which the consumer recovers from.
+	OnFetchError func(topic string, partition int32, err error)
+	// OnCaughtUp, when set, is called once, while Run is executing, when
+	// the lag of every partition assigned to the consumer is at most
+	// CaughtUpLag, such as to report readiness once the backlog found at
+	// startup has been processed. The lag is computed from the committed
+	// offsets every second until the consumer has caught up.
+	OnCaughtUp  func()
+	CaughtUpLag int64
+	// IdlePartitionTimeout, when set, pauses the fetching of the assigned
+	// partitions which haven't returned any records for the timeout, which
+	// reduces the fetch overhead of sparse topics with many partitions. The
+	// paused partitions are resumed on every rebalance, and probed every
+	// IdlePartitionProbeInterval, which defaults to IdlePartitionTimeout:
+	// they're resumed, and paused again unless they return records within
+	// the timeout. The new records of a paused partition are fetched with
+	// up to that interval of latency.
+	IdlePartitionTimeout       time.Duration
+	IdlePartitionProbeInterval time.Duration
+	// UnknownTopicBackoff defines the time waited before polling again
+	// while fetches fail because a topic or partition is unknown, such as
+	// when a topic is deleted. The metadata is refreshed before each poll.
+	// Once a deleted topic is recreated, its partitions are consumed from
+	// their start. Defaults to an exponential backoff from 100ms up to 5s.
+	UnknownTopicBackoff Backoff
+	// ProcessingErrorsBuffer, when set, is the capacity of the channel
+	// returned by ProcessingErrors, which receives the errors returned by
+	// the processors with the record coordinates. Sending never blocks, the
+	// errors are dropped and counted in Stats when the channel is full.
+	ProcessingErrorsBuffer int
+	// DeadLetterTopic is the topic where records are produced to when a
+	// DispositionProcessor returns DeadLetter for them. When empty, those
+	// records are logged and dropped.
+	DeadLetterTopic string
+	// PoisonThreshold, when set, is the number of consecutive times the same
+	// record can be retried before it's considered a poison pill. Poison
+	// records are produced to the DeadLetterTopic, or dropped when it's
+	// empty, so their partition progresses.
+	PoisonThreshold int
+	// MaxBufferedBytes, when set, bounds the size of the records that have
+	// been fetched but not yet processed. Fetching is throttled while the
+	// budget is used up and resumes as the processor drains the records.
+	// The bound is soft: a single record batch bigger than the budget is
+	// still fetched. It must be at least 2 when set.
+	MaxBufferedBytes int32
+	// ReorderKey and ReorderWindow, when set, deliver the records of each
+	// key returned by ReorderKey in the order of their timestamps, even
+	// across partitions, such as when reprocessing. The fetched records are
+	// held for ReorderWindow before they're processed, and the records of
+	// their key with an earlier timestamp which were fetched in the meantime
+	// are processed first. A longer window tolerates records further apart
+	// at the cost of the processing latency, and of the memory holding the
+	// records fetched during the window. The offsets are only committed up
+	// to the buffered records, which are redelivered if the consumer stops:
+	// the buffered records of a revoked or lost partition are dropped
+	// without being processed, and fetched again by its new owner. They
+	// can't be used with StreamProcessor or EnrichedProcessor.
+	ReorderKey    func(RawRecord) []byte
+	ReorderWindow time.Duration
+	// GroupByKey, when set, processes the events decoded from each fetch
+	// with Processor in a single batch, instead of one batch per record,
+	// grouped by the record keys. The groups are ordered by key, and the
+	// events of each key keep the records order, so, for example, all the
+	// spans of a trace keyed by its ID are delivered together. Like with
+	// EnrichedProcessor, the records are committed even when the processor
+	// fails. It requires Processor to be the only processor, and can't be
+	// used with ReorderKey or a DispositionProcessor.
+	GroupByKey bool
+	// RackID is the rack, or availability zone, the consumer runs in.
+	// FollowerFetch, when set, sends the RackID in the fetch requests, so
+	// brokers configured with a rack-aware replica selector can redirect the
+	// consumer to the replica in the same rack, which reduces the cross-zone
+	// traffic. It requires RackID to be set.
+	RackID        string
+	FollowerFetch bool
+	// MaxRecords, when set, makes Run return nil once that many records
+	// have been processed and their offsets committed. No more records are
+	// polled than the ones left to reach the limit. Zero means unbounded.
+	MaxRecords int
+
+	// OffsetStore, when set, stores the committed offsets outside of Kafka
+	// on Checkpoint and on Close, after the final commit. When
+	// CheckpointInterval is set, Run also checkpoints periodically.
+	OffsetStore        OffsetStore
+	CheckpointInterval time.Duration
+	// ResumeFromStore, when set, commits the offsets loaded from the
+	// OffsetStore for the group when the consumer is created, overriding
+	// the offsets committed for those partitions, so the consumption
+	// resumes from the last checkpoint.
+	ResumeFromStore bool
+
+	// clock is used for time-dependent operations, defaults to the system
+	// clock and is only overridden in tests.
+	clock clock
+}
+
+// CommitRetry configures the retries of failed offset commits.
+type CommitRetry struct {
+	// MaxAttempts is the maximum number of commit attempts, including the
+	// first one. Zero and one disable the retries.
+	MaxAttempts int
+	// Backoff defines the time waited between attempts. When nil, the
+	// commits are retried right away.
+	Backoff Backoff
 }
 
 // Validate ensures the configuration is valid, otherwise, returns an error.
@@ -68,17 +354,180 @@ func (cfg ConsumerConfig) Validate() error {
 	if cfg.Logger == nil {
 		errs = append(errs, errors.New("kafka: logger must be set"))
 	}
-	if cfg.Processor == nil {
-		errs = append(errs, errors.New("kafka: processor must be set"))
+	if err := validateJitterFraction(cfg.JitterFraction); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Backoff != nil && cfg.JitterFraction > 0 {
+		errs = append(errs, errors.New("kafka: backoff and jitter fraction cannot be set together"))
+	}
+	if err := cfg.ConnReconnectBackoff.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.MaxBufferedBytes < 0 {
+		errs = append(errs, errors.New("kafka: max buffered bytes cannot be negative"))
+	} else if cfg.MaxBufferedBytes == 1 {
+		// The budget is split between the fetch in flight and the one
+		// being processed.
+		errs = append(errs, errors.New("kafka: max buffered bytes must be at least 2"))
+	}
+	if (cfg.ReorderKey != nil) != (cfg.ReorderWindow > 0) {
+		errs = append(errs, errors.New("kafka: reorder key and a positive reorder window must be set together"))
+	}
+	if cfg.ReorderKey != nil && (cfg.StreamProcessor != nil || cfg.EnrichedProcessor != nil) {
+		errs = append(errs, errors.New("kafka: reorder key cannot be set with the stream or enriched processors"))
+	}
+	if cfg.GroupByKey {
+		_, disposition := cfg.Processor.(DispositionProcessor)
+		switch {
+		case cfg.Processor == nil || cfg.ProcessorRouter != nil || len(cfg.Processors) > 0:
+			errs = append(errs, errors.New("kafka: group by key requires processor to be the only processor"))
+		case disposition:
+			errs = append(errs, errors.New("kafka: group by key cannot be used with a disposition processor"))
+		}
+		if cfg.ReorderKey != nil {
+			errs = append(errs, errors.New("kafka: group by key cannot be set together with reorder key"))
+		}
+	}
+	if cfg.FollowerFetch && cfg.RackID == "" {
+		errs = append(errs, errors.New("kafka: rack ID must be set to fetch from followers"))
+	}
+	if cfg.ProcessingErrorsBuffer < 0 {
+		errs = append(errs, errors.New("kafka: processing errors buffer cannot be negative"))
+	}
+	if cfg.MaxRecords < 0 {
+		errs = append(errs, errors.New("kafka: max records cannot be negative"))
+	}
+	if cfg.PoisonThreshold < 0 {
+		errs = append(errs, errors.New("kafka: poison threshold cannot be negative"))
+	}
+	if cfg.IdlePartitionTimeout < 0 || cfg.IdlePartitionProbeInterval < 0 {
+		errs = append(errs, errors.New("kafka: idle partition timeout and probe interval cannot be negative"))
+	}
+	if cfg.IdlePartitionProbeInterval > 0 && cfg.IdlePartitionTimeout == 0 {
+		errs = append(errs, errors.New("kafka: idle partition timeout must be set to probe the idle partitions"))
+	}
+	if cfg.CaughtUpLag < 0 {
+		errs = append(errs, errors.New("kafka: caught up lag cannot be negative"))
+	}
+	if _, ok := cfg.Decoder.(NamedCodec); cfg.VerifyCodec && cfg.Decoder != nil && !ok {
+		errs = append(errs, errors.New("kafka: decoder must implement NamedCodec to verify the codec"))
+	}
+	if cfg.MaxChunkedRecordBytes < 0 {
+		errs = append(errs, errors.New("kafka: max chunked record bytes cannot be negative"))
+	}
+	if cfg.ChunkAssemblyTimeout < 0 {
+		errs = append(errs, errors.New("kafka: chunk assembly timeout cannot be negative"))
+	}
+	if cfg.ChunkAssemblyMaxGap < 0 {
+		errs = append(errs, errors.New("kafka: chunk assembly max gap cannot be negative"))
+	}
+	if cfg.DecodeConcurrency < 0 {
+		errs = append(errs, errors.New("kafka: decode concurrency cannot be negative"))
+	}
+	if cfg.CheckpointInterval < 0 {
+		errs = append(errs, errors.New("kafka: checkpoint interval cannot be negative"))
+	}
+	if cfg.OffsetStore == nil && (cfg.CheckpointInterval > 0 || cfg.ResumeFromStore) {
+		errs = append(errs, errors.New("kafka: offset store must be set to checkpoint or resume"))
+	}
+	if cfg.CommitRetry.MaxAttempts < 0 {
+		errs = append(errs, errors.New("kafka: commit retry max attempts cannot be negative"))
+	}
+	if cfg.CommitInterval < 0 {
+		errs = append(errs, errors.New("kafka: commit interval cannot be negative"))
+	}
+	if cfg.CommitBatchRecords < 0 {
+		errs = append(errs, errors.New("kafka: commit batch records cannot be negative"))
+	}
+	if cfg.CommitBatchRecords > 0 && cfg.CommitInterval <= 0 {
+		errs = append(errs, errors.New("kafka: commit interval must be set to batch commits"))
+	}
+	if cfg.CommitInterval > 0 && cfg.StreamProcessor != nil {
+		errs = append(errs, errors.New("kafka: commit interval cannot be used with a stream processor"))
+	}
+	hasProcessor := cfg.Processor != nil || cfg.ProcessorRouter != nil || len(cfg.Processors) > 0
+	if !hasProcessor && cfg.StreamProcessor == nil && cfg.EnrichedProcessor == nil {
+		errs = append(errs, errors.New("kafka: processor, processor router, processors, stream processor or enriched processor must be set"))
+	}
+	if hasProcessor && cfg.StreamProcessor != nil {
+		errs = append(errs, errors.New("kafka: stream processor cannot be set together with other processors"))
+	}
+	if cfg.EnrichedProcessor != nil && (hasProcessor || cfg.StreamProcessor != nil) {
+		errs = append(errs, errors.New("kafka: enriched processor cannot be set together with other processors"))
+	}
+	for topic := range cfg.Processors {
+		if !containsString(cfg.Topics, topic) {
+			errs = append(errs, fmt.Errorf("kafka: processor set for topic %s, which isn't consumed", topic))
+		}
 	}
 	return errors.Join(errs...)
 }
 
+// Decoder decodes a []byte into a model.APMEvent.
+type Decoder interface {
+	Decode([]byte, *model.APMEvent) error
+}
+
+// BatchDecoder can be optionally implemented by the Decoders of records
+// holding multiple events, such as JSON lines. The consumer decodes each
+// record value into its events with DecodeBatch, instead of Decode.
+type BatchDecoder interface {
+	Decoder
+	// DecodeBatch decodes the events of the record value, appending them to
+	// the batch. The batch is empty, but with PooledDecode its capacity may
+	// be reused, holding zeroed events past its length.
+	DecodeBatch([]byte, *model.Batch) error
+}
+
+// waitForConsumedInterval is the interval at which WaitForConsumed checks the
+// committed offsets.
+const waitForConsumedInterval = 100 * time.Millisecond
+
 // Consumer wraps a Kafka consumer and the consumption implementation details.
 type Consumer struct {
-	mu     sync.RWMutex
-	client *kgo.Client
-	cfg    ConsumerConfig
+	mu      sync.RWMutex
+	client  *kgo.Client
+	cfg     ConsumerConfig
+	tracer  *kotel.Tracer
+	metrics consumerMetrics
+	// buffered tracks the records fetched but not processed yet.
+	buffered *bufferTracker
+	// pending holds the processed records whose offsets haven't been
+	// committed yet.
+	pending []*kgo.Record
+	// consumed is the number of records processed so far, only tracked
+	// when MaxRecords is set.
+	consumed int
+	closed   bool
+	// pollMu guards closing and cancelPoll, which interrupts the poll in
+	// progress, if any, so Close doesn't wait for records to be fetched.
+	pollMu     sync.Mutex
+	closing    bool
+	cancelPoll context.CancelFunc
+	// revoking counts the rebalance hooks waiting for the lock, which don't
+	// let the consumer poll until they're done.
+	revoking int
+	// unknown tracks the partitions whose fetches failed because they were
+	// unknown.
+	unknown unknownPartitions
+	// poison tracks the records retried consecutively, for PoisonThreshold.
+	poison *poisonTracker
+	// reorder buffers the fetched records for ReorderWindow, nil when the
+	// records aren't reordered.
+	reorder *reorderBuffer
+	// chunks reassembles the chunked records.
+	chunks chunkAssembler
+	// idle pauses the idle partitions, nil when IdlePartitionTimeout isn't
+	// set.
+	idle *idlePartitions
+	// events holds the decoded batches, when PooledDecode is set.
+	events eventPool
+	// commits coalesces the offset commits, nil when CommitInterval isn't
+	// set.
+	commits *commitBatcher
+
+	processingErrors        chan ProcessError
+	droppedProcessingErrors atomic.Int64
 }
 
 // NewConsumer creates a new instance of a Consumer.
@@ -86,11 +535,56 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
+	cfg.clock = clockOrDefault(cfg.clock)
 	opts := []kgo.Opt{
 		kgo.SeedBrokers(cfg.Brokers...),
 		kgo.ConsumerGroup(cfg.GroupID),
 		kgo.ConsumeTopics(cfg.Topics...),
 		kgo.WithLogger(kzap.New(cfg.Logger)),
+		// Offsets are committed once the fetched records have been processed.
+		kgo.DisableAutoCommit(),
+		// Unknown topic or partition errors are handled by the consumer.
+		kgo.KeepRetryableFetchErrors(),
+	}
+	if len(cfg.SASL) > 0 {
+		opts = append(opts, kgo.SASL(cfg.SASL...))
+	}
+	if cfg.Backoff != nil {
+		opts = append(opts, kgo.RetryBackoffFn(cfg.Backoff.Next))
+	} else if cfg.JitterFraction > 0 {
+		opts = append(opts, kgo.RetryBackoffFn(jitteredBackoff(cfg.JitterFraction)))
+	}
+	if opt := dialOpt(cfg.TLS, cfg.ConnReconnectBackoff); opt != nil {
+		opts = append(opts, opt)
+	}
+	tracer := newTracer(cfg.TracerProvider,
+		kotel.ClientID(cfg.ClientID), kotel.ConsumerGroup(cfg.GroupID),
+	)
+	buffered := new(bufferTracker)
+	opts = append(opts, kgo.WithHooks(tracer, buffered))
+	if hook := newBrokerHook(cfg.OnBrokerConnect, cfg.OnBrokerDisconnect); hook != nil {
+		opts = append(opts, kgo.WithHooks(hook))
+	}
+	metrics, err := newConsumerMetrics(cfg.MeterProvider, cfg.clock)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed to create metrics: %w", err)
+	}
+	idle := newIdlePartitions(cfg.IdlePartitionTimeout, cfg.IdlePartitionProbeInterval, cfg.clock)
+	lifecycle := newPartitionLifecycle(cfg, metrics, idle)
+	opts = append(opts, lifecycle.opts()...)
+	if cfg.FollowerFetch {
+		opts = append(opts, kgo.Rack(cfg.RackID))
+	}
+	if cfg.MaxBufferedBytes > 0 {
+		// Only a single fetch can be in flight or buffered while the polled
+		// records are being processed, so each of them gets half of the
+		// budget.
+		fetchBytes := cfg.MaxBufferedBytes / 2
+		opts = append(opts,
+			kgo.MaxConcurrentFetches(1),
+			kgo.FetchMaxBytes(fetchBytes),
+			kgo.FetchMaxPartitionBytes(fetchBytes),
+		)
 	}
 	if cfg.ClientID != "" {
 		opts = append(opts, kgo.ClientID(cfg.ClientID))
@@ -100,7 +594,17 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 			))
 		}
 	}
-	// TODO(marclop) block on re-balances, auto-commit high watermarks.
+	if cfg.RequireExistingGroup {
+		if err := checkGroupExists(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ResumeFromStore {
+		if err := resumeFromStore(cfg); err != nil {
+			return nil, err
+		}
+	}
+	// TODO(marclop) block on re-balances.
 	client, err := kgo.NewClient(opts...)
 	if err != nil {
 		return nil, err
@@ -108,28 +612,249 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 	// Issue a metadata refresh request on construction, so the broker list is
 	// populated.
 	client.ForceMetadataRefresh()
+	if cfg.Decoder == nil {
+		cfg.Decoder = json.JSON{}
+	}
+	if cfg.UnknownTopicBackoff == nil {
+		cfg.UnknownTopicBackoff = ExponentialBackoff{
+			Min: 100 * time.Millisecond, Max: 5 * time.Second,
+		}
+	}
+	if cfg.StreamRetryBackoff == nil {
+		cfg.StreamRetryBackoff = ExponentialBackoff{
+			Min: 100 * time.Millisecond, Max: 5 * time.Second,
+		}
+	}
+	if cfg.ChunkAssemblyTimeout == 0 {
+		cfg.ChunkAssemblyTimeout = time.Minute
+	}
+	if cfg.ChunkAssemblyMaxGap == 0 {
+		cfg.ChunkAssemblyMaxGap = 10000
+	}
 	consumer := Consumer{
-		cfg:    cfg,
-		client: client,
+		cfg:      cfg,
+		client:   client,
+		tracer:   tracer,
+		metrics:  metrics,
+		buffered: buffered,
+		poison:   newPoisonTracker(cfg.PoisonThreshold),
+		reorder:  newReorderBuffer(cfg.ReorderKey, cfg.ReorderWindow),
+		chunks: chunkAssembler{
+			maxBytes: cfg.MaxChunkedRecordBytes,
+			timeout:  cfg.ChunkAssemblyTimeout,
+			maxGap:   cfg.ChunkAssemblyMaxGap,
+		},
+		idle:    idle,
+		commits: newCommitBatcher(cfg.CommitInterval, cfg.CommitBatchRecords, cfg.clock.Now()),
+	}
+	consumer.chunks.expired = consumer.chunkExpired
+	if cfg.ProcessingErrorsBuffer > 0 {
+		consumer.processingErrors = make(chan ProcessError, cfg.ProcessingErrorsBuffer)
 	}
+	lifecycle.setRevoke(consumer.revokePartitions)
 	return &consumer, nil
 }
 
-// Close closes the consumer.
+// Close closes the consumer. Unless DisableSyncCommitOnClose is set, the
+// offsets of all the processed records are committed before returning. The
+// returned error, if any, is a *CloseError.
 func (c *Consumer) Close() error {
+	c.interruptPoll()
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.close()
+}
+
+// CloseWithGrace closes the consumer like Close, waiting for up to grace for
+// the records being processed, if any, before committing their offsets. When
+// the grace is exceeded, the client is closed right away, without committing
+// the offsets of the in-flight records, which are redelivered to the next
+// consumer of their partitions, and the returned *CloseError wraps
+// ErrCloseGraceExceeded. The in-flight records are still processed after it
+// returns, but their offsets aren't committed.
+func (c *Consumer) CloseWithGrace(grace time.Duration) error {
+	c.interruptPoll()
+	if c.mu.TryLock() {
+		defer c.mu.Unlock()
+		return c.close()
+	}
+	locked := make(chan struct{})
+	go func() {
+		c.mu.Lock()
+		close(locked)
+	}()
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-locked:
+		defer c.mu.Unlock()
+		return c.close()
+	case <-timer.C:
+	}
 	c.client.Close()
-	return nil
+	go func() {
+		<-locked
+		defer c.mu.Unlock()
+		if !c.closed {
+			c.closed = true
+			if c.processingErrors != nil {
+				close(c.processingErrors)
+			}
+		}
+	}()
+	return closeError(fmt.Errorf("%w after %s", ErrCloseGraceExceeded, grace), nil)
+}
+
+// revokePartitions settles the pending records of the partitions revoked
+// from the consumer in a rebalance, so no later commit, such as a coalesced
+// one, writes their offsets once they're assigned to other members. The
+// pending records of the revoked partitions are committed synchronously, and
+// those of the lost partitions are dropped, since the partitions may already
+// be consumed by other members. It interrupts the poll in progress, if any,
+// to wait for the fetched records to be processed.
+func (c *Consumer) revokePartitions(ctx context.Context, revoked map[string][]int32, lost bool) {
+	c.pollMu.Lock()
+	if c.closing {
+		// Close commits the pending records before leaving the group.
+		c.pollMu.Unlock()
+		return
+	}
+	c.revoking++
+	if c.cancelPoll != nil {
+		c.cancelPoll()
+	}
+	c.pollMu.Unlock()
+	defer func() {
+		c.pollMu.Lock()
+		defer c.pollMu.Unlock()
+		c.revoking--
+	}()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var settle, keep []*kgo.Record
+	for _, msg := range c.pending {
+		if containsPartition(revoked, msg.Topic, msg.Partition) {
+			settle = append(settle, msg)
+		} else {
+			keep = append(keep, msg)
+		}
+	}
+	if len(settle) > 0 && !lost {
+		// The offsets are committed up to the records held by the reorder
+		// buffer or the chunk assembler, which are dropped below.
+		c.pending = settle
+		c.commitPending(ctx)
+	}
+	c.pending = keep
+	// The buffered records of the revoked partitions are fetched again by
+	// their new owner.
+	for topic, partitions := range revoked {
+		for _, partition := range partitions {
+			for _, e := range c.reorder.drop(topic, partition) {
+				c.buffered.processed(e.msg)
+				c.release(&e.decoded)
+			}
+		}
+	}
+	c.chunks.revoke(revoked)
+}
+
+// chunkExpired reports the incomplete chunked record as failing to decode.
+func (c *Consumer) chunkExpired(topic string, partition int32, err error) {
+	c.cfg.Logger.Error("unable to decode the record into model.APMEvent",
+		zap.Error(err),
+		zap.String("topic", topic),
+		zap.Int32("partition", partition),
+	)
+	c.metrics.recordOutcome(context.Background(), topic, true)
+}
+
+// interruptPoll stops polling, so the lock held while polling is released.
+func (c *Consumer) interruptPoll() {
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+	c.closing = true
+	if c.cancelPoll != nil {
+		c.cancelPoll()
+	}
 }
 
-// Run executes the consumer in a blocking manner.
+// close commits the offsets of the processed records and closes the client.
+// It must be called with the lock held.
+func (c *Consumer) close() error {
+	if c.closed {
+		return closeError(nil, errors.New("kafka: consumer already closed"))
+	}
+	c.closed = true
+	var flushErr error
+	if !c.cfg.DisableSyncCommitOnClose {
+		// The lock guarantees that no records are being processed.
+		if err := c.commit(context.Background()); err != nil {
+			flushErr = fmt.Errorf("kafka: failed to commit offsets on close: %w", err)
+		}
+	}
+	if c.cfg.OffsetStore != nil {
+		if err := c.Checkpoint(context.Background()); err != nil {
+			flushErr = errors.Join(flushErr, err)
+		}
+	}
+	c.client.Close()
+	if c.processingErrors != nil {
+		close(c.processingErrors)
+	}
+	return closeError(flushErr, nil)
+}
+
+// Run executes the consumer in a blocking manner. When MaxRecords is set,
+// it returns nil once that many records have been processed. It returns an
+// error wrapping ErrGroupNotAuthorized when the consumer isn't authorized to
+// join the consumer group.
 func (c *Consumer) Run(ctx context.Context) error {
+	if c.cfg.CheckpointInterval > 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go c.checkpointEvery(ctx)
+	}
+	if c.cfg.OnCaughtUp != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go c.notifyCaughtUp(ctx)
+	}
 	for {
+		if c.cfg.MaxRecords > 0 && c.consumed >= c.cfg.MaxRecords {
+			return nil
+		}
 		if err := c.fetch(ctx); err != nil {
 			return err
 		}
+		if c.unknown.attempts > 0 &&
+			!wait(ctx, c.cfg.UnknownTopicBackoff, c.unknown.attempts) {
+			return ctx.Err()
+		}
+	}
+}
+
+// AddTopics adds the topics to the consumer subscription. The consumer
+// group rebalances to assign the partitions of the new topics.
+func (c *Consumer) AddTopics(topics ...string) {
+	c.client.AddConsumeTopics(topics...)
+}
+
+// RemoveTopics removes the topics from the consumer subscription. The
+// offsets of the records processed so far are committed, then the topics
+// are purged from the client and the consumer group rebalances. Records of
+// the topics which were fetched but not processed are dropped. It blocks
+// until the in-flight fetch, if any, has been processed.
+func (c *Consumer) RemoveTopics(topics ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The lock guarantees that no records are being processed.
+	if err := c.commit(context.Background()); err != nil {
+		c.cfg.Logger.Error("unable to commit offsets before removing topics",
+			zap.Error(err), zap.Strings("topics", topics),
+		)
 	}
+	c.client.PurgeTopicsFromClient(topics...)
 }
 
 func (c *Consumer) fetch(ctx context.Context) error {
@@ -138,46 +863,652 @@ func (c *Consumer) fetch(ctx context.Context) error {
 	// state management and blocking when rebalances happen.
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	fetches := c.client.PollFetches(ctx)
-	if fetches.IsClientClosed() || errors.Is(fetches.Err0(), context.Canceled) {
-		return context.Canceled // Client closed or context cancelled.
+	pollCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The deadlines are measured on the consumer clock, so the polls are
+	// bounded by the time left until them.
+	now := c.cfg.clock.Now()
+	if deadline, ok := c.reorder.next(); ok {
+		// Stop polling once the next buffered records have to be released.
+		pollCtx, cancel = context.WithTimeout(pollCtx, deadline.Sub(now))
+		defer cancel()
+	}
+	c.idle.check(c.client, now)
+	if deadline, ok := c.idle.next(); ok {
+		// Stop polling once the next idle partition has to be paused or
+		// probed.
+		pollCtx, cancel = context.WithTimeout(pollCtx, deadline.Sub(now))
+		defer cancel()
+	}
+	c.chunks.expireTimeout(now)
+	if deadline, ok := c.chunks.next(); ok {
+		// Stop polling once the next incomplete chunked record expires.
+		pollCtx, cancel = context.WithTimeout(pollCtx, deadline.Sub(now))
+		defer cancel()
+	}
+	if deadline, ok := c.commits.next(len(c.pending)); ok {
+		// Stop polling once the coalesced commit is due.
+		pollCtx, cancel = context.WithTimeout(pollCtx, deadline.Sub(now))
+		defer cancel()
+	}
+	c.pollMu.Lock()
+	if c.closing {
+		c.pollMu.Unlock()
+		return context.Canceled // Consumer closing.
+	}
+	if c.revoking > 0 {
+		c.pollMu.Unlock()
+		return nil // Partitions being revoked, see revokePartitions.
 	}
+	c.cancelPoll = cancel
+	c.pollMu.Unlock()
+	var fetches kgo.Fetches
+	if c.cfg.MaxRecords > 0 {
+		fetches = c.client.PollRecords(pollCtx, c.cfg.MaxRecords-c.consumed)
+	} else {
+		fetches = c.client.PollFetches(pollCtx)
+	}
+	c.pollMu.Lock()
+	c.cancelPoll = nil
+	c.pollMu.Unlock()
+	if fetches.IsClientClosed() {
+		return context.Canceled // Client closed.
+	}
+	c.idle.fetched(fetches)
+	if err := ctx.Err(); err != nil {
+		c.buffered.discarded(fetches)
+		return err // Context cancelled or deadline exceeded.
+	}
+	if pollCtx.Err() != nil && fetches.NumRecords() == 0 {
+		// Interrupted, or only the reorder buffer has to be released, the
+		// idle partitions checked, the incomplete chunked records expired
+		// or the pending records committed.
+		fetches = nil
+	}
+	var groupErr error
+	var unknown []string
 	fetches.EachError(func(t string, p int32, err error) {
-		c.cfg.Logger.Error("consumer fetches returned error",
-			zap.Error(err), zap.String("topic", t), zap.Int32("partition", p),
-		)
+		switch {
+		case errors.Is(err, kerr.GroupAuthorizationFailed):
+			groupErr = groupError(c.cfg.GroupID, err)
+		case errors.Is(err, kerr.UnknownTopicOrPartition), errors.Is(err, kerr.UnknownTopicID):
+			if !containsString(unknown, t) {
+				unknown = append(unknown, t)
+			}
+			c.cfg.Logger.Debug("consumer fetches returned unknown topic or partition",
+				zap.Error(err), zap.String("topic", t), zap.Int32("partition", p),
+			)
+		case kerr.IsRetriable(err):
+			// Retriable errors are retried by the client.
+			c.cfg.Logger.Debug("consumer fetches returned retriable error",
+				zap.Error(err), zap.String("topic", t), zap.Int32("partition", p),
+			)
+		default:
+			c.cfg.Logger.Error("consumer fetches returned error",
+				zap.Error(err), zap.String("topic", t), zap.Int32("partition", p),
+			)
+		}
 	})
-	fetches.EachRecord(func(msg *kgo.Record) {
-		ctx := context.Background()
-		for _, h := range msg.Headers {
-			if h.Key == "project_id" {
-				ctx = queuecontext.WithProject(ctx, string(h.Value))
-				break
+	if groupErr == nil {
+		c.handleUnknownPartitions(ctx, unknown)
+	}
+	if c.cfg.OnFetchError != nil {
+		fetches.EachError(c.cfg.OnFetchError)
+	}
+	if groupErr != nil {
+		c.buffered.discarded(fetches)
+		return groupErr // The consumer can't join the group.
+	}
+	// Records are processed in order, when a record has to be retried, the
+	// rest of its partition's records are skipped and the partition is
+	// rewound to the record's offset, so it's fetched again.
+	rewind := make(map[string]map[int32]kgo.EpochOffset)
+	// EachRecord iterates the records in the same order as Records.
+	decoded := c.decodeRecords(ctx, fetches.Records())
+	if c.reorder == nil {
+		// The reorder buffer releases the records it holds once processed.
+		defer func() {
+			for i := range decoded {
+				c.release(&decoded[i])
 			}
+		}()
+	}
+	if c.cfg.EnrichedProcessor != nil {
+		c.processEnriched(ctx, fetches.Records(), decoded)
+		c.commitProcessed(ctx)
+		return nil
+	}
+	if c.cfg.GroupByKey {
+		c.processGrouped(ctx, fetches.Records(), decoded)
+		c.commitProcessed(ctx)
+		return nil
+	}
+	if c.reorder != nil {
+		c.reorderRecords(ctx, fetches.Records(), decoded, rewind)
+	} else if c.cfg.ProcessorRouter != nil || len(c.cfg.Processors) > 0 {
+		c.processRouted(ctx, fetches.Records(), decoded, rewind)
+	} else {
+		var i int
+		fetches.EachRecord(func(msg *kgo.Record) {
+			c.handleRecord(ctx, msg, decoded[i], rewind)
+			i++
+		})
+	}
+	if len(rewind) > 0 {
+		c.client.SetOffsets(rewind)
+		// The records fetched again, such as the chunks of a rewound
+		// chunked record, aren't committed.
+		pending := c.pending[:0]
+		for _, msg := range c.pending {
+			if offset, ok := rewind[msg.Topic][msg.Partition]; ok && msg.Offset >= offset.Offset {
+				continue
+			}
+			pending = append(pending, msg)
 		}
-		var event model.APMEvent
-		if err := json.Unmarshal(msg.Value, &event); err != nil {
-			c.cfg.Logger.Error("unable to unmarshal json into model.APMEvent",
-				zap.Error(err),
-				zap.String("topic", msg.Topic),
-				zap.ByteString("message.value", msg.Value),
-				zap.Int64("offset", msg.Offset),
-				zap.Int32("partition", int32(msg.Partition)),
-			)
+		c.pending = pending
+	}
+	// Commit the offsets once all the records have been processed.
+	c.commitProcessed(ctx)
+	return nil
+}
+
+// handleRecord processes the record, adding it to the pending records once
+// it's processed. When the record has to be retried, its partition is added
+// to rewind, and the following records of the partition are skipped.
+func (c *Consumer) handleRecord(ctx context.Context, msg *kgo.Record, record decodedRecord, rewind map[string]map[int32]kgo.EpochOffset) {
+	defer c.buffered.processed(msg)
+	if _, ok := rewind[msg.Topic][msg.Partition]; ok {
+		return
+	}
+	if record.skipped {
+		// Committed without being processed.
+		c.pending = append(c.pending, msg)
+		return
+	}
+	var disposition RecordDisposition
+	if c.cfg.StreamProcessor != nil {
+		if !c.waitStreamRetry(ctx, msg) {
+			// Run is returning, the record is fetched again if it's called
+			// again.
+			c.rewindRecord(msg, record, rewind)
+			return
+		}
+		disposition = c.processStreamRecord(ctx, msg)
+	} else {
+		disposition = c.processRecord(ctx, msg, record)
+	}
+	c.settleRecord(ctx, msg, record, disposition, rewind)
+}
+
+// rewindRecord adds the record's partition to rewind, so it's fetched again
+// from the record.
+func (c *Consumer) rewindRecord(msg *kgo.Record, record decodedRecord, rewind map[string]map[int32]kgo.EpochOffset) {
+	if rewind[msg.Topic] == nil {
+		rewind[msg.Topic] = make(map[int32]kgo.EpochOffset)
+	}
+	// Chunked records are fetched again from their first chunk.
+	rewind[msg.Topic][msg.Partition] = kgo.EpochOffset{
+		Epoch: msg.LeaderEpoch, Offset: record.first,
+	}
+}
+
+// settleRecord applies the disposition of the processed record: retried
+// records are added to rewind, unless they exceed the PoisonThreshold, and
+// the rest are added to the pending records.
+func (c *Consumer) settleRecord(ctx context.Context, msg *kgo.Record, record decodedRecord, disposition RecordDisposition, rewind map[string]map[int32]kgo.EpochOffset) {
+	if disposition == Retry && c.poison.failed(msg) {
+		c.cfg.Logger.Warn("record exceeded the poison threshold",
+			zap.Int("threshold", c.cfg.PoisonThreshold),
+			zap.String("topic", msg.Topic),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", int32(msg.Partition)),
+		)
+		disposition = c.deadLetter(ctx, msg)
+	}
+	if disposition == Retry {
+		c.rewindRecord(msg, record, rewind)
+		return
+	}
+	c.poison.done(msg)
+	c.pending = append(c.pending, msg)
+	if c.cfg.MaxRecords > 0 {
+		c.consumed++
+	}
+	if c.cfg.StreamProcessor != nil {
+		// StreamProcessor records are acknowledged individually.
+		c.commitPending(ctx)
+	}
+}
+
+// commitProcessed commits the records processed in a fetch, unless the
+// commits are coalesced and the commit isn't due yet. The records are always
+// committed once MaxRecords have been processed, since Run returns.
+func (c *Consumer) commitProcessed(ctx context.Context) {
+	if len(c.pending) == 0 {
+		return
+	}
+	maxed := c.cfg.MaxRecords > 0 && c.consumed >= c.cfg.MaxRecords
+	if !maxed && !c.commits.due(c.cfg.clock.Now(), len(c.pending)) {
+		return
+	}
+	c.commitPending(ctx)
+}
+
+// commitPending commits the offsets of the processed records, reporting the
+// result to OnCommit.
+func (c *Consumer) commitPending(ctx context.Context) {
+	err := c.commitWithRetry(ctx)
+	c.commits.committed(c.cfg.clock.Now())
+	if err != nil {
+		c.cfg.Logger.Error("unable to commit offsets", zap.Error(err))
+	}
+	if c.cfg.OnCommit != nil {
+		c.cfg.OnCommit(err)
+	}
+}
+
+// commitWithRetry commits the offsets of the processed records, retrying
+// the commits which fail with retriable errors as configured by CommitRetry.
+func (c *Consumer) commitWithRetry(ctx context.Context) error {
+	if c.cfg.CommitRetry.Backoff != nil {
+		c.cfg.CommitRetry.Backoff.Reset()
+	}
+	for attempt := 1; ; attempt++ {
+		err := c.commit(ctx)
+		if err == nil || attempt >= c.cfg.CommitRetry.MaxAttempts || !kerr.IsRetriable(err) {
+			return err
+		}
+		c.cfg.Logger.Warn("retrying failed offset commit",
+			zap.Error(err), zap.Int("attempt", attempt),
+		)
+		if !wait(ctx, c.cfg.CommitRetry.Backoff, attempt) {
+			return err
+		}
+	}
+}
+
+// commit commits the offsets of the processed records.
+func (c *Consumer) commit(ctx context.Context) error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	commit, held := c.reorder.committable(c.pending)
+	commit, heldChunks := c.chunks.committable(commit)
+	if len(commit) == 0 {
+		return nil
+	}
+	if err := c.client.CommitRecords(ctx, commit...); err != nil {
+		return err
+	}
+	c.pending = append(append(c.pending[:0], held...), heldChunks...)
+	return nil
+}
+
+// decodedRecord holds the events decoded from a record, or the decoding
+// error. Records hold a single event, unless the Decoder is a BatchDecoder.
+type decodedRecord struct {
+	events model.Batch
+	err    error
+	// skipped is set for the records rejected by the ConsumeInterceptors
+	// or PreDecodeFilter, which aren't decoded, and for the chunks
+	// preceding the last chunk of a chunked record.
+	skipped bool
+	// value is the record value, reassembled from the chunks of chunked
+	// records, and first the offset the record is fetched again from.
+	value []byte
+	first int64
+	// pooled is the batch events was taken from, when PooledDecode is set.
+	pooled *model.Batch
+}
+
+// decodeRecords decodes the records accepted by the ConsumeInterceptors and
+// PreDecodeFilter, using up to DecodeConcurrency goroutines. The decoded
+// records are returned in the records order. The StreamProcessor records
+// aren't decoded.
+func (c *Consumer) decodeRecords(ctx context.Context, records []*kgo.Record) []decodedRecord {
+	now := c.cfg.clock.Now()
+	decoded := make([]decodedRecord, len(records))
+	for i, r := range records {
+		decoded[i].first = r.Offset
+		decoded[i].skipped = !c.interceptConsume(ctx, r)
+		if !decoded[i].skipped && c.cfg.PreDecodeFilter != nil {
+			decoded[i].skipped = !c.cfg.PreDecodeFilter(newRawRecord(r))
+		}
+	}
+	if c.cfg.StreamProcessor != nil {
+		return decoded
+	}
+	for i, r := range records {
+		if decoded[i].skipped {
+			continue
+		}
+		value, first, complete, err := c.chunks.add(r, now)
+		decoded[i].value, decoded[i].first, decoded[i].err = value, first, err
+		// The chunks are committed with the record, once it's processed.
+		decoded[i].skipped = !complete
+	}
+	decode := func(i int) {
+		if decoded[i].skipped || decoded[i].err != nil {
 			return
 		}
-		batch := model.Batch{event}
-		if err := c.cfg.Processor.ProcessBatch(ctx, &batch); err != nil {
-			c.cfg.Logger.Error("unable to process event",
-				zap.Error(err),
+		if c.cfg.VerifyCodec {
+			if decoded[i].err = verifyCodec(c.cfg.Decoder, records[i].Headers); decoded[i].err != nil {
+				return
+			}
+		}
+		if c.cfg.PooledDecode {
+			decoded[i].pooled = c.events.get()
+			decoded[i].events = *decoded[i].pooled
+		}
+		if decoder, ok := c.cfg.Decoder.(BatchDecoder); ok {
+			decoded[i].err = decoder.DecodeBatch(decoded[i].value, &decoded[i].events)
+		} else {
+			decoded[i].events = append(decoded[i].events, model.APMEvent{})
+			decoded[i].err = c.cfg.Decoder.Decode(decoded[i].value, &decoded[i].events[0])
+		}
+		if decoded[i].err == nil && c.cfg.HeaderEnricher != nil {
+			headers := make(map[string][]byte, len(records[i].Headers))
+			for _, h := range records[i].Headers {
+				headers[h.Key] = h.Value
+			}
+			for j := range decoded[i].events {
+				c.cfg.HeaderEnricher(&decoded[i].events[j], headers)
+			}
+		}
+	}
+	workers := c.cfg.DecodeConcurrency
+	if workers > len(records) {
+		workers = len(records)
+	}
+	if workers <= 1 {
+		for i := range records {
+			decode(i)
+		}
+		return decoded
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				decode(i)
+			}
+		}()
+	}
+	for i := range records {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return decoded
+}
+
+// processRecord processes a single decoded record, returning what the
+// consumer should do with it. Records which failed to decode or process are
+// logged and acknowledged, unless the processor is a DispositionProcessor.
+func (c *Consumer) processRecord(ctx context.Context, msg *kgo.Record, decoded decodedRecord) RecordDisposition {
+	processCtx, span := c.tracer.WithProcessSpan(msg)
+	defer span.End()
+	span.SetAttributes(messageIDAttr(msg))
+	if project := recordProject(msg); project != "" {
+		processCtx = queuecontext.WithProject(processCtx, project)
+	}
+	processor, route := c.deliverable(processCtx, msg, decoded)
+	if processor == nil {
+		return Ack
+	}
+	batch := decoded.events
+	defer func() {
+		for _, event := range decoded.events {
+			c.metrics.recordDelay(processCtx, msg.Topic, event.Timestamp)
+		}
+	}()
+	events := int64(len(batch))
+	if dp, ok := processor.(DispositionProcessor); ok {
+		dispositions := dp.ProcessBatchDisposition(processCtx, &batch)
+		if len(dispositions) != int(events) {
+			c.cfg.Logger.Error("processor returned an unexpected number of dispositions",
+				zap.Int("dispositions", len(dispositions)),
 				zap.String("topic", msg.Topic),
 				zap.Int64("offset", msg.Offset),
 				zap.Int32("partition", int32(msg.Partition)),
 			)
-			return
+			c.metrics.recordOutcome(processCtx, msg.Topic, true)
+			return Retry
 		}
+		disposition := recordDisposition(dispositions)
+		c.metrics.recordOutcome(processCtx, msg.Topic, disposition != Ack)
+		if disposition == DeadLetter {
+			return c.deadLetter(ctx, msg)
+		}
+		return disposition
+	}
+	err := processor.ProcessBatch(processCtx, &batch)
+	c.metrics.recordOutcome(processCtx, msg.Topic, err != nil)
+	if err != nil {
+		c.processingError(msg, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		c.cfg.Logger.Error("unable to process event",
+			zap.Error(err),
+			zap.String("topic", msg.Topic),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", int32(msg.Partition)),
+		)
+		if route.routed {
+			// ProcessorRouter and Processors records are committed once
+			// processed successfully.
+			return Retry
+		}
+	}
+	return Ack
+}
+
+// deliverable returns the processor the record's events are delivered to,
+// and the route it was selected by. It returns a nil processor for the
+// records which have no processor, fail to decode or hold no events, which
+// are committed without being processed.
+func (c *Consumer) deliverable(ctx context.Context, msg *kgo.Record, decoded decodedRecord) (model.BatchProcessor, routeKey) {
+	processor, route := c.processor(msg)
+	if processor == nil {
+		c.cfg.Logger.Error("no processor found for record",
+			zap.String("topic", msg.Topic),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", int32(msg.Partition)),
+		)
+		return nil, routeKey{}
+	}
+	if err := decoded.err; err != nil {
+		c.cfg.Logger.Error("unable to decode the record into model.APMEvent",
+			zap.Error(err),
+			zap.String("topic", msg.Topic),
+			zap.ByteString("message.value", msg.Value),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", int32(msg.Partition)),
+		)
+		c.metrics.recordOutcome(ctx, msg.Topic, true)
+		return nil, routeKey{}
+	}
+	if len(decoded.events) == 0 {
+		return nil, routeKey{}
+	}
+	return processor, route
+}
+
+// deadLetter produces the record to the DeadLetterTopic. If the record can't
+// be produced, it is retried.
+func (c *Consumer) deadLetter(ctx context.Context, msg *kgo.Record) RecordDisposition {
+	if c.cfg.DeadLetterTopic == "" {
+		c.cfg.Logger.Error("dropping dead letter record, no dead letter topic configured",
+			zap.String("topic", msg.Topic),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", int32(msg.Partition)),
+		)
+		return Ack
+	}
+	dlq := &kgo.Record{
+		Topic:   c.cfg.DeadLetterTopic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: msg.Headers,
+	}
+	if err := c.client.ProduceSync(ctx, dlq).FirstErr(); err != nil {
+		c.cfg.Logger.Error("unable to produce record to the dead letter topic",
+			zap.Error(err),
+			zap.String("topic", msg.Topic),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", int32(msg.Partition)),
+		)
+		return Retry
+	}
+	return Ack
+}
+
+// processor returns the processor for the record, using ProcessorRouter
+// when set, then the topic processor, and falling back to Processor, with
+// the route identifying it.
+func (c *Consumer) processor(msg *kgo.Record) (model.BatchProcessor, routeKey) {
+	if c.cfg.ProcessorRouter != nil {
+		headers := make(map[string][]byte, len(msg.Headers))
+		for _, h := range msg.Headers {
+			headers[h.Key] = h.Value
+		}
+		if route, p := c.cfg.ProcessorRouter(headers); p != nil {
+			return p, routeKey{route: route, router: true, routed: true}
+		}
+	}
+	if p, ok := c.cfg.Processors[msg.Topic]; ok {
+		return p, routeKey{route: msg.Topic, routed: true}
+	}
+	return c.cfg.Processor, routeKey{}
+}
+
+func containsPartition(partitions map[string][]int32, topic string, partition int32) bool {
+	for _, p := range partitions[topic] {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupMember describes a member of the consumer group.
+type GroupMember struct {
+	// MemberID is the broker assigned member ID.
+	MemberID string
+	// ClientID is the client ID the member connected with.
+	ClientID string
+	// Host is the host the member is connecting from.
+	Host string
+	// Partitions holds the partitions assigned to the member, keyed by topic.
+	Partitions map[string][]int32
+}
+
+// ListGroupMembers returns the members of the consumer group and their
+// partition assignments.
+func (c *Consumer) ListGroupMembers(ctx context.Context) ([]GroupMember, error) {
+	groups, err := kadm.NewClient(c.client).DescribeGroups(ctx, c.cfg.GroupID)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed to describe group: %w", err)
+	}
+	group := groups[c.cfg.GroupID]
+	if group.Err != nil {
+		return nil, fmt.Errorf("kafka: failed to describe group: %w", group.Err)
+	}
+	members := make([]GroupMember, 0, len(group.Members))
+	for _, m := range group.Members {
+		member := GroupMember{
+			MemberID:   m.MemberID,
+			ClientID:   m.ClientID,
+			Host:       m.ClientHost,
+			Partitions: make(map[string][]int32),
+		}
+		if assigned, ok := m.Assigned.AsConsumer(); ok {
+			for _, t := range assigned.Topics {
+				member.Partitions[t.Topic] = t.Partitions
+			}
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// CommittedOffsets returns the offsets committed by the consumer group, keyed
+// by topic and partition, whether or not the group has active members.
+func (c *Consumer) CommittedOffsets(ctx context.Context) (map[string]map[int32]int64, error) {
+	fetched, err := kadm.NewClient(c.client).FetchOffsets(ctx, c.cfg.GroupID)
+	if err == nil {
+		err = fetched.Error()
+	}
+	offsets := make(map[string]map[int32]int64)
+	if errors.Is(err, kerr.GroupIDNotFound) {
+		return offsets, nil // The group hasn't committed any offsets.
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed to fetch offsets: %w", err)
+	}
+	fetched.Each(func(o kadm.OffsetResponse) {
+		if offsets[o.Topic] == nil {
+			offsets[o.Topic] = make(map[int32]int64)
+		}
+		offsets[o.Topic][o.Partition] = o.At
 	})
-	return nil
+	return offsets, nil
+}
+
+// WaitForConsumed blocks until the offsets committed by the consumer group
+// are past the target offsets, keyed by topic and partition, such as the ones
+// returned by Producer.ProduceWithOffsets, or until the context is done. The
+// committed offsets are checked every 100ms.
+func (c *Consumer) WaitForConsumed(ctx context.Context, offsets map[string]map[int32]int64) error {
+	ticker := time.NewTicker(waitForConsumedInterval)
+	defer ticker.Stop()
+	for {
+		committed, err := c.CommittedOffsets(ctx)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if err == nil && consumedPast(committed, offsets) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// consumedPast returns whether the committed offsets, which are the next
+// offsets to consume, are past all the target offsets.
+func consumedPast(committed, offsets map[string]map[int32]int64) bool {
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			if next, ok := committed[topic][partition]; !ok || next <= offset {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// QueueDepth returns the number of records which have been fetched, but not
+// processed yet, such as to autoscale the consumers. It includes the records
+// buffered by the client and the ones of the fetch being processed. It's
+// safe to call concurrently.
+func (c *Consumer) QueueDepth() int {
+	return int(c.buffered.records.Load())
 }
 
 // Healthy returns an error if the Kafka active broker length dips below 1.
@@ -18,12 +18,2171 @@
 package kafka
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/encrypt"
+	codecjson "github.com/elastic/apm-queue/codec/json"
 )
 
 func TestNewConsumer(t *testing.T) {
 	_, err := NewConsumer(ConsumerConfig{})
 	assert.Error(t, err)
 }
+
+func TestConsumerConfigValidate(t *testing.T) {
+	valid := func() ConsumerConfig {
+		return ConsumerConfig{
+			Brokers: []string{"localhost:9092"},
+			Topics:  []string{"topic"},
+			GroupID: "group",
+			Logger:  zap.NewNop(),
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				return nil
+			}),
+		}
+	}
+	for name, tc := range map[string]struct {
+		modify func(*ConsumerConfig)
+		err    string
+	}{
+		"brokers": {
+			modify: func(cfg *ConsumerConfig) { cfg.Brokers = nil },
+			err:    "kafka: at least one broker must be set",
+		},
+		"topics": {
+			modify: func(cfg *ConsumerConfig) { cfg.Topics = nil },
+			err:    "kafka: at least one topic must be set",
+		},
+		"group": {
+			modify: func(cfg *ConsumerConfig) { cfg.GroupID = "" },
+			err:    "kafka: consumer GroupID must be set",
+		},
+		"logger": {
+			modify: func(cfg *ConsumerConfig) { cfg.Logger = nil },
+			err:    "kafka: logger must be set",
+		},
+		"jitter_fraction": {
+			modify: func(cfg *ConsumerConfig) { cfg.JitterFraction = 1.5 },
+			err:    "kafka: jitter fraction must be between 0 and 1",
+		},
+		"max_buffered_bytes": {
+			modify: func(cfg *ConsumerConfig) { cfg.MaxBufferedBytes = -1 },
+			err:    "kafka: max buffered bytes cannot be negative",
+		},
+		"max_buffered_bytes_budget": {
+			modify: func(cfg *ConsumerConfig) { cfg.MaxBufferedBytes = 1 },
+			err:    "kafka: max buffered bytes must be at least 2",
+		},
+		"follower_fetch": {
+			modify: func(cfg *ConsumerConfig) { cfg.FollowerFetch = true },
+			err:    "kafka: rack ID must be set to fetch from followers",
+		},
+		"reorder_window": {
+			modify: func(cfg *ConsumerConfig) { cfg.ReorderWindow = time.Second },
+			err:    "kafka: reorder key and a positive reorder window must be set together",
+		},
+		"idle_partition_timeout": {
+			modify: func(cfg *ConsumerConfig) { cfg.IdlePartitionTimeout = -time.Second },
+			err:    "kafka: idle partition timeout and probe interval cannot be negative",
+		},
+		"idle_partition_probe_interval": {
+			modify: func(cfg *ConsumerConfig) { cfg.IdlePartitionProbeInterval = time.Second },
+			err:    "kafka: idle partition timeout must be set to probe the idle partitions",
+		},
+		"max_chunked_record_bytes": {
+			modify: func(cfg *ConsumerConfig) { cfg.MaxChunkedRecordBytes = -1 },
+			err:    "kafka: max chunked record bytes cannot be negative",
+		},
+		"chunk_assembly_timeout": {
+			modify: func(cfg *ConsumerConfig) { cfg.ChunkAssemblyTimeout = -1 },
+			err:    "kafka: chunk assembly timeout cannot be negative",
+		},
+		"chunk_assembly_max_gap": {
+			modify: func(cfg *ConsumerConfig) { cfg.ChunkAssemblyMaxGap = -1 },
+			err:    "kafka: chunk assembly max gap cannot be negative",
+		},
+		"group_by_key_processors": {
+			modify: func(cfg *ConsumerConfig) {
+				cfg.GroupByKey = true
+				cfg.Processors = map[string]model.BatchProcessor{"topic": cfg.Processor}
+			},
+			err: "kafka: group by key requires processor to be the only processor",
+		},
+		"group_by_key_disposition": {
+			modify: func(cfg *ConsumerConfig) {
+				cfg.GroupByKey = true
+				cfg.Processor = dispositionProcessorFunc(nil)
+			},
+			err: "kafka: group by key cannot be used with a disposition processor",
+		},
+		"processing_errors_buffer": {
+			modify: func(cfg *ConsumerConfig) { cfg.ProcessingErrorsBuffer = -1 },
+			err:    "kafka: processing errors buffer cannot be negative",
+		},
+		"max_records": {
+			modify: func(cfg *ConsumerConfig) { cfg.MaxRecords = -1 },
+			err:    "kafka: max records cannot be negative",
+		},
+		"decode_concurrency": {
+			modify: func(cfg *ConsumerConfig) { cfg.DecodeConcurrency = -1 },
+			err:    "kafka: decode concurrency cannot be negative",
+		},
+		"checkpoint_interval": {
+			modify: func(cfg *ConsumerConfig) {
+				cfg.OffsetStore = new(memoryOffsetStore)
+				cfg.CheckpointInterval = -time.Second
+			},
+			err: "kafka: checkpoint interval cannot be negative",
+		},
+		"resume_from_store": {
+			modify: func(cfg *ConsumerConfig) { cfg.ResumeFromStore = true },
+			err:    "kafka: offset store must be set to checkpoint or resume",
+		},
+		"commit_retry_max_attempts": {
+			modify: func(cfg *ConsumerConfig) { cfg.CommitRetry.MaxAttempts = -1 },
+			err:    "kafka: commit retry max attempts cannot be negative",
+		},
+		"commit_interval": {
+			modify: func(cfg *ConsumerConfig) { cfg.CommitInterval = -1 },
+			err:    "kafka: commit interval cannot be negative",
+		},
+		"commit_batch_records_without_interval": {
+			modify: func(cfg *ConsumerConfig) { cfg.CommitBatchRecords = 10 },
+			err:    "kafka: commit interval must be set to batch commits",
+		},
+		"backoff_and_jitter_fraction": {
+			modify: func(cfg *ConsumerConfig) {
+				cfg.Backoff = ConstantBackoff(time.Second)
+				cfg.JitterFraction = 0.5
+			},
+			err: "kafka: backoff and jitter fraction cannot be set together",
+		},
+		"processor": {
+			modify: func(cfg *ConsumerConfig) { cfg.Processor = nil },
+			err:    "kafka: processor, processor router, processors, stream processor or enriched processor must be set",
+		},
+		"stream_processor": {
+			modify: func(cfg *ConsumerConfig) {
+				cfg.StreamProcessor = StreamProcessorFunc(func(context.Context, RawRecord) error {
+					return nil
+				})
+			},
+			err: "kafka: stream processor cannot be set together with other processors",
+		},
+		"enriched_processor": {
+			modify: func(cfg *ConsumerConfig) {
+				cfg.EnrichedProcessor = func(context.Context, []EnrichedRecord) error {
+					return nil
+				}
+			},
+			err: "kafka: enriched processor cannot be set together with other processors",
+		},
+		"processors_topic": {
+			modify: func(cfg *ConsumerConfig) {
+				cfg.Processors = map[string]model.BatchProcessor{"other": cfg.Processor}
+			},
+			err: "kafka: processor set for topic other, which isn't consumed",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid()
+			tc.modify(&cfg)
+			assert.EqualError(t, cfg.Validate(), tc.err)
+		})
+	}
+	t.Run("valid", func(t *testing.T) {
+		assert.NoError(t, valid().Validate())
+		cfg := valid()
+		cfg.Processor = nil
+		cfg.ProcessorRouter = func(map[string][]byte) (string, model.BatchProcessor) { return "", nil }
+		assert.NoError(t, cfg.Validate())
+		cfg.ProcessorRouter = nil
+		cfg.EnrichedProcessor = func(context.Context, []EnrichedRecord) error { return nil }
+		assert.NoError(t, cfg.Validate())
+	})
+}
+
+func TestConsumerListGroupMembers(t *testing.T) {
+	topic := "list-group-members"
+	cluster := newFakeCluster(t, 2, topic)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newConsumer := func(clientID string) *Consumer {
+		consumer, err := NewConsumer(ConsumerConfig{
+			Brokers:  cluster.ListenAddrs(),
+			Topics:   []string{topic},
+			GroupID:  "group",
+			ClientID: clientID,
+			Logger:   zaptest.NewLogger(t),
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				return nil
+			}),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { consumer.Close() })
+		go consumer.Run(ctx)
+		return consumer
+	}
+	consumer := newConsumer("consumer-a")
+	newConsumer("consumer-b")
+
+	var members []GroupMember
+	assert.Eventually(t, func() bool {
+		var err error
+		members, err = consumer.ListGroupMembers(ctx)
+		if err != nil || len(members) != 2 {
+			return false
+		}
+		for _, m := range members {
+			if len(m.Partitions[topic]) != 1 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+
+	clientIDs := make([]string, 0, len(members))
+	var partitions []int32
+	for _, m := range members {
+		assert.NotEmpty(t, m.MemberID)
+		assert.NotEmpty(t, m.Host)
+		clientIDs = append(clientIDs, m.ClientID)
+		partitions = append(partitions, m.Partitions[topic]...)
+	}
+	assert.ElementsMatch(t, []string{"consumer-a", "consumer-b"}, clientIDs)
+	assert.ElementsMatch(t, []int32{0, 1}, partitions)
+}
+
+func TestConsumerProcessorRouter(t *testing.T) {
+	topic := "processor-router"
+	cluster := newFakeCluster(t, 1, topic)
+	var records []*kgo.Record
+	for i, stream := range []string{"a", "b", "a", "b", "b"} {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{
+			ID: fmt.Sprintf("%s-%d", stream, i),
+		}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{
+			Topic:   topic,
+			Headers: []kgo.RecordHeader{{Key: "stream", Value: []byte(stream)}},
+			Value:   event,
+		})
+	}
+	produceRecords(t, cluster, records...)
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	newProcessor := func(stream string) model.BatchProcessor {
+		return model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, event := range *b {
+				received[stream] = append(received[stream], event.Trace.ID)
+			}
+			return nil
+		})
+	}
+	processors := map[string]model.BatchProcessor{
+		"a": newProcessor("a"),
+		"b": newProcessor("b"),
+	}
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		ProcessorRouter: func(headers map[string][]byte) (string, model.BatchProcessor) {
+			stream := string(headers["stream"])
+			return stream, processors[stream]
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received["a"])+len(received["b"]) == len(records)
+	}, 10*time.Second, 50*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string][]string{
+		"a": {"a-0", "a-2"},
+		"b": {"b-1", "b-3", "b-4"},
+	}, received)
+}
+
+// routeProcessor is a value processor, boxed anew by each router call.
+type routeProcessor struct {
+	stream  string
+	mu      *sync.Mutex
+	batches map[string][][]string
+}
+
+func (p routeProcessor) ProcessBatch(_ context.Context, b *model.Batch) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ids []string
+	for _, event := range *b {
+		ids = append(ids, event.Trace.ID)
+	}
+	p.batches[p.stream] = append(p.batches[p.stream], ids)
+	return nil
+}
+
+func TestConsumerProcessorRouterRoutes(t *testing.T) {
+	topic := "processor-router-routes"
+	cluster := newFakeCluster(t, 1, topic)
+	var records []*kgo.Record
+	for i, stream := range []string{"a", "b", "a", "b", "b"} {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{
+			ID: fmt.Sprintf("%s-%d", stream, i),
+		}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{
+			Topic:   topic,
+			Headers: []kgo.RecordHeader{{Key: "stream", Value: []byte(stream)}},
+			Value:   event,
+		})
+	}
+	produceRecords(t, cluster, records...)
+
+	var mu sync.Mutex
+	batches := make(map[string][][]string)
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		ProcessorRouter: func(headers map[string][]byte) (string, model.BatchProcessor) {
+			stream := string(headers["stream"])
+			return stream, routeProcessor{stream: stream, mu: &mu, batches: batches}
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		var n int
+		for _, stream := range batches {
+			for _, batch := range stream {
+				n += len(batch)
+			}
+		}
+		return n == len(records)
+	}, 10*time.Second, 50*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	// The records of each route are delivered together.
+	assert.Equal(t, map[string][][]string{
+		"a": {{"a-0", "a-2"}},
+		"b": {{"b-1", "b-3", "b-4"}},
+	}, batches)
+}
+
+func TestConsumerProcessorRouterFailure(t *testing.T) {
+	topic := "processor-router-failure"
+	cluster := newFakeCluster(t, 2, topic)
+	// The records of each stream are produced to their own partition.
+	var records []*kgo.Record
+	for i, stream := range []string{"a", "b", "a", "b", "b"} {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{
+			ID: fmt.Sprintf("%s-%d", stream, i),
+		}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{
+			Topic:     topic,
+			Partition: int32(stream[0] - 'a'),
+			Headers:   []kgo.RecordHeader{{Key: "stream", Value: []byte(stream)}},
+			Value:     event,
+		})
+	}
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.ProduceSync(context.Background(), records...).FirstErr())
+
+	var mu sync.Mutex
+	batches := make(map[string][][]string)
+	newProcessor := func(stream string, err error) model.BatchProcessor {
+		return model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			var ids []string
+			for _, event := range *b {
+				ids = append(ids, event.Trace.ID)
+			}
+			batches[stream] = append(batches[stream], ids)
+			return err
+		})
+	}
+	processors := map[string]model.BatchProcessor{
+		"a": newProcessor("a", nil),
+		"b": newProcessor("b", errors.New("boom")),
+	}
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zap.NewNop(),
+		ProcessorRouter: func(headers map[string][]byte) (string, model.BatchProcessor) {
+			stream := string(headers["stream"])
+			return stream, processors[stream]
+		},
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		consumer.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		consumer.Close()
+		wg.Wait()
+	})
+
+	// The failed records are redelivered.
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(batches["b"]) > 1
+	}, 10*time.Second, 10*time.Millisecond)
+	admin := kadm.NewClient(client)
+	assert.Eventually(t, func() bool {
+		offsets, err := admin.FetchOffsets(context.Background(), "group")
+		if err != nil {
+			return false
+		}
+		offset, ok := offsets.Lookup(topic, 0)
+		return ok && offset.At == 2
+	}, 10*time.Second, 50*time.Millisecond)
+	offsets, err := admin.FetchOffsets(context.Background(), "group")
+	require.NoError(t, err)
+	if offset, ok := offsets.Lookup(topic, 1); ok {
+		assert.LessOrEqual(t, offset.At, int64(0))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Each processor receives its records' events in a single batch.
+	assert.Equal(t, [][]string{{"a-0", "a-2"}}, batches["a"])
+	for _, batch := range batches["b"] {
+		assert.Equal(t, []string{"b-1", "b-3", "b-4"}, batch)
+	}
+}
+
+// produceRecords produces the records to the cluster, failing the test on
+// any error.
+func produceRecords(t testing.TB, cluster *kfake.Cluster, records ...*kgo.Record) {
+	t.Helper()
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.ProduceSync(context.Background(), records...).FirstErr())
+}
+
+func TestConsumerSyncCommitOnClose(t *testing.T) {
+	topic := "sync-commit-on-close"
+	cluster := newFakeCluster(t, 1, topic)
+	var records []*kgo.Record
+	for i := 0; i < 10; i++ {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{
+			ID: fmt.Sprint(i),
+		}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{Topic: topic, Value: event})
+	}
+	produceRecords(t, cluster, records...)
+
+	var processed atomic.Int64
+	newConsumer := func(processor model.BatchProcessor) *Consumer {
+		consumer, err := NewConsumer(ConsumerConfig{
+			Brokers:   cluster.ListenAddrs(),
+			Topics:    []string{topic},
+			GroupID:   "group",
+			Logger:    zaptest.NewLogger(t),
+			Processor: processor,
+		})
+		require.NoError(t, err)
+		return consumer
+	}
+
+	// Cancel the Run context once all the records have been processed, so
+	// the commit issued after the fetch fails and only Close commits.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer := newConsumer(model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+		if processed.Add(1) == int64(len(records)) {
+			cancel()
+		}
+		return nil
+	}))
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	assert.Equal(t, int64(len(records)), processed.Load())
+	require.NoError(t, consumer.Close())
+
+	var reprocessed atomic.Int64
+	consumer = newConsumer(model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+		reprocessed.Add(1)
+		return nil
+	}))
+	t.Cleanup(func() { consumer.Close() })
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	consumer.Run(ctx)
+	assert.Zero(t, reprocessed.Load())
+}
+
+type dispositionProcessorFunc func(context.Context, *model.Batch) []RecordDisposition
+
+func (f dispositionProcessorFunc) ProcessBatch(ctx context.Context, b *model.Batch) error {
+	return errors.New("unexpected ProcessBatch call")
+}
+
+func (f dispositionProcessorFunc) ProcessBatchDisposition(ctx context.Context, b *model.Batch) []RecordDisposition {
+	return f(ctx, b)
+}
+
+func TestConsumerDispositionProcessor(t *testing.T) {
+	topic, dlqTopic := "disposition", "disposition-dlq"
+	cluster := newFakeCluster(t, 1, topic, dlqTopic)
+	ids := []string{"ack-0", "retry-1", "dead_letter-2", "ack-3"}
+	var records []*kgo.Record
+	for _, id := range ids {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: id}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{Topic: topic, Value: event})
+	}
+	produceRecords(t, cluster, records...)
+
+	var mu sync.Mutex
+	var processed []string
+	retried := make(map[string]bool)
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:         cluster.ListenAddrs(),
+		Topics:          []string{topic},
+		GroupID:         "group",
+		Logger:          zaptest.NewLogger(t),
+		DeadLetterTopic: dlqTopic,
+		Processor: dispositionProcessorFunc(func(_ context.Context, b *model.Batch) []RecordDisposition {
+			mu.Lock()
+			defer mu.Unlock()
+			dispositions := make([]RecordDisposition, 0, len(*b))
+			for _, event := range *b {
+				id := event.Trace.ID
+				d := Ack
+				switch {
+				case strings.HasPrefix(id, "retry") && !retried[id]:
+					retried[id] = true
+					d = Retry
+				case strings.HasPrefix(id, "dead_letter"):
+					d = DeadLetter
+				}
+				processed = append(processed, id)
+				dispositions = append(dispositions, d)
+			}
+			return dispositions
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	// The retried record is redelivered, followed by the remaining records
+	// of its partition.
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed) == len(ids)+1
+	}, 10*time.Second, 50*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{
+		"ack-0", "retry-1", "retry-1", "dead_letter-2", "ack-3",
+	}, processed)
+	mu.Unlock()
+
+	dlq := consumeRecords(t, cluster, dlqTopic, 1)
+	require.Len(t, dlq, 1)
+	assert.Equal(t, records[2].Value, dlq[0].Value)
+
+	admin := kadm.NewClient(consumer.client)
+	assert.Eventually(t, func() bool {
+		offsets, err := admin.FetchOffsets(ctx, "group")
+		if err != nil {
+			return false
+		}
+		offset, ok := offsets.Lookup(topic, 0)
+		return ok && offset.At == int64(len(ids))
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestConsumerMaxBufferedBytes(t *testing.T) {
+	const maxBufferedBytes = 64 << 10
+	topic := "max-buffered-bytes"
+	cluster := newFakeCluster(t, 1, topic)
+	value := bytes.Repeat([]byte("a"), 1<<10)
+	for i := 0; i < 50; i++ {
+		event, err := json.Marshal(model.APMEvent{Message: string(value)})
+		require.NoError(t, err)
+		// Produce the records individually so each is its own batch.
+		produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+	}
+
+	var consumer *Consumer
+	var processed, maxBuffered atomic.Int64
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:          cluster.ListenAddrs(),
+		Topics:           []string{topic},
+		GroupID:          "group",
+		Logger:           zaptest.NewLogger(t),
+		MaxBufferedBytes: maxBufferedBytes,
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			// Slow processor, which allows the client to fetch ahead.
+			time.Sleep(5 * time.Millisecond)
+			if buffered := consumer.buffered.bytes.Load(); buffered > maxBuffered.Load() {
+				maxBuffered.Store(buffered)
+			}
+			processed.Add(1)
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	assert.Eventually(t, func() bool {
+		return processed.Load() == 50
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Greater(t, maxBuffered.Load(), int64(0))
+	assert.LessOrEqual(t, maxBuffered.Load(), int64(maxBufferedBytes))
+}
+
+func TestConsumerQueueDepth(t *testing.T) {
+	topic := "queue-depth"
+	cluster := newFakeCluster(t, 1, topic)
+	records := make([]*kgo.Record, 20)
+	for i := range records {
+		records[i] = &kgo.Record{Topic: topic, Value: []byte(`{}`)}
+	}
+	produceRecords(t, cluster, records...)
+
+	var processed, maxDepth atomic.Int64
+	var consumer *Consumer
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			if depth := int64(consumer.QueueDepth()); depth > maxDepth.Load() {
+				maxDepth.Store(depth)
+			}
+			time.Sleep(10 * time.Millisecond)
+			processed.Add(1)
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	assert.Equal(t, 0, consumer.QueueDepth())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	assert.Eventually(t, func() bool {
+		return processed.Load() == int64(len(records))
+	}, 10*time.Second, 10*time.Millisecond)
+	// The whole topic was fetched before the first record was processed.
+	assert.Equal(t, int64(len(records)), maxDepth.Load())
+	assert.Eventually(t, func() bool {
+		return consumer.QueueDepth() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// bufferedContext is canceled once the consumer has buffered records, so Run
+// returns right after polling them, without processing them.
+type bufferedContext struct {
+	context.Context
+	consumer *Consumer
+}
+
+func (ctx bufferedContext) Done() <-chan struct{} { return nil }
+
+func (ctx bufferedContext) Err() error {
+	if ctx.consumer.QueueDepth() > 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestConsumerQueueDepthDiscarded(t *testing.T) {
+	topic := "queue-depth-discarded"
+	cluster := newFakeCluster(t, 1, topic)
+	records := make([]*kgo.Record, 5)
+	for i := range records {
+		records[i] = &kgo.Record{Topic: topic, Value: []byte(`{}`)}
+	}
+	produceRecords(t, cluster, records...)
+
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			t.Error("the records shouldn't be processed")
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	ctx := bufferedContext{Context: context.Background(), consumer: consumer}
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	// The polled records aren't counted once Run returns without them.
+	assert.Equal(t, 0, consumer.QueueDepth())
+}
+
+func TestConsumerCloseWithGrace(t *testing.T) {
+	for name, tc := range map[string]struct {
+		grace     time.Duration
+		err       error
+		committed int64
+	}{
+		"exceeded": {grace: 50 * time.Millisecond, err: ErrCloseGraceExceeded, committed: -1},
+		"finished": {grace: 5 * time.Second, committed: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			topic := "close-with-grace"
+			cluster := newFakeCluster(t, 1, topic)
+			produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: []byte(`{}`)})
+
+			processing := make(chan struct{})
+			consumer, err := NewConsumer(ConsumerConfig{
+				Brokers: cluster.ListenAddrs(),
+				Topics:  []string{topic},
+				GroupID: "group",
+				Logger:  zaptest.NewLogger(t),
+				Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+					close(processing)
+					time.Sleep(500 * time.Millisecond)
+					return nil
+				}),
+			})
+			require.NoError(t, err)
+			// Run isn't cancelled, CloseWithGrace stops it.
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				consumer.Run(context.Background())
+			}()
+			// The in-flight record is still processed and logged.
+			t.Cleanup(func() { <-done })
+			select {
+			case <-processing:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for the record to be processed")
+			}
+
+			err = consumer.CloseWithGrace(tc.grace)
+			if tc.err != nil {
+				var closeErr *CloseError
+				require.ErrorAs(t, err, &closeErr)
+				assert.ErrorIs(t, closeErr.Flush, tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+			require.NoError(t, err)
+			defer client.Close()
+			offsets, err := kadm.NewClient(client).FetchOffsets(context.Background(), "group")
+			require.NoError(t, err)
+			offset, ok := offsets.Lookup(topic, 0)
+			if tc.committed < 0 {
+				assert.False(t, ok)
+			} else {
+				require.True(t, ok)
+				assert.Equal(t, tc.committed, offset.At)
+			}
+		})
+	}
+}
+
+func TestConsumerCloseWithGraceIdle(t *testing.T) {
+	topic := "close-with-grace-idle"
+	cluster := newFakeCluster(t, 1, topic)
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- consumer.Run(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// The polling consumer has no records in flight.
+	require.NoError(t, consumer.CloseWithGrace(time.Second))
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestConsumerMaxRecords(t *testing.T) {
+	topic := "max-records"
+	cluster := newFakeCluster(t, 1, topic)
+	records := make([]*kgo.Record, 50)
+	for i := range records {
+		event, err := json.Marshal(model.APMEvent{})
+		require.NoError(t, err)
+		records[i] = &kgo.Record{Topic: topic, Value: event}
+	}
+	produceRecords(t, cluster, records...)
+
+	var processed atomic.Int64
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:    cluster.ListenAddrs(),
+		Topics:     []string{topic},
+		GroupID:    "group",
+		Logger:     zaptest.NewLogger(t),
+		MaxRecords: 10,
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			processed.Add(1)
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, consumer.Run(ctx))
+	require.NoError(t, consumer.Close())
+	assert.Equal(t, int64(10), processed.Load())
+
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	offsets, err := kadm.NewClient(client).FetchOffsets(context.Background(), "group")
+	require.NoError(t, err)
+	offset, ok := offsets.Lookup(topic, 0)
+	require.True(t, ok)
+	assert.Equal(t, int64(10), offset.At)
+}
+
+func TestConsumerCommittedOffsets(t *testing.T) {
+	topic := "committed-offsets"
+	cluster := newFakeCluster(t, 1, topic)
+	records := make([]*kgo.Record, 3)
+	for i := range records {
+		event, err := json.Marshal(model.APMEvent{})
+		require.NoError(t, err)
+		records[i] = &kgo.Record{Topic: topic, Value: event}
+	}
+	produceRecords(t, cluster, records...)
+
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:    cluster.ListenAddrs(),
+		Topics:     []string{topic},
+		GroupID:    "group",
+		Logger:     zaptest.NewLogger(t),
+		MaxRecords: len(records),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Nothing is committed before the records are consumed.
+	offsets, err := consumer.CommittedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, offsets)
+
+	require.NoError(t, consumer.Run(ctx))
+	offsets, err = consumer.CommittedOffsets(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[int32]int64{topic: {0: 3}}, offsets)
+}
+
+func TestConsumerAddRemoveTopics(t *testing.T) {
+	topicA, topicB := "add-topics-a", "add-topics-b"
+	cluster := newFakeCluster(t, 1, topicA, topicB)
+	produce := func(topic string) {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: topic}})
+		require.NoError(t, err)
+		produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+	}
+	produce(topicA)
+
+	processed := make(chan string, 10)
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topicA},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processed <- (*b)[0].Trace.ID
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	next := func() string {
+		select {
+		case id := <-processed:
+			return id
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for a processed record")
+		}
+		return ""
+	}
+	assert.Equal(t, topicA, next())
+
+	consumer.AddTopics(topicB)
+	produce(topicB)
+	assert.Equal(t, topicB, next())
+
+	consumer.RemoveTopics(topicB)
+	produce(topicB)
+	produce(topicA)
+	assert.Equal(t, topicA, next())
+	select {
+	case id := <-processed:
+		t.Fatalf("unexpected record processed from %s", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConsumerStreamProcessor(t *testing.T) {
+	topic := "stream-processor"
+	cluster := newFakeCluster(t, 1, topic)
+	records := make([]*kgo.Record, 5)
+	for i := range records {
+		records[i] = &kgo.Record{Topic: topic, Value: []byte(strconv.Itoa(i))}
+	}
+	produceRecords(t, cluster, records...)
+
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	admin := kadm.NewClient(client)
+	committed := func() int64 {
+		offsets, err := admin.FetchOffsets(context.Background(), "group")
+		require.NoError(t, err)
+		if offset, ok := offsets.Lookup(topic, 0); ok {
+			return offset.At
+		}
+		return -1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var processed []string
+	var failed bool
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		StreamProcessor: StreamProcessorFunc(func(_ context.Context, r RawRecord) error {
+			// The previous records are committed before the next one is
+			// processed.
+			if r.Offset > 0 {
+				assert.Equal(t, r.Offset, committed())
+			}
+			processed = append(processed, string(r.Value))
+			if r.Offset == 2 && !failed {
+				failed = true
+				return errors.New("failed")
+			}
+			if r.Offset == 4 {
+				cancel()
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	assert.Equal(t, []string{"0", "1", "2", "2", "3", "4"}, processed)
+	// The last record is committed on close, the run context is canceled.
+	require.NoError(t, consumer.Close())
+	assert.Equal(t, int64(5), committed())
+}
+
+func TestConsumerStreamProcessorRetry(t *testing.T) {
+	topic := "stream-processor-retry"
+	cluster := newFakeCluster(t, 1, topic)
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: []byte("0")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	const backoff = 50 * time.Millisecond
+	var attempts []time.Time
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:            cluster.ListenAddrs(),
+		Topics:             []string{topic},
+		GroupID:            "group",
+		Logger:             zaptest.NewLogger(t),
+		StreamRetryBackoff: ConstantBackoff(backoff),
+		StreamProcessor: StreamProcessorFunc(func(context.Context, RawRecord) error {
+			attempts = append(attempts, time.Now())
+			if len(attempts) < 3 {
+				return errors.New("failed")
+			}
+			cancel()
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	require.Len(t, attempts, 3)
+	for i := 1; i < len(attempts); i++ {
+		assert.GreaterOrEqual(t, attempts[i].Sub(attempts[i-1]), backoff)
+	}
+}
+
+func TestConsumerStreamProcessorRunContext(t *testing.T) {
+	topic := "stream-processor-run-context"
+	cluster := newFakeCluster(t, 1, topic)
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: []byte("0")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var attempts int
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:            cluster.ListenAddrs(),
+		Topics:             []string{topic},
+		GroupID:            "group",
+		Logger:             zaptest.NewLogger(t),
+		StreamRetryBackoff: ConstantBackoff(time.Hour),
+		StreamProcessor: StreamProcessorFunc(func(processCtx context.Context, _ RawRecord) error {
+			attempts++
+			cancel()
+			// The record is processed with the Run context.
+			<-processCtx.Done()
+			return processCtx.Err()
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+
+	// Run returns without waiting for the backoff of the failed record, nor
+	// redelivering it.
+	done := make(chan error, 1)
+	go func() { done <- consumer.Run(ctx) }()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return once its context was canceled")
+	}
+	assert.Equal(t, 1, attempts)
+}
+
+func TestConsumerProcessingErrors(t *testing.T) {
+	topic := "processing-errors"
+	cluster := newFakeCluster(t, 1, topic)
+	records := make([]*kgo.Record, 3)
+	for i := range records {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: strconv.Itoa(i)}})
+		require.NoError(t, err)
+		records[i] = &kgo.Record{Topic: topic, Value: event}
+	}
+	produceRecords(t, cluster, records...)
+
+	processErr := errors.New("failed")
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:                cluster.ListenAddrs(),
+		Topics:                 []string{topic},
+		GroupID:                "group",
+		Logger:                 zaptest.NewLogger(t),
+		MaxRecords:             len(records),
+		ProcessingErrorsBuffer: 1,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			if (*b)[0].Trace.ID == "1" {
+				return nil
+			}
+			return processErr
+		}),
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, consumer.Run(ctx))
+
+	// The channel is never read while consuming, only the first error fits.
+	processingErr := <-consumer.ProcessingErrors()
+	assert.Equal(t, ProcessError{Topic: topic, Partition: 0, Offset: 0, Err: processErr}, processingErr)
+	assert.ErrorIs(t, processingErr, processErr)
+	assert.Equal(t, ConsumerStats{DroppedProcessingErrors: 1}, consumer.Stats())
+
+	require.NoError(t, consumer.Close())
+	_, ok := <-consumer.ProcessingErrors()
+	assert.False(t, ok)
+}
+
+func TestConsumerTopicRecreated(t *testing.T) {
+	topic := "topic-recreated"
+	cluster := newFakeCluster(t, 1, topic)
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: []byte(`{"trace":{"id":"0"}}`)})
+
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	admin := kadm.NewClient(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var processed []string
+	var fetchErrors []error
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:             cluster.ListenAddrs(),
+		Topics:              []string{topic},
+		GroupID:             "group",
+		Logger:              zaptest.NewLogger(t),
+		UnknownTopicBackoff: ConstantBackoff(10 * time.Millisecond),
+		OnFetchError: func(_ string, _ int32, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			fetchErrors = append(fetchErrors, err)
+		},
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed = append(processed, (*b)[0].Trace.ID)
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	done := make(chan error, 1)
+	go func() { done <- consumer.Run(ctx) }()
+	// The recreated topic is detected once the in-flight poll returns,
+	// which is bounded by the fetch max wait.
+	waitProcessed := func(n int) {
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(processed) == n
+		}, 15*time.Second, 10*time.Millisecond)
+	}
+	waitProcessed(1)
+
+	// Delete the topic and wait for the consumer to observe it.
+	_, err = admin.DeleteTopics(ctx, topic)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, err := range fetchErrors {
+			if errors.Is(err, kerr.UnknownTopicOrPartition) || errors.Is(err, kerr.UnknownTopicID) {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The consumer recovers once the topic is recreated.
+	_, err = admin.CreateTopics(ctx, 1, 1, nil, topic)
+	require.NoError(t, err)
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: []byte(`{"trace":{"id":"1"}}`)})
+	waitProcessed(2)
+	mu.Lock()
+	assert.Equal(t, []string{"0", "1"}, processed)
+	mu.Unlock()
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestConsumerEncryptedCodec(t *testing.T) {
+	topic := "encrypted"
+	cluster := newFakeCluster(t, 1, topic)
+	codec, err := encrypt.New(bytes.Repeat([]byte("k"), 32), codecjson.JSON{})
+	require.NoError(t, err)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+		Encoder: codec,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+	event := model.APMEvent{Trace: model.Trace{ID: "trace_id"}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &model.Batch{event}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var processed model.Batch
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		Decoder: codec,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processed = append(processed, *b...)
+			cancel()
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	assert.Equal(t, model.Batch{event}, processed)
+}
+
+func TestConsumerCommitRetry(t *testing.T) {
+	for name, tc := range map[string]struct {
+		failure  *kerr.Error
+		attempts int
+		err      error
+	}{
+		"retriable":     {failure: kerr.UnknownTopicOrPartition, attempts: 2},
+		"non_retriable": {failure: kerr.GroupAuthorizationFailed, attempts: 1, err: kerr.GroupAuthorizationFailed},
+	} {
+		t.Run(name, func(t *testing.T) {
+			topic := "commit-retry"
+			cluster := newFakeCluster(t, 1, topic)
+			event, err := json.Marshal(model.APMEvent{})
+			require.NoError(t, err)
+			produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+
+			// Fail the first commit.
+			var attempts atomic.Int64
+			cluster.ControlKey(int16(kmsg.OffsetCommit), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+				cluster.KeepControl()
+				if attempts.Add(1) > 1 {
+					return nil, nil, false
+				}
+				req := kreq.(*kmsg.OffsetCommitRequest)
+				resp := req.ResponseKind().(*kmsg.OffsetCommitResponse)
+				for _, rt := range req.Topics {
+					st := kmsg.NewOffsetCommitResponseTopic()
+					st.Topic = rt.Topic
+					for _, rp := range rt.Partitions {
+						sp := kmsg.NewOffsetCommitResponseTopicPartition()
+						sp.Partition = rp.Partition
+						sp.ErrorCode = tc.failure.Code
+						st.Partitions = append(st.Partitions, sp)
+					}
+					resp.Topics = append(resp.Topics, st)
+				}
+				return resp, nil, true
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var commitErr error
+			consumer, err := NewConsumer(ConsumerConfig{
+				Brokers: cluster.ListenAddrs(),
+				Topics:  []string{topic},
+				GroupID: "group",
+				Logger:  zaptest.NewLogger(t),
+				CommitRetry: CommitRetry{
+					MaxAttempts: 3,
+					Backoff:     ConstantBackoff(time.Millisecond),
+				},
+				OnCommit: func(err error) {
+					commitErr = err
+					cancel()
+				},
+				DisableSyncCommitOnClose: true,
+				Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+					return nil
+				}),
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() { consumer.Close() })
+			assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+			assert.Equal(t, int64(tc.attempts), attempts.Load())
+			if tc.err != nil {
+				assert.ErrorIs(t, commitErr, tc.err)
+				return
+			}
+			require.NoError(t, commitErr)
+
+			client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+			require.NoError(t, err)
+			defer client.Close()
+			offsets, err := kadm.NewClient(client).FetchOffsets(context.Background(), "group")
+			require.NoError(t, err)
+			offset, ok := offsets.Lookup(topic, 0)
+			require.True(t, ok)
+			assert.Equal(t, int64(1), offset.At)
+		})
+	}
+}
+
+func TestConsumerProcessors(t *testing.T) {
+	topicA, topicB, topicC := "processors-a", "processors-b", "processors-c"
+	cluster := newFakeCluster(t, 1, topicA, topicB, topicC)
+	for _, topic := range []string{topicA, topicB, topicC} {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: topic}})
+		require.NoError(t, err)
+		produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	processed := make(map[string][]string)
+	processor := func(name string) model.BatchProcessor {
+		return model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed[name] = append(processed[name], (*b)[0].Trace.ID)
+			if len(processed) == 3 {
+				cancel()
+			}
+			return nil
+		})
+	}
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:   cluster.ListenAddrs(),
+		Topics:    []string{topicA, topicB, topicC},
+		GroupID:   "group",
+		Logger:    zaptest.NewLogger(t),
+		Processor: processor("fallback"),
+		Processors: map[string]model.BatchProcessor{
+			topicA: processor("a"),
+			topicB: processor("b"),
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	assert.Equal(t, map[string][]string{
+		"a":        {topicA},
+		"b":        {topicB},
+		"fallback": {topicC},
+	}, processed)
+}
+
+func TestConsumerProcessorsFailure(t *testing.T) {
+	topicA, topicB := "processors-failure-a", "processors-failure-b"
+	cluster := newFakeCluster(t, 1, topicA, topicB)
+	for _, topic := range []string{topicA, topicB} {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: topic}})
+		require.NoError(t, err)
+		produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+	}
+
+	var attempts atomic.Int64
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topicA, topicB},
+		GroupID: "group",
+		Logger:  zap.NewNop(),
+		Processors: map[string]model.BatchProcessor{
+			topicA: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				return nil
+			}),
+			topicB: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				attempts.Add(1)
+				return errors.New("failed")
+			}),
+		},
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		consumer.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		consumer.Close()
+		wg.Wait()
+	})
+
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	admin := kadm.NewClient(client)
+	assert.Eventually(t, func() bool {
+		offsets, err := admin.FetchOffsets(context.Background(), "group")
+		if err != nil {
+			return false
+		}
+		offset, ok := offsets.Lookup(topicA, 0)
+		return ok && offset.At == 1 && attempts.Load() > 1
+	}, 10*time.Second, 50*time.Millisecond)
+	// The failed topic's record is redelivered, and its offset isn't
+	// committed.
+	offsets, err := admin.FetchOffsets(context.Background(), "group")
+	require.NoError(t, err)
+	if offset, ok := offsets.Lookup(topicB, 0); ok {
+		assert.LessOrEqual(t, offset.At, int64(0))
+	}
+}
+
+func TestConsumerNoEmptyBatches(t *testing.T) {
+	topic := "no-empty-batches"
+	cluster := newFakeCluster(t, 1, topic)
+	records := []*kgo.Record{
+		{Topic: topic, Value: []byte(`{}`)},
+		{Topic: topic, Value: []byte("invalid")},
+		{Topic: topic, Value: []byte(`{}`), Headers: []kgo.RecordHeader{{Key: "skip"}}},
+		{Topic: topic, Value: []byte(`{"trace":{"id":"last"}}`)},
+	}
+	produceRecords(t, cluster, records...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var processed int
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		PreDecodeFilter: func(r RawRecord) bool {
+			_, skip := r.Headers["skip"]
+			return !skip
+		},
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			assert.Len(t, *b, 1)
+			processed++
+			if (*b)[0].Trace.ID == "last" {
+				cancel()
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	assert.Equal(t, 2, processed)
+}
+
+func TestConsumerBatchDecoder(t *testing.T) {
+	topic := "batch-decoder"
+	cluster := newFakeCluster(t, 1, topic)
+	produceRecords(t, cluster,
+		&kgo.Record{Topic: topic, Value: []byte(
+			`{"trace":{"id":"1"}}` + "\n" + `{"trace":{"id":"2"}}` + "\n" + `{"trace":{"id":"3"}}` + "\n",
+		)},
+		&kgo.Record{Topic: topic, Value: []byte(`[{"trace":{"id":"4"}},{"trace":{"id":"5"}}]`)},
+		// Records without events aren't processed.
+		&kgo.Record{Topic: topic, Value: []byte(`[]`)},
+		&kgo.Record{Topic: topic, Value: []byte(`{"trace":{"id":"6"}}`)},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var batches [][]string
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		Decoder: codecjson.Lines{},
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			var ids []string
+			for _, event := range *b {
+				ids = append(ids, event.Trace.ID)
+			}
+			batches = append(batches, ids)
+			if ids[len(ids)-1] == "6" {
+				cancel()
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	assert.Equal(t, [][]string{{"1", "2", "3"}, {"4", "5"}, {"6"}}, batches)
+}
+
+func TestConsumerHeaderEnricher(t *testing.T) {
+	topic := "header-enricher"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:        cluster.ListenAddrs(),
+		Topic:          topic,
+		Logger:         zaptest.NewLogger(t),
+		DefaultHeaders: map[string]string{"tenant": "acme"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+	batch := model.Batch{{Trace: model.Trace{ID: "1"}}, {Trace: model.Trace{ID: "2"}}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	var tenants []string
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:    cluster.ListenAddrs(),
+		Topics:     []string{topic},
+		GroupID:    "group",
+		Logger:     zaptest.NewLogger(t),
+		MaxRecords: len(batch),
+		HeaderEnricher: func(event *model.APMEvent, headers map[string][]byte) {
+			if event.Labels == nil {
+				event.Labels = make(model.Labels)
+			}
+			event.Labels.Set("tenant", string(headers["tenant"]))
+		},
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				tenants = append(tenants, event.Labels["tenant"].Value)
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	require.NoError(t, consumer.Run(context.Background()))
+	require.NoError(t, consumer.Close())
+	assert.Equal(t, []string{"acme", "acme"}, tenants)
+}
+
+func TestConsumerDelayMetric(t *testing.T) {
+	topic := "delay-metric"
+	cluster := newFakeCluster(t, 1, topic)
+	event, err := json.Marshal(model.APMEvent{Timestamp: time.Now().Add(-time.Minute)})
+	require.NoError(t, err)
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+
+	reader := sdkmetric.NewManualReader()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:       cluster.ListenAddrs(),
+		Topics:        []string{topic},
+		GroupID:       "group",
+		Logger:        zaptest.NewLogger(t),
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			cancel()
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+
+	m := collectMetric(t, reader, "consumer.messages.delay")
+	hist, ok := m.Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	require.Len(t, hist.DataPoints, 1)
+	dp := hist.DataPoints[0]
+	assert.Equal(t, uint64(1), dp.Count)
+	assert.GreaterOrEqual(t, dp.Sum, time.Minute.Seconds())
+	topicAttr, _ := dp.Attributes.Value("messaging.destination.name")
+	assert.Equal(t, topic, topicAttr.AsString())
+}
+
+func TestConsumerTracing(t *testing.T) {
+	topic := "consumer-tracing"
+	cluster := newFakeCluster(t, 1, topic)
+	event, err := json.Marshal(model.APMEvent{})
+	require.NoError(t, err)
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+
+	recorder := tracetest.NewSpanRecorder()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var processSpan trace.SpanContext
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		TracerProvider: sdktrace.NewTracerProvider(
+			sdktrace.WithSpanProcessor(recorder),
+		),
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, _ *model.Batch) error {
+			processSpan = trace.SpanContextFromContext(ctx)
+			cancel()
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	receive, process := spans[0], spans[1]
+	assert.Equal(t, topic+" receive", receive.Name())
+	assert.Equal(t, topic+" process", process.Name())
+	assert.Equal(t, trace.SpanKindConsumer, process.SpanKind())
+	// The processor runs within the process span, which is a child of the
+	// span of the record being received.
+	assert.Equal(t, process.SpanContext(), processSpan)
+	assert.Equal(t, receive.SpanContext().SpanID(), process.Parent().SpanID())
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range process.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, map[attribute.Key]attribute.Value{
+		"messaging.system":                 attribute.StringValue("kafka"),
+		"messaging.source.kind":            attribute.StringValue("topic"),
+		"messaging.source.name":            attribute.StringValue(topic),
+		"messaging.operation":              attribute.StringValue("process"),
+		"messaging.kafka.source.partition": attribute.IntValue(0),
+		"messaging.kafka.message.offset":   attribute.IntValue(0),
+		"messaging.kafka.consumer.group":   attribute.StringValue("group"),
+		"messaging.message.id":             attribute.StringValue("0"),
+	}, attrs)
+}
+
+func TestConsumerOutcomeMetrics(t *testing.T) {
+	topicA, topicB := "outcome-a", "outcome-b"
+	cluster := newFakeCluster(t, 1, topicA, topicB)
+	var records []*kgo.Record
+	for _, topic := range []string{topicA, topicB} {
+		for i := 0; i < 3; i++ {
+			records = append(records, &kgo.Record{Topic: topic, Value: []byte(`{}`)})
+		}
+	}
+	produceRecords(t, cluster, records...)
+
+	reader := sdkmetric.NewManualReader()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// The records of topicB fail once, then they're redelivered.
+	var processed, failed int
+	done := func() {
+		if processed == len(records) && failed > 0 {
+			cancel()
+		}
+	}
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:       cluster.ListenAddrs(),
+		Topics:        []string{topicA, topicB},
+		GroupID:       "group",
+		Logger:        zaptest.NewLogger(t),
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		Processors: map[string]model.BatchProcessor{
+			topicA: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+				processed += len(*b)
+				done()
+				return nil
+			}),
+			topicB: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+				if failed < len(*b) {
+					failed += len(*b)
+					return errors.New("failed")
+				}
+				processed += len(*b)
+				done()
+				return nil
+			}),
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+
+	countsByTopic := func(name string) map[string]int64 {
+		m := collectMetric(t, reader, name)
+		sum, ok := m.Data.(metricdata.Sum[int64])
+		require.True(t, ok)
+		counts := make(map[string]int64)
+		for _, dp := range sum.DataPoints {
+			topic, _ := dp.Attributes.Value("messaging.destination.name")
+			counts[topic.AsString()] = dp.Value
+		}
+		return counts
+	}
+	assert.Equal(t, map[string]int64{topicA: 3, topicB: 3}, countsByTopic("apmqueue.consumer.records.processed"))
+	assert.Equal(t, map[string]int64{topicB: 3}, countsByTopic("apmqueue.consumer.records.errors"))
+}
+
+func TestConsumerOutcomeMetricsBatchDecoder(t *testing.T) {
+	// The records are counted once, regardless of their number of events.
+	for name, configure := range map[string]func(cfg *ConsumerConfig, process func(n int)){
+		"processor": func(cfg *ConsumerConfig, process func(n int)) {
+			cfg.Processor = model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+				process(len(*b))
+				return nil
+			})
+		},
+		"processors": func(cfg *ConsumerConfig, process func(n int)) {
+			cfg.Processors = map[string]model.BatchProcessor{
+				cfg.Topics[0]: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+					process(len(*b))
+					return nil
+				}),
+			}
+		},
+		"group_by_key": func(cfg *ConsumerConfig, process func(n int)) {
+			cfg.GroupByKey = true
+			cfg.Processor = model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+				process(len(*b))
+				return nil
+			})
+		},
+		"enriched": func(cfg *ConsumerConfig, process func(n int)) {
+			cfg.EnrichedProcessor = func(_ context.Context, records []EnrichedRecord) error {
+				process(len(records))
+				return nil
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			topic := "outcome-batch-decoder"
+			cluster := newFakeCluster(t, 1, topic)
+			produceRecords(t, cluster,
+				&kgo.Record{Topic: topic, Value: []byte("{")},
+				&kgo.Record{Topic: topic, Value: []byte("{}\n{}\n{}")},
+				&kgo.Record{Topic: topic, Value: []byte("{}\n{}\n{}")},
+			)
+			reader := sdkmetric.NewManualReader()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var events int
+			cfg := ConsumerConfig{
+				Brokers:       cluster.ListenAddrs(),
+				Topics:        []string{topic},
+				GroupID:       "group",
+				Logger:        zaptest.NewLogger(t),
+				Decoder:       codecjson.Lines{},
+				MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			}
+			configure(&cfg, func(n int) {
+				if events += n; events == 6 {
+					cancel()
+				}
+			})
+			consumer, err := NewConsumer(cfg)
+			require.NoError(t, err)
+			t.Cleanup(func() { consumer.Close() })
+			assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+
+			count := func(name string) int64 {
+				sum, ok := collectMetric(t, reader, name).Data.(metricdata.Sum[int64])
+				require.True(t, ok)
+				require.Len(t, sum.DataPoints, 1)
+				return sum.DataPoints[0].Value
+			}
+			assert.Equal(t, int64(2), count("apmqueue.consumer.records.processed"))
+			assert.Equal(t, int64(1), count("apmqueue.consumer.records.errors"))
+		})
+	}
+}
+
+// collectMetric collects the metrics of the reader, returning the one with
+// the name.
+func collectMetric(t testing.TB, reader sdkmetric.Reader, name string) metricdata.Metrics {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m
+			}
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return metricdata.Metrics{}
+}
+
+func TestConsumerDecodeConcurrency(t *testing.T) {
+	topic := "decode-concurrency"
+	cluster := newFakeCluster(t, 1, topic)
+	var records []*kgo.Record
+	var expected []string
+	for i := 0; i < 100; i++ {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{
+			ID: fmt.Sprint(i),
+		}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{Topic: topic, Value: event})
+		expected = append(expected, fmt.Sprint(i))
+	}
+	produceRecords(t, cluster, records...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var processed []string
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:           cluster.ListenAddrs(),
+		Topics:            []string{topic},
+		GroupID:           "group",
+		Logger:            zaptest.NewLogger(t),
+		DecodeConcurrency: 8,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processed = append(processed, (*b)[0].Trace.ID)
+			if len(processed) == len(expected) {
+				cancel()
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	assert.Equal(t, expected, processed)
+}
+
+// decodeSpy counts the decoded records.
+type decodeSpy struct {
+	decoded atomic.Int64
+}
+
+func (d *decodeSpy) Decode(b []byte, event *model.APMEvent) error {
+	d.decoded.Add(1)
+	return codecjson.JSON{}.Decode(b, event)
+}
+
+func TestConsumerPreDecodeFilter(t *testing.T) {
+	topic := "pre-decode-filter"
+	cluster := newFakeCluster(t, 1, topic)
+	var records []*kgo.Record
+	for i := 0; i < 6; i++ {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{
+			ID: fmt.Sprint(i),
+		}})
+		require.NoError(t, err)
+		record := &kgo.Record{Topic: topic, Value: event}
+		if i%2 == 0 {
+			record.Headers = []kgo.RecordHeader{{Key: "keep", Value: []byte("true")}}
+		}
+		records = append(records, record)
+	}
+	produceRecords(t, cluster, records...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var decoder decodeSpy
+	var processed []string
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		Decoder: &decoder,
+		PreDecodeFilter: func(r RawRecord) bool {
+			return string(r.Headers["keep"]) == "true"
+		},
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processed = append(processed, (*b)[0].Trace.ID)
+			if len(processed) == 3 {
+				cancel()
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	require.NoError(t, consumer.Close())
+	assert.Equal(t, []string{"0", "2", "4"}, processed)
+	assert.Equal(t, int64(3), decoder.decoded.Load())
+
+	// The skipped records are committed too.
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	offsets, err := kadm.NewClient(client).FetchOffsets(context.Background(), "group")
+	require.NoError(t, err)
+	offset, ok := offsets.Lookup(topic, 0)
+	require.True(t, ok)
+	assert.Equal(t, int64(6), offset.At)
+}
+
+func BenchmarkConsumerDecodeRecords(b *testing.B) {
+	// Large events, with many labels.
+	event := model.APMEvent{Labels: make(model.Labels)}
+	for i := 0; i < 1000; i++ {
+		event.Labels.Set(fmt.Sprintf("label_%d", i), strings.Repeat("v", 100))
+	}
+	value, err := json.Marshal(event)
+	require.NoError(b, err)
+	records := make([]*kgo.Record, 100)
+	for i := range records {
+		records[i] = &kgo.Record{Value: value}
+	}
+	for _, concurrency := range []int{1, 4, 8} {
+		for _, pooled := range []bool{false, true} {
+			name := fmt.Sprintf("concurrency_%d", concurrency)
+			if pooled {
+				name += "_pooled"
+			}
+			b.Run(name, func(b *testing.B) {
+				c := Consumer{cfg: ConsumerConfig{
+					Decoder:           codecjson.JSON{},
+					DecodeConcurrency: concurrency,
+					PooledDecode:      pooled,
+					clock:             systemClock{},
+				}}
+				b.SetBytes(int64(len(value) * len(records)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					decoded := c.decodeRecords(context.Background(), records)
+					for i := range decoded {
+						c.release(&decoded[i])
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestConsumerPooledDecode(t *testing.T) {
+	topic := "pooled-decode"
+	cluster := newFakeCluster(t, 1, topic)
+	var records []*kgo.Record
+	for i := 0; i < 100; i++ {
+		event := model.APMEvent{Trace: model.Trace{ID: fmt.Sprint(i)}}
+		if i%2 == 0 {
+			// The reused events are reset before decoding.
+			event.Message = "even"
+		}
+		value, err := json.Marshal(event)
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{Topic: topic, Value: value})
+	}
+	// Produce the records in several fetches.
+	for i := 0; i < len(records); i += 10 {
+		produceRecords(t, cluster, records[i:i+10]...)
+	}
+
+	var processed []string
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:      cluster.ListenAddrs(),
+		Topics:       []string{topic},
+		GroupID:      "group",
+		Logger:       zaptest.NewLogger(t),
+		MaxRecords:   len(records),
+		PooledDecode: true,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				processed = append(processed, event.Trace.ID+":"+event.Message)
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	require.NoError(t, consumer.Run(context.Background()))
+	require.NoError(t, consumer.Close())
+	require.Len(t, processed, len(records))
+	for i, event := range processed {
+		if i%2 == 0 {
+			assert.Equal(t, fmt.Sprintf("%d:even", i), event)
+		} else {
+			assert.Equal(t, fmt.Sprintf("%d:", i), event)
+		}
+	}
+}
+
+func TestConsumerCloseError(t *testing.T) {
+	topic := "close-error"
+	cluster := newFakeCluster(t, 1, topic)
+	event, err := json.Marshal(model.APMEvent{})
+	require.NoError(t, err)
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+
+	// Fail all the commits, so the offsets are still pending on close.
+	cluster.ControlKey(int16(kmsg.OffsetCommit), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := kreq.(*kmsg.OffsetCommitRequest)
+		resp := req.ResponseKind().(*kmsg.OffsetCommitResponse)
+		for _, rt := range req.Topics {
+			st := kmsg.NewOffsetCommitResponseTopic()
+			st.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				sp := kmsg.NewOffsetCommitResponseTopicPartition()
+				sp.Partition = rp.Partition
+				sp.ErrorCode = kerr.GroupAuthorizationFailed.Code
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp, nil, true
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:  cluster.ListenAddrs(),
+		Topics:   []string{topic},
+		GroupID:  "group",
+		Logger:   zaptest.NewLogger(t),
+		OnCommit: func(error) { cancel() },
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+
+	err = consumer.Close()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.ErrorIs(t, closeErr.Flush, kerr.GroupAuthorizationFailed)
+	assert.NoError(t, closeErr.Closed)
+	assert.ErrorIs(t, err, kerr.GroupAuthorizationFailed)
+
+	err = consumer.Close()
+	require.ErrorAs(t, err, &closeErr)
+	assert.NoError(t, closeErr.Flush)
+	assert.EqualError(t, closeErr.Closed, "kafka: consumer already closed")
+}
+
+func TestConsumerWaitForConsumed(t *testing.T) {
+	topic := "wait-for-consumed"
+	cluster := newFakeCluster(t, 2, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+	batch := make(model.Batch, 10)
+	offsets, err := producer.ProduceWithOffsets(context.Background(), &batch)
+	require.NoError(t, err)
+	require.Contains(t, offsets, topic)
+	var produced int64
+	for _, offset := range offsets[topic] {
+		produced += offset + 1
+	}
+	assert.Equal(t, int64(len(batch)), produced)
+
+	var processed atomic.Int64
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			processed.Add(1)
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+
+	// Nothing is consumed until the consumer runs.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, consumer.WaitForConsumed(ctx, offsets), context.DeadlineExceeded)
+
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	done := make(chan error, 1)
+	go func() { done <- consumer.Run(runCtx) }()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, consumer.WaitForConsumed(ctx, offsets))
+	assert.Equal(t, int64(len(batch)), processed.Load())
+	committed, err := consumer.CommittedOffsets(ctx)
+	require.NoError(t, err)
+	for partition, offset := range offsets[topic] {
+		assert.Greater(t, committed[topic][partition], offset)
+	}
+	cancelRun()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	require.NoError(t, consumer.Close())
+}
+
+func TestConsumerFollowerFetch(t *testing.T) {
+	topic := "follower-fetch"
+	for name, tc := range map[string]struct {
+		followerFetch bool
+		expected      string
+	}{
+		"enabled":  {followerFetch: true, expected: "zone-a"},
+		"disabled": {expected: ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cluster := newFakeCluster(t, 1, topic)
+			event, err := json.Marshal(model.APMEvent{})
+			require.NoError(t, err)
+			produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+
+			// Follower fetching requires a rack-aware cluster, so only the
+			// rack sent in the fetch requests is asserted.
+			racks := make(chan string, 1)
+			cluster.ControlKey(int16(kmsg.Fetch), func(req kmsg.Request) (kmsg.Response, error, bool) {
+				select {
+				case racks <- req.(*kmsg.FetchRequest).Rack:
+				default:
+				}
+				return nil, nil, false
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			consumer, err := NewConsumer(ConsumerConfig{
+				Brokers:       cluster.ListenAddrs(),
+				Topics:        []string{topic},
+				GroupID:       "group",
+				Logger:        zaptest.NewLogger(t),
+				RackID:        "zone-a",
+				FollowerFetch: tc.followerFetch,
+				Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+					cancel()
+					return nil
+				}),
+			})
+			require.NoError(t, err)
+			assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+			require.NoError(t, consumer.Close())
+			select {
+			case rack := <-racks:
+				assert.Equal(t, tc.expected, rack)
+			default:
+				t.Fatal("no fetch request was sent")
+			}
+		})
+	}
+}
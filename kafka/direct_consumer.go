@@ -0,0 +1,422 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/plugin/kzap"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// DirectPartitionConsumerConfig defines the configuration for the Kafka
+// DirectPartitionConsumer.
+type DirectPartitionConsumerConfig struct {
+	// Brokers is the list of kafka brokers used to seed the Kafka client.
+	Brokers []string
+	// Topic that the consumer will consume messages from.
+	Topic string
+	// Partitions of the Topic to consume from. When empty, all the topic
+	// partitions are consumed.
+	Partitions []int32
+	// ClientID to use when connecting to Kafka. This is used for logging
+	// and client identification purposes.
+	ClientID string
+	// Version is the software version to use in the Kafka client. This is
+	// useful since it shows up in Kafka metrics and logs.
+	Version string
+	// SASL mechanisms to authenticate with, in order of preference.
+	SASL []sasl.Mechanism
+	// TLS, when set, makes the client connect to the brokers over TLS.
+	TLS *TLS
+
+	// StartTimestamp, when set, starts consuming each partition from the
+	// first record produced at or after the timestamp. Partitions without
+	// such records start at their end offset. Otherwise, the partitions are
+	// consumed from their earliest offset.
+	StartTimestamp time.Time
+	// Tail, when set, starts consuming each partition from the last Tail
+	// records before its end offset, or from its earliest offset when it
+	// has fewer records. It can't be used together with StartTimestamp.
+	Tail int64
+	// StopAtEnd, when set, makes Run return once the records up to the end
+	// offsets of the partitions at creation time have been processed.
+	// Otherwise, Run keeps consuming the records as they're produced.
+	StopAtEnd bool
+	// CompactOnConsume, when set, delivers only the latest record of each
+	// key among the records up to the end offsets of the partitions at
+	// creation time, like a compacted topic, once all of them have been
+	// consumed. The keys whose latest record is a tombstone are dropped,
+	// and the records without a key are all delivered. The records after
+	// the end offsets are then processed as they're consumed. The initial
+	// records are held in memory until they're delivered.
+	CompactOnConsume bool
+
+	// Logger to use for any errors.
+	Logger *zap.Logger
+	// Decoder decodes the record values into events, defaults to JSON.
+	Decoder Decoder
+	// Processor that will be used to process each event individually.
+	Processor model.BatchProcessor
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg DirectPartitionConsumerConfig) Validate() error {
+	var errs []error
+	if len(cfg.Brokers) == 0 {
+		errs = append(errs, errors.New("kafka: at least one broker must be set"))
+	}
+	if cfg.Topic == "" {
+		errs = append(errs, errors.New("kafka: topic must be set"))
+	}
+	if cfg.Logger == nil {
+		errs = append(errs, errors.New("kafka: logger must be set"))
+	}
+	if cfg.Tail < 0 {
+		errs = append(errs, errors.New("kafka: tail cannot be negative"))
+	}
+	if cfg.Tail > 0 && !cfg.StartTimestamp.IsZero() {
+		errs = append(errs, errors.New("kafka: tail and start timestamp cannot be set together"))
+	}
+	if cfg.Processor == nil {
+		errs = append(errs, errors.New("kafka: processor must be set"))
+	}
+	return errors.Join(errs...)
+}
+
+// DirectPartitionConsumer consumes the partitions of a topic directly,
+// without joining a consumer group or committing offsets.
+type DirectPartitionConsumer struct {
+	mu     sync.RWMutex
+	client *kgo.Client
+	cfg    DirectPartitionConsumerConfig
+	// remaining holds the end offsets of the partitions which haven't been
+	// fully consumed yet, only when StopAtEnd or CompactOnConsume is set.
+	remaining map[int32]int64
+
+	// loading is set while CompactOnConsume holds the initial records.
+	loading bool
+	// loaded holds the initial records, in consume order. A record is
+	// replaced by the latest one with the same key, indexed by loadedKeys.
+	loaded     []*kgo.Record
+	loadedKeys map[string]int
+	// streamed holds the records after the end offsets consumed while
+	// loading, which are processed once the initial records are delivered.
+	streamed []*kgo.Record
+}
+
+// NewDirectPartitionConsumer creates a new instance of a
+// DirectPartitionConsumer. The starting offsets of the partitions are
+// resolved on creation.
+func NewDirectPartitionConsumer(ctx context.Context, cfg DirectPartitionConsumerConfig) (*DirectPartitionConsumer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.WithLogger(kzap.New(cfg.Logger)),
+	}
+	if len(cfg.SASL) > 0 {
+		opts = append(opts, kgo.SASL(cfg.SASL...))
+	}
+	if opt := dialOpt(cfg.TLS, ReconnectBackoff{}); opt != nil {
+		opts = append(opts, opt)
+	}
+	if cfg.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.ClientID))
+		if cfg.Version != "" {
+			opts = append(opts, kgo.SoftwareNameAndVersion(
+				cfg.ClientID, cfg.Version,
+			))
+		}
+	}
+	offsets, remaining, err := startOffsets(ctx, cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kgo.NewClient(append(opts,
+		kgo.ConsumePartitions(map[string]map[int32]kgo.Offset{cfg.Topic: offsets}),
+		// The control records, such as the transaction markers, are fetched
+		// so the partitions ending with them are known to be consumed.
+		kgo.KeepControlRecords(),
+	)...)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Logger = cfg.Logger.With(zap.String("topic", cfg.Topic))
+	if cfg.Decoder == nil {
+		cfg.Decoder = json.JSON{}
+	}
+	return &DirectPartitionConsumer{
+		cfg:        cfg,
+		client:     client,
+		remaining:  remaining,
+		loading:    cfg.CompactOnConsume && len(remaining) > 0,
+		loadedKeys: make(map[string]int),
+	}, nil
+}
+
+// startOffsets returns the offsets to start consuming each partition from
+// and, when StopAtEnd or CompactOnConsume is set, the end offsets of the
+// partitions which have records to consume.
+func startOffsets(ctx context.Context, cfg DirectPartitionConsumerConfig, opts []kgo.Opt) (
+	map[int32]kgo.Offset, map[int32]int64, error,
+) {
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer client.Close()
+	admin := kadm.NewClient(client)
+	listOffsets := func(list func(context.Context, ...string) (kadm.ListedOffsets, error)) (kadm.ListedOffsets, error) {
+		listed, err := list(ctx, cfg.Topic)
+		if err == nil {
+			err = listed.Error()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("kafka: failed to list offsets: %w", err)
+		}
+		return listed, nil
+	}
+	start := admin.ListStartOffsets
+	if !cfg.StartTimestamp.IsZero() {
+		start = func(ctx context.Context, topics ...string) (kadm.ListedOffsets, error) {
+			return admin.ListOffsetsAfterMilli(ctx, cfg.StartTimestamp.UnixMilli(), topics...)
+		}
+	}
+	listed, err := listOffsets(start)
+	if err != nil {
+		return nil, nil, err
+	}
+	var end kadm.ListedOffsets
+	if cfg.Tail > 0 || cfg.StopAtEnd || cfg.CompactOnConsume {
+		if end, err = listOffsets(admin.ListEndOffsets); err != nil {
+			return nil, nil, err
+		}
+	}
+	partitions := cfg.Partitions
+	if len(partitions) == 0 {
+		for p := range listed[cfg.Topic] {
+			partitions = append(partitions, p)
+		}
+	}
+	offsets := make(map[int32]kgo.Offset, len(partitions))
+	var remaining map[int32]int64
+	if cfg.StopAtEnd || cfg.CompactOnConsume {
+		remaining = make(map[int32]int64, len(partitions))
+	}
+	for _, p := range partitions {
+		o, ok := listed.Lookup(cfg.Topic, p)
+		if !ok {
+			return nil, nil, fmt.Errorf("kafka: partition %d not found in topic %s", p, cfg.Topic)
+		}
+		offset := o.Offset
+		if end != nil {
+			e, _ := end.Lookup(cfg.Topic, p)
+			if cfg.Tail > 0 && e.Offset-cfg.Tail > offset {
+				offset = e.Offset - cfg.Tail
+			}
+			if remaining != nil && offset < e.Offset {
+				remaining[p] = e.Offset
+			}
+		}
+		offsets[p] = kgo.NewOffset().At(offset)
+	}
+	return offsets, remaining, nil
+}
+
+// Close closes the consumer.
+func (c *DirectPartitionConsumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client.Close()
+	return nil
+}
+
+// Run executes the consumer in a blocking manner. When StopAtEnd is set,
+// it returns nil once all the partitions have been consumed up to their end
+// offsets at creation time.
+func (c *DirectPartitionConsumer) Run(ctx context.Context) error {
+	for {
+		if c.cfg.StopAtEnd && len(c.remaining) == 0 {
+			return nil
+		}
+		if err := c.fetch(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *DirectPartitionConsumer) fetch(ctx context.Context) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fetches := c.client.PollFetches(ctx)
+	if fetches.IsClientClosed() {
+		return context.Canceled // Client closed.
+	}
+	if err := ctx.Err(); err != nil {
+		return err // Context cancelled or deadline exceeded.
+	}
+	fetches.EachError(func(t string, p int32, err error) {
+		c.cfg.Logger.Error("consumer fetches returned error",
+			zap.Error(err), zap.String("topic", t), zap.Int32("partition", p),
+		)
+	})
+	fetches.EachPartition(func(fp kgo.FetchTopicPartition) {
+		for _, msg := range fp.Records {
+			if c.loading {
+				c.loadRecord(msg)
+			} else {
+				c.consumeRecord(msg)
+			}
+		}
+		if fp.Err == nil && len(fp.Records) == 0 {
+			c.caughtUp(fp.Partition, fp.HighWatermark)
+		}
+	})
+	return nil
+}
+
+// caughtUp stops tracking the partition once it's fetched without records
+// at a high watermark past its end offset, since the records before the end
+// offset may have been compacted or aborted.
+func (c *DirectPartitionConsumer) caughtUp(partition int32, highWatermark int64) {
+	end, ok := c.remaining[partition]
+	if !ok || highWatermark < end {
+		return
+	}
+	delete(c.remaining, partition)
+	if c.loading && len(c.remaining) == 0 {
+		c.deliverLoaded()
+	}
+}
+
+// loadRecord holds the record consumed while CompactOnConsume is loading
+// the initial records, and delivers them once all the partitions have been
+// consumed up to their end offsets.
+func (c *DirectPartitionConsumer) loadRecord(msg *kgo.Record) {
+	end, ok := c.remaining[msg.Partition]
+	if !ok || msg.Offset >= end {
+		if !msg.Attrs.IsControl() {
+			c.streamed = append(c.streamed, msg)
+		}
+		return
+	}
+	if msg.Offset+1 >= end {
+		delete(c.remaining, msg.Partition)
+	}
+	switch i, ok := c.loadedKeys[string(msg.Key)]; {
+	case msg.Attrs.IsControl():
+		// Control records only advance the partition position.
+	case ok && msg.Key != nil:
+		c.loaded[i] = msg
+	default:
+		if msg.Key != nil {
+			c.loadedKeys[string(msg.Key)] = len(c.loaded)
+		}
+		c.loaded = append(c.loaded, msg)
+	}
+	if len(c.remaining) == 0 {
+		c.deliverLoaded()
+	}
+}
+
+// deliverLoaded processes the compacted initial records, followed by the
+// records streamed while loading them.
+func (c *DirectPartitionConsumer) deliverLoaded() {
+	c.loading = false
+	for _, r := range c.loaded {
+		if r.Key != nil && r.Value == nil {
+			continue // The key was deleted.
+		}
+		c.processRecord(r)
+	}
+	streamed := c.streamed
+	c.loaded, c.loadedKeys, c.streamed = nil, nil, nil
+	for _, r := range streamed {
+		c.consumeRecord(r)
+	}
+}
+
+// consumeRecord processes the record, unless it's a control record, or
+// StopAtEnd is set and the record is after the end offset of its partition.
+func (c *DirectPartitionConsumer) consumeRecord(msg *kgo.Record) {
+	if c.cfg.StopAtEnd {
+		end, ok := c.remaining[msg.Partition]
+		if !ok {
+			return // The partition has been consumed up to its end offset.
+		}
+		if msg.Offset+1 >= end {
+			delete(c.remaining, msg.Partition)
+		}
+		if msg.Offset >= end {
+			return
+		}
+	}
+	if msg.Attrs.IsControl() {
+		return
+	}
+	c.processRecord(msg)
+}
+
+func (c *DirectPartitionConsumer) processRecord(msg *kgo.Record) {
+	ctx := context.Background()
+	for _, h := range msg.Headers {
+		if h.Key == "project_id" {
+			ctx = queuecontext.WithProject(ctx, string(h.Value))
+			break
+		}
+	}
+	var event model.APMEvent
+	if err := c.cfg.Decoder.Decode(msg.Value, &event); err != nil {
+		c.cfg.Logger.Error("unable to decode the record into model.APMEvent",
+			zap.Error(err),
+			zap.ByteString("message.value", msg.Value),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", int32(msg.Partition)),
+		)
+		return
+	}
+	batch := model.Batch{event}
+	if err := c.cfg.Processor.ProcessBatch(ctx, &batch); err != nil {
+		c.cfg.Logger.Error("unable to process event",
+			zap.Error(err),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", int32(msg.Partition)),
+		)
+	}
+}
+
+// Healthy returns an error if the Kafka active broker length dips below 1.
+func (c *DirectPartitionConsumer) Healthy() error {
+	if brokers := c.client.DiscoveredBrokers(); len(brokers) < 1 {
+		return fmt.Errorf("number of brokers below 1")
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestNewDirectPartitionConsumer(t *testing.T) {
+	_, err := NewDirectPartitionConsumer(context.Background(), DirectPartitionConsumerConfig{})
+	assert.EqualError(t, err, "kafka: at least one broker must be set\n"+
+		"kafka: topic must be set\n"+
+		"kafka: logger must be set\n"+
+		"kafka: processor must be set",
+	)
+	assert.EqualError(t, DirectPartitionConsumerConfig{
+		Brokers:        []string{"localhost:9092"},
+		Topic:          "topic",
+		Logger:         zaptest.NewLogger(t),
+		Processor:      model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+		StartTimestamp: time.Now(),
+		Tail:           1,
+	}.Validate(), "kafka: tail and start timestamp cannot be set together")
+}
+
+func TestDirectPartitionConsumerStartTimestamp(t *testing.T) {
+	topic := "start-timestamp"
+	cluster := newFakeCluster(t, 1, topic)
+	start := time.Now().Truncate(time.Millisecond)
+	var timestamps []time.Time
+	for i := -3; i < 3; i++ {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{
+			ID: fmt.Sprint(i),
+		}})
+		require.NoError(t, err)
+		ts := start.Add(time.Duration(i) * time.Minute)
+		timestamps = append(timestamps, ts)
+		produceRecords(t, cluster, &kgo.Record{
+			Topic: topic, Value: event, Timestamp: ts,
+		})
+	}
+	// kfake doesn't resolve offsets by timestamp correctly, answer the
+	// timestamp lookups from the produced record timestamps instead.
+	cluster.ControlKey(int16(kmsg.ListOffsets), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := kreq.(*kmsg.ListOffsetsRequest)
+		resp := req.ResponseKind().(*kmsg.ListOffsetsResponse)
+		for _, rt := range req.Topics {
+			st := kmsg.NewListOffsetsResponseTopic()
+			st.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				if rp.Timestamp < 0 {
+					return nil, nil, false
+				}
+				sp := kmsg.NewListOffsetsResponseTopicPartition()
+				sp.Partition = rp.Partition
+				sp.Offset = int64(len(timestamps))
+				for offset, ts := range timestamps {
+					if ts.UnixMilli() >= rp.Timestamp {
+						sp.Offset = int64(offset)
+						sp.Timestamp = ts.UnixMilli()
+						break
+					}
+				}
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp, nil, true
+	})
+
+	for name, tc := range map[string]struct {
+		start    time.Time
+		expected []string
+	}{
+		"zero":    {expected: []string{"-3", "-2", "-1", "0", "1", "2"}},
+		"exact":   {start: start, expected: []string{"0", "1", "2"}},
+		"between": {start: start.Add(90 * time.Second), expected: []string{"2"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var processed []string
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			consumer, err := NewDirectPartitionConsumer(ctx, DirectPartitionConsumerConfig{
+				Brokers:        cluster.ListenAddrs(),
+				Topic:          topic,
+				Logger:         zaptest.NewLogger(t),
+				StartTimestamp: tc.start,
+				Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+					mu.Lock()
+					defer mu.Unlock()
+					for _, event := range *b {
+						processed = append(processed, event.Trace.ID)
+					}
+					if len(processed) == len(tc.expected) {
+						cancel()
+					}
+					return nil
+				}),
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() { consumer.Close() })
+			assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+			assert.Equal(t, tc.expected, processed)
+		})
+	}
+}
+
+func TestDirectPartitionConsumerTail(t *testing.T) {
+	topic := "tail"
+	cluster := newFakeCluster(t, 1, topic)
+	for i := 0; i < 20; i++ {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{
+			ID: fmt.Sprint(i),
+		}})
+		require.NoError(t, err)
+		produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var processed []string
+	consumer, err := NewDirectPartitionConsumer(ctx, DirectPartitionConsumerConfig{
+		Brokers:   cluster.ListenAddrs(),
+		Topic:     topic,
+		Logger:    zaptest.NewLogger(t),
+		Tail:      5,
+		StopAtEnd: true,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				processed = append(processed, event.Trace.ID)
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	require.NoError(t, consumer.Run(ctx))
+	assert.Equal(t, []string{"15", "16", "17", "18", "19"}, processed)
+}
+
+func TestDirectPartitionConsumerCompactOnConsume(t *testing.T) {
+	topic := "compact-on-consume"
+	cluster := newFakeCluster(t, 1, topic)
+	record := func(key, id string) *kgo.Record {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: id}})
+		require.NoError(t, err)
+		r := &kgo.Record{Topic: topic, Value: event}
+		if key != "" {
+			r.Key = []byte(key)
+		}
+		return r
+	}
+	produceRecords(t, cluster,
+		record("k1", "a"), record("k2", "b"), record("k1", "c"),
+		record("k3", "d"), record("k2", "e"), record("", "f"),
+		&kgo.Record{Topic: topic, Key: []byte("k3")}, // Tombstone.
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var processed []string
+	consumer, err := NewDirectPartitionConsumer(ctx, DirectPartitionConsumerConfig{
+		Brokers:          cluster.ListenAddrs(),
+		Topic:            topic,
+		Logger:           zaptest.NewLogger(t),
+		CompactOnConsume: true,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			for _, event := range *b {
+				processed = append(processed, event.Trace.ID)
+			}
+			switch len(processed) {
+			case 3:
+				// The records after the initial load are streamed.
+				produceRecords(t, cluster, record("k1", "g"))
+			case 4:
+				cancel()
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	assert.Equal(t, []string{"c", "e", "f", "g"}, processed)
+}
+
+func TestDirectPartitionConsumerStopAtEndControlRecord(t *testing.T) {
+	for name, compact := range map[string]bool{"stop_at_end": false, "compact_on_consume": true} {
+		t.Run(name, func(t *testing.T) {
+			topic := "stop-at-end-control"
+			cluster := newFakeCluster(t, 1, topic)
+			for i := 0; i < 2; i++ {
+				event, err := json.Marshal(model.APMEvent{Trace: model.Trace{
+					ID: fmt.Sprint(i),
+				}})
+				require.NoError(t, err)
+				produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+			}
+			// The partition ends with a transaction marker after the records.
+			appendControlRecord(t, cluster, topic, 2)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var processed []string
+			consumer, err := NewDirectPartitionConsumer(ctx, DirectPartitionConsumerConfig{
+				Brokers:          cluster.ListenAddrs(),
+				Topic:            topic,
+				Logger:           zaptest.NewLogger(t),
+				StopAtEnd:        true,
+				CompactOnConsume: compact,
+				Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+					for _, event := range *b {
+						processed = append(processed, event.Trace.ID)
+					}
+					return nil
+				}),
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() { consumer.Close() })
+			require.NoError(t, consumer.Run(ctx))
+			assert.Equal(t, []string{"0", "1"}, processed)
+		})
+	}
+}
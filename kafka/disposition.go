@@ -0,0 +1,76 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+
+	"github.com/elastic/apm-data/model"
+)
+
+const (
+	// Ack marks the record as processed, its offset is committed.
+	Ack RecordDisposition = iota
+	// Retry redelivers the record to the processor.
+	Retry
+	// DeadLetter produces the record to the consumer's DeadLetterTopic and
+	// commits its offset.
+	DeadLetter
+)
+
+// RecordDisposition defines what the consumer does with a processed record.
+type RecordDisposition uint8
+
+func (d RecordDisposition) String() string {
+	switch d {
+	case Ack:
+		return "ack"
+	case Retry:
+		return "retry"
+	case DeadLetter:
+		return "dead_letter"
+	default:
+		return ""
+	}
+}
+
+// recordDisposition returns the disposition of a record from the ones of its
+// events. The record is retried if any of them is retried, since its events
+// can't be redelivered separately, then dead lettered if any of them is.
+func recordDisposition(dispositions []RecordDisposition) RecordDisposition {
+	disposition := Ack
+	for _, d := range dispositions {
+		switch d {
+		case Retry:
+			return Retry
+		case DeadLetter:
+			disposition = DeadLetter
+		}
+	}
+	return disposition
+}
+
+// DispositionProcessor can be optionally implemented by the consumer
+// processors to decide the outcome of each record, rather than failing or
+// succeeding the whole batch.
+type DispositionProcessor interface {
+	model.BatchProcessor
+	// ProcessBatchDisposition processes the batch returning a disposition
+	// for each of its events, in the same order.
+	ProcessBatchDisposition(ctx context.Context, b *model.Batch) []RecordDisposition
+}
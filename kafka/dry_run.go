@@ -0,0 +1,150 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// dryRunner resolves the records produced with DryRun without sending them
+// to the brokers. The records are partitioned by the partitioner of the
+// client, and the produce hooks of the client are called as if each record
+// was produced in its own uncompressed batch.
+type dryRunner struct {
+	client      *kgo.Client
+	partitioner kgo.Partitioner
+	hooks       []kgo.Hook
+
+	mu sync.Mutex
+	// topics holds the partitioning state of each topic, once a record is
+	// produced to it.
+	topics map[string]*dryRunTopic
+}
+
+// dryRunTopic holds the partitioner of a topic and the next synthetic
+// offset of each of its partitions.
+type dryRunTopic struct {
+	partitioner kgo.TopicPartitioner
+	offsets     []int64
+}
+
+// newDryRunner returns a dryRunner for the client, which is created with the
+// partitioner and the hooks. A nil partitioner is the client's default one.
+func newDryRunner(client *kgo.Client, partitioner kgo.Partitioner, hooks ...kgo.Hook) *dryRunner {
+	if partitioner == nil {
+		partitioner = kgo.UniformBytesPartitioner(64<<10, true, true, nil)
+	}
+	return &dryRunner{client: client, partitioner: partitioner, hooks: hooks}
+}
+
+// produce resolves the record as produced to the partition picked by the
+// partitioner, with an offset increasing by one per partition. The topic
+// partitions are looked up from the brokers on first use.
+func (d *dryRunner) produce(ctx context.Context, r *kgo.Record, defaultTopic string) error {
+	if r.Context == nil {
+		r.Context = ctx
+	}
+	if r.Topic == "" {
+		r.Topic = defaultTopic
+	}
+	for _, h := range d.hooks {
+		if h, ok := h.(kgo.HookProduceRecordBuffered); ok {
+			h.OnProduceRecordBuffered(r)
+		}
+	}
+	err := d.partition(ctx, r)
+	if err == nil {
+		size := int(recordSize(r))
+		batch := kgo.ProduceBatchMetrics{NumRecords: 1, UncompressedBytes: size, CompressedBytes: size}
+		for _, h := range d.hooks {
+			if h, ok := h.(kgo.HookProduceBatchWritten); ok {
+				h.OnProduceBatchWritten(kgo.BrokerMetadata{}, r.Topic, r.Partition, batch)
+			}
+		}
+	}
+	for _, h := range d.hooks {
+		if h, ok := h.(kgo.HookProduceRecordUnbuffered); ok {
+			h.OnProduceRecordUnbuffered(r, err)
+		}
+	}
+	return err
+}
+
+// partition sets the partition and the offset of the record.
+func (d *dryRunner) partition(ctx context.Context, r *kgo.Record) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.topics[r.Topic]
+	if !ok {
+		topics, err := kadm.NewClient(d.client).ListTopics(ctx, r.Topic)
+		if err != nil {
+			return fmt.Errorf("kafka: failed to list the partitions of topic %s: %w", r.Topic, err)
+		}
+		detail := topics[r.Topic]
+		if detail.Err != nil {
+			return fmt.Errorf("kafka: failed to list the partitions of topic %s: %w", r.Topic, detail.Err)
+		}
+		t = &dryRunTopic{
+			partitioner: d.partitioner.ForTopic(r.Topic),
+			offsets:     make([]int64, len(detail.Partitions)),
+		}
+		if d.topics == nil {
+			d.topics = make(map[string]*dryRunTopic)
+		}
+		d.topics[r.Topic] = t
+	}
+	n := len(t.offsets)
+	if n == 0 {
+		return fmt.Errorf("kafka: topic %s has no partitions", r.Topic)
+	}
+	var partition int
+	if backup, ok := t.partitioner.(kgo.TopicBackupPartitioner); ok {
+		partition = backup.PartitionByBackup(r, n, &emptyBackupIter{n: n})
+	} else {
+		partition = t.partitioner.Partition(r, n)
+	}
+	if partition < 0 || partition >= n {
+		return fmt.Errorf("kafka: invalid partition %d of %d partitions", partition, n)
+	}
+	r.Partition = int32(partition)
+	r.Offset = t.offsets[partition]
+	t.offsets[partition]++
+	return nil
+}
+
+// emptyBackupIter iterates over the partitions as if none of them had
+// buffered records, since the dry run records are never buffered.
+type emptyBackupIter struct {
+	n, i int
+}
+
+// Next implements kgo.TopicBackupIter.
+func (it *emptyBackupIter) Next() (int, int64) {
+	it.i++
+	return it.i - 1, 0
+}
+
+// Rem implements kgo.TopicBackupIter.
+func (it *emptyBackupIter) Rem() int {
+	return it.n - it.i
+}
@@ -0,0 +1,154 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestProducerDryRun(t *testing.T) {
+	topic := "dry-run"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+		DryRun:  true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx := context.Background()
+	batch := model.Batch{{}, {}, {}}
+	offsets, err := producer.ProduceWithOffsets(ctx, &batch)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[int32]int64{topic: {0: 2}}, offsets)
+	for i, f := range producer.ProcessBatchAsync(ctx, &batch) {
+		result, err := f.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, ProduceResult{Partition: 0, Offset: int64(3 + i)}, result)
+	}
+	require.NoError(t, producer.ProcessTombstones(ctx, topic, [][]byte{[]byte("key")}))
+	assert.Equal(t, int64(7), producer.PartitionStats()[topic][0].Records)
+
+	// Nothing was produced to the brokers.
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	end, err := kadm.NewClient(client).ListEndOffsets(ctx, topic)
+	require.NoError(t, err)
+	offset, ok := end.Lookup(topic, 0)
+	require.True(t, ok)
+	assert.Equal(t, int64(0), offset.Offset)
+}
+
+func TestProducerDryRunPartitioning(t *testing.T) {
+	topic := "dry-run-partitioning"
+	cluster := newFakeCluster(t, 4, topic)
+	recorder := tracetest.NewSpanRecorder()
+	reader := sdkmetric.NewManualReader()
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:       cluster.ListenAddrs(),
+		Topic:         topic,
+		Logger:        zaptest.NewLogger(t),
+		DryRun:        true,
+		PartitionHash: PartitionHashMurmur2Java,
+		KeyRouter: func(event model.APMEvent) []byte {
+			return []byte(event.Trace.ID)
+		},
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+		MeterProvider:  sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	batch := make(model.Batch, 20)
+	for i := range batch {
+		batch[i].Trace.ID = fmt.Sprint(i)
+	}
+	// The compression override doesn't create a client with the codec.
+	ctx := queuecontext.WithCompression(context.Background(), "zstd")
+	offsets, err := producer.ProduceWithOffsets(ctx, &batch)
+	require.NoError(t, err)
+	assert.Empty(t, producer.compressed)
+
+	// The records are partitioned by key, like when producing them.
+	partitioner := kgo.StickyKeyPartitioner(nil).ForTopic(topic)
+	counts := make(map[int32]int64)
+	for _, event := range batch {
+		partition := partitioner.Partition(&kgo.Record{Key: []byte(event.Trace.ID)}, 4)
+		counts[int32(partition)]++
+	}
+	require.Greater(t, len(counts), 1)
+	stats := producer.PartitionStats()[topic]
+	for partition, count := range counts {
+		assert.Equal(t, count-1, offsets[topic][partition], partition)
+		assert.Equal(t, count, stats[partition].Records, partition)
+		assert.Equal(t, stats[partition].UncompressedBytes, stats[partition].CompressedBytes, partition)
+	}
+
+	// The records are traced and measured by the client hooks.
+	spans := recorder.Ended()
+	require.Len(t, spans, len(batch))
+	for _, span := range spans {
+		var partition int64 = -1
+		for _, kv := range span.Attributes() {
+			if kv.Key == "messaging.kafka.destination.partition" {
+				partition = kv.Value.AsInt64()
+			}
+		}
+		assert.Contains(t, counts, int32(partition))
+	}
+	hist, ok := collectMetric(t, reader, "apmqueue.producer.compression.ratio").Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	require.Len(t, hist.DataPoints, 1)
+	codec, _ := hist.DataPoints[0].Attributes.Value("compression.codec")
+	assert.Equal(t, "none", codec.AsString())
+	assert.Equal(t, uint64(len(batch)), hist.DataPoints[0].Count)
+	assert.Equal(t, float64(len(batch)), hist.DataPoints[0].Sum)
+}
+
+func TestProducerDryRunUnknownTopic(t *testing.T) {
+	cluster := newFakeCluster(t, 1, "dry-run")
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   "dry-run-unknown",
+		Logger:  zaptest.NewLogger(t),
+		DryRun:  true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+	batch := model.Batch{{}}
+	assert.ErrorIs(t, producer.ProcessBatch(context.Background(), &batch), kerr.UnknownTopicOrPartition)
+}
@@ -0,0 +1,97 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// EnrichedRecord holds an event decoded from a consumed record, together
+// with the record it was decoded from.
+type EnrichedRecord struct {
+	RawRecord
+	Event model.APMEvent
+}
+
+// EnrichedProcessor processes the events decoded from the records of a
+// fetch, in the records order, with the metadata of their records.
+type EnrichedProcessor func(ctx context.Context, records []EnrichedRecord) error
+
+// processEnriched processes the events decoded from the records with the
+// EnrichedProcessor, adding all the records to the pending ones. The records
+// which were skipped or failed to decode aren't processed.
+func (c *Consumer) processEnriched(ctx context.Context, records []*kgo.Record, decoded []decodedRecord) {
+	defer func() {
+		for _, msg := range records {
+			c.buffered.processed(msg)
+		}
+	}()
+	enriched := make([]EnrichedRecord, 0, len(records))
+	// delivered holds the records whose events are processed.
+	delivered := make([]*kgo.Record, 0, len(records))
+	for i, msg := range records {
+		c.pending = append(c.pending, msg)
+		if c.cfg.MaxRecords > 0 {
+			c.consumed++
+		}
+		if decoded[i].skipped {
+			continue
+		}
+		if err := decoded[i].err; err != nil {
+			c.cfg.Logger.Error("unable to decode the record into model.APMEvent",
+				zap.Error(err),
+				zap.String("topic", msg.Topic),
+				zap.ByteString("message.value", msg.Value),
+				zap.Int64("offset", msg.Offset),
+				zap.Int32("partition", int32(msg.Partition)),
+			)
+			c.metrics.recordOutcome(ctx, msg.Topic, true)
+			continue
+		}
+		delivered = append(delivered, msg)
+		for _, event := range decoded[i].events {
+			enriched = append(enriched, EnrichedRecord{
+				RawRecord: newRawRecord(msg),
+				Event:     event,
+			})
+		}
+	}
+	if len(enriched) == 0 {
+		return
+	}
+	err := c.cfg.EnrichedProcessor(ctx, enriched)
+	if err != nil {
+		c.cfg.Logger.Error("unable to process events",
+			zap.Error(err),
+			zap.Int("events", len(enriched)),
+		)
+	}
+	// The measurements recorded with a done ctx are dropped, such as when
+	// the processor cancels it.
+	for _, msg := range delivered {
+		c.metrics.recordOutcome(context.Background(), msg.Topic, err != nil)
+	}
+	for _, record := range enriched {
+		c.metrics.recordDelay(context.Background(), record.Topic, record.Event.Timestamp)
+	}
+}
@@ -0,0 +1,87 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestConsumerEnrichedProcessor(t *testing.T) {
+	topic := "enriched-processor"
+	cluster := newFakeCluster(t, 1, topic)
+	var records []*kgo.Record
+	for i := 0; i < 5; i++ {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: fmt.Sprint(i)}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{
+			Topic:   topic,
+			Value:   event,
+			Headers: []kgo.RecordHeader{{Key: "index", Value: []byte(fmt.Sprint(i))}},
+		})
+	}
+	// The records which fail to decode aren't processed.
+	records = append(records, &kgo.Record{Topic: topic, Value: []byte("invalid")})
+	produceRecords(t, cluster, records...)
+
+	var processed []EnrichedRecord
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:    cluster.ListenAddrs(),
+		Topics:     []string{topic},
+		GroupID:    "group",
+		Logger:     zaptest.NewLogger(t),
+		MaxRecords: len(records),
+		EnrichedProcessor: func(_ context.Context, records []EnrichedRecord) error {
+			processed = append(processed, records...)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, consumer.Run(ctx))
+	require.NoError(t, consumer.Close())
+
+	require.Len(t, processed, 5)
+	for i, record := range processed {
+		assert.Equal(t, fmt.Sprint(i), record.Event.Trace.ID)
+		assert.Equal(t, topic, record.Topic)
+		assert.Equal(t, int32(0), record.Partition)
+		assert.Equal(t, int64(i), record.Offset)
+		assert.Equal(t, map[string][]byte{"index": []byte(fmt.Sprint(i))}, record.Headers)
+	}
+
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	offsets, err := kadm.NewClient(client).FetchOffsets(context.Background(), "group")
+	require.NoError(t, err)
+	offset, ok := offsets.Lookup(topic, 0)
+	require.True(t, ok)
+	assert.Equal(t, int64(len(records)), offset.At)
+}
@@ -0,0 +1,227 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"bufio"
+	"context"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/plugin/kzap"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+const (
+	// ExportFormatEvents writes the decoded events, encoded as JSON.
+	ExportFormatEvents ExportFormat = iota
+	// ExportFormatRaw writes the record values as they are, so the values
+	// containing newlines can't be imported back.
+	ExportFormatRaw
+	// ExportFormatRecords writes the records as JSON objects holding their
+	// key, value and headers, with the bytes encoded as base64.
+	ExportFormatRecords
+)
+
+// ExportFormat defines the format of each line written by ExportTopic and
+// read by ImportTopic.
+type ExportFormat uint8
+
+// exportedRecord is a record in the ExportFormatRecords format.
+type exportedRecord struct {
+	Key     []byte           `json:"key,omitempty"`
+	Value   []byte           `json:"value"`
+	Headers []exportedHeader `json:"headers,omitempty"`
+}
+
+type exportedHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// ExportConfig defines the configuration for ExportTopic.
+type ExportConfig struct {
+	// Brokers is the list of kafka brokers used to seed the Kafka client.
+	Brokers []string
+	// SASL mechanisms to authenticate with, in order of preference.
+	SASL []sasl.Mechanism
+	// TLS, when set, makes the client connect to the brokers over TLS.
+	TLS *TLS
+	// Logger to use for any errors.
+	Logger *zap.Logger
+	// Decoder decodes the record values into events, defaults to JSON. Only
+	// used by ExportFormatEvents.
+	Decoder Decoder
+	// Format of the written lines, defaults to ExportFormatEvents.
+	Format ExportFormat
+	// OnProgress, when set, is called after each fetch with the number of
+	// records exported so far and the total number of records to export.
+	// The total excludes the control records fetched so far, such as the
+	// transaction markers, which aren't exported.
+	OnProgress func(exported, total int64)
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg ExportConfig) Validate() error {
+	var errs []error
+	if len(cfg.Brokers) == 0 {
+		errs = append(errs, errors.New("kafka: at least one broker must be set"))
+	}
+	if cfg.Logger == nil {
+		errs = append(errs, errors.New("kafka: logger must be set"))
+	}
+	if cfg.Format > ExportFormatRecords {
+		errs = append(errs, errors.New("kafka: unknown export format"))
+	}
+	if cfg.Format != ExportFormatEvents && cfg.Decoder != nil {
+		errs = append(errs, errors.New("kafka: decoder can only be set for the events format"))
+	}
+	return errors.Join(errs...)
+}
+
+// ExportTopic writes the records of all the topic partitions, from their
+// earliest offset up to their end offset when called, to w as newline
+// delimited lines in the configured Format. It doesn't join a consumer group
+// or commit offsets, and returns once all the records have been written.
+func ExportTopic(ctx context.Context, topic string, w io.Writer, cfg ExportConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if topic == "" {
+		return errors.New("kafka: topic must be set")
+	}
+	if cfg.Decoder == nil {
+		cfg.Decoder = json.JSON{}
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.WithLogger(kzap.New(cfg.Logger)),
+	}
+	if len(cfg.SASL) > 0 {
+		opts = append(opts, kgo.SASL(cfg.SASL...))
+	}
+	if opt := dialOpt(cfg.TLS, ReconnectBackoff{}); opt != nil {
+		opts = append(opts, opt)
+	}
+	offsets, remaining, err := startOffsets(ctx, DirectPartitionConsumerConfig{
+		Topic: topic, StopAtEnd: true,
+	}, opts)
+	if err != nil {
+		return err
+	}
+	var exported, total int64
+	for p, end := range remaining {
+		total += end - offsets[p].EpochOffset().Offset
+	}
+	client, err := kgo.NewClient(append(opts,
+		kgo.ConsumePartitions(map[string]map[int32]kgo.Offset{topic: offsets}),
+		// The control records, such as the transaction markers, are fetched
+		// so the partitions ending with them are known to be exported.
+		kgo.KeepControlRecords(),
+	)...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	bw := bufio.NewWriter(w)
+	for len(remaining) > 0 {
+		fetches := client.PollFetches(ctx)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// The retriable fetch errors are retried by the client, the others
+		// would be returned by every fetch.
+		var fetchErr error
+		fetches.EachError(func(t string, p int32, err error) {
+			fetchErr = errors.Join(fetchErr, fmt.Errorf("kafka: failed to fetch %s[%d]: %w", t, p, err))
+		})
+		if fetchErr != nil {
+			return fetchErr
+		}
+		var writeErr error
+		fetches.EachRecord(func(msg *kgo.Record) {
+			end, ok := remaining[msg.Partition]
+			if writeErr != nil || !ok || msg.Offset >= end {
+				return
+			}
+			if msg.Attrs.IsControl() {
+				total--
+			} else {
+				if writeErr = exportRecord(bw, cfg, msg); writeErr != nil {
+					return
+				}
+				exported++
+			}
+			if msg.Offset+1 >= end {
+				delete(remaining, msg.Partition)
+			}
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+		if cfg.OnProgress != nil {
+			cfg.OnProgress(exported, total)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("kafka: failed to write export: %w", err)
+	}
+	return nil
+}
+
+// exportRecord writes the record as a single line.
+func exportRecord(w *bufio.Writer, cfg ExportConfig, msg *kgo.Record) error {
+	line := msg.Value
+	var err error
+	switch cfg.Format {
+	case ExportFormatEvents:
+		var event model.APMEvent
+		if err := cfg.Decoder.Decode(msg.Value, &event); err != nil {
+			return fmt.Errorf("kafka: failed to decode record %s[%d]@%d: %w",
+				msg.Topic, msg.Partition, msg.Offset, err,
+			)
+		}
+		line, err = json.JSON{}.Encode(event)
+	case ExportFormatRecords:
+		record := exportedRecord{Key: msg.Key, Value: msg.Value}
+		for _, h := range msg.Headers {
+			record.Headers = append(record.Headers, exportedHeader{Key: h.Key, Value: h.Value})
+		}
+		line, err = stdjson.Marshal(record)
+	}
+	if err != nil {
+		return fmt.Errorf("kafka: failed to encode record %s[%d]@%d: %w",
+			msg.Topic, msg.Partition, msg.Offset, err,
+		)
+	}
+	if _, err := w.Write(line); err != nil {
+		return fmt.Errorf("kafka: failed to write export: %w", err)
+	}
+	if err := w.WriteByte('\n'); err != nil {
+		return fmt.Errorf("kafka: failed to write export: %w", err)
+	}
+	return nil
+}
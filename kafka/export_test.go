@@ -0,0 +1,212 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestExportTopic(t *testing.T) {
+	topic := "export"
+	cluster := newFakeCluster(t, 3, topic)
+	var records []*kgo.Record
+	for i := 0; i < 25; i++ {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: fmt.Sprint(i)}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{Topic: topic, Value: event})
+	}
+	produceRecords(t, cluster, records...)
+
+	for _, format := range []ExportFormat{ExportFormatEvents, ExportFormatRaw} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		var out bytes.Buffer
+		var exported, total int64
+		err := ExportTopic(ctx, topic, &out, ExportConfig{
+			Brokers: cluster.ListenAddrs(),
+			Logger:  zaptest.NewLogger(t),
+			Format:  format,
+			OnProgress: func(e, t int64) {
+				exported, total = e, t
+			},
+		})
+		cancel()
+		require.NoError(t, err)
+		assert.Equal(t, int64(25), exported)
+		assert.Equal(t, int64(25), total)
+
+		var ids []string
+		scanner := bufio.NewScanner(&out)
+		for scanner.Scan() {
+			var event model.APMEvent
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			ids = append(ids, event.Trace.ID)
+		}
+		require.NoError(t, scanner.Err())
+		assert.Len(t, ids, 25, "format %d", format)
+	}
+}
+
+func TestExportTopicEmpty(t *testing.T) {
+	topic := "export-empty"
+	cluster := newFakeCluster(t, 1, topic)
+	var out bytes.Buffer
+	require.NoError(t, ExportTopic(context.Background(), topic, &out, ExportConfig{
+		Brokers: cluster.ListenAddrs(),
+		Logger:  zaptest.NewLogger(t),
+	}))
+	assert.Zero(t, out.Len())
+}
+
+func TestExportTopicEndingWithControlRecord(t *testing.T) {
+	topic := "export-control"
+	cluster := newFakeCluster(t, 1, topic)
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: []byte(`{}`)})
+	// The partition ends with a transaction marker after the record.
+	appendControlRecord(t, cluster, topic, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var out bytes.Buffer
+	var exported, total int64
+	require.NoError(t, ExportTopic(ctx, topic, &out, ExportConfig{
+		Brokers: cluster.ListenAddrs(),
+		Logger:  zaptest.NewLogger(t),
+		Format:  ExportFormatRaw,
+		OnProgress: func(e, t int64) {
+			exported, total = e, t
+		},
+	}))
+	assert.Equal(t, "{}\n", out.String())
+	assert.Equal(t, int64(1), exported)
+	assert.Equal(t, int64(1), total)
+}
+
+func TestExportTopicFetchError(t *testing.T) {
+	topic := "export-fetch-error"
+	cluster := newFakeCluster(t, 1, topic)
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: []byte(`{}`)})
+	cluster.ControlKey(int16(kmsg.Fetch), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := kreq.(*kmsg.FetchRequest)
+		resp := req.ResponseKind().(*kmsg.FetchResponse)
+		for _, rt := range req.Topics {
+			st := kmsg.NewFetchResponseTopic()
+			st.Topic, st.TopicID = rt.Topic, rt.TopicID
+			for _, rp := range rt.Partitions {
+				sp := kmsg.NewFetchResponseTopicPartition()
+				sp.Partition = rp.Partition
+				sp.ErrorCode = kerr.TopicAuthorizationFailed.Code
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp, nil, true
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := ExportTopic(ctx, topic, io.Discard, ExportConfig{
+		Brokers: cluster.ListenAddrs(),
+		Logger:  zaptest.NewLogger(t),
+	})
+	assert.ErrorIs(t, err, kerr.TopicAuthorizationFailed)
+	assert.NoError(t, ctx.Err())
+}
+
+// appendControlRecord makes partition zero of the topic end with a commit
+// marker at the offset, which must be the high watermark. kfake doesn't
+// support transactions, so the end offsets listed and the fetches at the
+// offset are answered by the cluster controls.
+func appendControlRecord(t testing.TB, cluster *kfake.Cluster, topic string, offset int64) {
+	t.Helper()
+	end := offset + 1
+	cluster.ControlKey(int16(kmsg.ListOffsets), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := kreq.(*kmsg.ListOffsetsRequest)
+		resp := req.ResponseKind().(*kmsg.ListOffsetsResponse)
+		for _, rt := range req.Topics {
+			st := kmsg.NewListOffsetsResponseTopic()
+			st.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				if rt.Topic != topic || rp.Partition != 0 || rp.Timestamp != -1 {
+					return nil, nil, false
+				}
+				sp := kmsg.NewListOffsetsResponseTopicPartition()
+				sp.Partition = rp.Partition
+				sp.Offset = end
+				sp.LeaderEpoch = -1
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp, nil, true
+	})
+
+	// The control record key holds its version and type, one for commit.
+	record := kmsg.Record{Key: []byte{0, 0, 0, 1}, Value: []byte{0, 0, 0, 0, 0, 0}}
+	record.Length = int32(len(record.AppendTo(nil)) - 1)
+	batch := kmsg.RecordBatch{
+		FirstOffset:   offset,
+		Magic:         2,
+		Attributes:    0x0030, // Transactional control batch.
+		ProducerID:    1,
+		ProducerEpoch: 0,
+		FirstSequence: -1,
+		NumRecords:    1,
+		Records:       record.AppendTo(nil),
+	}
+	batch.Length = int32(len(batch.AppendTo(nil)) - 12)
+	raw := batch.AppendTo(nil)
+	batch.CRC = int32(crc32.Checksum(raw[21:], crc32.MakeTable(crc32.Castagnoli)))
+	raw = batch.AppendTo(nil)
+	cluster.ControlKey(int16(kmsg.Fetch), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := kreq.(*kmsg.FetchRequest)
+		if len(req.Topics) != 1 || len(req.Topics[0].Partitions) != 1 ||
+			req.Topics[0].Partitions[0].FetchOffset != offset {
+			return nil, nil, false
+		}
+		resp := req.ResponseKind().(*kmsg.FetchResponse)
+		st := kmsg.NewFetchResponseTopic()
+		st.Topic, st.TopicID = req.Topics[0].Topic, req.Topics[0].TopicID
+		sp := kmsg.NewFetchResponseTopicPartition()
+		sp.HighWatermark, sp.LastStableOffset = end, end
+		sp.RecordBatches = raw
+		st.Partitions = append(st.Partitions, sp)
+		resp.Topics = append(resp.Topics, st)
+		return resp, nil, true
+	})
+}
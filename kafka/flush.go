@@ -0,0 +1,111 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+)
+
+// FlushBarrier blocks until all the records enqueued by the producer before
+// it was called, from any goroutine, have been acknowledged by the brokers
+// or failed, or until the context is done, returning the context error. The
+// records enqueued after it's called aren't waited for, nor blocked. The
+// errors of the failed records are returned by the calls producing them.
+func (p *Producer) FlushBarrier(ctx context.Context) error {
+	select {
+	case <-p.flush.barrier():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flushTracker tracks the records being produced by epoch, which FlushBarrier
+// advances, to wait for the records enqueued before each barrier.
+type flushTracker struct {
+	mu    sync.Mutex
+	epoch uint64
+	// inflight holds the number of records of each epoch being produced.
+	inflight map[uint64]int
+	waiters  []flushWaiter
+}
+
+// flushWaiter is closed once the records of its epoch and the previous ones
+// have been produced.
+type flushWaiter struct {
+	epoch uint64
+	done  chan struct{}
+}
+
+// add tracks n records being produced, returning their epoch.
+func (t *flushTracker) add(n int) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inflight == nil {
+		t.inflight = make(map[uint64]int)
+	}
+	t.inflight[t.epoch] += n
+	return t.epoch
+}
+
+// done stops tracking n records of the epoch, releasing the barriers which
+// were waiting for them.
+func (t *flushTracker) done(epoch uint64, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inflight[epoch] -= n; t.inflight[epoch] > 0 {
+		return
+	}
+	delete(t.inflight, epoch)
+	waiters := t.waiters[:0]
+	for _, w := range t.waiters {
+		if t.pending(w.epoch) {
+			waiters = append(waiters, w)
+			continue
+		}
+		close(w.done)
+	}
+	t.waiters = waiters
+}
+
+// barrier advances the epoch, returning a channel which is closed once the
+// records of the previous epochs have been produced.
+func (t *flushTracker) barrier() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w := flushWaiter{epoch: t.epoch, done: make(chan struct{})}
+	t.epoch++
+	if !t.pending(w.epoch) {
+		close(w.done)
+		return w.done
+	}
+	t.waiters = append(t.waiters, w)
+	return w.done
+}
+
+// pending returns whether records of the epoch, or a previous one, are
+// being produced.
+func (t *flushTracker) pending(epoch uint64) bool {
+	for e := range t.inflight {
+		if e <= epoch {
+			return true
+		}
+	}
+	return false
+}
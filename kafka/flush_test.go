@@ -0,0 +1,97 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestProducerFlushBarrier(t *testing.T) {
+	topic := "flush-barrier"
+	cluster := newFakeCluster(t, 4, topic)
+	// Delay the acknowledgements, so records are in flight.
+	cluster.ControlKey(int16(kmsg.Produce), func(kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		time.Sleep(10 * time.Millisecond)
+		return nil, nil, false
+	})
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	var futures []*Future
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				batch := model.Batch{{}, {}}
+				produced := producer.ProcessBatchAsync(context.Background(), &batch)
+				mu.Lock()
+				futures = append(futures, produced...)
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		before := append([]*Future(nil), futures...)
+		mu.Unlock()
+		require.NotEmpty(t, before)
+
+		require.NoError(t, producer.FlushBarrier(ctx))
+		for _, f := range before {
+			select {
+			case <-f.Done():
+			default:
+				t.Fatal("record enqueued before the barrier wasn't acknowledged")
+			}
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	// Without records in flight, the barrier returns right away.
+	require.NoError(t, producer.FlushBarrier(context.Background()))
+	// The barrier honors the context.
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	batch := model.Batch{{}}
+	producer.ProcessBatchAsync(context.Background(), &batch)
+	assert.ErrorIs(t, producer.FlushBarrier(cancelled), context.Canceled)
+}
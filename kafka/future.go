@@ -0,0 +1,254 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// ErrEventExpired is the result of the events dropped by ProcessBatchAsync
+// because they were older than MaxProduceDelay.
+var ErrEventExpired = errors.New("kafka: event expired")
+
+// ProduceResult is the outcome of producing an event.
+type ProduceResult struct {
+	// Partition and Offset locate the produced record, when Err is nil.
+	Partition int32
+	Offset    int64
+	// Err is the error producing the event, if any.
+	Err error
+}
+
+// Future resolves to the ProduceResult of an event produced by
+// ProcessBatchAsync.
+type Future struct {
+	once   sync.Once
+	done   chan struct{}
+	result ProduceResult
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// Done returns a channel which is closed once the future is resolved.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the future is resolved, returning its result, or until
+// the context is done, returning the context error.
+func (f *Future) Wait(ctx context.Context) (ProduceResult, error) {
+	select {
+	case <-f.done:
+		return f.result, nil
+	case <-ctx.Done():
+		return ProduceResult{}, ctx.Err()
+	}
+}
+
+// resolve resolves the future to the result, returning false if it had
+// already been resolved.
+func (f *Future) resolve(result ProduceResult) bool {
+	var resolved bool
+	f.once.Do(func() {
+		f.result = result
+		close(f.done)
+		resolved = true
+	})
+	return resolved
+}
+
+// ProcessBatchAsync produces the events in the batch to the configured topic,
+// returning once they have been buffered by the producer. It returns a
+// future for each of the events, in the batch order, which resolves once the
+// event has been acknowledged by the brokers or failed. Buffering blocks
+// while the producer buffer is full, until the context is done. Like
+// ProcessBatch, the batch isn't mutated or retained once it returns.
+//
+// The context deadline is honored after ProcessBatchAsync returns: the
+// futures which aren't resolved by the deadline resolve to an error wrapping
+// context.DeadlineExceeded, and are counted in Stats. The records which were
+// already sent to the brokers may still be written.
+func (p *Producer) ProcessBatchAsync(ctx context.Context, batch *model.Batch) []*Future {
+	futures := make([]*Future, len(*batch))
+	for i := range futures {
+		futures[i] = newFuture()
+	}
+	release, err := p.acquireInflight(ctx)
+	if err != nil {
+		for _, f := range futures {
+			f.resolve(ProduceResult{Err: err})
+		}
+		return futures
+	}
+	defer p.releaseOnResolved(futures, release)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	select {
+	case <-p.closed:
+		for _, f := range futures {
+			f.resolve(ProduceResult{Err: errProducerClosed})
+		}
+		return futures
+	default:
+	}
+	now := p.cfg.clock.Now()
+	headers, err := p.recordHeaders(ctx, now)
+	var client *kgo.Client
+	if err == nil {
+		client, err = p.compressionClient(ctx)
+	}
+	if err != nil {
+		for _, f := range futures {
+			f.resolve(ProduceResult{Err: err})
+		}
+		return futures
+	}
+	key := p.metadataKey(ctx)
+	topic := p.metadataTopic(ctx)
+	invalid := p.validateBatch(*batch)
+	if invalid != nil && p.cfg.ValidationPolicy == ValidationFailBatch {
+		err := errors.Join(invalid...)
+		for i, f := range futures {
+			if invalid[i] != nil {
+				f.resolve(ProduceResult{Err: invalid[i]})
+			} else {
+				f.resolve(ProduceResult{Err: err})
+			}
+		}
+		return futures
+	}
+	records := make([]*kgo.Record, 0, len(*batch))
+	for i, event := range *batch {
+		future := futures[i]
+		if invalid != nil && invalid[i] != nil {
+			future.resolve(ProduceResult{Err: invalid[i]})
+			continue
+		}
+		if p.expiredEvent(event, now) {
+			p.expired.Add(1)
+			future.resolve(ProduceResult{Err: ErrEventExpired})
+			continue
+		}
+		record, err := p.newRecord(event, headers, key)
+		if err != nil {
+			future.resolve(ProduceResult{Err: err})
+			continue
+		}
+		record.Topic = topic
+		if !p.interceptProduce(ctx, record) {
+			future.resolve(ProduceResult{Err: ErrRecordDropped})
+			continue
+		}
+		chunks, err := p.chunkRecord(record)
+		if err != nil {
+			future.resolve(ProduceResult{Err: err})
+			continue
+		}
+		p.stampSequence(record)
+		if !p.cfg.DryRun {
+			records = append(records, record)
+		}
+		resolve := chunkedResult(len(chunks), func(result ProduceResult) {
+			p.resolveProduced(future, result)
+		})
+		for i, chunk := range chunks {
+			i := i
+			if p.cfg.DryRun {
+				err := p.dryRun.produce(ctx, chunk, p.cfg.Topic)
+				resolve(i, ProduceResult{
+					Partition: chunk.Partition,
+					Offset:    chunk.Offset,
+					Err:       p.produceError(chunk, err),
+				})
+				continue
+			}
+			epoch := p.flush.add(1)
+			client.Produce(ctx, chunk, func(r *kgo.Record, err error) {
+				defer p.flush.done(epoch, 1)
+				resolve(i, ProduceResult{
+					Partition: r.Partition,
+					Offset:    r.Offset,
+					Err:       p.produceError(r, err),
+				})
+			})
+		}
+	}
+	p.saveSequence(ctx)
+	p.mirror(records)
+	if _, ok := ctx.Deadline(); ok {
+		go p.failOnDeadline(ctx, futures)
+	}
+	return futures
+}
+
+// releaseOnResolved releases the MaxInflightProduceBatches slot of the call
+// once all its futures are resolved.
+func (p *Producer) releaseOnResolved(futures []*Future, release func()) {
+	if p.inflight == nil {
+		return
+	}
+	go func() {
+		for _, f := range futures {
+			<-f.done
+		}
+		release()
+	}()
+}
+
+// resolveProduced resolves the future of a produced record, counting the
+// records which failed because their context deadline passed.
+func (p *Producer) resolveProduced(f *Future, result ProduceResult) {
+	if f.resolve(result) && errors.Is(result.Err, context.DeadlineExceeded) {
+		p.deadlineExceeded.Add(1)
+	}
+}
+
+// failOnDeadline resolves the futures still pending once the context
+// deadline passes. The client only fails the buffered records when their
+// context is done, not the ones waiting for the brokers to acknowledge them.
+func (p *Producer) failOnDeadline(ctx context.Context, futures []*Future) {
+	var failed int
+	for _, f := range futures {
+		select {
+		case <-f.done:
+			continue
+		case <-ctx.Done():
+		}
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return
+		}
+		if f.resolve(ProduceResult{Err: ctx.Err()}) {
+			p.deadlineExceeded.Add(1)
+			failed++
+		}
+	}
+	if failed > 0 {
+		p.cfg.Logger.Warn("produce context deadline exceeded before the records were acknowledged",
+			zap.Int("records", failed),
+		)
+	}
+}
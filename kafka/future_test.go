@@ -0,0 +1,160 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestProducerProcessBatchAsync(t *testing.T) {
+	topic := "process-batch-async"
+	cluster := newFakeCluster(t, 2, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:         cluster.ListenAddrs(),
+		Topic:           topic,
+		Logger:          zaptest.NewLogger(t),
+		MaxProduceDelay: time.Hour,
+		KeyRouter: func(event model.APMEvent) []byte {
+			return []byte(event.Trace.ID)
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	batch := model.Batch{
+		{Trace: model.Trace{ID: "a"}},
+		{Trace: model.Trace{ID: "b"}},
+		{Trace: model.Trace{ID: "expired"}, Timestamp: time.Now().Add(-2 * time.Hour)},
+		{Trace: model.Trace{ID: "a"}},
+	}
+	futures := producer.ProcessBatchAsync(ctx, &batch)
+	require.Len(t, futures, len(batch))
+
+	var results []ProduceResult
+	for _, f := range futures {
+		result, err := f.Wait(ctx)
+		require.NoError(t, err)
+		results = append(results, result)
+	}
+	assert.ErrorIs(t, results[2].Err, ErrEventExpired)
+	for _, i := range []int{0, 1, 3} {
+		require.NoError(t, results[i].Err)
+	}
+	// Events with the same key are produced to the same partition, in order.
+	assert.Equal(t, results[0].Partition, results[3].Partition)
+	assert.Greater(t, results[3].Offset, results[0].Offset)
+
+	records := consumeRecords(t, cluster, topic, 3)
+	produced := make(map[ProduceResult]string)
+	for _, r := range records {
+		produced[ProduceResult{Partition: r.Partition, Offset: r.Offset}] = string(r.Key)
+	}
+	for _, i := range []int{0, 1, 3} {
+		assert.Equal(t, batch[i].Trace.ID, produced[results[i]])
+	}
+}
+
+func TestProducerProcessBatchAsyncClosed(t *testing.T) {
+	topic := "process-batch-async-closed"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+	})
+	require.NoError(t, err)
+	require.NoError(t, producer.Close())
+
+	batch := model.Batch{{}}
+	futures := producer.ProcessBatchAsync(context.Background(), &batch)
+	require.Len(t, futures, 1)
+	<-futures[0].Done()
+	result, err := futures[0].Wait(context.Background())
+	require.NoError(t, err)
+	assert.EqualError(t, result.Err, "producer closed")
+}
+
+func TestProducerProcessBatchAsyncDeadline(t *testing.T) {
+	topic := "process-batch-async-deadline"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+	batch := model.Batch{{}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	// The broker stalls the produce requests past the deadline.
+	cluster.ControlKey(int16(kmsg.Produce), func(kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		time.Sleep(time.Second)
+		return nil, nil, false
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	batch = model.Batch{{}, {}}
+	futures := producer.ProcessBatchAsync(ctx, &batch)
+	require.Len(t, futures, 2)
+	for _, f := range futures {
+		result, err := f.Wait(context.Background())
+		require.NoError(t, err)
+		assert.ErrorIs(t, result.Err, context.DeadlineExceeded)
+	}
+	assert.Equal(t, int64(2), producer.Stats().DeadlineExceeded)
+}
+
+func TestProducerProcessBatchAsyncTopicFromMetadata(t *testing.T) {
+	topic := "default"
+	cluster := newFakeCluster(t, 1, topic, "tenant-a")
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:                 cluster.ListenAddrs(),
+		Topic:                   topic,
+		Logger:                  zaptest.NewLogger(t),
+		TopicFromMetadata:       "tenant",
+		TopicFromMetadataPrefix: "tenant-",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{
+		"tenant": "a",
+	})
+	batch := model.Batch{{Trace: model.Trace{ID: "a"}}}
+	for _, f := range producer.ProcessBatchAsync(ctx, &batch) {
+		result, err := f.Wait(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, result.Err)
+	}
+	records := consumeRecords(t, cluster, "tenant-a", 1)
+	require.Len(t, records, 1)
+}
@@ -0,0 +1,98 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/plugin/kzap"
+)
+
+// describeGroupTimeout bounds the time spent describing the consumer group
+// when the consumer is created with RequireExistingGroup.
+const describeGroupTimeout = 10 * time.Second
+
+var (
+	// ErrGroupNotAuthorized is returned when the consumer isn't authorized
+	// to join or create the consumer group.
+	ErrGroupNotAuthorized = errors.New("kafka: not authorized to join the consumer group")
+	// ErrGroupNotFound is returned by NewConsumer when RequireExistingGroup
+	// is set and the consumer group doesn't exist.
+	ErrGroupNotFound = errors.New("kafka: consumer group not found")
+)
+
+// newAdminClient returns a client which doesn't join the consumer group, for
+// the administrative requests issued when the consumer is created.
+func newAdminClient(cfg ConsumerConfig) (*kgo.Client, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.WithLogger(kzap.New(cfg.Logger)),
+	}
+	if len(cfg.SASL) > 0 {
+		opts = append(opts, kgo.SASL(cfg.SASL...))
+	}
+	if opt := dialOpt(cfg.TLS, cfg.ConnReconnectBackoff); opt != nil {
+		opts = append(opts, opt)
+	}
+	if cfg.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.ClientID))
+	}
+	return kgo.NewClient(opts...)
+}
+
+// checkGroupExists returns ErrGroupNotFound when the consumer group doesn't
+// exist, so it isn't created by joining it.
+func checkGroupExists(cfg ConsumerConfig) error {
+	client, err := newAdminClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), describeGroupTimeout)
+	defer cancel()
+	groups, err := kadm.NewClient(client).DescribeGroups(ctx, cfg.GroupID)
+	if err != nil {
+		return fmt.Errorf("kafka: failed to describe group: %w", err)
+	}
+	group := groups[cfg.GroupID]
+	switch {
+	case errors.Is(group.Err, kerr.GroupAuthorizationFailed):
+		return groupError(cfg.GroupID, group.Err)
+	case errors.Is(group.Err, kerr.GroupIDNotFound), group.State == "Dead":
+		return fmt.Errorf("%w: %s", ErrGroupNotFound, cfg.GroupID)
+	case group.Err != nil:
+		return fmt.Errorf("kafka: failed to describe group: %w", group.Err)
+	}
+	return nil
+}
+
+// groupError wraps the errors joining the consumer group with
+// ErrGroupNotAuthorized when the group authorization failed. Other errors
+// are returned as is.
+func groupError(groupID string, err error) error {
+	if errors.Is(err, kerr.GroupAuthorizationFailed) {
+		return fmt.Errorf("%w %s: %w", ErrGroupNotAuthorized, groupID, err)
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestConsumerGroupNotAuthorized(t *testing.T) {
+	topic := "group-not-authorized"
+	cluster := newFakeCluster(t, 1, topic)
+	// Reject the group creation, as locked-down clusters do.
+	cluster.ControlKey(int16(kmsg.JoinGroup), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		resp := kreq.(*kmsg.JoinGroupRequest).ResponseKind().(*kmsg.JoinGroupResponse)
+		resp.ErrorCode = kerr.GroupAuthorizationFailed.Code
+		return resp, nil, true
+	})
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: []byte(`{}`)})
+
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "locked",
+		Logger:  zaptest.NewLogger(t),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			t.Error("no records should be processed")
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = consumer.Run(ctx)
+	assert.ErrorIs(t, err, ErrGroupNotAuthorized)
+	assert.ErrorIs(t, err, kerr.GroupAuthorizationFailed)
+	assert.ErrorContains(t, err, "locked")
+}
+
+func TestConsumerRequireExistingGroup(t *testing.T) {
+	topic := "require-existing-group"
+	cluster := newFakeCluster(t, 1, topic)
+	cfg := ConsumerConfig{
+		Brokers:              cluster.ListenAddrs(),
+		Topics:               []string{topic},
+		GroupID:              "group",
+		Logger:               zaptest.NewLogger(t),
+		RequireExistingGroup: true,
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			return nil
+		}),
+	}
+	_, err := NewConsumer(cfg)
+	assert.ErrorIs(t, err, ErrGroupNotFound)
+
+	// Create the group by joining it.
+	cfg.RequireExistingGroup = false
+	consumer, err := NewConsumer(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: []byte(`{}`)})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go consumer.Run(ctx)
+	assert.Eventually(t, func() bool {
+		members, err := consumer.ListGroupMembers(ctx)
+		return err == nil && len(members) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cfg.RequireExistingGroup = true
+	existing, err := NewConsumer(cfg)
+	require.NoError(t, err)
+	require.NoError(t, existing.Close())
+}
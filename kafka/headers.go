@@ -0,0 +1,108 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+const (
+	// HeaderLimitTruncate drops the headers which exceed the limits, in the
+	// order they'd be set.
+	HeaderLimitTruncate HeaderLimitPolicy = iota
+	// HeaderLimitError fails the events whose headers exceed the limits
+	// with ErrHeaderLimit.
+	HeaderLimitError
+)
+
+// HeaderLimitPolicy defines what the producer does with the record headers
+// which exceed MaxHeaderCount or MaxHeaderBytes.
+type HeaderLimitPolicy uint8
+
+// ErrHeaderLimit is returned for the events whose headers exceed the
+// configured limits, when the HeaderLimitPolicy is HeaderLimitError.
+var ErrHeaderLimit = errors.New("kafka: record headers exceed the limits")
+
+// sortedHeaders returns the headers of the map, sorted by key.
+func sortedHeaders(m map[string]string) []kgo.RecordHeader {
+	headers := make([]kgo.RecordHeader, 0, len(m))
+	for k, v := range m {
+		headers = append(headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].Key < headers[j].Key
+	})
+	return headers
+}
+
+// mergeHeaders returns the defaults whose keys aren't set by the headers,
+// followed by the headers.
+func mergeHeaders(defaults, headers []kgo.RecordHeader) []kgo.RecordHeader {
+	if len(defaults) == 0 {
+		return headers
+	}
+	merged := make([]kgo.RecordHeader, 0, len(defaults)+len(headers))
+	for _, d := range defaults {
+		var set bool
+		for _, h := range headers {
+			if h.Key == d.Key {
+				set = true
+				break
+			}
+		}
+		if !set {
+			merged = append(merged, d)
+		}
+	}
+	return append(merged, headers...)
+}
+
+// headerSize returns the size in bytes of the record header.
+func headerSize(h kgo.RecordHeader) int {
+	return len(h.Key) + len(h.Value)
+}
+
+// limitHeaders applies the header limits of the config to the headers. When
+// truncating, the headers are dropped from the first one which exceeds the
+// limits.
+func limitHeaders(cfg ProducerConfig, headers []kgo.RecordHeader) ([]kgo.RecordHeader, error) {
+	if cfg.MaxHeaderCount == 0 && cfg.MaxHeaderBytes == 0 {
+		return headers, nil
+	}
+	var size int
+	for i, h := range headers {
+		size += headerSize(h)
+		overCount := cfg.MaxHeaderCount > 0 && i+1 > cfg.MaxHeaderCount
+		overBytes := cfg.MaxHeaderBytes > 0 && size > cfg.MaxHeaderBytes
+		if !overCount && !overBytes {
+			continue
+		}
+		if cfg.HeaderLimitPolicy == HeaderLimitError {
+			return nil, ErrHeaderLimit
+		}
+		cfg.Logger.Warn("dropping record headers exceeding the limits",
+			zap.String("header", h.Key), zap.Int("dropped", len(headers)-i),
+		)
+		return headers[:i], nil
+	}
+	return headers, nil
+}
@@ -0,0 +1,193 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// idlePartitions pauses the fetching of the assigned partitions which
+// haven't returned records for the timeout, and resumes them every probe
+// interval, and on every rebalance, so their new records are fetched.
+type idlePartitions struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	probe   time.Duration
+	// active holds the time the last records of each assigned partition
+	// were fetched, or it was assigned or resumed at. paused holds the time
+	// the paused partitions were paused at.
+	active map[string]map[int32]time.Time
+	paused map[string]map[int32]time.Time
+	clock  clock
+}
+
+func newIdlePartitions(timeout, probe time.Duration, clock clock) *idlePartitions {
+	if timeout <= 0 {
+		return nil
+	}
+	if probe <= 0 {
+		probe = timeout
+	}
+	return &idlePartitions{
+		timeout: timeout,
+		probe:   probe,
+		active:  make(map[string]map[int32]time.Time),
+		paused:  make(map[string]map[int32]time.Time),
+		clock:   clockOrDefault(clock),
+	}
+}
+
+// assigned resumes the paused partitions, since the group rebalanced, and
+// tracks the partitions assigned.
+func (p *idlePartitions) assigned(client *kgo.Client, assigned map[string][]int32) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.clock.Now()
+	p.resume(client, p.paused, now)
+	for topic, partitions := range assigned {
+		for _, partition := range partitions {
+			setPartitionTime(p.active, topic, partition, now)
+		}
+	}
+}
+
+// revoked stops tracking the partitions and resumes them, since the paused
+// partitions stay paused in the client.
+func (p *idlePartitions) revoked(client *kgo.Client, revoked map[string][]int32) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	client.ResumeFetchPartitions(revoked)
+	for topic, partitions := range revoked {
+		for _, partition := range partitions {
+			delete(p.active[topic], partition)
+			delete(p.paused[topic], partition)
+		}
+	}
+}
+
+// fetched marks the partitions with fetched records as active.
+func (p *idlePartitions) fetched(fetches kgo.Fetches) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.clock.Now()
+	fetches.EachPartition(func(fp kgo.FetchTopicPartition) {
+		if len(fp.Records) == 0 {
+			return
+		}
+		if _, ok := p.active[fp.Topic][fp.Partition]; ok {
+			p.active[fp.Topic][fp.Partition] = now
+		}
+	})
+}
+
+// check pauses the partitions idle for the timeout at now, and resumes the
+// ones paused for the probe interval, which are paused again unless they
+// return records within the timeout. It must be called between polls, since
+// pausing partitions restarts the fetches, which stalls a concurrent poll.
+func (p *idlePartitions) check(client *kgo.Client, now time.Time) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	probe := make(map[string]map[int32]time.Time)
+	for topic, partitions := range p.paused {
+		for partition, pausedAt := range partitions {
+			if now.Sub(pausedAt) >= p.probe {
+				setPartitionTime(probe, topic, partition, pausedAt)
+			}
+		}
+	}
+	p.resume(client, probe, now)
+	idle := make(map[string][]int32)
+	for topic, partitions := range p.active {
+		for partition, activeAt := range partitions {
+			if _, ok := p.paused[topic][partition]; ok || now.Sub(activeAt) < p.timeout {
+				continue
+			}
+			idle[topic] = append(idle[topic], partition)
+			setPartitionTime(p.paused, topic, partition, now)
+		}
+	}
+	if len(idle) > 0 {
+		client.PauseFetchPartitions(idle)
+	}
+}
+
+// next returns the time at which the next partition has to be paused or
+// probed.
+func (p *idlePartitions) next() (time.Time, bool) {
+	if p == nil {
+		return time.Time{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var next time.Time
+	earliest := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	for topic, partitions := range p.active {
+		for partition, activeAt := range partitions {
+			if pausedAt, ok := p.paused[topic][partition]; ok {
+				earliest(pausedAt.Add(p.probe))
+			} else {
+				earliest(activeAt.Add(p.timeout))
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// resume resumes the partitions, which are active from now.
+func (p *idlePartitions) resume(client *kgo.Client, resumed map[string]map[int32]time.Time, now time.Time) {
+	if len(resumed) == 0 {
+		return
+	}
+	partitions := make(map[string][]int32, len(resumed))
+	for topic, paused := range resumed {
+		for partition := range paused {
+			partitions[topic] = append(partitions[topic], partition)
+			delete(p.paused[topic], partition)
+			if _, ok := p.active[topic][partition]; ok {
+				p.active[topic][partition] = now
+			}
+		}
+	}
+	client.ResumeFetchPartitions(partitions)
+}
+
+func setPartitionTime(m map[string]map[int32]time.Time, topic string, partition int32, t time.Time) {
+	if m[topic] == nil {
+		m[topic] = make(map[int32]time.Time)
+	}
+	m[topic][partition] = t
+}
@@ -0,0 +1,148 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestConsumerIdlePartitionTimeout(t *testing.T) {
+	topic := "idle-partition"
+	cluster := newFakeCluster(t, 2, topic)
+	var fetchesMu sync.Mutex
+	fetches := make(map[int32]int)
+	cluster.ControlKey(int16(kmsg.Fetch), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		fetchesMu.Lock()
+		defer fetchesMu.Unlock()
+		for _, rt := range kreq.(*kmsg.FetchRequest).Topics {
+			for _, rp := range rt.Partitions {
+				fetches[rp.Partition]++
+			}
+		}
+		return nil, nil, false
+	})
+	fetched := func() map[int32]int {
+		fetchesMu.Lock()
+		defer fetchesMu.Unlock()
+		counts := make(map[int32]int, len(fetches))
+		for partition, n := range fetches {
+			counts[partition] = n
+		}
+		return counts
+	}
+
+	// Only partition 0 receives records.
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			client.ProduceSync(ctx, &kgo.Record{Topic: topic, Partition: 0, Value: []byte("{}")})
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	var processed atomic.Int64
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:                    cluster.ListenAddrs(),
+		Topics:                     []string{topic},
+		GroupID:                    "group",
+		Logger:                     zaptest.NewLogger(t),
+		IdlePartitionTimeout:       200 * time.Millisecond,
+		IdlePartitionProbeInterval: time.Minute,
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			processed.Add(1)
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		consumer.Run(ctx)
+	}()
+	t.Cleanup(func() { <-consumerDone })
+	defer consumer.Close()
+
+	// Wait until the idle partition is paused.
+	time.Sleep(time.Second)
+	before := fetched()
+	time.Sleep(time.Second)
+	after := fetched()
+	assert.Equal(t, map[string][]int32{topic: {1}}, consumer.client.PauseFetchPartitions(nil))
+	assert.Greater(t, after[0], before[0])
+	assert.Equal(t, before[1], after[1])
+	assert.NotZero(t, processed.Load())
+}
+
+func TestIdlePartitionsProbe(t *testing.T) {
+	client, err := kgo.NewClient(kgo.ConsumeTopics("topic"))
+	require.NoError(t, err)
+	defer client.Close()
+	paused := func() map[string][]int32 {
+		// Pausing no partitions returns the paused ones, in no particular
+		// order.
+		paused := client.PauseFetchPartitions(nil)
+		for _, partitions := range paused {
+			sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+		}
+		return paused
+	}
+	idle := newIdlePartitions(time.Second, 10*time.Second, nil)
+	idle.assigned(client, map[string][]int32{"topic": {0, 1}})
+	now := time.Now()
+	idle.active["topic"][0] = now.Add(2 * time.Second)
+
+	idle.check(client, now.Add(time.Second))
+	assert.Equal(t, map[string][]int32{"topic": {1}}, paused())
+
+	// The paused partition is resumed once the probe interval passes, and
+	// paused again if it stays idle for the timeout. Meanwhile, partition 0
+	// went idle.
+	idle.check(client, now.Add(11*time.Second))
+	assert.Equal(t, map[string][]int32{"topic": {0}}, paused())
+	idle.check(client, now.Add(12*time.Second))
+	assert.Equal(t, map[string][]int32{"topic": {0, 1}}, paused())
+
+	// Rebalances resume the paused partitions.
+	idle.assigned(client, map[string][]int32{"topic": {0, 1}})
+	assert.Empty(t, paused())
+}
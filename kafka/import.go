@@ -0,0 +1,173 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/plugin/kzap"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+// importBatchSize is the number of records ImportTopic produces at once.
+const importBatchSize = 1000
+
+// ImportConfig defines the configuration for ImportTopic.
+type ImportConfig struct {
+	// Brokers is the list of kafka brokers used to seed the Kafka client.
+	Brokers []string
+	// SASL mechanisms to authenticate with, in order of preference.
+	SASL []sasl.Mechanism
+	// TLS, when set, makes the client connect to the brokers over TLS.
+	TLS *TLS
+	// Logger to use for any errors.
+	Logger *zap.Logger
+	// Encoder encodes the events into record values, defaults to JSON. Only
+	// used by ExportFormatEvents.
+	Encoder Encoder
+	// Format of the read lines, defaults to ExportFormatEvents.
+	Format ExportFormat
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg ImportConfig) Validate() error {
+	var errs []error
+	if len(cfg.Brokers) == 0 {
+		errs = append(errs, errors.New("kafka: at least one broker must be set"))
+	}
+	if cfg.Logger == nil {
+		errs = append(errs, errors.New("kafka: logger must be set"))
+	}
+	if cfg.Format > ExportFormatRecords {
+		errs = append(errs, errors.New("kafka: unknown export format"))
+	}
+	if cfg.Format != ExportFormatEvents && cfg.Encoder != nil {
+		errs = append(errs, errors.New("kafka: encoder can only be set for the events format"))
+	}
+	return errors.Join(errs...)
+}
+
+// ImportTopic reads the newline delimited lines in the configured Format
+// from r, such as the ones written by ExportTopic, and produces them to the
+// topic. The keys and headers are only preserved by ExportFormatRecords. It
+// returns the number of records produced, once all of them are acknowledged
+// or producing any of them fails.
+func ImportTopic(ctx context.Context, topic string, r io.Reader, cfg ImportConfig) (int64, error) {
+	if err := cfg.Validate(); err != nil {
+		return 0, err
+	}
+	if topic == "" {
+		return 0, errors.New("kafka: topic must be set")
+	}
+	if cfg.Encoder == nil {
+		cfg.Encoder = json.JSON{}
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.WithLogger(kzap.New(cfg.Logger)),
+		kgo.DefaultProduceTopic(topic),
+	}
+	if len(cfg.SASL) > 0 {
+		opts = append(opts, kgo.SASL(cfg.SASL...))
+	}
+	if opt := dialOpt(cfg.TLS, ReconnectBackoff{}); opt != nil {
+		opts = append(opts, opt)
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	var imported int64
+	records := make([]*kgo.Record, 0, importBatchSize)
+	produce := func() error {
+		if err := client.ProduceSync(ctx, records...).FirstErr(); err != nil {
+			return fmt.Errorf("kafka: failed to produce imported records: %w", err)
+		}
+		imported += int64(len(records))
+		records = records[:0]
+		return nil
+	}
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, readErr := br.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return imported, fmt.Errorf("kafka: failed to read import: %w", readErr)
+		}
+		if b = bytes.TrimSuffix(b, []byte("\n")); len(b) > 0 {
+			record, err := importRecord(cfg, b)
+			if err != nil {
+				return imported, fmt.Errorf("kafka: invalid import line %d: %w", line, err)
+			}
+			if records = append(records, record); len(records) == importBatchSize {
+				if err := produce(); err != nil {
+					return imported, err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if len(records) > 0 {
+		if err := produce(); err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+// importRecord returns the record for the line.
+func importRecord(cfg ImportConfig, line []byte) (*kgo.Record, error) {
+	switch cfg.Format {
+	case ExportFormatRaw:
+		return &kgo.Record{Value: line}, nil
+	case ExportFormatRecords:
+		var exported exportedRecord
+		if err := stdjson.Unmarshal(line, &exported); err != nil {
+			return nil, err
+		}
+		record := &kgo.Record{Key: exported.Key, Value: exported.Value}
+		for _, h := range exported.Headers {
+			record.Headers = append(record.Headers, kgo.RecordHeader{Key: h.Key, Value: h.Value})
+		}
+		return record, nil
+	default:
+		var event model.APMEvent
+		if err := (json.JSON{}).Decode(line, &event); err != nil {
+			return nil, err
+		}
+		value, err := cfg.Encoder.Encode(event)
+		if err != nil {
+			return nil, err
+		}
+		return &kgo.Record{Value: value}, nil
+	}
+}
@@ -0,0 +1,108 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestImportTopicRoundTrip(t *testing.T) {
+	source, target := "import-source", "import-target"
+	cluster := newFakeCluster(t, 2, source, target)
+	var records []*kgo.Record
+	for i := 0; i < 10; i++ {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: fmt.Sprint(i)}})
+		require.NoError(t, err)
+		record := &kgo.Record{Topic: source, Value: event}
+		if i%2 == 0 {
+			record.Key = []byte(fmt.Sprintf("key-%d", i))
+			record.Headers = []kgo.RecordHeader{{Key: "project_id", Value: []byte("project")}}
+		}
+		records = append(records, record)
+	}
+	produceRecords(t, cluster, records...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var dump bytes.Buffer
+	require.NoError(t, ExportTopic(ctx, source, &dump, ExportConfig{
+		Brokers: cluster.ListenAddrs(),
+		Logger:  zaptest.NewLogger(t),
+		Format:  ExportFormatRecords,
+	}))
+	imported, err := ImportTopic(ctx, target, &dump, ImportConfig{
+		Brokers: cluster.ListenAddrs(),
+		Logger:  zaptest.NewLogger(t),
+		Format:  ExportFormatRecords,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), imported)
+
+	type record struct {
+		Key, Value string
+		Headers    []kgo.RecordHeader
+	}
+	recordsOf := func(topic string) []record {
+		var out []record
+		for _, r := range consumeRecords(t, cluster, topic, 10) {
+			out = append(out, record{Key: string(r.Key), Value: string(r.Value), Headers: r.Headers})
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Value < out[j].Value })
+		return out
+	}
+	assert.Equal(t, recordsOf(source), recordsOf(target))
+}
+
+func TestImportTopicEvents(t *testing.T) {
+	topic := "import-events"
+	cluster := newFakeCluster(t, 1, topic)
+	lines := `{"trace":{"id":"a"}}` + "\n\n" + `{"trace":{"id":"b"}}`
+	imported, err := ImportTopic(context.Background(), topic, bytes.NewBufferString(lines), ImportConfig{
+		Brokers: cluster.ListenAddrs(),
+		Logger:  zaptest.NewLogger(t),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), imported)
+
+	var ids []string
+	for _, r := range consumeRecords(t, cluster, topic, 2) {
+		var event model.APMEvent
+		require.NoError(t, json.Unmarshal(r.Value, &event))
+		ids = append(ids, event.Trace.ID)
+	}
+	assert.Equal(t, []string{"a", "b"}, ids)
+
+	_, err = ImportTopic(context.Background(), topic, bytes.NewBufferString("{"), ImportConfig{
+		Brokers: cluster.ListenAddrs(),
+		Logger:  zaptest.NewLogger(t),
+	})
+	assert.ErrorContains(t, err, "kafka: invalid import line 1")
+}
@@ -0,0 +1,127 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// ErrRecordDropped is the result of the events whose record was dropped by
+// a ProduceInterceptor in ProcessBatchAsync.
+var ErrRecordDropped = errors.New("kafka: record dropped by interceptor")
+
+// ProduceInterceptor observes and modifies the records before they're
+// produced, such as for auditing or redaction.
+type ProduceInterceptor interface {
+	// InterceptProduce is called with each record before it's produced,
+	// and may modify its Key, Value and Headers. Its Partition and Offset
+	// aren't known yet. Returning false drops the record, without calling
+	// the following interceptors.
+	InterceptProduce(ctx context.Context, record *RawRecord) bool
+}
+
+// ProduceInterceptorFunc is a function type that implements
+// ProduceInterceptor.
+type ProduceInterceptorFunc func(context.Context, *RawRecord) bool
+
+// InterceptProduce calls f(ctx, record).
+func (f ProduceInterceptorFunc) InterceptProduce(ctx context.Context, record *RawRecord) bool {
+	return f(ctx, record)
+}
+
+// ConsumeInterceptor observes and modifies the consumed records before
+// they're decoded and processed.
+type ConsumeInterceptor interface {
+	// InterceptConsume is called with each consumed record, and may modify
+	// its Key, Value and Headers. Returning false skips the record, which is
+	// committed without being processed, and without calling the following
+	// interceptors.
+	InterceptConsume(ctx context.Context, record *RawRecord) bool
+}
+
+// ConsumeInterceptorFunc is a function type that implements
+// ConsumeInterceptor.
+type ConsumeInterceptorFunc func(context.Context, *RawRecord) bool
+
+// InterceptConsume calls f(ctx, record).
+func (f ConsumeInterceptorFunc) InterceptConsume(ctx context.Context, record *RawRecord) bool {
+	return f(ctx, record)
+}
+
+// interceptProduce calls the ProduceInterceptors in order with the record,
+// returning false if it's dropped.
+func (p *Producer) interceptProduce(ctx context.Context, msg *kgo.Record) bool {
+	if len(p.cfg.ProduceInterceptors) == 0 {
+		return true
+	}
+	record := newRawRecord(msg)
+	for _, interceptor := range p.cfg.ProduceInterceptors {
+		if !interceptor.InterceptProduce(ctx, &record) {
+			return false
+		}
+	}
+	applyRawRecord(msg, record)
+	return true
+}
+
+// interceptConsume calls the ConsumeInterceptors in order with the record,
+// returning false if it's skipped.
+func (c *Consumer) interceptConsume(ctx context.Context, msg *kgo.Record) bool {
+	if len(c.cfg.ConsumeInterceptors) == 0 {
+		return true
+	}
+	record := newRawRecord(msg)
+	for _, interceptor := range c.cfg.ConsumeInterceptors {
+		if !interceptor.InterceptConsume(ctx, &record) {
+			return false
+		}
+	}
+	applyRawRecord(msg, record)
+	return true
+}
+
+// applyRawRecord sets the key, value and headers of the record to the ones
+// of the intercepted record. The headers which are kept preserve their order,
+// the added ones are appended sorted by key.
+func applyRawRecord(msg *kgo.Record, record RawRecord) {
+	msg.Key = record.Key
+	msg.Value = record.Value
+	headers := make([]kgo.RecordHeader, 0, len(record.Headers))
+	seen := make(map[string]bool, len(msg.Headers))
+	for _, h := range msg.Headers {
+		if value, ok := record.Headers[h.Key]; ok && !seen[h.Key] {
+			headers = append(headers, kgo.RecordHeader{Key: h.Key, Value: value})
+		}
+		seen[h.Key] = true
+	}
+	var added []string
+	for key := range record.Headers {
+		if !seen[key] {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	for _, key := range added {
+		headers = append(headers, kgo.RecordHeader{Key: key, Value: record.Headers[key]})
+	}
+	msg.Headers = headers
+}
@@ -0,0 +1,148 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// interceptorLog records the interceptor calls, in order.
+type interceptorLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *interceptorLog) add(call string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, call)
+}
+
+func TestProducerInterceptors(t *testing.T) {
+	topic := "produce-interceptors"
+	cluster := newFakeCluster(t, 1, topic)
+	var log interceptorLog
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+		KeyRouter: func(event model.APMEvent) []byte {
+			return []byte(event.Trace.ID)
+		},
+		ProduceInterceptors: []ProduceInterceptor{
+			ProduceInterceptorFunc(func(_ context.Context, r *RawRecord) bool {
+				log.add("audit " + string(r.Key))
+				if string(r.Key) == "secret" {
+					return false
+				}
+				r.Headers["audited"] = []byte("true")
+				return true
+			}),
+			ProduceInterceptorFunc(func(_ context.Context, r *RawRecord) bool {
+				log.add("redact " + string(r.Key))
+				delete(r.Headers, "project_id")
+				return true
+			}),
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	batch := model.Batch{
+		{Trace: model.Trace{ID: "a"}},
+		{Trace: model.Trace{ID: "secret"}},
+		{Trace: model.Trace{ID: "b"}},
+	}
+	ctx := queuecontext.WithProject(context.Background(), "project")
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	assert.Equal(t, []string{"audit a", "redact a", "audit secret", "audit b", "redact b"}, log.calls)
+
+	records := consumeRecords(t, cluster, topic, 2)
+	require.Len(t, records, 2)
+	for i, key := range []string{"a", "b"} {
+		assert.Equal(t, key, string(records[i].Key))
+		assert.Equal(t, []kgo.RecordHeader{{Key: "audited", Value: []byte("true")}}, records[i].Headers)
+	}
+
+	// The dropped records fail with ErrRecordDropped.
+	results := producer.ProcessBatchAsync(ctx, &model.Batch{{Trace: model.Trace{ID: "secret"}}})
+	require.Len(t, results, 1)
+	result, err := results[0].Wait(context.Background())
+	require.NoError(t, err)
+	assert.ErrorIs(t, result.Err, ErrRecordDropped)
+}
+
+func TestConsumerInterceptors(t *testing.T) {
+	topic := "consume-interceptors"
+	cluster := newFakeCluster(t, 1, topic)
+	produceRecords(t, cluster,
+		&kgo.Record{Topic: topic, Key: []byte("a"), Value: []byte("{}")},
+		&kgo.Record{Topic: topic, Key: []byte("skip"), Value: []byte("{}")},
+		&kgo.Record{Topic: topic, Key: []byte("b"), Value: []byte("{}")},
+	)
+
+	var log interceptorLog
+	var processed []RawRecord
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		ConsumeInterceptors: []ConsumeInterceptor{
+			ConsumeInterceptorFunc(func(_ context.Context, r *RawRecord) bool {
+				log.add("first " + string(r.Key))
+				r.Headers["intercepted"] = []byte("first")
+				return string(r.Key) != "skip"
+			}),
+			ConsumeInterceptorFunc(func(_ context.Context, r *RawRecord) bool {
+				log.add("second " + string(r.Key))
+				r.Headers["intercepted"] = append(r.Headers["intercepted"], ",second"...)
+				return true
+			}),
+		},
+		StreamProcessor: StreamProcessorFunc(func(_ context.Context, r RawRecord) error {
+			processed = append(processed, r)
+			if len(processed) == 2 {
+				cancel()
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+	require.NoError(t, consumer.Close())
+
+	assert.Equal(t, []string{"first a", "second a", "first skip", "first b", "second b"}, log.calls)
+	require.Len(t, processed, 2)
+	for i, key := range []string{"a", "b"} {
+		assert.Equal(t, key, string(processed[i].Key))
+		assert.Equal(t, map[string][]byte{"intercepted": []byte("first,second")}, processed[i].Headers)
+	}
+}
@@ -0,0 +1,110 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// KeyEncoder encodes typed key values into record keys. Services that share
+// the same KeyEncoder produce identical keys for the same values, so their
+// records are co-partitioned.
+type KeyEncoder interface {
+	EncodeKey(v any) ([]byte, error)
+}
+
+// KeyEncoderFunc is a function that implements KeyEncoder.
+type KeyEncoderFunc func(v any) ([]byte, error)
+
+// EncodeKey calls f(v).
+func (f KeyEncoderFunc) EncodeKey(v any) ([]byte, error) {
+	return f(v)
+}
+
+var (
+	// Int64KeyEncoder encodes signed and unsigned integer keys as 8 byte
+	// big-endian integers.
+	Int64KeyEncoder KeyEncoder = KeyEncoderFunc(encodeInt64Key)
+	// UUIDKeyEncoder encodes UUID keys, either [16]byte or strings in the
+	// canonical or hex form, as their 16 bytes.
+	UUIDKeyEncoder KeyEncoder = KeyEncoderFunc(encodeUUIDKey)
+	// StringKeyEncoder encodes string keys as their bytes.
+	StringKeyEncoder KeyEncoder = KeyEncoderFunc(encodeStringKey)
+)
+
+func encodeInt64Key(v any) ([]byte, error) {
+	var n uint64
+	switch v := v.(type) {
+	case int:
+		n = uint64(v)
+	case int8:
+		n = uint64(v)
+	case int16:
+		n = uint64(v)
+	case int32:
+		n = uint64(v)
+	case int64:
+		n = uint64(v)
+	case uint:
+		n = uint64(v)
+	case uint8:
+		n = uint64(v)
+	case uint16:
+		n = uint64(v)
+	case uint32:
+		n = uint64(v)
+	case uint64:
+		n = v
+	default:
+		return nil, fmt.Errorf("kafka: cannot encode %T as an int64 key", v)
+	}
+	return binary.BigEndian.AppendUint64(make([]byte, 0, 8), n), nil
+}
+
+func encodeUUIDKey(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case [16]byte:
+		return v[:], nil
+	case string:
+		s := v
+		if len(s) == 36 {
+			s = strings.ReplaceAll(s, "-", "")
+		}
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != 16 {
+			return nil, fmt.Errorf("kafka: invalid uuid key %q", v)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("kafka: cannot encode %T as a uuid key", v)
+	}
+}
+
+func encodeStringKey(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("kafka: cannot encode %T as a string key", v)
+	}
+}
@@ -0,0 +1,107 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sort"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// processGrouped processes the events decoded from the records with the
+// Processor in a single batch, grouped by the record keys, adding all the
+// records to the pending ones. The groups are ordered by key and the events
+// of each group keep the records order. The records which were skipped or
+// failed to decode aren't processed.
+func (c *Consumer) processGrouped(ctx context.Context, records []*kgo.Record, decoded []decodedRecord) {
+	defer func() {
+		for _, msg := range records {
+			c.buffered.processed(msg)
+		}
+	}()
+	type keyGroup struct {
+		key    string
+		topics []string
+		events model.Batch
+	}
+	var groups []*keyGroup
+	index := make(map[string]*keyGroup)
+	// delivered holds the records whose events are processed.
+	delivered := make([]*kgo.Record, 0, len(records))
+	for i, msg := range records {
+		c.pending = append(c.pending, msg)
+		if c.cfg.MaxRecords > 0 {
+			c.consumed++
+		}
+		if decoded[i].skipped {
+			continue
+		}
+		if err := decoded[i].err; err != nil {
+			c.cfg.Logger.Error("unable to decode the record into model.APMEvent",
+				zap.Error(err),
+				zap.String("topic", msg.Topic),
+				zap.ByteString("message.value", msg.Value),
+				zap.Int64("offset", msg.Offset),
+				zap.Int32("partition", int32(msg.Partition)),
+			)
+			c.metrics.recordOutcome(ctx, msg.Topic, true)
+			continue
+		}
+		delivered = append(delivered, msg)
+		group, ok := index[string(msg.Key)]
+		if !ok {
+			group = &keyGroup{key: string(msg.Key)}
+			index[group.key] = group
+			groups = append(groups, group)
+		}
+		for _, event := range decoded[i].events {
+			group.topics = append(group.topics, msg.Topic)
+			group.events = append(group.events, event)
+		}
+	}
+	if len(groups) == 0 {
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].key < groups[j].key })
+	var batch model.Batch
+	var topics []string
+	for _, group := range groups {
+		batch = append(batch, group.events...)
+		topics = append(topics, group.topics...)
+	}
+	events := batch[:len(batch):len(batch)]
+	err := c.cfg.Processor.ProcessBatch(ctx, &batch)
+	if err != nil {
+		c.cfg.Logger.Error("unable to process events",
+			zap.Error(err),
+			zap.Int("events", len(events)),
+		)
+	}
+	// The measurements recorded with a done ctx are dropped, such as when
+	// the processor cancels it.
+	for _, msg := range delivered {
+		c.metrics.recordOutcome(context.Background(), msg.Topic, err != nil)
+	}
+	for i, event := range events {
+		c.metrics.recordDelay(context.Background(), topics[i], event.Timestamp)
+	}
+}
@@ -0,0 +1,73 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestConsumerGroupByKey(t *testing.T) {
+	topic := "group-by-key"
+	cluster := newFakeCluster(t, 1, topic)
+	var records []*kgo.Record
+	for i, key := range []string{"c", "a", "b", "a", "c", "b", "a"} {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: fmt.Sprintf("%s-%d", key, i)}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{Topic: topic, Key: []byte(key), Value: event})
+	}
+	produceRecords(t, cluster, records...)
+
+	var batches [][]string
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:    cluster.ListenAddrs(),
+		Topics:     []string{topic},
+		GroupID:    "group",
+		Logger:     zaptest.NewLogger(t),
+		MaxRecords: len(records),
+		GroupByKey: true,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			var ids []string
+			for _, event := range *b {
+				ids = append(ids, event.Trace.ID)
+			}
+			batches = append(batches, ids)
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	require.NoError(t, consumer.Run(ctx))
+	require.NoError(t, consumer.Close())
+
+	// The records were produced before running the consumer, so they're
+	// all processed in a single batch. The events are grouped by key,
+	// keeping the records order.
+	require.Len(t, batches, 1)
+	assert.Equal(t, []string{"a-1", "a-3", "a-6", "b-2", "b-5", "c-0", "c-4"}, batches[0])
+}
@@ -0,0 +1,197 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestKeyEncoders(t *testing.T) {
+	uuid := [16]byte{
+		0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3,
+		0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00,
+	}
+	for name, tc := range map[string]struct {
+		encoder  KeyEncoder
+		value    any
+		expected []byte
+		err      string
+	}{
+		"int64": {
+			encoder:  Int64KeyEncoder,
+			value:    int64(258),
+			expected: []byte{0, 0, 0, 0, 0, 0, 1, 2},
+		},
+		"int": {
+			encoder:  Int64KeyEncoder,
+			value:    258,
+			expected: []byte{0, 0, 0, 0, 0, 0, 1, 2},
+		},
+		"negative_int": {
+			encoder:  Int64KeyEncoder,
+			value:    int32(-1),
+			expected: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		},
+		"int64_invalid": {
+			encoder: Int64KeyEncoder,
+			value:   "1",
+			err:     "kafka: cannot encode string as an int64 key",
+		},
+		"uuid_bytes": {
+			encoder:  UUIDKeyEncoder,
+			value:    uuid,
+			expected: uuid[:],
+		},
+		"uuid_canonical": {
+			encoder:  UUIDKeyEncoder,
+			value:    "123e4567-e89b-12d3-a456-426614174000",
+			expected: uuid[:],
+		},
+		"uuid_hex": {
+			encoder:  UUIDKeyEncoder,
+			value:    "123e4567e89b12d3a456426614174000",
+			expected: uuid[:],
+		},
+		"uuid_invalid": {
+			encoder: UUIDKeyEncoder,
+			value:   "123e4567",
+			err:     `kafka: invalid uuid key "123e4567"`,
+		},
+		"string": {
+			encoder:  StringKeyEncoder,
+			value:    "key",
+			expected: []byte("key"),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			key, err := tc.encoder.EncodeKey(tc.value)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, key)
+		})
+	}
+}
+
+func TestProducerKeyEncoder(t *testing.T) {
+	const partitions = 10
+	topic := "key-encoder"
+	cluster := newFakeCluster(t, partitions, topic)
+	// Two services keying their events by the same typed value, read from
+	// different event fields.
+	newProducer := func(value func(model.APMEvent) any) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers:       cluster.ListenAddrs(),
+			Topic:         topic,
+			Logger:        zaptest.NewLogger(t),
+			PartitionHash: PartitionHashMurmur2Java,
+			KeyValue:      value,
+			KeyEncoder:    Int64KeyEncoder,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { producer.Close() })
+		return producer
+	}
+	serviceA := newProducer(func(event model.APMEvent) any {
+		return event.Process.Pid
+	})
+	serviceB := newProducer(func(event model.APMEvent) any {
+		return int64(event.Process.Pid)
+	})
+
+	ctx := context.Background()
+	var batch model.Batch
+	for pid := 1; pid <= 5; pid++ {
+		batch = append(batch, model.APMEvent{Process: model.Process{Pid: pid}})
+	}
+	require.NoError(t, serviceA.ProcessBatch(ctx, &batch))
+	require.NoError(t, serviceB.ProcessBatch(ctx, &batch))
+
+	keys := make(map[string][]int32)
+	for _, record := range consumeRecords(t, cluster, topic, 2*len(batch)) {
+		keys[string(record.Key)] = append(keys[string(record.Key)], record.Partition)
+	}
+	require.Len(t, keys, len(batch))
+	for key, partitions := range keys {
+		assert.Len(t, key, 8)
+		require.Len(t, partitions, 2)
+		assert.Equal(t, partitions[0], partitions[1], "key %x", key)
+	}
+}
+
+func TestProducerKeyFromMetadata(t *testing.T) {
+	const partitions = 10
+	topic := "key-from-metadata"
+	cluster := newFakeCluster(t, partitions, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:         cluster.ListenAddrs(),
+		Topic:           topic,
+		Logger:          zaptest.NewLogger(t),
+		KeyFromMetadata: "tenant",
+		KeyRouter: func(event model.APMEvent) []byte {
+			return []byte(event.Trace.ID)
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	tenants := []string{"tenant-a", "tenant-b", "tenant-c"}
+	var produced int
+	for i := 0; i < 3; i++ {
+		for _, tenant := range tenants {
+			ctx := queuecontext.WithMetadata(context.Background(), map[string]string{
+				"tenant": tenant,
+			})
+			batch := model.Batch{
+				{Trace: model.Trace{ID: fmt.Sprint(i, "a")}},
+				{Trace: model.Trace{ID: fmt.Sprint(i, "b")}},
+			}
+			require.NoError(t, producer.ProcessBatch(ctx, &batch))
+			produced += len(batch)
+		}
+	}
+	// Without the metadata entry, the KeyRouter key is used.
+	batch := model.Batch{{Trace: model.Trace{ID: "trace"}}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	produced++
+
+	keys := make(map[string][]int32)
+	for _, record := range consumeRecords(t, cluster, topic, produced) {
+		keys[string(record.Key)] = append(keys[string(record.Key)], record.Partition)
+	}
+	assert.Len(t, keys["trace"], 1)
+	for _, tenant := range tenants {
+		partitions := keys[tenant]
+		require.Len(t, partitions, 6, tenant)
+		for _, partition := range partitions {
+			assert.Equal(t, partitions[0], partition, tenant)
+		}
+	}
+	assert.Len(t, keys, len(tenants)+1)
+}
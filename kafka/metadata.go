@@ -0,0 +1,96 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// refreshMetadataInterval is the interval at which refreshMetadata checks
+// whether the client loaded the refreshed metadata.
+const refreshMetadataInterval = 100 * time.Millisecond
+
+// RefreshMetadata refreshes the metadata of the producer clients right away,
+// instead of waiting for MetadataMaxAge, so changes such as new partitions
+// are picked up. It blocks until the clients, including the ones of the
+// compression overrides, loaded the partitions returned by the brokers for
+// the topics they produce to, or the context is done.
+func (p *Producer) RefreshMetadata(ctx context.Context) error {
+	for _, client := range p.clients() {
+		if err := refreshMetadata(ctx, client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RefreshMetadata refreshes the metadata of the consumer client right away,
+// instead of waiting for MetadataMaxAge, so changes such as new partitions
+// are picked up. It blocks until the client loaded the partitions returned
+// by the brokers for the topics it consumes, or the context is done.
+func (c *Consumer) RefreshMetadata(ctx context.Context) error {
+	return refreshMetadata(ctx, c.client)
+}
+
+func refreshMetadata(ctx context.Context, client *kgo.Client) error {
+	metadata, err := kadm.NewClient(client).Metadata(ctx)
+	if err != nil {
+		return fmt.Errorf("kafka: failed to refresh metadata: %w", err)
+	}
+	ticker := time.NewTicker(refreshMetadataInterval)
+	defer ticker.Stop()
+	for {
+		client.ForceMetadataRefresh()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if metadataLoaded(client, metadata.Topics) {
+			return nil
+		}
+	}
+}
+
+// metadataLoaded returns whether the client loaded all the partitions of the
+// topics it produces to or consumes from. The topics the client doesn't
+// use are ignored.
+func metadataLoaded(client *kgo.Client, topics kadm.TopicDetails) bool {
+	for topic, detail := range topics {
+		if detail.Err != nil {
+			continue
+		}
+		if leader, _, _ := client.PartitionLeader(topic, 0); leader < 0 {
+			continue // Not used by the client.
+		}
+		for partition, p := range detail.Partitions {
+			if p.Err != nil || p.Leader < 0 {
+				continue // Can't be loaded until it has a leader.
+			}
+			if leader, _, _ := client.PartitionLeader(topic, partition); leader < 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestRefreshMetadata(t *testing.T) {
+	topic := "refresh-metadata"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Producing loads the topic metadata of the producer client.
+	batch := model.Batch{{}}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = kadm.NewClient(client).CreatePartitions(ctx, 2, topic)
+	require.NoError(t, err)
+
+	for name, c := range map[string]interface {
+		RefreshMetadata(context.Context) error
+	}{
+		"producer": producer,
+		"consumer": consumer,
+	} {
+		require.NoError(t, c.RefreshMetadata(ctx), name)
+	}
+	for name, client := range map[string]*kgo.Client{
+		"producer": producer.client,
+		"consumer": consumer.client,
+	} {
+		for partition := int32(0); partition < 3; partition++ {
+			leader, _, err := client.PartitionLeader(topic, partition)
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, leader, int32(0), "%s partition %d", name, partition)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.18.0"
+)
+
+// instrumentName is the name of the OTel instrumentation scope.
+const instrumentName = "github.com/elastic/apm-queue/kafka"
+
+// consumerMetrics holds the consumer OTel instruments.
+type consumerMetrics struct {
+	// delay records the time elapsed between the event timestamp and the
+	// event being processed.
+	delay metric.Float64Histogram
+	// rebalances counts the consumer group rebalances, by trigger.
+	rebalances metric.Int64Counter
+	// rebalanceDuration records the time elapsed between the partitions
+	// being revoked or lost and the next assignment.
+	rebalanceDuration metric.Float64Histogram
+	// processed and errors count the records processed successfully and
+	// the records which failed to decode or process, by topic.
+	processed metric.Int64Counter
+	errors    metric.Int64Counter
+	// clock is the time the event delays are measured at.
+	clock clock
+}
+
+// newConsumerMetrics creates the consumer instruments. A nil mp uses the
+// global meter provider, and a nil clock the system clock.
+func newConsumerMetrics(mp metric.MeterProvider, clock clock) (consumerMetrics, error) {
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	meter := mp.Meter(instrumentName)
+	delay, err := meter.Float64Histogram("consumer.messages.delay",
+		metric.WithUnit("s"),
+		metric.WithDescription("The time elapsed between the event timestamp and its processing"),
+	)
+	if err != nil {
+		return consumerMetrics{}, err
+	}
+	rebalances, err := meter.Int64Counter("consumer.rebalances",
+		metric.WithDescription("The number of consumer group rebalances"),
+	)
+	if err != nil {
+		return consumerMetrics{}, err
+	}
+	rebalanceDuration, err := meter.Float64Histogram("consumer.rebalance.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("The time elapsed between the partitions being revoked and reassigned"),
+	)
+	if err != nil {
+		return consumerMetrics{}, err
+	}
+	processed, err := meter.Int64Counter("apmqueue.consumer.records.processed",
+		metric.WithDescription("The number of records processed successfully"),
+	)
+	if err != nil {
+		return consumerMetrics{}, err
+	}
+	failed, err := meter.Int64Counter("apmqueue.consumer.records.errors",
+		metric.WithDescription("The number of records which failed to decode or process"),
+	)
+	if err != nil {
+		return consumerMetrics{}, err
+	}
+	return consumerMetrics{
+		delay:             delay,
+		rebalances:        rebalances,
+		rebalanceDuration: rebalanceDuration,
+		processed:         processed,
+		errors:            failed,
+		clock:             clockOrDefault(clock),
+	}, nil
+}
+
+// recordOutcome counts a record of the topic as processed, or as an error
+// when failed is set.
+func (m consumerMetrics) recordOutcome(ctx context.Context, topic string, failed bool) {
+	attrs := metric.WithAttributes(semconv.MessagingDestinationName(topic))
+	if failed {
+		m.errors.Add(ctx, 1, attrs)
+		return
+	}
+	m.processed.Add(ctx, 1, attrs)
+}
+
+// recordRebalance counts a completed rebalance and records its duration,
+// unless it's the first assignment, which has none.
+func (m consumerMetrics) recordRebalance(ctx context.Context, trigger string, duration time.Duration) {
+	attrs := metric.WithAttributes(attribute.String("rebalance.trigger", trigger))
+	m.rebalances.Add(ctx, 1, attrs)
+	if trigger != rebalanceJoin {
+		m.rebalanceDuration.Record(ctx, duration.Seconds(), attrs)
+	}
+}
+
+// recordDelay records the end-to-end latency of the event, from its
+// timestamp to now. Events without a timestamp aren't recorded.
+func (m consumerMetrics) recordDelay(ctx context.Context, topic string, timestamp time.Time) {
+	if timestamp.IsZero() {
+		return
+	}
+	m.delay.Record(ctx, m.clock.Now().Sub(timestamp).Seconds(), metric.WithAttributes(
+		semconv.MessagingDestinationName(topic),
+	))
+}
+
+// compressionCodecs holds the names of the kgo compression codecs, indexed by
+// their compression type.
+var compressionCodecs = [...]string{"none", "gzip", "snappy", "lz4", "zstd"}
+
+// producerMetrics holds the producer OTel instruments.
+type producerMetrics struct {
+	// compressionRatio records the ratio between the uncompressed and the
+	// compressed size of the produced record batches.
+	compressionRatio metric.Float64Histogram
+}
+
+// newProducerMetrics creates the producer instruments. A nil mp uses the
+// global meter provider.
+func newProducerMetrics(mp metric.MeterProvider) (producerMetrics, error) {
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	meter := mp.Meter(instrumentName)
+	ratio, err := meter.Float64Histogram("apmqueue.producer.compression.ratio",
+		metric.WithUnit("1"),
+		metric.WithDescription("The uncompressed to compressed size ratio of the produced record batches"),
+	)
+	if err != nil {
+		return producerMetrics{}, err
+	}
+	return producerMetrics{compressionRatio: ratio}, nil
+}
+
+// OnProduceBatchWritten implements kgo.HookProduceBatchWritten.
+func (m producerMetrics) OnProduceBatchWritten(_ kgo.BrokerMetadata, topic string, _ int32, batch kgo.ProduceBatchMetrics) {
+	if batch.CompressedBytes <= 0 {
+		return
+	}
+	codec := "unknown"
+	if int(batch.CompressionType) < len(compressionCodecs) {
+		codec = compressionCodecs[batch.CompressionType]
+	}
+	ratio := float64(batch.UncompressedBytes) / float64(batch.CompressedBytes)
+	m.compressionRatio.Record(context.Background(), ratio, metric.WithAttributes(
+		semconv.MessagingDestinationName(topic),
+		attribute.String("compression.codec", codec),
+	))
+}
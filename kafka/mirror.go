@@ -0,0 +1,86 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+// mirrorFlushTimeout bounds the time Close waits for the mirrored records to
+// be flushed.
+const mirrorFlushTimeout = 5 * time.Second
+
+// MirrorConfig configures the mirroring of a fraction of the produced
+// records to a secondary cluster, e.g. to test migrations with production
+// traffic.
+type MirrorConfig struct {
+	// Producer configures the producer for the secondary cluster. It can't
+	// have a Mirror itself.
+	Producer ProducerConfig
+	// SampleRate is the fraction of the records, greater than 0 and up to
+	// 1, which are mirrored.
+	SampleRate float64
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg MirrorConfig) Validate() error {
+	var errs []error
+	if cfg.SampleRate <= 0 || cfg.SampleRate > 1 {
+		errs = append(errs, errors.New("kafka: mirror sample rate must be greater than 0 and up to 1"))
+	}
+	if cfg.Producer.Mirror != nil {
+		errs = append(errs, errors.New("kafka: mirror producer cannot have a mirror"))
+	}
+	producer := cfg.Producer
+	producer.Mirror = nil
+	if err := producer.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// mirror copies the sampled records to the secondary producer, without ever
+// blocking or failing the primary produce. Nothing is mirrored with DryRun.
+func (p *Producer) mirror(records []*kgo.Record) {
+	if p.secondary == nil || p.cfg.DryRun {
+		return
+	}
+	for _, r := range records {
+		if p.cfg.Mirror.SampleRate < 1 && rand.Float64() >= p.cfg.Mirror.SampleRate {
+			continue
+		}
+		// The primary record is owned by the primary client.
+		mirrored := &kgo.Record{Key: r.Key, Value: r.Value, Headers: r.Headers}
+		// TryProduce fails the record rather than blocking when the
+		// secondary buffer is full.
+		p.secondary.client.TryProduce(context.Background(), mirrored, func(r *kgo.Record, err error) {
+			if err != nil {
+				p.mirrorErrors.Add(1)
+				p.cfg.Logger.Debug("failed mirroring record", zap.Error(err))
+				return
+			}
+			p.mirrored.Add(1)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestMirrorConfigValidate(t *testing.T) {
+	cfg := ProducerConfig{
+		Brokers: []string{"localhost:9092"},
+		Topic:   "topic",
+		Logger:  zap.NewNop(),
+	}
+	assert.EqualError(t, MirrorConfig{
+		Producer: ProducerConfig{Mirror: &MirrorConfig{}},
+	}.Validate(), "kafka: mirror sample rate must be greater than 0 and up to 1\n"+
+		"kafka: mirror producer cannot have a mirror\n"+
+		"kafka: at least one broker must be set\n"+
+		"kafka: topic must be set\n"+
+		"kafka: logger must be set",
+	)
+	assert.NoError(t, MirrorConfig{Producer: cfg, SampleRate: 1}.Validate())
+}
+
+func TestProducerMirror(t *testing.T) {
+	topic := "mirror"
+	primary := newFakeCluster(t, 1, topic)
+	secondary := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: primary.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+		Mirror: &MirrorConfig{
+			SampleRate: 1,
+			Producer: ProducerConfig{
+				Brokers: secondary.ListenAddrs(),
+				Topic:   topic,
+				Logger:  zaptest.NewLogger(t),
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	batch := model.Batch{{Trace: model.Trace{ID: "a"}}, {Trace: model.Trace{ID: "b"}}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Len(t, consumeRecords(t, primary, topic, 2), 2)
+	assert.Len(t, consumeRecords(t, secondary, topic, 2), 2)
+	assert.Eventually(t, func() bool {
+		return producer.Stats() == ProducerStats{Mirrored: 2}
+	}, time.Second, time.Millisecond)
+}
+
+func TestProducerMirrorUnavailable(t *testing.T) {
+	topic := "mirror-unavailable"
+	primary := newFakeCluster(t, 1, topic)
+	unavailable := newFakeCluster(t, 1, topic)
+	addrs := unavailable.ListenAddrs()
+	unavailable.Close()
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: primary.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+		Mirror: &MirrorConfig{
+			SampleRate: 1,
+			Producer: ProducerConfig{
+				Brokers:             addrs,
+				Topic:               topic,
+				Logger:              zaptest.NewLogger(t),
+				CompactedTopicCheck: CompactedTopicCheckDisabled,
+				RecordBufferTimeout: time.Second,
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	// The primary produce is unaffected by the mirror failures.
+	batch := model.Batch{{Trace: model.Trace{ID: "a"}}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Len(t, consumeRecords(t, primary, topic, 1), 1)
+	assert.Eventually(t, func() bool {
+		return producer.Stats() == ProducerStats{MirrorErrors: 1}
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,138 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// MultiClusterConsumerConfig defines the configuration for the Kafka
+// MultiClusterConsumer.
+type MultiClusterConsumerConfig struct {
+	// Consumers configures a consumer for each of the clusters to consume
+	// from. Their Processor is replaced by the shared Processor, and they
+	// can't set a ProcessorRouter, Processors, StreamProcessor or
+	// EnrichedProcessor.
+	Consumers []ConsumerConfig
+	// Processor that will be used to process the records of all the
+	// clusters. It's called concurrently by the underlying consumers.
+	Processor model.BatchProcessor
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg MultiClusterConsumerConfig) Validate() error {
+	var errs []error
+	if len(cfg.Consumers) == 0 {
+		errs = append(errs, errors.New("kafka: at least one consumer must be set"))
+	}
+	if cfg.Processor == nil {
+		errs = append(errs, errors.New("kafka: processor must be set"))
+	}
+	for i, consumer := range cfg.Consumers {
+		if consumer.ProcessorRouter != nil || len(consumer.Processors) > 0 ||
+			consumer.StreamProcessor != nil || consumer.EnrichedProcessor != nil {
+			errs = append(errs, fmt.Errorf("kafka: consumer %d: only the shared processor can be used", i))
+		}
+		consumer.Processor = cfg.Processor
+		consumer.ProcessorRouter, consumer.Processors = nil, nil
+		consumer.StreamProcessor, consumer.EnrichedProcessor = nil, nil
+		if err := consumer.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("kafka: consumer %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MultiClusterConsumer drains several Kafka clusters into a single
+// Processor, running a Consumer for each of them.
+type MultiClusterConsumer struct {
+	consumers []*Consumer
+}
+
+// NewMultiClusterConsumer creates a new instance of a MultiClusterConsumer.
+// The consumers already created are closed if any of them fails.
+func NewMultiClusterConsumer(cfg MultiClusterConsumerConfig) (*MultiClusterConsumer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	m := &MultiClusterConsumer{}
+	for i, consumerCfg := range cfg.Consumers {
+		consumerCfg.Processor = cfg.Processor
+		consumer, err := NewConsumer(consumerCfg)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("kafka: failed to create consumer %d: %w", i, err)
+		}
+		m.consumers = append(m.consumers, consumer)
+	}
+	return m, nil
+}
+
+// Run executes the consumers in a blocking manner. When one of them fails,
+// the rest are stopped and the error is returned. It returns nil once all
+// the consumers return nil, for example when their MaxRecords is set.
+func (m *MultiClusterConsumer) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, len(m.consumers))
+	for i, consumer := range m.consumers {
+		wg.Add(1)
+		go func(i int, consumer *Consumer) {
+			defer wg.Done()
+			if err := consumer.Run(ctx); err != nil {
+				errs[i] = err
+				cancel()
+			}
+		}(i, consumer)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// Close closes all the consumers, returning their joined errors.
+func (m *MultiClusterConsumer) Close() error {
+	var errs []error
+	for _, consumer := range m.consumers {
+		if err := consumer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Healthy returns an error if any of the consumers is unhealthy.
+func (m *MultiClusterConsumer) Healthy() error {
+	var errs []error
+	for i, consumer := range m.consumers {
+		if err := consumer.Healthy(); err != nil {
+			errs = append(errs, fmt.Errorf("kafka: consumer %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
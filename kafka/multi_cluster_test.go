@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestMultiClusterConsumerConfigValidate(t *testing.T) {
+	var cfg MultiClusterConsumerConfig
+	assert.EqualError(t, cfg.Validate(), "kafka: at least one consumer must be set\n"+
+		"kafka: processor must be set",
+	)
+	cfg.Processor = model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil })
+	cfg.Consumers = []ConsumerConfig{{
+		Brokers: []string{"localhost:9092"},
+		Topics:  []string{"topic"},
+		Logger:  zaptest.NewLogger(t),
+	}}
+	assert.EqualError(t, cfg.Validate(), "kafka: consumer 0: kafka: consumer GroupID must be set")
+	cfg.Consumers[0].GroupID = "group"
+	assert.NoError(t, cfg.Validate())
+
+	// The consumers can only use the shared processor.
+	for name, modify := range map[string]func(*ConsumerConfig){
+		"processor_router": func(cfg *ConsumerConfig) {
+			cfg.ProcessorRouter = func(map[string][]byte) (string, model.BatchProcessor) { return "", nil }
+		},
+		"processors": func(cfg *ConsumerConfig) {
+			cfg.Processors = map[string]model.BatchProcessor{"topic": cfg.Processor}
+		},
+		"stream_processor": func(cfg *ConsumerConfig) {
+			cfg.StreamProcessor = StreamProcessorFunc(func(context.Context, RawRecord) error { return nil })
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			consumer := cfg.Consumers[0]
+			modify(&consumer)
+			cfg := cfg
+			cfg.Consumers = []ConsumerConfig{consumer}
+			assert.EqualError(t, cfg.Validate(), "kafka: consumer 0: only the shared processor can be used")
+		})
+	}
+}
+
+func TestMultiClusterConsumer(t *testing.T) {
+	topic := "multi-cluster"
+	clusters := map[string][]string{
+		"a": {"a-1", "a-2"},
+		"b": {"b-1"},
+	}
+	var cfg MultiClusterConsumerConfig
+	for name, ids := range clusters {
+		cluster := newFakeCluster(t, 1, topic)
+		for _, id := range ids {
+			event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: id}})
+			require.NoError(t, err)
+			produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+		}
+		cfg.Consumers = append(cfg.Consumers, ConsumerConfig{
+			Brokers:    cluster.ListenAddrs(),
+			Topics:     []string{topic},
+			GroupID:    "group-" + name,
+			Logger:     zaptest.NewLogger(t),
+			MaxRecords: len(ids),
+		})
+	}
+	var mu sync.Mutex
+	var processed []string
+	cfg.Processor = model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, event := range *b {
+			processed = append(processed, event.Trace.ID)
+		}
+		return nil
+	})
+	consumer, err := NewMultiClusterConsumer(cfg)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, consumer.Run(ctx))
+	assert.NoError(t, consumer.Healthy())
+	assert.NoError(t, consumer.Close())
+	assert.ElementsMatch(t, []string{"a-1", "a-2", "b-1"}, processed)
+}
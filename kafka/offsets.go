@@ -0,0 +1,156 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/plugin/kzap"
+	"go.uber.org/zap"
+)
+
+const (
+	// OffsetEarliest resets a partition to its earliest available offset.
+	OffsetEarliest OffsetSpec = -2
+	// OffsetLatest resets a partition to its end offset.
+	OffsetLatest OffsetSpec = -1
+)
+
+// OffsetSpec specifies the offset a group partition is reset to. Any value
+// other than OffsetEarliest and OffsetLatest is used as the exact offset.
+type OffsetSpec int64
+
+// ResetOffsetsConfig holds the configuration used to reset the committed
+// offsets of a consumer group.
+type ResetOffsetsConfig struct {
+	// Brokers is the list of kafka brokers used to seed the Kafka client.
+	Brokers []string
+	// GroupID whose offsets are reset.
+	GroupID string
+	// ClientID to use when connecting to Kafka. This is used for logging
+	// and client identification purposes.
+	ClientID string
+	// SASL mechanisms to authenticate with, in order of preference.
+	SASL []sasl.Mechanism
+	// TLS, when set, makes the client connect to the brokers over TLS.
+	TLS *TLS
+	// Logger to use for any errors.
+	Logger *zap.Logger
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg ResetOffsetsConfig) Validate() error {
+	var errs []error
+	if len(cfg.Brokers) == 0 {
+		errs = append(errs, errors.New("kafka: at least one broker must be set"))
+	}
+	if cfg.GroupID == "" {
+		errs = append(errs, errors.New("kafka: consumer GroupID must be set"))
+	}
+	if cfg.Logger == nil {
+		errs = append(errs, errors.New("kafka: logger must be set"))
+	}
+	return errors.Join(errs...)
+}
+
+// ResetOffsets commits the offsets of the topic partitions for the consumer
+// group, keyed by topic and partition. The group must be empty; an error is
+// returned if it has any active members.
+func ResetOffsets(ctx context.Context, cfg ResetOffsetsConfig, offsets map[string]map[int32]OffsetSpec) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.WithLogger(kzap.New(cfg.Logger)),
+	}
+	if len(cfg.SASL) > 0 {
+		opts = append(opts, kgo.SASL(cfg.SASL...))
+	}
+	if opt := dialOpt(cfg.TLS, ReconnectBackoff{}); opt != nil {
+		opts = append(opts, opt)
+	}
+	if cfg.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.ClientID))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	admin := kadm.NewClient(client)
+
+	groups, err := admin.DescribeGroups(ctx, cfg.GroupID)
+	if err != nil {
+		return fmt.Errorf("kafka: failed to describe group: %w", err)
+	}
+	if group, ok := groups[cfg.GroupID]; ok && len(group.Members) > 0 {
+		return fmt.Errorf("kafka: cannot reset offsets of group %s with %d active members",
+			cfg.GroupID, len(group.Members),
+		)
+	}
+
+	var topics []string
+	for topic := range offsets {
+		topics = append(topics, topic)
+	}
+	start, err := admin.ListStartOffsets(ctx, topics...)
+	if err != nil {
+		return fmt.Errorf("kafka: failed to list start offsets: %w", err)
+	}
+	end, err := admin.ListEndOffsets(ctx, topics...)
+	if err != nil {
+		return fmt.Errorf("kafka: failed to list end offsets: %w", err)
+	}
+	var commit kadm.Offsets
+	for topic, partitions := range offsets {
+		for partition, spec := range partitions {
+			var listed kadm.ListedOffsets
+			switch spec {
+			case OffsetEarliest:
+				listed = start
+			case OffsetLatest:
+				listed = end
+			default:
+				commit.AddOffset(topic, partition, int64(spec), -1)
+				continue
+			}
+			o, ok := listed.Lookup(topic, partition)
+			if !ok {
+				return fmt.Errorf("kafka: partition %d not found in topic %s", partition, topic)
+			}
+			if o.Err != nil {
+				return fmt.Errorf("kafka: failed to list offsets: %w", o.Err)
+			}
+			commit.AddOffset(topic, partition, o.Offset, -1)
+		}
+	}
+	committed, err := admin.CommitOffsets(ctx, cfg.GroupID, commit)
+	if err != nil {
+		return fmt.Errorf("kafka: failed to commit offsets: %w", err)
+	}
+	if err := committed.Error(); err != nil {
+		return fmt.Errorf("kafka: failed to commit offsets: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestResetOffsetsConfigValidate(t *testing.T) {
+	assert.EqualError(t, ResetOffsetsConfig{}.Validate(),
+		"kafka: at least one broker must be set\n"+
+			"kafka: consumer GroupID must be set\n"+
+			"kafka: logger must be set",
+	)
+}
+
+func TestResetOffsets(t *testing.T) {
+	topic, group := "reset-offsets", "group"
+	cluster := newFakeCluster(t, 1, topic)
+	var records []*kgo.Record
+	for i := 0; i < 5; i++ {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{
+			ID: fmt.Sprint(i),
+		}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{Topic: topic, Value: event})
+	}
+	produceRecords(t, cluster, records...)
+
+	// consumeAll consumes all the records, returning the consumer which is
+	// still a group member.
+	consumeAll := func() *Consumer {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var processed atomic.Int64
+		consumer, err := NewConsumer(ConsumerConfig{
+			Brokers: cluster.ListenAddrs(),
+			Topics:  []string{topic},
+			GroupID: group,
+			Logger:  zaptest.NewLogger(t),
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				if processed.Add(1) == int64(len(records)) {
+					cancel()
+				}
+				return nil
+			}),
+		})
+		require.NoError(t, err)
+		assert.ErrorIs(t, consumer.Run(ctx), context.Canceled)
+		return consumer
+	}
+
+	emulateEmptyGroupCommits(t, cluster)
+	cfg := ResetOffsetsConfig{
+		Brokers: cluster.ListenAddrs(),
+		GroupID: group,
+		Logger:  zaptest.NewLogger(t),
+	}
+	earliest := map[string]map[int32]OffsetSpec{topic: {0: OffsetEarliest}}
+	ctx := context.Background()
+	consumer := consumeAll()
+	assert.EqualError(t, ResetOffsets(ctx, cfg, earliest),
+		"kafka: cannot reset offsets of group group with 1 active members",
+	)
+	require.NoError(t, consumer.Close())
+
+	require.NoError(t, ResetOffsets(ctx, cfg, earliest))
+	consumer = consumeAll()
+	require.NoError(t, consumer.Close())
+}
+
+// emulateEmptyGroupCommits handles the offset commits issued outside of the
+// group generation, which kfake doesn't support, and returns the committed
+// offsets on the next offset fetch of the group.
+func emulateEmptyGroupCommits(t testing.TB, cluster *kfake.Cluster) {
+	t.Helper()
+	var mu sync.Mutex
+	committed := make(map[string]map[string]map[int32]int64)
+	cluster.ControlKey(int16(kmsg.OffsetCommit), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := kreq.(*kmsg.OffsetCommitRequest)
+		if req.MemberID != "" {
+			return nil, nil, false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		resp := req.ResponseKind().(*kmsg.OffsetCommitResponse)
+		topics := make(map[string]map[int32]int64)
+		for _, rt := range req.Topics {
+			st := kmsg.NewOffsetCommitResponseTopic()
+			st.Topic = rt.Topic
+			topics[rt.Topic] = make(map[int32]int64)
+			for _, rp := range rt.Partitions {
+				topics[rt.Topic][rp.Partition] = rp.Offset
+				sp := kmsg.NewOffsetCommitResponseTopicPartition()
+				sp.Partition = rp.Partition
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		committed[req.Group] = topics
+		return resp, nil, true
+	})
+	cluster.ControlKey(int16(kmsg.OffsetFetch), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := kreq.(*kmsg.OffsetFetchRequest)
+		mu.Lock()
+		defer mu.Unlock()
+		if req.Version < 8 || len(req.Groups) != 1 {
+			return nil, nil, false
+		}
+		topics, ok := committed[req.Groups[0].Group]
+		if !ok {
+			return nil, nil, false
+		}
+		delete(committed, req.Groups[0].Group)
+		resp := req.ResponseKind().(*kmsg.OffsetFetchResponse)
+		sg := kmsg.NewOffsetFetchResponseGroup()
+		sg.Group = req.Groups[0].Group
+		for topic, partitions := range topics {
+			st := kmsg.NewOffsetFetchResponseGroupTopic()
+			st.Topic = topic
+			for partition, offset := range partitions {
+				sp := kmsg.NewOffsetFetchResponseGroupTopicPartition()
+				sp.Partition = partition
+				sp.Offset = offset
+				sp.LeaderEpoch = -1
+				st.Partitions = append(st.Partitions, sp)
+			}
+			sg.Topics = append(sg.Topics, st)
+		}
+		resp.Groups = append(resp.Groups, sg)
+		return resp, nil, true
+	})
+}
@@ -0,0 +1,63 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"os"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// The origin headers set on the produced records when
+// ProducerConfig.OriginHeaders is set. They share the "origin." prefix,
+// which isn't used by any other header set by the producer.
+const (
+	// OriginClientIDHeader holds the producer ClientID, only set when the
+	// ClientID is configured.
+	OriginClientIDHeader = "origin.client_id"
+	// OriginHostHeader holds the hostname of the producer.
+	OriginHostHeader = "origin.host"
+	// OriginProducedAtHeader holds the time the record was produced at, in
+	// RFC 3339 format with nanoseconds.
+	OriginProducedAtHeader = "origin.produced_at"
+)
+
+// staticOriginHeaders returns the origin headers which stay the same for all
+// the records of the producer.
+func staticOriginHeaders(cfg ProducerConfig) []kgo.RecordHeader {
+	var headers []kgo.RecordHeader
+	if cfg.ClientID != "" {
+		headers = append(headers, kgo.RecordHeader{
+			Key: OriginClientIDHeader, Value: []byte(cfg.ClientID),
+		})
+	}
+	if host, err := os.Hostname(); err == nil {
+		headers = append(headers, kgo.RecordHeader{
+			Key: OriginHostHeader, Value: []byte(host),
+		})
+	}
+	return headers
+}
+
+// producedAtHeader returns the origin header holding the produce time.
+func producedAtHeader(now time.Time) kgo.RecordHeader {
+	return kgo.RecordHeader{
+		Key: OriginProducedAtHeader, Value: []byte(now.UTC().Format(time.RFC3339Nano)),
+	}
+}
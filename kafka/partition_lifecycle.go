@@ -0,0 +1,164 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// The triggers of the rebalances recorded by the consumer metrics.
+const (
+	// rebalanceJoin is the first assignment after the consumer joins.
+	rebalanceJoin = "join"
+	// rebalanceRevoke is a rebalance of the group, for example because a
+	// member joined or left.
+	rebalanceRevoke = "revoke"
+	// rebalanceLost is an assignment after the consumer lost its
+	// partitions, for example because its session expired.
+	rebalanceLost = "lost"
+)
+
+// partitionLifecycle calls the OnPartitionStart and OnPartitionStop hooks as
+// the partitions are assigned to and revoked from the consumer, once per
+// partition: a partition is only stopped if it was started, and only started
+// again after it was stopped. It also records the rebalance metrics, as the
+// client calls it on every rebalance, even when no partitions move, and
+// tracks the assigned partitions for IdlePartitionTimeout.
+type partitionLifecycle struct {
+	mu      sync.Mutex
+	start   func(ctx context.Context, topic string, partition int32)
+	stop    func(ctx context.Context, topic string, partition int32)
+	started map[string]map[int32]struct{}
+	// revoke, once set, settles the consumer state of the revoked or lost
+	// partitions, before they're stopped.
+	revoke func(ctx context.Context, revoked map[string][]int32, lost bool)
+
+	metrics consumerMetrics
+	// idle tracks the assigned partitions, to pause the idle ones.
+	idle *idlePartitions
+	// trigger and revokedAt describe the rebalance in progress, from the
+	// partitions being revoked or lost until the next assignment.
+	trigger   string
+	revokedAt time.Time
+	clock     clock
+}
+
+func newPartitionLifecycle(cfg ConsumerConfig, metrics consumerMetrics, idle *idlePartitions) *partitionLifecycle {
+	return &partitionLifecycle{
+		start:   cfg.OnPartitionStart,
+		stop:    cfg.OnPartitionStop,
+		started: make(map[string]map[int32]struct{}),
+		metrics: metrics,
+		idle:    idle,
+		trigger: rebalanceJoin,
+		clock:   clockOrDefault(cfg.clock),
+	}
+}
+
+// opts returns the kgo options which call the hooks and record the
+// rebalance metrics.
+func (l *partitionLifecycle) opts() []kgo.Opt {
+	return []kgo.Opt{
+		kgo.OnPartitionsAssigned(l.assigned),
+		kgo.OnPartitionsRevoked(l.revoked),
+		kgo.OnPartitionsLost(l.lost),
+	}
+}
+
+// setRevoke sets the function called with the revoked and lost partitions,
+// once the consumer is created. The partitions revoked before then have no
+// consumer state to settle.
+func (l *partitionLifecycle) setRevoke(revoke func(ctx context.Context, revoked map[string][]int32, lost bool)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.revoke = revoke
+}
+
+func (l *partitionLifecycle) assigned(ctx context.Context, client *kgo.Client, assigned map[string][]int32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.idle.assigned(client, assigned)
+	var duration time.Duration
+	if !l.revokedAt.IsZero() {
+		duration = l.clock.Now().Sub(l.revokedAt)
+	}
+	l.metrics.recordRebalance(ctx, l.trigger, duration)
+	l.trigger, l.revokedAt = "", time.Time{}
+	for topic, partitions := range assigned {
+		for _, partition := range partitions {
+			if _, ok := l.started[topic][partition]; ok {
+				continue
+			}
+			if l.started[topic] == nil {
+				l.started[topic] = make(map[int32]struct{})
+			}
+			l.started[topic][partition] = struct{}{}
+			if l.start != nil {
+				l.start(ctx, topic, partition)
+			}
+		}
+	}
+}
+
+func (l *partitionLifecycle) revoked(ctx context.Context, client *kgo.Client, revoked map[string][]int32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.idle.revoked(client, revoked)
+	l.rebalancing(rebalanceRevoke)
+	if l.revoke != nil {
+		l.revoke(ctx, revoked, false)
+	}
+	l.stopPartitions(ctx, revoked)
+}
+
+func (l *partitionLifecycle) lost(ctx context.Context, client *kgo.Client, lost map[string][]int32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.idle.revoked(client, lost)
+	l.rebalancing(rebalanceLost)
+	if l.revoke != nil {
+		l.revoke(ctx, lost, true)
+	}
+	l.stopPartitions(ctx, lost)
+}
+
+// rebalancing marks the start of a rebalance, unless one is in progress.
+func (l *partitionLifecycle) rebalancing(trigger string) {
+	if l.trigger == "" {
+		l.trigger, l.revokedAt = trigger, l.clock.Now()
+	}
+}
+
+// stopPartitions calls OnPartitionStop for the started partitions.
+func (l *partitionLifecycle) stopPartitions(ctx context.Context, revoked map[string][]int32) {
+	for topic, partitions := range revoked {
+		for _, partition := range partitions {
+			if _, ok := l.started[topic][partition]; !ok {
+				continue
+			}
+			delete(l.started[topic], partition)
+			if l.stop != nil {
+				l.stop(ctx, topic, partition)
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestConsumerPartitionLifecycle(t *testing.T) {
+	topic := "partition-lifecycle"
+	cluster := newFakeCluster(t, 4, topic)
+
+	var mu sync.Mutex
+	// events holds the started and stopped events of each consumer
+	// partition, in order.
+	events := make(map[string][]string)
+	// started returns the number of partitions started by the consumer.
+	started := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		var n int
+		for key, e := range events {
+			if strings.HasPrefix(key, name+"-") && e[len(e)-1] == "start" {
+				n++
+			}
+		}
+		return n
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	newConsumer := func(name string) *Consumer {
+		hook := func(event string) func(context.Context, string, int32) {
+			return func(_ context.Context, topic string, partition int32) {
+				mu.Lock()
+				defer mu.Unlock()
+				key := fmt.Sprintf("%s-%s-%d", name, topic, partition)
+				events[key] = append(events[key], event)
+			}
+		}
+		consumer, err := NewConsumer(ConsumerConfig{
+			Brokers:          cluster.ListenAddrs(),
+			Topics:           []string{topic},
+			GroupID:          "group",
+			Logger:           zaptest.NewLogger(t),
+			OnPartitionStart: hook("start"),
+			OnPartitionStop:  hook("stop"),
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				return nil
+			}),
+		})
+		require.NoError(t, err)
+		go consumer.Run(ctx)
+		return consumer
+	}
+
+	a := newConsumer("a")
+	assert.Eventually(t, func() bool { return started("a") == 4 }, 10*time.Second, 10*time.Millisecond)
+	// The group rebalances, a keeps half of the partitions.
+	b := newConsumer("b")
+	assert.Eventually(t, func() bool {
+		return started("a") == 2 && started("b") == 2
+	}, 15*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, a.Close())
+	require.NoError(t, b.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("a-%s-%d", topic, i)
+		assert.Equal(t, []string{"start", "stop"}, events[key], key)
+	}
+	for key, e := range events {
+		// b may be assigned the partitions revoked from a on close.
+		if !assert.Zero(t, len(e)%2, "%s: %v", key, e) {
+			continue
+		}
+		for i := 0; i < len(e); i += 2 {
+			assert.Equal(t, []string{"start", "stop"}, e[i:i+2], key)
+		}
+	}
+}
+
+func TestConsumerRebalanceMetrics(t *testing.T) {
+	topic := "rebalance-metrics"
+	cluster := newFakeCluster(t, 4, topic)
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	newConsumer := func() (*Consumer, context.CancelFunc) {
+		consumer, err := NewConsumer(ConsumerConfig{
+			Brokers:       cluster.ListenAddrs(),
+			Topics:        []string{topic},
+			GroupID:       "group",
+			Logger:        zaptest.NewLogger(t),
+			MeterProvider: mp,
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				return nil
+			}),
+		})
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		go consumer.Run(ctx)
+		return consumer, cancel
+	}
+	rebalances := func() map[string]int64 {
+		counts := make(map[string]int64)
+		m := collectMetric(t, reader, "consumer.rebalances")
+		sum, ok := m.Data.(metricdata.Sum[int64])
+		require.True(t, ok)
+		for _, dp := range sum.DataPoints {
+			trigger, _ := dp.Attributes.Value("rebalance.trigger")
+			counts[trigger.AsString()] += dp.Value
+		}
+		return counts
+	}
+
+	a, cancelA := newConsumer()
+	assert.Eventually(t, func() bool {
+		return rebalances()[rebalanceJoin] == 1
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// A second consumer joining the group rebalances the first one.
+	b, cancelB := newConsumer()
+	assert.Eventually(t, func() bool {
+		counts := rebalances()
+		return counts[rebalanceJoin] == 2 && counts[rebalanceRevoke] > 0
+	}, 10*time.Second, 50*time.Millisecond)
+	hist, ok := collectMetric(t, reader, "consumer.rebalance.duration").Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	require.NotEmpty(t, hist.DataPoints)
+
+	cancelA()
+	cancelB()
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,124 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// PartitionStat holds the counters of the records produced to a partition.
+type PartitionStat struct {
+	// Records is the number of records produced.
+	Records int64
+	// Bytes is the size of the records produced, including their keys,
+	// values and headers.
+	Bytes int64
+	// UncompressedBytes and CompressedBytes are the sizes of the produced
+	// record batches before and after compression, as reported by the
+	// client. Their ratio is the compression ratio achieved.
+	UncompressedBytes int64
+	CompressedBytes   int64
+}
+
+// partitionCounters holds the counters of a partition.
+type partitionCounters struct {
+	records           atomic.Int64
+	bytes             atomic.Int64
+	uncompressedBytes atomic.Int64
+	compressedBytes   atomic.Int64
+}
+
+// partitionStats counts the records successfully produced to each topic
+// partition.
+type partitionStats struct {
+	mu sync.RWMutex
+	// counters are keyed by topic and partition. Counters are only added,
+	// so they are updated while the read lock is held.
+	counters map[string]map[int32]*partitionCounters
+}
+
+// OnProduceRecordUnbuffered implements kgo.HookProduceRecordUnbuffered.
+func (s *partitionStats) OnProduceRecordUnbuffered(r *kgo.Record, err error) {
+	if err != nil {
+		return
+	}
+	c := s.partition(r.Topic, r.Partition)
+	c.records.Add(1)
+	c.bytes.Add(recordSize(r))
+}
+
+// OnProduceBatchWritten implements kgo.HookProduceBatchWritten.
+func (s *partitionStats) OnProduceBatchWritten(_ kgo.BrokerMetadata, topic string, partition int32, batch kgo.ProduceBatchMetrics) {
+	c := s.partition(topic, partition)
+	c.uncompressedBytes.Add(int64(batch.UncompressedBytes))
+	c.compressedBytes.Add(int64(batch.CompressedBytes))
+}
+
+// partition returns the counters of the partition, adding them if needed.
+func (s *partitionStats) partition(topic string, partition int32) *partitionCounters {
+	s.mu.RLock()
+	c, ok := s.counters[topic][partition]
+	s.mu.RUnlock()
+	if ok {
+		return c
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.counters[topic][partition]; ok {
+		return c
+	}
+	if s.counters == nil {
+		s.counters = make(map[string]map[int32]*partitionCounters)
+	}
+	if s.counters[topic] == nil {
+		s.counters[topic] = make(map[int32]*partitionCounters)
+	}
+	c = new(partitionCounters)
+	s.counters[topic][partition] = c
+	return c
+}
+
+// snapshot returns the current counters.
+func (s *partitionStats) snapshot() map[string]map[int32]PartitionStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := make(map[string]map[int32]PartitionStat, len(s.counters))
+	for topic, partitions := range s.counters {
+		stats[topic] = make(map[int32]PartitionStat, len(partitions))
+		for partition, c := range partitions {
+			stats[topic][partition] = PartitionStat{
+				Records:           c.records.Load(),
+				Bytes:             c.bytes.Load(),
+				UncompressedBytes: c.uncompressedBytes.Load(),
+				CompressedBytes:   c.compressedBytes.Load(),
+			}
+		}
+	}
+	return stats
+}
+
+// PartitionStats returns the counters of the records produced to each topic
+// partition, keyed by topic and partition. Only the records acknowledged by
+// the brokers are counted, including the ones produced by the clients of the
+// compression overrides.
+func (p *Producer) PartitionStats() map[string]map[int32]PartitionStat {
+	return p.partitionStats.snapshot()
+}
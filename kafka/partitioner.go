@@ -0,0 +1,146 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"hash/crc32"
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	// PartitionHashDefault uses the franz-go default partitioner.
+	PartitionHashDefault PartitionHash = iota
+	// PartitionHashMurmur2Java hashes keys with murmur2, matching the Java
+	// client default partitioner.
+	PartitionHashMurmur2Java
+	// PartitionHashFNV hashes keys with fnv-1a, matching the Sarama default
+	// partitioner.
+	PartitionHashFNV
+	// PartitionHashCRC32 hashes keys with crc32, matching the librdkafka
+	// consistent partitioner.
+	PartitionHashCRC32
+)
+
+// PartitionHash defines the hashing algorithm used to select the partition
+// for records with a key. Records without a key are spread across partitions
+// regardless of the PartitionHash.
+type PartitionHash uint8
+
+func (h PartitionHash) String() string {
+	switch h {
+	case PartitionHashDefault:
+		return "default"
+	case PartitionHashMurmur2Java:
+		return "murmur2_java"
+	case PartitionHashFNV:
+		return "fnv"
+	case PartitionHashCRC32:
+		return "crc32"
+	default:
+		return ""
+	}
+}
+
+// partitioner returns the kgo partitioner for the hash, or nil if the
+// franz-go default partitioner should be used.
+func (h PartitionHash) partitioner() kgo.Partitioner {
+	switch h {
+	case PartitionHashMurmur2Java:
+		// A nil hasher partitions exactly like the Java client does.
+		return kgo.StickyKeyPartitioner(nil)
+	case PartitionHashFNV:
+		return kgo.StickyKeyPartitioner(kgo.SaramaHasher(func(key []byte) uint32 {
+			h := fnv.New32a()
+			h.Write(key)
+			return h.Sum32()
+		}))
+	case PartitionHashCRC32:
+		return kgo.StickyKeyPartitioner(func(key []byte, n int) int {
+			return int(crc32.ChecksumIEEE(key) % uint32(n))
+		})
+	default:
+		return nil
+	}
+}
+
+// stickyWindowPartitioner produces the keyless records to the same partition
+// for a time window before rotating to the next one. The records with a key
+// are partitioned by the keyed partitioner.
+type stickyWindowPartitioner struct {
+	window time.Duration
+	clock  clock
+	keyed  kgo.Partitioner
+}
+
+// newStickyWindowPartitioner returns a stickyWindowPartitioner which
+// partitions the records with a key with the hash partitioner.
+func newStickyWindowPartitioner(window time.Duration, c clock, hash PartitionHash) kgo.Partitioner {
+	keyed := hash.partitioner()
+	if keyed == nil {
+		// Matches the key hashing of the franz-go default partitioner.
+		keyed = kgo.StickyKeyPartitioner(nil)
+	}
+	return stickyWindowPartitioner{window: window, clock: c, keyed: keyed}
+}
+
+// ForTopic implements kgo.Partitioner.
+func (p stickyWindowPartitioner) ForTopic(topic string) kgo.TopicPartitioner {
+	return &stickyWindowTopicPartitioner{
+		stickyWindowPartitioner: p,
+		keyed:                   p.keyed.ForTopic(topic),
+		partition:               -1,
+	}
+}
+
+type stickyWindowTopicPartitioner struct {
+	stickyWindowPartitioner
+	keyed kgo.TopicPartitioner
+	// partition is the partition of the current window, or -1 before the
+	// first keyless record.
+	partition int
+	// rotateAt is the time the current window ends.
+	rotateAt time.Time
+}
+
+// RequiresConsistency implements kgo.TopicPartitioner.
+func (p *stickyWindowTopicPartitioner) RequiresConsistency(r *kgo.Record) bool {
+	return p.keyed.RequiresConsistency(r)
+}
+
+// Partition implements kgo.TopicPartitioner.
+func (p *stickyWindowTopicPartitioner) Partition(r *kgo.Record, n int) int {
+	if r.Key != nil {
+		return p.keyed.Partition(r, n)
+	}
+	now := p.clock.Now()
+	switch {
+	case p.partition < 0:
+		p.partition = rand.Intn(n)
+	case !now.Before(p.rotateAt):
+		p.partition++
+	default:
+		return p.partition % n
+	}
+	p.partition %= n
+	p.rotateAt = now.Add(p.window)
+	return p.partition
+}
@@ -0,0 +1,129 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestPartitionHashMurmur2Java(t *testing.T) {
+	const partitions = 10
+	topic := "murmur2-java"
+	cluster := newFakeCluster(t, partitions, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:       cluster.ListenAddrs(),
+		Topic:         topic,
+		Logger:        zaptest.NewLogger(t),
+		PartitionHash: PartitionHashMurmur2Java,
+		KeyRouter: func(event model.APMEvent) []byte {
+			return []byte(event.Trace.ID)
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	// murmur2 hashes computed by the Java client, Utils.murmur2.
+	javaHashes := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"abc":                        479470107,
+	}
+	var batch model.Batch
+	for key := range javaHashes {
+		batch = append(batch, model.APMEvent{Trace: model.Trace{ID: key}})
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	for _, record := range consumeRecords(t, cluster, topic, len(javaHashes)) {
+		// Java: Utils.toPositive(Utils.murmur2(key)) % numPartitions.
+		expected := (javaHashes[string(record.Key)] & 0x7fffffff) % partitions
+		assert.Equal(t, expected, record.Partition, "key %s", record.Key)
+	}
+}
+
+func TestStickyPartitioning(t *testing.T) {
+	const partitions = 4
+	topic := "sticky-partitioning"
+	cluster := newFakeCluster(t, partitions, topic)
+	clock := newFakeClock(time.Now())
+	cfg := ProducerConfig{
+		Brokers:            cluster.ListenAddrs(),
+		Topic:              topic,
+		Logger:             zaptest.NewLogger(t),
+		StickyPartitioning: time.Minute,
+		KeyRouter: func(event model.APMEvent) []byte {
+			if event.Trace.ID == "" {
+				return nil
+			}
+			return []byte(event.Trace.ID)
+		},
+	}
+	cfg.withClock(clock)
+	producer, err := NewProducer(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	produce := func() {
+		var batch model.Batch
+		for i := 0; i < 20; i++ {
+			batch = append(batch, model.APMEvent{}, model.APMEvent{
+				Trace: model.Trace{ID: fmt.Sprint(i)},
+			})
+		}
+		require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	}
+	produce()
+	clock.Advance(30 * time.Second)
+	produce()
+	clock.Advance(30 * time.Second)
+	produce()
+
+	keyed := kgo.StickyKeyPartitioner(nil).ForTopic(topic)
+	keyless := make(map[int32]int)
+	for _, record := range consumeRecords(t, cluster, topic, 120) {
+		if record.Key == nil {
+			keyless[record.Partition]++
+			continue
+		}
+		// The keyed records are still partitioned by their key.
+		expected := keyed.Partition(record, partitions)
+		assert.Equal(t, int32(expected), record.Partition, "key %s", record.Key)
+	}
+	// The keyless records stick to one partition within the window, then
+	// rotate to the next one.
+	require.Len(t, keyless, 2)
+	for partition, n := range keyless {
+		if n == 40 {
+			assert.Equal(t, 20, keyless[(partition+1)%partitions])
+			return
+		}
+	}
+	t.Fatalf("no partition received the first window records: %v", keyless)
+}
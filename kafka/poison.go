@@ -0,0 +1,75 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import "github.com/twmb/franz-go/pkg/kgo"
+
+// poisonTracker counts the consecutive redeliveries of the record each
+// partition is retrying, to detect the records which never succeed, and to
+// back off between the StreamProcessor attempts.
+type poisonTracker struct {
+	threshold int
+	// retrying holds the offset being retried by each topic partition and
+	// the number of failed attempts.
+	retrying map[string]map[int32]retriedOffset
+}
+
+type retriedOffset struct {
+	offset   int64
+	attempts int
+}
+
+func newPoisonTracker(threshold int) *poisonTracker {
+	return &poisonTracker{
+		threshold: threshold,
+		retrying:  make(map[string]map[int32]retriedOffset),
+	}
+}
+
+// failed records a failed attempt to process the record, returning true
+// once it has failed PoisonThreshold consecutive times, when set.
+func (t *poisonTracker) failed(msg *kgo.Record) bool {
+	partitions := t.retrying[msg.Topic]
+	if partitions == nil {
+		partitions = make(map[int32]retriedOffset)
+		t.retrying[msg.Topic] = partitions
+	}
+	retried := partitions[msg.Partition]
+	if retried.offset != msg.Offset {
+		retried = retriedOffset{offset: msg.Offset}
+	}
+	retried.attempts++
+	partitions[msg.Partition] = retried
+	return t.threshold > 0 && retried.attempts >= t.threshold
+}
+
+// attempts returns the consecutive failed attempts to process the record.
+func (t *poisonTracker) attempts(msg *kgo.Record) int {
+	if retried, ok := t.retrying[msg.Topic][msg.Partition]; ok && retried.offset == msg.Offset {
+		return retried.attempts
+	}
+	return 0
+}
+
+// done forgets the failed attempts of the record's partition, once the
+// partition advances past the record being retried.
+func (t *poisonTracker) done(msg *kgo.Record) {
+	if partitions := t.retrying[msg.Topic]; partitions != nil {
+		delete(partitions, msg.Partition)
+	}
+}
@@ -0,0 +1,101 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestConsumerPoisonThreshold(t *testing.T) {
+	topic, dlqTopic := "poison", "poison-dlq"
+	cluster := newFakeCluster(t, 1, topic, dlqTopic)
+	var records []*kgo.Record
+	for _, id := range []string{"poison", "ok"} {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: id}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{Topic: topic, Value: event})
+	}
+	produceRecords(t, cluster, records...)
+
+	var mu sync.Mutex
+	var processed []string
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:         cluster.ListenAddrs(),
+		Topics:          []string{topic},
+		GroupID:         "group",
+		Logger:          zaptest.NewLogger(t),
+		DeadLetterTopic: dlqTopic,
+		PoisonThreshold: 3,
+		Processor: dispositionProcessorFunc(func(_ context.Context, b *model.Batch) []RecordDisposition {
+			mu.Lock()
+			defer mu.Unlock()
+			dispositions := make([]RecordDisposition, 0, len(*b))
+			for _, event := range *b {
+				processed = append(processed, event.Trace.ID)
+				d := Ack
+				if event.Trace.ID == "poison" {
+					d = Retry // Fails permanently.
+				}
+				dispositions = append(dispositions, d)
+			}
+			return dispositions
+		}),
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(ctx)
+	}()
+
+	// The poison record is dead lettered once it has been retried up to the
+	// threshold, and the partition progresses.
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed) == 4
+	}, 10*time.Second, 50*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{"poison", "poison", "poison", "ok"}, processed)
+	mu.Unlock()
+
+	dlq := consumeRecords(t, cluster, dlqTopic, 1)
+	require.Len(t, dlq, 1)
+	assert.Equal(t, records[0].Value, dlq[0].Value)
+
+	assert.Eventually(t, func() bool {
+		offsets, err := consumer.CommittedOffsets(ctx)
+		return err == nil && offsets[topic][0] == int64(len(records))
+	}, 10*time.Second, 50*time.Millisecond)
+	cancel()
+	<-done
+	require.NoError(t, consumer.Close())
+}
@@ -0,0 +1,58 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"sync"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// eventPool holds the batches the records are decoded into, which are reused
+// across fetches when PooledDecode is set.
+type eventPool struct {
+	pool sync.Pool
+}
+
+// get returns an empty batch from the pool.
+func (p *eventPool) get() *model.Batch {
+	if b, ok := p.pool.Get().(*model.Batch); ok {
+		return b
+	}
+	return new(model.Batch)
+}
+
+// put returns the batch to the pool, once its events have been processed.
+// The events are zeroed, so the batch doesn't retain the values they
+// reference while it's pooled.
+func (p *eventPool) put(b *model.Batch, events model.Batch) {
+	for i := range events {
+		events[i] = model.APMEvent{}
+	}
+	*b = events[:0]
+	p.pool.Put(b)
+}
+
+// release returns the batch of the decoded record to the pool, if any.
+func (c *Consumer) release(d *decodedRecord) {
+	if d.pooled == nil {
+		return
+	}
+	c.events.put(d.pooled, d.events)
+	d.pooled, d.events = nil, nil
+}
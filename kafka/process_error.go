@@ -0,0 +1,85 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// ProcessError describes a record which the consumer processor failed to
+// process.
+type ProcessError struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	// Err is the error returned by the processor.
+	Err error
+}
+
+// Error implements the error interface.
+func (e ProcessError) Error() string {
+	return fmt.Sprintf("kafka: failed to process record %s[%d]@%d: %v",
+		e.Topic, e.Partition, e.Offset, e.Err,
+	)
+}
+
+// Unwrap returns the processor error.
+func (e ProcessError) Unwrap() error {
+	return e.Err
+}
+
+// ConsumerStats holds the consumer counters.
+type ConsumerStats struct {
+	// DroppedProcessingErrors is the number of processing errors which
+	// weren't sent to the ProcessingErrors channel because it was full.
+	DroppedProcessingErrors int64
+}
+
+// ProcessingErrors returns the channel which receives the processing errors,
+// when ProcessingErrorsBuffer is set. Otherwise, it returns nil. The channel
+// is closed when the consumer is closed.
+func (c *Consumer) ProcessingErrors() <-chan ProcessError {
+	return c.processingErrors
+}
+
+// Stats returns the consumer counters.
+func (c *Consumer) Stats() ConsumerStats {
+	return ConsumerStats{
+		DroppedProcessingErrors: c.droppedProcessingErrors.Load(),
+	}
+}
+
+// processingError sends the processing error to the ProcessingErrors
+// channel, dropping it if the channel is full.
+func (c *Consumer) processingError(msg *kgo.Record, err error) {
+	if c.processingErrors == nil {
+		return
+	}
+	select {
+	case c.processingErrors <- ProcessError{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Err:       err,
+	}:
+	default:
+		c.droppedProcessingErrors.Add(1)
+	}
+}
@@ -17,4 +17,997 @@
 
 package kafka
 
-// TODO
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/plugin/kotel"
+	"github.com/twmb/franz-go/plugin/kzap"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+	"github.com/elastic/apm-queue/queueconfig"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// ProducerConfig holds configuration for publishing events to Kafka.
+type ProducerConfig struct {
+	// Brokers is the list of kafka brokers used to seed the Kafka client.
+	Brokers []string
+	// Topic where events are produced.
+	Topic string
+	// ClientID to use when connecting to Kafka. This is used for logging
+	// and client identification purposes.
+	ClientID string
+	// Version is the software version to use in the Kafka client. This is
+	// useful since it shows up in Kafka metrics and logs.
+	Version string
+
+	// SASL mechanisms to authenticate with, in order of preference. The
+	// first mechanism is proposed in the SASL handshake; if the broker
+	// rejects it, the first of the remaining mechanisms that the broker
+	// advertises as supported is used instead.
+	SASL []sasl.Mechanism
+	// TLS, when set, makes the client connect to the brokers over TLS.
+	TLS *TLS
+	// JitterFraction is the fraction, between 0 and 1, by which the
+	// exponential retry backoff of the client requests is randomly reduced,
+	// so clients don't retry in lockstep. When zero, the franz-go default
+	// backoff is used.
+	JitterFraction float64
+	// Backoff, when set, defines the time waited before retrying the client
+	// requests, instead of the franz-go default backoff. It can't be used
+	// together with JitterFraction.
+	Backoff Backoff
+	// ConnReconnectBackoff, when its Max is set, spaces out the connection
+	// attempts to the brokers which failed to connect, such as after a
+	// broker restart. By default, brokers are dialed again right away.
+	ConnReconnectBackoff ReconnectBackoff
+	// TracerProvider is used to create a publish span for each produced
+	// record, following the OTel messaging semantic conventions, which is a
+	// child of the span in the produce context and ends once the record is
+	// acknowledged, or fails. Defaults to the global tracer provider.
+	TracerProvider trace.TracerProvider
+	// TraceProduceErrors, when set, records the errors of the records which
+	// failed to be produced by ProcessBatch, ProduceWithOffsets and
+	// ProcessByTopic as an exception event on the span of their context,
+	// if any, and sets its status to error.
+	TraceProduceErrors bool
+	// MeterProvider is used to create the producer metrics, such as the
+	// apmqueue.producer.compression.ratio histogram, which records the
+	// compression ratio of each produced record batch. Defaults to the
+	// global meter provider.
+	MeterProvider metric.MeterProvider
+
+	// OnBrokerConnect, when set, is called with the broker address and the
+	// dial error, if any, every time a connection to a broker is attempted.
+	OnBrokerConnect func(addr string, err error)
+	// OnBrokerDisconnect, when set, is called with the broker address every
+	// time a connection to a broker is closed.
+	OnBrokerDisconnect func(addr string)
+
+	// Logger for the producer.
+	Logger *zap.Logger
+	// Encoder encodes the events into record values, defaults to JSON.
+	Encoder Encoder
+	// CopyOnProduce, when set, copies the record values and keys returned
+	// by the Encoder, KeyRouter and KeyEncoder before producing them. It's
+	// required when they return memory which is reused or owned by the
+	// caller, such as a shared encoding buffer or bytes held by the events.
+	CopyOnProduce bool
+	// ValidateEvent, when set, is called with each event before it's
+	// encoded. The events for which it returns an error fail with a
+	// ValidationError. ValidationPolicy defines whether the rest of the
+	// batch is produced, defaults to producing the valid events.
+	ValidateEvent    func(model.APMEvent) error
+	ValidationPolicy ValidationPolicy
+
+	// KeyRouter, when set, returns the record key for each event. Events
+	// with the same key are produced to the same partition.
+	KeyRouter KeyRouter
+	// KeyValue, when set, returns the typed key value for each event, which
+	// is encoded into the record key by KeyEncoder. It can't be used together
+	// with KeyRouter.
+	KeyValue func(event model.APMEvent) any
+	// KeyEncoder encodes the values returned by KeyValue into record keys.
+	KeyEncoder KeyEncoder
+	// KeyFromMetadata, when set, names the queuecontext metadata entry whose
+	// value becomes the key of the records produced with that metadata, such
+	// as a tenant ID. It takes precedence over KeyRouter and KeyValue, which
+	// are used for the batches without the entry.
+	KeyFromMetadata string
+	// TopicFromMetadata, when set, names the queuecontext metadata entry
+	// whose value, prefixed by TopicFromMetadataPrefix, is the topic the
+	// records produced with that metadata are sent to, such as a topic per
+	// tenant. The batches without the entry are produced to Topic.
+	TopicFromMetadata       string
+	TopicFromMetadataPrefix string
+	// ProduceInterceptors, when set, are called in order with each record
+	// before it's produced, such as for auditing or redaction, and can
+	// modify or drop it.
+	ProduceInterceptors []ProduceInterceptor
+	// Compression is the codec compressing the produced record batches, one
+	// of none, gzip, snappy, lz4 or zstd. Defaults to the franz-go default,
+	// snappy. The codec of a ProcessBatch call can be overridden with
+	// queuecontext.WithCompression, such as for backfills trading latency
+	// for size, which creates an additional client for each codec.
+	Compression string
+	// PartitionHash selects the algorithm used to hash record keys into
+	// partitions, defaults to the franz-go partitioner.
+	PartitionHash PartitionHash
+	// StickyPartitioning, when set, produces the records without a key to
+	// the same partition for the window before rotating to the next one,
+	// which reduces the number of small batches. The records with a key are
+	// still partitioned by PartitionHash.
+	StickyPartitioning time.Duration
+
+	// CompactedTopicCheck defines how the producer reacts on creation when
+	// the topic has cleanup.policy=compact, but no KeyRouter or KeyValue is
+	// set. Keyless records are lost when such topics are compacted. Only
+	// checked when the topic configs can be described, defaults to logging
+	// a warning.
+	CompactedTopicCheck CompactedTopicCheck
+
+	// MaxInflightProduceBatches, when set, limits the number of ProcessBatch
+	// and ProcessBatchAsync calls running concurrently. The calls beyond the
+	// limit block until another call completes or their context is done. A
+	// ProcessBatchAsync call completes once all its futures are resolved,
+	// not when it returns.
+	MaxInflightProduceBatches int
+	// SplitBatchRecords and SplitBatchBytes, when set, split the records of
+	// a ProcessBatch call into sub-batches of up to that many records, and
+	// of up to that size, including their keys, values and headers. The
+	// sub-batches are produced one after the other, so batches of any size
+	// can be produced without exceeding the broker limits. A single record
+	// bigger than SplitBatchBytes is produced on its own.
+	SplitBatchRecords int
+	SplitBatchBytes   int
+	// ChunkSize, when set, splits the record values bigger than ChunkSize
+	// bytes into chunks of up to that size, produced as consecutive records
+	// with the chunk headers, so very large events don't exceed the broker
+	// limits. The chunks keep the record key and headers, and the keyless
+	// records are keyed by their chunk ID, so the chunks of a record are
+	// produced to the same partition. The consumers reassemble the chunks
+	// before decoding them. The ProcessBatchAsync futures resolve once all
+	// the chunks are produced, to the offset of the last chunk.
+	ChunkSize int
+
+	// ProduceAckTimeout is how long the brokers are allowed to wait for the
+	// produce requests to be acknowledged, defaults to 10s. ProcessBatch
+	// retries the requests which time out. Must be at least 100ms when set.
+	ProduceAckTimeout time.Duration
+	// BlockUntilReady, when set, makes NewProducer wait up to that long for
+	// a metadata request to the cluster to succeed, failing otherwise. See
+	// WaitReady to gate startup with a context instead.
+	BlockUntilReady time.Duration
+	// RecordBufferTimeout, when set, bounds how long a record can be
+	// buffered by the producer, waiting for metadata or retrying requests,
+	// before it's failed with ErrRecordTimeout. By default, records are
+	// retried until the ProcessBatch context is done. Must be at least 1s
+	// when set.
+	RecordBufferTimeout time.Duration
+	// MaxProduceAttempts, when set, bounds the number of times the record
+	// batches which fail with retriable errors are produced, including the
+	// first attempt, after which their records fail with the last error, so
+	// 1 never retries. It surfaces the errors which are otherwise retried
+	// until the records time out, such as the writes rejected because fewer
+	// than the topic min.insync.replicas are in sync, which fail with
+	// ErrInsufficientReplicas.
+	MaxProduceAttempts int
+
+	// MaxHeaderCount and MaxHeaderBytes, when set, limit the number and the
+	// total size of the headers set by the producer on each record, such
+	// as the default, project_id and origin headers. The trace context
+	// headers aren't limited. HeaderLimitPolicy defines what happens with
+	// the headers exceeding the limits, defaults to dropping them.
+	MaxHeaderCount    int
+	MaxHeaderBytes    int
+	HeaderLimitPolicy HeaderLimitPolicy
+
+	// ProducerBatching maps Linger to the franz-go producer linger and
+	// MaxBatchBytes to the maximum record batch size.
+	queueconfig.ProducerBatching
+
+	// Mirror, when set, copies a sample of the produced records to a
+	// secondary cluster, asynchronously and on a best-effort basis. Mirror
+	// failures don't affect ProcessBatch, they're reported by Stats.
+	Mirror *MirrorConfig
+
+	// DefaultHeaders are set on every produced record, such as the headers
+	// which are constant per process. The headers set from the context,
+	// such as project_id, and the origin headers take precedence over the
+	// default headers with the same key.
+	DefaultHeaders map[string]string
+
+	// OriginHeaders, when set, adds the origin headers to every produced
+	// record: OriginClientIDHeader, OriginHostHeader and
+	// OriginProducedAtHeader.
+	OriginHeaders bool
+	// StampCodec, when set, adds the CodecHeader with the Encoder name to
+	// every produced record, so consumers can verify they decode it with
+	// the same codec. The Encoder must implement NamedCodec.
+	StampCodec bool
+	// SequenceHeader, when set, is the header holding the sequence of each
+	// produced record, a decimal counter increasing by one with every
+	// record of the producer, so consumers can detect the missing records
+	// from the gaps between sequences. The sequence starts from one, or
+	// from the one loaded from SequenceStore, when set, which stores the
+	// last sequence after every produce call.
+	SequenceHeader string
+	SequenceStore  SequenceStore
+
+	// DryRun, when set, runs the records through the encoding, routing,
+	// headers, interceptors and partitioner like when producing them, but
+	// never sends them to the brokers, such as to validate a configuration
+	// in staging. The records succeed as if they were produced, with
+	// synthetic offsets increasing per partition, and are traced and counted
+	// in PartitionStats as uncompressed records. Only the partitions of the
+	// topics are looked up from the brokers. They aren't mirrored.
+	DryRun bool
+
+	// MaxProduceDelay, when set, drops any event whose Timestamp is older
+	// than the delay at the time it is produced. Dropped events are counted
+	// and reported by Stats.
+	MaxProduceDelay time.Duration
+
+	// clock is used for time-dependent operations, defaults to the system
+	// clock and is only overridden in tests.
+	clock clock
+}
+
+const (
+	// CompactedTopicCheckWarn logs a warning.
+	CompactedTopicCheckWarn CompactedTopicCheck = iota
+	// CompactedTopicCheckError fails the producer creation.
+	CompactedTopicCheckError
+	// CompactedTopicCheckDisabled skips the check.
+	CompactedTopicCheckDisabled
+)
+
+// CompactedTopicCheck defines the severity of producing keyless records to
+// a compacted topic.
+type CompactedTopicCheck uint8
+
+// describeConfigsTimeout bounds the time spent describing the topic configs
+// when the producer is created.
+const describeConfigsTimeout = 5 * time.Second
+
+// ErrRecordTimeout is returned by ProcessBatch for the records which weren't
+// produced within RecordBufferTimeout.
+var ErrRecordTimeout = errors.New("kafka: record timed out")
+
+// ErrInsufficientReplicas is returned by ProcessBatch for the records which
+// the brokers rejected, or wrote without acknowledging them, because fewer
+// replicas than the topic min.insync.replicas were in sync. The writes may
+// succeed once the replicas catch up. See MaxProduceAttempts.
+var ErrInsufficientReplicas = errors.New("kafka: not enough in-sync replicas")
+
+// errProducerClosed is returned when producing with a closed producer.
+var errProducerClosed = errors.New("producer closed")
+
+// Encoder encodes a model.APMEvent into a []byte.
+type Encoder interface {
+	Encode(model.APMEvent) ([]byte, error)
+}
+
+// KeyRouter returns the record key for an event.
+type KeyRouter func(event model.APMEvent) []byte
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg ProducerConfig) Validate() error {
+	var errs []error
+	if len(cfg.Brokers) == 0 {
+		errs = append(errs, errors.New("kafka: at least one broker must be set"))
+	}
+	if cfg.Topic == "" {
+		errs = append(errs, errors.New("kafka: topic must be set"))
+	}
+	if cfg.Logger == nil {
+		errs = append(errs, errors.New("kafka: logger must be set"))
+	}
+	if err := validateJitterFraction(cfg.JitterFraction); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Backoff != nil && cfg.JitterFraction > 0 {
+		errs = append(errs, errors.New("kafka: backoff and jitter fraction cannot be set together"))
+	}
+	if err := cfg.ConnReconnectBackoff.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.KeyRouter != nil && cfg.KeyValue != nil {
+		errs = append(errs, errors.New("kafka: key router and key value cannot be set together"))
+	}
+	if (cfg.KeyValue != nil) != (cfg.KeyEncoder != nil) {
+		errs = append(errs, errors.New("kafka: key value and key encoder must be set together"))
+	}
+	if cfg.TopicFromMetadataPrefix != "" && cfg.TopicFromMetadata == "" {
+		errs = append(errs, errors.New("kafka: topic from metadata must be set to use its prefix"))
+	}
+	if _, ok := compressionCodec(cfg.Compression); cfg.Compression != "" && !ok {
+		errs = append(errs, fmt.Errorf("kafka: unknown compression codec %q", cfg.Compression))
+	}
+	if cfg.SequenceStore != nil && cfg.SequenceHeader == "" {
+		errs = append(errs, errors.New("kafka: sequence header must be set to store the sequence"))
+	}
+	if cfg.PartitionHash > PartitionHashCRC32 {
+		errs = append(errs, errors.New("kafka: unknown partition hash"))
+	}
+	if cfg.StickyPartitioning < 0 {
+		errs = append(errs, errors.New("kafka: sticky partitioning window cannot be negative"))
+	}
+	if cfg.CompactedTopicCheck > CompactedTopicCheckDisabled {
+		errs = append(errs, errors.New("kafka: unknown compacted topic check"))
+	}
+	if cfg.BlockUntilReady < 0 {
+		errs = append(errs, errors.New("kafka: block until ready cannot be negative"))
+	}
+	if cfg.ProduceAckTimeout != 0 && cfg.ProduceAckTimeout < 100*time.Millisecond {
+		errs = append(errs, errors.New("kafka: produce ack timeout must be at least 100ms"))
+	}
+	if cfg.MaxProduceAttempts < 0 {
+		errs = append(errs, errors.New("kafka: max produce attempts cannot be negative"))
+	}
+	if cfg.RecordBufferTimeout != 0 && cfg.RecordBufferTimeout < time.Second {
+		errs = append(errs, errors.New("kafka: record buffer timeout must be at least 1s"))
+	}
+	if cfg.MaxInflightProduceBatches < 0 {
+		errs = append(errs, errors.New("kafka: max inflight produce batches cannot be negative"))
+	}
+	if cfg.SplitBatchRecords < 0 || cfg.SplitBatchBytes < 0 {
+		errs = append(errs, errors.New("kafka: split batch limits cannot be negative"))
+	}
+	if cfg.ChunkSize < 0 {
+		errs = append(errs, errors.New("kafka: chunk size cannot be negative"))
+	}
+	if cfg.MaxHeaderCount < 0 {
+		errs = append(errs, errors.New("kafka: max header count cannot be negative"))
+	}
+	if cfg.MaxHeaderBytes < 0 {
+		errs = append(errs, errors.New("kafka: max header bytes cannot be negative"))
+	}
+	if cfg.HeaderLimitPolicy > HeaderLimitError {
+		errs = append(errs, errors.New("kafka: unknown header limit policy"))
+	}
+	if cfg.ValidationPolicy > ValidationFailBatch {
+		errs = append(errs, errors.New("kafka: unknown validation policy"))
+	}
+	if _, ok := cfg.Encoder.(NamedCodec); cfg.StampCodec && cfg.Encoder != nil && !ok {
+		errs = append(errs, errors.New("kafka: encoder must implement NamedCodec to stamp the codec"))
+	}
+	if cfg.Linger < 0 {
+		errs = append(errs, errors.New("kafka: linger cannot be negative"))
+	}
+	if cfg.MaxBatchBytes < 0 || cfg.MaxBatchBytes > math.MaxInt32 {
+		errs = append(errs, errors.New("kafka: max batch bytes must be between 0 and 2^31-1"))
+	}
+	if cfg.Mirror != nil {
+		if err := cfg.Mirror.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.MaxProduceDelay < 0 {
+		errs = append(errs, errors.New("kafka: max produce delay cannot be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// ProducerStats holds the producer counters.
+type ProducerStats struct {
+	// Expired is the number of events dropped because they were older
+	// than MaxProduceDelay.
+	Expired int64
+	// Mirrored is the number of records mirrored to the secondary cluster.
+	Mirrored int64
+	// MirrorErrors is the number of records which failed to be mirrored.
+	MirrorErrors int64
+	// DeadlineExceeded is the number of records of ProcessBatchAsync which
+	// weren't acknowledged before their context deadline.
+	DeadlineExceeded int64
+}
+
+// Producer implements the model.BatchProcessor interface and sends each of
+// the events in a batch to a Kafka topic.
+type Producer struct {
+	mu      sync.RWMutex
+	cfg     ProducerConfig
+	client  *kgo.Client
+	closed  chan struct{}
+	expired atomic.Int64
+	// deadlineExceeded counts the ProcessBatchAsync records failed because
+	// their context deadline passed.
+	deadlineExceeded atomic.Int64
+	// inflight bounds the concurrent produce calls, when
+	// MaxInflightProduceBatches is set.
+	inflight chan struct{}
+	// partitionStats counts the records produced to each partition.
+	partitionStats *partitionStats
+	// origin holds the static origin headers, when OriginHeaders is set.
+	origin []kgo.RecordHeader
+	// defaults holds the DefaultHeaders, sorted by key.
+	defaults []kgo.RecordHeader
+
+	// opts are the options of client, which the compression override
+	// clients are created with.
+	opts []kgo.Opt
+	// compressed holds the clients of the queuecontext compression
+	// overrides, by codec.
+	compressedMu sync.Mutex
+	compressed   map[string]*kgo.Client
+
+	// sequence is the last sequence stamped on a record, and savedSequence
+	// the last one saved to the SequenceStore.
+	sequence      atomic.Uint64
+	sequenceMu    sync.Mutex
+	savedSequence uint64
+
+	// flush tracks the records being produced, for FlushBarrier.
+	flush flushTracker
+	// dryRun resolves the records produced with DryRun.
+	dryRun *dryRunner
+
+	// secondary is the Mirror producer, if any.
+	secondary    *Producer
+	mirrored     atomic.Int64
+	mirrorErrors atomic.Int64
+}
+
+// NewProducer returns a new Producer with the given config.
+func NewProducer(cfg ProducerConfig) (*Producer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.DefaultProduceTopic(cfg.Topic),
+		kgo.WithLogger(kzap.New(cfg.Logger)),
+	}
+	if len(cfg.SASL) > 0 {
+		opts = append(opts, kgo.SASL(cfg.SASL...))
+	}
+	if cfg.Backoff != nil {
+		opts = append(opts, kgo.RetryBackoffFn(cfg.Backoff.Next))
+	} else if cfg.JitterFraction > 0 {
+		opts = append(opts, kgo.RetryBackoffFn(jitteredBackoff(cfg.JitterFraction)))
+	}
+	if opt := dialOpt(cfg.TLS, cfg.ConnReconnectBackoff); opt != nil {
+		opts = append(opts, opt)
+	}
+	if cfg.MaxProduceAttempts > 0 {
+		opts = append(opts, kgo.RecordRetries(cfg.MaxProduceAttempts))
+	}
+	if cfg.ProduceAckTimeout > 0 {
+		opts = append(opts, kgo.ProduceRequestTimeout(cfg.ProduceAckTimeout))
+	}
+	if cfg.RecordBufferTimeout > 0 {
+		opts = append(opts, kgo.RecordDeliveryTimeout(cfg.RecordBufferTimeout))
+	}
+	if cfg.Linger > 0 {
+		opts = append(opts, kgo.ProducerLinger(cfg.Linger))
+	}
+	if cfg.MaxBatchBytes > 0 {
+		opts = append(opts, kgo.ProducerBatchMaxBytes(int32(cfg.MaxBatchBytes)))
+	}
+	if codec, ok := compressionCodec(cfg.Compression); ok {
+		opts = append(opts, kgo.ProducerBatchCompression(codec))
+	}
+	tracer := newTracer(cfg.TracerProvider, kotel.ClientID(cfg.ClientID))
+	metrics, err := newProducerMetrics(cfg.MeterProvider)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed to create metrics: %w", err)
+	}
+	stats := new(partitionStats)
+	hooks := []kgo.Hook{messageIDHook{}, tracer, stats, metrics}
+	opts = append(opts, kgo.WithHooks(hooks...))
+	if hook := newBrokerHook(cfg.OnBrokerConnect, cfg.OnBrokerDisconnect); hook != nil {
+		opts = append(opts, kgo.WithHooks(hook))
+	}
+	partitioner := cfg.PartitionHash.partitioner()
+	if cfg.StickyPartitioning > 0 {
+		partitioner = newStickyWindowPartitioner(
+			cfg.StickyPartitioning, clockOrDefault(cfg.clock), cfg.PartitionHash,
+		)
+	}
+	if partitioner != nil {
+		opts = append(opts, kgo.RecordPartitioner(partitioner))
+	}
+	if cfg.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.ClientID))
+		if cfg.Version != "" {
+			opts = append(opts, kgo.SoftwareNameAndVersion(
+				cfg.ClientID, cfg.Version,
+			))
+		}
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Issue a metadata refresh request on construction, so the broker list is
+	// populated.
+	client.ForceMetadataRefresh()
+	if cfg.BlockUntilReady > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.BlockUntilReady)
+		err := waitReady(ctx, client)
+		cancel()
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	cfg.Logger = cfg.Logger.With(zap.String("topic", cfg.Topic))
+	if err := checkCompactedTopic(client, cfg); err != nil {
+		client.Close()
+		return nil, err
+	}
+	cfg.clock = clockOrDefault(cfg.clock)
+	if cfg.Encoder == nil {
+		cfg.Encoder = json.JSON{}
+	}
+	sequence, err := loadSequence(cfg)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	var secondary *Producer
+	if cfg.Mirror != nil {
+		if secondary, err = NewProducer(cfg.Mirror.Producer); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("kafka: failed to create mirror producer: %w", err)
+		}
+	}
+	producer := &Producer{
+		cfg:            cfg,
+		client:         client,
+		opts:           opts,
+		closed:         make(chan struct{}),
+		secondary:      secondary,
+		defaults:       sortedHeaders(cfg.DefaultHeaders),
+		partitionStats: stats,
+	}
+	if cfg.DryRun {
+		producer.dryRun = newDryRunner(client, partitioner, hooks...)
+	}
+	producer.sequence.Store(sequence)
+	producer.savedSequence = sequence
+	if cfg.OriginHeaders {
+		producer.origin = staticOriginHeaders(cfg)
+	}
+	if cfg.MaxInflightProduceBatches > 0 {
+		producer.inflight = make(chan struct{}, cfg.MaxInflightProduceBatches)
+	}
+	return producer, nil
+}
+
+// checkCompactedTopic reports producing keyless records to a compacted topic
+// with the configured severity.
+func checkCompactedTopic(client *kgo.Client, cfg ProducerConfig) error {
+	if cfg.CompactedTopicCheck == CompactedTopicCheckDisabled ||
+		cfg.KeyRouter != nil || cfg.KeyValue != nil || cfg.KeyFromMetadata != "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), describeConfigsTimeout)
+	defer cancel()
+	configs, err := kadm.NewClient(client).DescribeTopicConfigs(ctx, cfg.Topic)
+	if err != nil {
+		cfg.Logger.Debug("unable to describe topic configs", zap.Error(err))
+		return nil
+	}
+	config, err := configs.On(cfg.Topic, nil)
+	if err == nil {
+		err = config.Err
+	}
+	if err != nil {
+		cfg.Logger.Debug("unable to describe topic configs", zap.Error(err))
+		return nil
+	}
+	for _, c := range config.Configs {
+		if c.Key != "cleanup.policy" || !strings.Contains(c.MaybeValue(), "compact") {
+			continue
+		}
+		if cfg.CompactedTopicCheck == CompactedTopicCheckError {
+			return fmt.Errorf("kafka: topic %s is compacted, but no key router is set", cfg.Topic)
+		}
+		cfg.Logger.Warn("producing keyless records to a compacted topic, records will be lost on compaction")
+	}
+	return nil
+}
+
+// Close stops the producer, flushing any buffered records. The records
+// buffered by the Mirror producer are flushed for up to mirrorFlushTimeout,
+// then dropped. The returned error, if any, is a *CloseError.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closed:
+		return closeError(nil, errors.New("kafka: producer already closed"))
+	default:
+	}
+	close(p.closed)
+	if p.secondary != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), mirrorFlushTimeout)
+		p.secondary.client.Flush(ctx)
+		cancel()
+		p.secondary.client.Close()
+	}
+	var flushErrs []error
+	if err := p.client.Flush(context.Background()); err != nil {
+		flushErrs = append(flushErrs, fmt.Errorf("kafka: failed to flush records on close: %w", err))
+	}
+	p.client.Close()
+	if err := p.closeCompressed(context.Background()); err != nil {
+		flushErrs = append(flushErrs, err)
+	}
+	return closeError(errors.Join(flushErrs...), nil)
+}
+
+// ProcessBatch produces the events in the batch to the configured topic,
+// waiting until they have been acknowledged by the brokers. The batch is
+// neither mutated nor retained after ProcessBatch returns, so the caller can
+// reuse it. See CopyOnProduce for the bytes returned by the Encoder and the
+// key functions.
+func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
+	_, err := p.produceBatch(ctx, batch)
+	return err
+}
+
+// ProduceWithOffsets produces the batch synchronously like ProcessBatch, and
+// returns the highest offset produced to each topic partition, keyed by topic
+// and partition. The offsets are returned even when some of the records
+// failed to be produced. Together with Consumer.WaitForConsumed, it lets the
+// callers wait until the produced events have been consumed.
+func (p *Producer) ProduceWithOffsets(ctx context.Context, batch *model.Batch) (map[string]map[int32]int64, error) {
+	produced, err := p.produceBatch(ctx, batch)
+	offsets := make(map[string]map[int32]int64)
+	for _, record := range produced {
+		partitions := offsets[record.Topic]
+		if partitions == nil {
+			partitions = make(map[int32]int64)
+			offsets[record.Topic] = partitions
+		}
+		if current, ok := partitions[record.Partition]; !ok || record.Offset > current {
+			partitions[record.Partition] = record.Offset
+		}
+	}
+	return offsets, err
+}
+
+// ProcessByTopic produces the events of each batch to the topic they're keyed
+// by, such as for events already grouped by the caller, instead of Topic or
+// TopicFromMetadata. The batches are produced together, waiting until they
+// have been acknowledged by the brokers, and the errors of all the batches
+// are returned joined. The batches are neither mutated nor retained.
+func (p *Producer) ProcessByTopic(ctx context.Context, batches map[string]model.Batch) error {
+	groups := make([]topicBatch, 0, len(batches))
+	for topic, batch := range batches {
+		if topic == "" {
+			return errors.New("kafka: topic must be set")
+		}
+		groups = append(groups, topicBatch{topic: topic, batch: batch})
+	}
+	_, err := p.produceBatches(ctx, groups)
+	return err
+}
+
+// topicBatch is a batch of events produced to the topic. An empty topic
+// produces the events to Topic.
+type topicBatch struct {
+	topic string
+	batch model.Batch
+}
+
+// produceBatch produces the batch synchronously, returning the records which
+// were produced successfully.
+func (p *Producer) produceBatch(ctx context.Context, batch *model.Batch) ([]*kgo.Record, error) {
+	return p.produceBatches(ctx, []topicBatch{{topic: p.metadataTopic(ctx), batch: *batch}})
+}
+
+// produceBatches produces the batches synchronously to their topics,
+// returning the records which were produced successfully. The batches which
+// fail validation with ValidationFailBatch aren't produced.
+func (p *Producer) produceBatches(ctx context.Context, batches []topicBatch) ([]*kgo.Record, error) {
+	release, err := p.acquireInflight(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	select {
+	case <-p.closed:
+		return nil, errProducerClosed
+	default:
+	}
+	now := p.cfg.clock.Now()
+	headers, err := p.recordHeaders(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	key := p.metadataKey(ctx)
+	client, err := p.compressionClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	var records []*kgo.Record
+	for _, group := range batches {
+		invalid := p.validateBatch(group.batch)
+		errs = append(errs, invalid...)
+		if invalid != nil && p.cfg.ValidationPolicy == ValidationFailBatch {
+			continue
+		}
+		for i, event := range group.batch {
+			if invalid != nil && invalid[i] != nil {
+				continue
+			}
+			if p.expiredEvent(event, now) {
+				p.expired.Add(1)
+				continue
+			}
+			record, err := p.newRecord(event, headers, key)
+			if err != nil {
+				return nil, err
+			}
+			record.Topic = group.topic
+			if !p.interceptProduce(ctx, record) {
+				continue
+			}
+			p.stampSequence(record)
+			records = append(records, record)
+		}
+	}
+	if len(records) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	chunked, err := p.chunkRecords(records)
+	if err != nil {
+		return nil, errors.Join(append(errs, err)...)
+	}
+	p.saveSequence(ctx)
+	p.mirror(records)
+	records = chunked
+	produced := make([]*kgo.Record, 0, len(records))
+	var produceErrs []error
+	epoch := p.flush.add(len(records))
+	defer p.flush.done(epoch, len(records))
+	if p.cfg.DryRun {
+		for _, record := range records {
+			err := p.dryRun.produce(ctx, record, p.cfg.Topic)
+			if err == nil {
+				produced = append(produced, record)
+			}
+			if err := p.produceError(record, err); err != nil {
+				produceErrs = append(produceErrs, err)
+			}
+		}
+		return produced, errors.Join(append(errs, produceErrs...)...)
+	}
+	for _, split := range splitRecords(records, p.cfg.SplitBatchRecords, p.cfg.SplitBatchBytes) {
+		for _, res := range client.ProduceSync(ctx, split...) {
+			if res.Err == nil {
+				produced = append(produced, res.Record)
+			}
+			if err := p.produceError(res.Record, res.Err); err != nil {
+				produceErrs = append(produceErrs, err)
+			}
+		}
+	}
+	if p.cfg.TraceProduceErrors && len(produceErrs) > 0 {
+		recordSpanError(ctx, errors.Join(produceErrs...))
+	}
+	return produced, errors.Join(append(errs, produceErrs...)...)
+}
+
+// recordHeaders returns the headers set on all the records of a batch, merged
+// onto the default headers, with the header limits applied.
+func (p *Producer) recordHeaders(ctx context.Context, now time.Time) ([]kgo.RecordHeader, error) {
+	var headers []kgo.RecordHeader
+	if projectID, ok := queuecontext.ProjectFromContext(ctx); ok {
+		headers = append(headers, kgo.RecordHeader{
+			Key: "project_id", Value: []byte(projectID),
+		})
+	}
+	if p.cfg.OriginHeaders {
+		headers = append(headers, p.origin...)
+		headers = append(headers, producedAtHeader(now))
+	}
+	if p.cfg.StampCodec {
+		headers = append(headers, codecHeader(p.cfg.Encoder))
+	}
+	return limitHeaders(p.cfg, mergeHeaders(p.defaults, headers))
+}
+
+// splitRecords splits the records into sub-batches of up to maxRecords
+// records and maxBytes bytes. A zero limit isn't enforced.
+func splitRecords(records []*kgo.Record, maxRecords, maxBytes int) [][]*kgo.Record {
+	if maxRecords == 0 && maxBytes == 0 {
+		return [][]*kgo.Record{records}
+	}
+	var splits [][]*kgo.Record
+	var start int
+	var size int64
+	for i, r := range records {
+		n := recordSize(r)
+		overRecords := maxRecords > 0 && i-start >= maxRecords
+		overBytes := maxBytes > 0 && size+n > int64(maxBytes)
+		if i > start && (overRecords || overBytes) {
+			splits = append(splits, records[start:i])
+			start, size = i, 0
+		}
+		size += n
+	}
+	return append(splits, records[start:])
+}
+
+// acquireInflight blocks until the call can run within the
+// MaxInflightProduceBatches limit, or the context is done. The returned
+// function releases the call slot.
+func (p *Producer) acquireInflight(ctx context.Context) (func(), error) {
+	if p.inflight == nil {
+		return func() {}, nil
+	}
+	select {
+	case p.inflight <- struct{}{}:
+		return func() { <-p.inflight }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// metadataKey returns the record key held by the KeyFromMetadata entry of
+// the queuecontext metadata, or nil if there is none.
+func (p *Producer) metadataKey(ctx context.Context) []byte {
+	if p.cfg.KeyFromMetadata == "" {
+		return nil
+	}
+	metadata, _ := queuecontext.MetadataFromContext(ctx)
+	if value, ok := metadata[p.cfg.KeyFromMetadata]; ok {
+		return []byte(value)
+	}
+	return nil
+}
+
+// metadataTopic returns the topic named by the TopicFromMetadata entry of
+// the queuecontext metadata, or an empty topic to produce to Topic.
+func (p *Producer) metadataTopic(ctx context.Context) string {
+	if p.cfg.TopicFromMetadata == "" {
+		return ""
+	}
+	metadata, _ := queuecontext.MetadataFromContext(ctx)
+	if value, ok := metadata[p.cfg.TopicFromMetadata]; ok && value != "" {
+		return p.cfg.TopicFromMetadataPrefix + value
+	}
+	return ""
+}
+
+// newRecord encodes the event and its key into a record. A non-nil key takes
+// precedence over the KeyRouter and KeyValue keys.
+func (p *Producer) newRecord(event model.APMEvent, headers []kgo.RecordHeader, key []byte) (*kgo.Record, error) {
+	encoded, err := p.cfg.Encoder.Encode(event)
+	if err != nil {
+		return nil, err
+	}
+	record := &kgo.Record{
+		Headers: headers,
+		Value:   encoded,
+	}
+	switch {
+	case key != nil:
+		record.Key = key
+	case p.cfg.KeyRouter != nil:
+		record.Key = p.cfg.KeyRouter(event)
+	case p.cfg.KeyValue != nil:
+		if record.Key, err = p.cfg.KeyEncoder.EncodeKey(p.cfg.KeyValue(event)); err != nil {
+			return nil, err
+		}
+	}
+	if p.cfg.CopyOnProduce {
+		record.Value = copyBytes(record.Value)
+		record.Key = copyBytes(record.Key)
+	}
+	return record, nil
+}
+
+// copyBytes returns a copy of b, or nil if b is nil.
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
+
+// produceError logs the error of a record which failed to be produced and
+// returns it, wrapping ErrRecordTimeout when the record timed out, and
+// ErrInsufficientReplicas when there weren't enough in-sync replicas.
+func (p *Producer) produceError(record *kgo.Record, err error) error {
+	if err == nil {
+		return nil
+	}
+	p.cfg.Logger.Error("failed producing message",
+		zap.Error(err),
+		zap.Int32("partition", record.Partition),
+	)
+	switch {
+	case errors.Is(err, kgo.ErrRecordTimeout):
+		err = fmt.Errorf("%w: %w", ErrRecordTimeout, err)
+	case errors.Is(err, kerr.NotEnoughReplicas), errors.Is(err, kerr.NotEnoughReplicasAfterAppend):
+		err = fmt.Errorf("%w: %w", ErrInsufficientReplicas, err)
+	}
+	return err
+}
+
+// expiredEvent returns true when the event is older than MaxProduceDelay.
+func (p *Producer) expiredEvent(event model.APMEvent, now time.Time) bool {
+	if p.cfg.MaxProduceDelay <= 0 || event.Timestamp.IsZero() {
+		return false
+	}
+	return now.Sub(event.Timestamp) > p.cfg.MaxProduceDelay
+}
+
+// Stats returns the producer counters.
+func (p *Producer) Stats() ProducerStats {
+	return ProducerStats{
+		Expired:          p.expired.Load(),
+		Mirrored:         p.mirrored.Load(),
+		MirrorErrors:     p.mirrorErrors.Load(),
+		DeadlineExceeded: p.deadlineExceeded.Load(),
+	}
+}
+
+// Healthy returns an error if the Kafka active broker length of any of the
+// producer clients, including the ones of the compression overrides, dips
+// below 1.
+func (p *Producer) Healthy() error {
+	for _, client := range p.clients() {
+		if brokers := client.DiscoveredBrokers(); len(brokers) < 1 {
+			return fmt.Errorf("number of brokers below 1")
+		}
+	}
+	return nil
+}
+
+// readyBackoff is the time waited between the metadata requests issued by
+// WaitReady.
+var readyBackoff = ExponentialBackoff{
+	Min: 100 * time.Millisecond, Max: 2 * time.Second,
+}
+
+// WaitReady blocks until a metadata request to the cluster succeeds, such as
+// to gate startup until the cluster is reachable, for each of the producer
+// clients, including the ones of the compression overrides. When ctx is done
+// first, the returned error wraps the ctx error and the last metadata request
+// error.
+func (p *Producer) WaitReady(ctx context.Context) error {
+	for _, client := range p.clients() {
+		if err := waitReady(ctx, client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func waitReady(ctx context.Context, client *kgo.Client) error {
+	admin := kadm.NewClient(client)
+	for attempt := 1; ; attempt++ {
+		_, err := admin.BrokerMetadata(ctx)
+		if err == nil {
+			return nil
+		}
+		if !wait(ctx, readyBackoff, attempt) {
+			return fmt.Errorf("kafka: cluster not ready: %w: %w", ctx.Err(), err)
+		}
+	}
+}
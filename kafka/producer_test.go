@@ -0,0 +1,1254 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/oauth"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queueconfig"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestNewProducer(t *testing.T) {
+	_, err := NewProducer(ProducerConfig{})
+	assert.Error(t, err)
+}
+
+func TestProducerConfigValidate(t *testing.T) {
+	valid := func() ProducerConfig {
+		return ProducerConfig{
+			Brokers: []string{"localhost:9092"},
+			Topic:   "topic",
+			Logger:  zap.NewNop(),
+		}
+	}
+	for name, tc := range map[string]struct {
+		modify func(*ProducerConfig)
+		err    string
+	}{
+		"brokers": {
+			modify: func(cfg *ProducerConfig) { cfg.Brokers = nil },
+			err:    "kafka: at least one broker must be set",
+		},
+		"topic": {
+			modify: func(cfg *ProducerConfig) { cfg.Topic = "" },
+			err:    "kafka: topic must be set",
+		},
+		"logger": {
+			modify: func(cfg *ProducerConfig) { cfg.Logger = nil },
+			err:    "kafka: logger must be set",
+		},
+		"jitter_fraction": {
+			modify: func(cfg *ProducerConfig) { cfg.JitterFraction = 1.5 },
+			err:    "kafka: jitter fraction must be between 0 and 1",
+		},
+		"partition_hash": {
+			modify: func(cfg *ProducerConfig) { cfg.PartitionHash = 100 },
+			err:    "kafka: unknown partition hash",
+		},
+		"key_router_and_key_value": {
+			modify: func(cfg *ProducerConfig) {
+				cfg.KeyRouter = func(model.APMEvent) []byte { return nil }
+				cfg.KeyValue = func(model.APMEvent) any { return nil }
+				cfg.KeyEncoder = StringKeyEncoder
+			},
+			err: "kafka: key router and key value cannot be set together",
+		},
+		"key_value_without_encoder": {
+			modify: func(cfg *ProducerConfig) {
+				cfg.KeyValue = func(model.APMEvent) any { return nil }
+			},
+			err: "kafka: key value and key encoder must be set together",
+		},
+		"compression": {
+			modify: func(cfg *ProducerConfig) { cfg.Compression = "brotli" },
+			err:    `kafka: unknown compression codec "brotli"`,
+		},
+		"topic_from_metadata_prefix": {
+			modify: func(cfg *ProducerConfig) { cfg.TopicFromMetadataPrefix = "prefix-" },
+			err:    "kafka: topic from metadata must be set to use its prefix",
+		},
+		"compacted_topic_check": {
+			modify: func(cfg *ProducerConfig) { cfg.CompactedTopicCheck = 100 },
+			err:    "kafka: unknown compacted topic check",
+		},
+		"block_until_ready": {
+			modify: func(cfg *ProducerConfig) { cfg.BlockUntilReady = -1 },
+			err:    "kafka: block until ready cannot be negative",
+		},
+		"produce_ack_timeout": {
+			modify: func(cfg *ProducerConfig) { cfg.ProduceAckTimeout = time.Millisecond },
+			err:    "kafka: produce ack timeout must be at least 100ms",
+		},
+		"record_buffer_timeout": {
+			modify: func(cfg *ProducerConfig) { cfg.RecordBufferTimeout = time.Millisecond },
+			err:    "kafka: record buffer timeout must be at least 1s",
+		},
+		"reconnect_backoff": {
+			modify: func(cfg *ProducerConfig) {
+				cfg.ConnReconnectBackoff = ReconnectBackoff{Min: time.Second, Max: time.Millisecond}
+			},
+			err: "kafka: reconnect backoff min cannot be greater than max",
+		},
+		"max_header_count": {
+			modify: func(cfg *ProducerConfig) { cfg.MaxHeaderCount = -1 },
+			err:    "kafka: max header count cannot be negative",
+		},
+		"header_limit_policy": {
+			modify: func(cfg *ProducerConfig) { cfg.HeaderLimitPolicy = 100 },
+			err:    "kafka: unknown header limit policy",
+		},
+		"validation_policy": {
+			modify: func(cfg *ProducerConfig) { cfg.ValidationPolicy = 100 },
+			err:    "kafka: unknown validation policy",
+		},
+		"linger": {
+			modify: func(cfg *ProducerConfig) { cfg.Linger = -time.Second },
+			err:    "kafka: linger cannot be negative",
+		},
+		"max_batch_bytes": {
+			modify: func(cfg *ProducerConfig) { cfg.MaxBatchBytes = -1 },
+			err:    "kafka: max batch bytes must be between 0 and 2^31-1",
+		},
+		"negative_max_produce_delay": {
+			modify: func(cfg *ProducerConfig) { cfg.MaxProduceDelay = -time.Second },
+			err:    "kafka: max produce delay cannot be negative",
+		},
+		"chunk_size": {
+			modify: func(cfg *ProducerConfig) { cfg.ChunkSize = -1 },
+			err:    "kafka: chunk size cannot be negative",
+		},
+		"max_produce_retries": {
+			modify: func(cfg *ProducerConfig) { cfg.MaxProduceAttempts = -1 },
+			err:    "kafka: max produce attempts cannot be negative",
+		},
+		"sequence_store_without_header": {
+			modify: func(cfg *ProducerConfig) { cfg.SequenceStore = new(memorySequenceStore) },
+			err:    "kafka: sequence header must be set to store the sequence",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid()
+			tc.modify(&cfg)
+			assert.EqualError(t, cfg.Validate(), tc.err)
+		})
+	}
+	t.Run("valid", func(t *testing.T) {
+		assert.NoError(t, valid().Validate())
+	})
+}
+
+func TestProducerMaxProduceDelay(t *testing.T) {
+	topic := "max-produce-delay"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:         cluster.ListenAddrs(),
+		Topic:           topic,
+		Logger:          zaptest.NewLogger(t),
+		MaxProduceDelay: time.Minute,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	now := time.Now()
+	batch := model.Batch{
+		{Timestamp: now.Add(-time.Hour), Trace: model.Trace{ID: "old"}},
+		{Timestamp: now, Trace: model.Trace{ID: "fresh"}},
+		{Timestamp: now.Add(-2 * time.Minute), Trace: model.Trace{ID: "stale"}},
+		{Timestamp: now.Add(-time.Second), Trace: model.Trace{ID: "recent"}},
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Equal(t, ProducerStats{Expired: 2}, producer.Stats())
+
+	var ids []string
+	for _, record := range consumeRecords(t, cluster, topic, 2) {
+		var event model.APMEvent
+		require.NoError(t, json.Unmarshal(record.Value, &event))
+		ids = append(ids, event.Trace.ID)
+	}
+	assert.ElementsMatch(t, []string{"fresh", "recent"}, ids)
+}
+
+func TestProducerMaxProduceDelayClock(t *testing.T) {
+	topic := "max-produce-delay-clock"
+	cluster := newFakeCluster(t, 1, topic)
+	clock := newFakeClock(time.Now())
+	cfg := ProducerConfig{
+		Brokers:         cluster.ListenAddrs(),
+		Topic:           topic,
+		Logger:          zaptest.NewLogger(t),
+		MaxProduceDelay: time.Minute,
+	}
+	cfg.withClock(clock)
+	producer, err := NewProducer(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	batch := model.Batch{{Timestamp: clock.Now()}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Equal(t, ProducerStats{}, producer.Stats())
+
+	// The same event expires once the clock moves past MaxProduceDelay.
+	clock.Advance(time.Minute + time.Second)
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Equal(t, ProducerStats{Expired: 1}, producer.Stats())
+	assert.Len(t, consumeRecords(t, cluster, topic, 1), 1)
+}
+
+func TestProducerOriginHeaders(t *testing.T) {
+	topic := "origin-headers"
+	cluster := newFakeCluster(t, 1, topic)
+	now := time.Date(2023, 6, 1, 10, 0, 0, 123, time.UTC)
+	cfg := ProducerConfig{
+		Brokers:       cluster.ListenAddrs(),
+		Topic:         topic,
+		ClientID:      "origin-client",
+		Logger:        zaptest.NewLogger(t),
+		OriginHeaders: true,
+	}
+	cfg.withClock(newFakeClock(now))
+	producer, err := NewProducer(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx := queuecontext.WithProject(context.Background(), "project")
+	batch := model.Batch{{Trace: model.Trace{ID: "a"}}}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	records := consumeRecords(t, cluster, topic, 1)
+	require.Len(t, records, 1)
+	headers := make(map[string]string)
+	for _, h := range records[0].Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	host, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, "project", headers["project_id"])
+	assert.Equal(t, "origin-client", headers[OriginClientIDHeader])
+	assert.Equal(t, host, headers[OriginHostHeader])
+	assert.Equal(t, "2023-06-01T10:00:00.000000123Z", headers[OriginProducedAtHeader])
+}
+
+func TestProducerMaxInflightProduceBatches(t *testing.T) {
+	topic := "max-inflight"
+	cluster := newFakeCluster(t, 1, topic)
+	const limit = 2
+	var inflight, peak atomic.Int64
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:                   cluster.ListenAddrs(),
+		Topic:                     topic,
+		Logger:                    zaptest.NewLogger(t),
+		MaxInflightProduceBatches: limit,
+		ValidateEvent: func(model.APMEvent) error {
+			n := inflight.Add(1)
+			defer inflight.Add(-1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch := model.Batch{{}}
+			assert.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, peak.Load(), int64(limit))
+
+	// The ProcessBatchAsync calls hold their slot until their futures are
+	// resolved, the calls beyond the limit give up once their context is
+	// done.
+	unblock := make(chan struct{})
+	var unblockOnce sync.Once
+	unblockProduce := func() { unblockOnce.Do(func() { close(unblock) }) }
+	t.Cleanup(unblockProduce)
+	cluster.ControlKey(int16(kmsg.Produce), func(kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		<-unblock
+		return nil, nil, false
+	})
+	var futures []*Future
+	for i := 0; i < limit; i++ {
+		batch := model.Batch{{}}
+		futures = append(futures, producer.ProcessBatchAsync(context.Background(), &batch)...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	batch := model.Batch{{}}
+	assert.ErrorIs(t, producer.ProcessBatch(ctx, &batch), context.DeadlineExceeded)
+
+	unblockProduce()
+	for _, f := range futures {
+		_, err := f.Wait(context.Background())
+		require.NoError(t, err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, producer.ProcessBatch(ctx, &batch))
+}
+
+func TestSplitRecords(t *testing.T) {
+	records := make([]*kgo.Record, 5)
+	for i := range records {
+		records[i] = &kgo.Record{Value: make([]byte, 10)}
+	}
+	lens := func(splits [][]*kgo.Record) []int {
+		var n []int
+		for _, split := range splits {
+			n = append(n, len(split))
+		}
+		return n
+	}
+	assert.Equal(t, []int{5}, lens(splitRecords(records, 0, 0)))
+	assert.Equal(t, []int{2, 2, 1}, lens(splitRecords(records, 2, 0)))
+	assert.Equal(t, []int{3, 2}, lens(splitRecords(records, 0, 35)))
+	assert.Equal(t, []int{2, 2, 1}, lens(splitRecords(records, 3, 25)))
+	// Records bigger than the limit are split on their own.
+	assert.Equal(t, []int{1, 1, 1, 1, 1}, lens(splitRecords(records, 0, 5)))
+}
+
+func TestProducerSplitBatch(t *testing.T) {
+	topic := "split-batch"
+	cluster := newFakeCluster(t, 2, topic)
+	var requests atomic.Int64
+	cluster.ControlKey(int16(kmsg.Produce), func(kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		requests.Add(1)
+		return nil, nil, false
+	})
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:           cluster.ListenAddrs(),
+		Topic:             topic,
+		Logger:            zaptest.NewLogger(t),
+		SplitBatchRecords: 100,
+		SplitBatchBytes:   16 << 10,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	const events = 2000
+	batch := make(model.Batch, events)
+	for i := range batch {
+		batch[i] = model.APMEvent{Trace: model.Trace{ID: fmt.Sprint(i)}}
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	// Each sub-batch is produced separately.
+	assert.GreaterOrEqual(t, requests.Load(), int64(events/100))
+
+	ids := make(map[string]bool)
+	for _, record := range consumeRecords(t, cluster, topic, events) {
+		var event model.APMEvent
+		require.NoError(t, json.Unmarshal(record.Value, &event))
+		ids[event.Trace.ID] = true
+	}
+	assert.Len(t, ids, events)
+}
+
+// reusingEncoder encodes the event messages into the same buffer.
+type reusingEncoder struct{ buf []byte }
+
+func (e *reusingEncoder) Encode(event model.APMEvent) ([]byte, error) {
+	e.buf = append(e.buf[:0], event.Message...)
+	return e.buf, nil
+}
+
+func TestProducerCopyOnProduce(t *testing.T) {
+	topic := "copy-on-produce"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:       cluster.ListenAddrs(),
+		Topic:         topic,
+		Logger:        zaptest.NewLogger(t),
+		Encoder:       &reusingEncoder{},
+		CopyOnProduce: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	batch := model.Batch{{Message: "a"}, {Message: "b"}, {Message: "c"}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	assert.Equal(t, model.Batch{{Message: "a"}, {Message: "b"}, {Message: "c"}}, batch)
+	// The caller reuses the batch once ProcessBatch returns.
+	for i := range batch {
+		batch[i] = model.APMEvent{Message: "reused"}
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	var values []string
+	for _, record := range consumeRecords(t, cluster, topic, 6) {
+		values = append(values, string(record.Value))
+	}
+	assert.Equal(t, []string{"a", "b", "c", "reused", "reused", "reused"}, values)
+}
+
+func TestProducerDefaultHeaders(t *testing.T) {
+	topic := "default-headers"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+		DefaultHeaders: map[string]string{
+			"tenant":     "t1",
+			"region":     "eu",
+			"project_id": "default",
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	batch := model.Batch{{Trace: model.Trace{ID: "a"}}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	ctx := queuecontext.WithProject(context.Background(), "project")
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	records := consumeRecords(t, cluster, topic, 2)
+	require.Len(t, records, 2)
+	headers := func(r *kgo.Record) map[string]string {
+		m := make(map[string]string)
+		for _, h := range r.Headers {
+			if h.Key != "traceparent" {
+				m[h.Key] = string(h.Value)
+			}
+		}
+		return m
+	}
+	assert.Equal(t, map[string]string{
+		"tenant": "t1", "region": "eu", "project_id": "default",
+	}, headers(records[0]))
+	// The context project overrides the default header.
+	assert.Equal(t, map[string]string{
+		"tenant": "t1", "region": "eu", "project_id": "project",
+	}, headers(records[1]))
+	var projectHeaders int
+	for _, h := range records[1].Headers {
+		if h.Key == "project_id" {
+			projectHeaders++
+		}
+	}
+	assert.Equal(t, 1, projectHeaders)
+}
+
+func TestProducerHeaderLimits(t *testing.T) {
+	project := strings.Repeat("p", 1024)
+	for name, tc := range map[string]struct {
+		modify  func(*ProducerConfig)
+		headers []string
+		err     error
+	}{
+		"unlimited": {
+			headers: []string{"project_id", OriginHostHeader, OriginProducedAtHeader},
+		},
+		"truncate_count": {
+			modify:  func(cfg *ProducerConfig) { cfg.MaxHeaderCount = 2 },
+			headers: []string{"project_id", OriginHostHeader},
+		},
+		"truncate_bytes": {
+			// The project_id header alone exceeds the limit.
+			modify: func(cfg *ProducerConfig) { cfg.MaxHeaderBytes = 512 },
+		},
+		"error": {
+			modify: func(cfg *ProducerConfig) {
+				cfg.MaxHeaderBytes = 512
+				cfg.HeaderLimitPolicy = HeaderLimitError
+			},
+			err: ErrHeaderLimit,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			topic := "header-limits"
+			cluster := newFakeCluster(t, 1, topic)
+			cfg := ProducerConfig{
+				Brokers:       cluster.ListenAddrs(),
+				Topic:         topic,
+				Logger:        zaptest.NewLogger(t),
+				OriginHeaders: true,
+			}
+			if tc.modify != nil {
+				tc.modify(&cfg)
+			}
+			producer, err := NewProducer(cfg)
+			require.NoError(t, err)
+			t.Cleanup(func() { producer.Close() })
+
+			ctx := queuecontext.WithProject(context.Background(), project)
+			batch := model.Batch{{Trace: model.Trace{ID: "a"}}}
+			err = producer.ProcessBatch(ctx, &batch)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			records := consumeRecords(t, cluster, topic, 1)
+			require.Len(t, records, 1)
+			var headers []string
+			for _, h := range records[0].Headers {
+				if h.Key != "traceparent" {
+					headers = append(headers, h.Key)
+				}
+			}
+			assert.Equal(t, tc.headers, headers)
+		})
+	}
+}
+
+func TestProducerValidateEvent(t *testing.T) {
+	errMissingTraceID := errors.New("missing trace.id")
+	for name, tc := range map[string]struct {
+		policy   ValidationPolicy
+		produced []string
+	}{
+		"drop_invalid": {policy: ValidationDropInvalid, produced: []string{"a", "c"}},
+		"fail_batch":   {policy: ValidationFailBatch},
+	} {
+		t.Run(name, func(t *testing.T) {
+			topic := "validate-event"
+			cluster := newFakeCluster(t, 1, topic)
+			producer, err := NewProducer(ProducerConfig{
+				Brokers: cluster.ListenAddrs(),
+				Topic:   topic,
+				Logger:  zaptest.NewLogger(t),
+				ValidateEvent: func(event model.APMEvent) error {
+					if event.Trace.ID == "" {
+						return errMissingTraceID
+					}
+					return nil
+				},
+				ValidationPolicy: tc.policy,
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() { producer.Close() })
+
+			batch := model.Batch{
+				{Trace: model.Trace{ID: "a"}},
+				{},
+				{Trace: model.Trace{ID: "c"}},
+			}
+			err = producer.ProcessBatch(context.Background(), &batch)
+			assert.ErrorIs(t, err, ErrValidation)
+			assert.ErrorIs(t, err, errMissingTraceID)
+			var validationErr ValidationError
+			require.ErrorAs(t, err, &validationErr)
+			assert.Equal(t, 1, validationErr.Index)
+
+			// Produce a marker event, so the consumed records can be
+			// asserted when nothing was produced by the invalid batch.
+			marker := model.Batch{{Trace: model.Trace{ID: "marker"}}}
+			require.NoError(t, producer.ProcessBatch(context.Background(), &marker))
+			records := consumeRecords(t, cluster, topic, len(tc.produced)+1)
+			var produced []string
+			for _, r := range records {
+				var event model.APMEvent
+				require.NoError(t, json.Unmarshal(r.Value, &event))
+				produced = append(produced, event.Trace.ID)
+			}
+			assert.Equal(t, append(tc.produced, "marker"), produced)
+		})
+	}
+}
+
+func TestProducerPartitionStats(t *testing.T) {
+	topic := "partition-stats"
+	cluster := newFakeCluster(t, 4, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+		KeyRouter: func(event model.APMEvent) []byte {
+			return []byte(event.Service.Name)
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+	assert.Empty(t, producer.PartitionStats())
+
+	var batch model.Batch
+	for i := 0; i < 100; i++ {
+		service := "hot"
+		if i%10 == 0 {
+			service = fmt.Sprintf("cold-%d", i)
+		}
+		batch = append(batch, model.APMEvent{Service: model.Service{Name: service}})
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	stats := producer.PartitionStats()
+	require.Contains(t, stats, topic)
+	var total, hot PartitionStat
+	for _, stat := range stats[topic] {
+		total.Records += stat.Records
+		total.Bytes += stat.Bytes
+		if stat.Records > hot.Records {
+			hot = stat
+		}
+	}
+	assert.Equal(t, int64(100), total.Records)
+	assert.GreaterOrEqual(t, hot.Records, int64(90))
+	assert.Greater(t, hot.Bytes, total.Bytes/2)
+}
+
+func TestProducerCompressionRatio(t *testing.T) {
+	cluster := newFakeCluster(t, 1, "compressible", "incompressible")
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	random := make([]byte, 4096)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	messages := map[string]string{
+		"compressible":   strings.Repeat("a", 8192),
+		"incompressible": base64.StdEncoding.EncodeToString(random),
+	}
+	for topic, message := range messages {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers:       cluster.ListenAddrs(),
+			Topic:         topic,
+			Logger:        zaptest.NewLogger(t),
+			MeterProvider: mp,
+		})
+		require.NoError(t, err)
+		batch := model.Batch{{Message: message}}
+		require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+		stat := producer.PartitionStats()[topic][0]
+		assert.Greater(t, stat.UncompressedBytes, int64(0))
+		assert.Greater(t, stat.CompressedBytes, int64(0))
+		require.NoError(t, producer.Close())
+	}
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	require.Len(t, rm.ScopeMetrics[0].Metrics, 1)
+	m := rm.ScopeMetrics[0].Metrics[0]
+	assert.Equal(t, "apmqueue.producer.compression.ratio", m.Name)
+	hist, ok := m.Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	require.Len(t, hist.DataPoints, 2)
+	ratios := make(map[string]float64)
+	for _, dp := range hist.DataPoints {
+		topic, _ := dp.Attributes.Value("messaging.destination.name")
+		codec, _ := dp.Attributes.Value("compression.codec")
+		assert.Equal(t, "snappy", codec.AsString())
+		assert.Equal(t, uint64(1), dp.Count)
+		ratios[topic.AsString()] = dp.Sum
+	}
+	assert.Greater(t, ratios["compressible"], 4.0)
+	assert.Less(t, ratios["incompressible"], 1.5)
+}
+
+func TestProducerProcessByTopic(t *testing.T) {
+	cluster := newFakeCluster(t, 1, "default", "routed", "topic-a", "topic-b")
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:           cluster.ListenAddrs(),
+		Topic:             "default",
+		Logger:            zaptest.NewLogger(t),
+		TopicFromMetadata: "topic",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	// The topic routing is bypassed.
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{
+		"topic": "routed",
+	})
+	require.NoError(t, producer.ProcessByTopic(ctx, map[string]model.Batch{
+		"topic-a": {{Trace: model.Trace{ID: "a1"}}, {Trace: model.Trace{ID: "a2"}}},
+		"topic-b": {{Trace: model.Trace{ID: "b1"}}},
+	}))
+	for topic, ids := range map[string][]string{
+		"topic-a": {"a1", "a2"},
+		"topic-b": {"b1"},
+	} {
+		var got []string
+		for _, record := range consumeRecords(t, cluster, topic, len(ids)) {
+			var event model.APMEvent
+			require.NoError(t, json.Unmarshal(record.Value, &event))
+			got = append(got, event.Trace.ID)
+		}
+		assert.Equal(t, ids, got, topic)
+	}
+	// Nothing was produced to the routed and default topics.
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	offsets, err := kadm.NewClient(client).ListEndOffsets(context.Background(), "default", "routed")
+	require.NoError(t, err)
+	offsets.Each(func(o kadm.ListedOffset) {
+		assert.Equal(t, int64(0), o.Offset, o.Topic)
+	})
+
+	assert.EqualError(t, producer.ProcessByTopic(ctx, map[string]model.Batch{"": {{}}}),
+		"kafka: topic must be set",
+	)
+}
+
+func TestProducerCompressionOverride(t *testing.T) {
+	topic := "compression-override"
+	cluster := newFakeCluster(t, 1, topic)
+	reader := sdkmetric.NewManualReader()
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:       cluster.ListenAddrs(),
+		Topic:         topic,
+		Logger:        zaptest.NewLogger(t),
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		Compression:   "lz4",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	message := strings.Repeat("a", 8192)
+	batch := model.Batch{{Message: message}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	ctx := queuecontext.WithCompression(context.Background(), "zstd")
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	_, err = producer.ProcessBatchAsync(ctx, &batch)[0].Wait(ctx)
+	require.NoError(t, err)
+
+	// Unknown codecs fail the call.
+	ctx = queuecontext.WithCompression(context.Background(), "unknown")
+	assert.EqualError(t, producer.ProcessBatch(ctx, &batch), `kafka: unknown compression codec "unknown"`)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	hist, ok := rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	batches := make(map[string]uint64)
+	for _, dp := range hist.DataPoints {
+		codec, _ := dp.Attributes.Value("compression.codec")
+		batches[codec.AsString()] += dp.Count
+	}
+	assert.Equal(t, map[string]uint64{"lz4": 1, "zstd": 2}, batches)
+	assert.Len(t, consumeRecords(t, cluster, topic, 3), 3)
+	assert.Equal(t, int64(3), producer.PartitionStats()[topic][0].Records)
+
+	// The client of the override is used by the client wide calls.
+	require.Len(t, producer.clients(), 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, producer.RefreshMetadata(ctx))
+	assert.NoError(t, producer.WaitReady(ctx))
+	assert.NoError(t, producer.Healthy())
+	versions, err := producer.APIVersions(ctx)
+	require.NoError(t, err)
+	assert.NotEmpty(t, versions)
+}
+
+func TestProducerCompressionOverrideDefault(t *testing.T) {
+	topic := "compression-override-default"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	// The override of the default codec reuses the producer client.
+	ctx := queuecontext.WithCompression(context.Background(), defaultCompression)
+	batch := model.Batch{{}}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	assert.Len(t, producer.clients(), 1)
+}
+
+func TestProducerSASLFallback(t *testing.T) {
+	topic := "sasl-fallback"
+	cluster, err := kfake.NewCluster(
+		kfake.NumBrokers(1),
+		kfake.SeedTopics(1, topic),
+		kfake.EnableSASL(),
+		kfake.Superuser("SCRAM-SHA-256", "user", "pass"),
+	)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+
+	// kfake rejects the OAUTHBEARER handshake, advertising the SCRAM
+	// mechanisms as supported.
+	oauthMechanism := oauth.Auth{Token: "token"}.AsMechanism()
+	scramMechanism := scram.Auth{User: "user", Pass: "pass"}.AsSha256Mechanism()
+	newProducer := func(mechanisms ...sasl.Mechanism) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers: cluster.ListenAddrs(),
+			Topic:   topic,
+			Logger:  zaptest.NewLogger(t),
+			SASL:    mechanisms,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { producer.Close() })
+		return producer
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	batch := model.Batch{{Trace: model.Trace{ID: "id"}}}
+	producer := newProducer(oauthMechanism, scramMechanism)
+	assert.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	producer = newProducer(oauthMechanism)
+	assert.Error(t, producer.ProcessBatch(ctx, &batch))
+}
+
+func TestProducerTracing(t *testing.T) {
+	topic := "tracing"
+	cluster := newFakeCluster(t, 1, topic)
+	recorder := tracetest.NewSpanRecorder()
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+		TracerProvider: sdktrace.NewTracerProvider(
+			sdktrace.WithSpanProcessor(recorder),
+		),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	batch := model.Batch{{Trace: model.Trace{ID: "id"}}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, topic+" publish", spans[0].Name())
+	assert.Equal(t, trace.SpanKindProducer, spans[0].SpanKind())
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range spans[0].Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, map[attribute.Key]attribute.Value{
+		"messaging.system":                      attribute.StringValue("kafka"),
+		"messaging.destination.kind":            attribute.StringValue("topic"),
+		"messaging.destination.name":            attribute.StringValue(topic),
+		"messaging.operation":                   attribute.StringValue("publish"),
+		"messaging.kafka.destination.partition": attribute.IntValue(0),
+		"messaging.message.id":                  attribute.StringValue("0"),
+	}, attrs)
+}
+
+func TestProducerTraceProduceErrors(t *testing.T) {
+	topic := "trace-produce-errors"
+	cluster := newFakeCluster(t, 1, topic)
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:            cluster.ListenAddrs(),
+		Topic:              topic,
+		Logger:             zaptest.NewLogger(t),
+		TracerProvider:     tp,
+		TraceProduceErrors: true,
+		ProducerBatching:   queueconfig.ProducerBatching{MaxBatchBytes: 1024},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "caller")
+	// The record is larger than the max batch size, so it fails.
+	batch := model.Batch{{Message: strings.Repeat("a", 4096)}}
+	produceErr := producer.ProcessBatch(ctx, &batch)
+	require.Error(t, produceErr)
+	span.End()
+
+	var caller sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Name() == "caller" {
+			caller = s
+		}
+	}
+	require.NotNil(t, caller)
+	assert.Equal(t, codes.Error, caller.Status().Code)
+	require.Len(t, caller.Events(), 1)
+	event := caller.Events()[0]
+	assert.Equal(t, "exception", event.Name)
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range event.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, produceErr.Error(), attrs["exception.message"].AsString())
+}
+
+func TestProducerCompactedTopicCheck(t *testing.T) {
+	topic := "compacted"
+	cluster := newFakeCluster(t, 1)
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	policy := "compact"
+	_, err = kadm.NewClient(client).CreateTopic(context.Background(), 1, 1,
+		map[string]*string{"cleanup.policy": &policy}, topic,
+	)
+	require.NoError(t, err)
+
+	newProducer := func(cfg ProducerConfig) (*Producer, *observer.ObservedLogs, error) {
+		core, logs := observer.New(zap.WarnLevel)
+		cfg.Brokers = cluster.ListenAddrs()
+		cfg.Topic = topic
+		cfg.Logger = zap.New(core)
+		producer, err := NewProducer(cfg)
+		if err == nil {
+			t.Cleanup(func() { producer.Close() })
+		}
+		return producer, logs, err
+	}
+	const warning = "producing keyless records to a compacted topic, records will be lost on compaction"
+
+	t.Run("warn", func(t *testing.T) {
+		_, logs, err := newProducer(ProducerConfig{})
+		require.NoError(t, err)
+		require.Equal(t, 1, logs.FilterMessage(warning).Len())
+	})
+	t.Run("error", func(t *testing.T) {
+		_, _, err := newProducer(ProducerConfig{
+			CompactedTopicCheck: CompactedTopicCheckError,
+		})
+		assert.EqualError(t, err, "kafka: topic compacted is compacted, but no key router is set")
+	})
+	t.Run("disabled", func(t *testing.T) {
+		_, logs, err := newProducer(ProducerConfig{
+			CompactedTopicCheck: CompactedTopicCheckDisabled,
+		})
+		require.NoError(t, err)
+		assert.Zero(t, logs.Len())
+	})
+	t.Run("key_router", func(t *testing.T) {
+		_, logs, err := newProducer(ProducerConfig{
+			CompactedTopicCheck: CompactedTopicCheckError,
+			KeyRouter:           func(model.APMEvent) []byte { return nil },
+		})
+		require.NoError(t, err)
+		assert.Zero(t, logs.Len())
+	})
+}
+
+func TestProducerRecordBufferTimeout(t *testing.T) {
+	topic := "record-buffer-timeout"
+	cluster := newFakeCluster(t, 1, topic)
+	// Stall the broker, so the producer never learns the topic partitions.
+	cluster.ControlKey(int16(kmsg.Metadata), func(kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		return nil, nil, true
+	})
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:             cluster.ListenAddrs(),
+		Topic:               topic,
+		Logger:              zaptest.NewLogger(t),
+		CompactedTopicCheck: CompactedTopicCheckDisabled,
+		RecordBufferTimeout: time.Second,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	err = producer.ProcessBatch(ctx, &model.Batch{{}})
+	assert.ErrorIs(t, err, ErrRecordTimeout)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestProducerWaitReady(t *testing.T) {
+	// Reserve a port for the cluster, which isn't reachable until started.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := lis.Addr().(*net.TCPAddr).Port
+	require.NoError(t, lis.Close())
+	brokers := []string{lis.Addr().String()}
+
+	t.Run("block_until_ready", func(t *testing.T) {
+		_, err := NewProducer(ProducerConfig{
+			Brokers:             brokers,
+			Topic:               "wait-ready",
+			Logger:              zap.NewNop(),
+			CompactedTopicCheck: CompactedTopicCheckDisabled,
+			BlockUntilReady:     200 * time.Millisecond,
+		})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:             brokers,
+		Topic:               "wait-ready",
+		Logger:              zap.NewNop(),
+		CompactedTopicCheck: CompactedTopicCheckDisabled,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, producer.WaitReady(ctx), context.DeadlineExceeded)
+
+	ready := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		ready <- producer.WaitReady(ctx)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	cluster, err := kfake.NewCluster(
+		kfake.NumBrokers(1),
+		kfake.Ports(port),
+		kfake.SeedTopics(1, "wait-ready"),
+	)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	select {
+	case err := <-ready:
+		assert.NoError(t, err)
+	case <-time.After(20 * time.Second):
+		t.Fatal("timed out waiting for the producer to be ready")
+	}
+}
+
+func TestProducerInsufficientReplicas(t *testing.T) {
+	topic := "insufficient-replicas"
+	cluster := newFakeCluster(t, 1, topic)
+	var attempts atomic.Int64
+	cluster.ControlKey(int16(kmsg.Produce), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		attempts.Add(1)
+		req := kreq.(*kmsg.ProduceRequest)
+		resp := req.ResponseKind().(*kmsg.ProduceResponse)
+		for _, rt := range req.Topics {
+			st := kmsg.NewProduceResponseTopic()
+			st.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				sp := kmsg.NewProduceResponseTopicPartition()
+				sp.Partition = rp.Partition
+				sp.ErrorCode = kerr.NotEnoughReplicas.Code
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp, nil, true
+	})
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:            cluster.ListenAddrs(),
+		Topic:              topic,
+		Logger:             zaptest.NewLogger(t),
+		MaxProduceAttempts: 1,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = producer.ProcessBatch(ctx, &model.Batch{{}})
+	assert.ErrorIs(t, err, ErrInsufficientReplicas)
+	assert.ErrorIs(t, err, kerr.NotEnoughReplicas)
+	assert.Equal(t, int64(1), attempts.Load())
+}
+
+func TestProducerBrokerCallbacks(t *testing.T) {
+	topic := "broker-callbacks"
+	cluster := newFakeCluster(t, 1, topic)
+	var mu sync.Mutex
+	var connected, disconnected []string
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+		OnBrokerConnect: func(addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.NoError(t, err)
+			connected = append(connected, addr)
+		},
+		OnBrokerDisconnect: func(addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			disconnected = append(disconnected, addr)
+		},
+	})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(connected) > 0
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, producer.Close())
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, connected, cluster.ListenAddrs()[0])
+	assert.Contains(t, disconnected, cluster.ListenAddrs()[0])
+}
+
+func TestProducerBatching(t *testing.T) {
+	topic := "producer-batching"
+	cluster := newFakeCluster(t, 1, topic)
+	newProducer := func(batching queueconfig.ProducerBatching) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers:          cluster.ListenAddrs(),
+			Topic:            topic,
+			Logger:           zaptest.NewLogger(t),
+			ProducerBatching: batching,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { producer.Close() })
+		return producer
+	}
+	defaults := newProducer(queueconfig.ProducerBatching{})
+	assert.Equal(t, time.Duration(0), defaults.client.OptValue(kgo.ProducerLinger))
+	assert.Equal(t, int32(1000012), defaults.client.OptValue(kgo.ProducerBatchMaxBytes))
+
+	tuned := newProducer(queueconfig.ProducerBatching{
+		Linger:        50 * time.Millisecond,
+		MaxBatchBytes: 1 << 20,
+	})
+	assert.Equal(t, 50*time.Millisecond, tuned.client.OptValue(kgo.ProducerLinger))
+	assert.Equal(t, int32(1<<20), tuned.client.OptValue(kgo.ProducerBatchMaxBytes))
+}
+
+func TestProducerCloseTwice(t *testing.T) {
+	topic := "close-twice"
+	cluster := newFakeCluster(t, 1, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+	})
+	require.NoError(t, err)
+	require.NoError(t, producer.Close())
+
+	var closeErr *CloseError
+	require.ErrorAs(t, producer.Close(), &closeErr)
+	assert.NoError(t, closeErr.Flush)
+	assert.EqualError(t, closeErr.Closed, "kafka: producer already closed")
+}
+
+func TestProducerTopicFromMetadata(t *testing.T) {
+	topic := "default"
+	cluster := newFakeCluster(t, 1, topic, "tenant-a", "tenant-b")
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:                 cluster.ListenAddrs(),
+		Topic:                   topic,
+		Logger:                  zaptest.NewLogger(t),
+		TopicFromMetadata:       "tenant",
+		TopicFromMetadataPrefix: "tenant-",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	for _, tenant := range []string{"a", "b", "a"} {
+		ctx := queuecontext.WithMetadata(context.Background(), map[string]string{
+			"tenant": tenant,
+		})
+		batch := model.Batch{{Trace: model.Trace{ID: tenant}}}
+		require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	}
+	// Without the metadata entry, the records are produced to Topic.
+	batch := model.Batch{{Trace: model.Trace{ID: "default"}}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	for topic, ids := range map[string][]string{
+		"tenant-a": {"a", "a"},
+		"tenant-b": {"b"},
+		"default":  {"default"},
+	} {
+		var got []string
+		for _, record := range consumeRecords(t, cluster, topic, len(ids)) {
+			var event model.APMEvent
+			require.NoError(t, json.Unmarshal(record.Value, &event))
+			got = append(got, event.Trace.ID)
+		}
+		assert.Equal(t, ids, got, topic)
+	}
+}
+
+// newFakeCluster returns a single broker kfake cluster with the topics
+// created, which is closed when the test finishes.
+func newFakeCluster(t testing.TB, partitions int32, topics ...string) *kfake.Cluster {
+	t.Helper()
+	cluster, err := kfake.NewCluster(
+		kfake.NumBrokers(1),
+		kfake.SeedTopics(partitions, topics...),
+	)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+// consumeRecords reads n records from the start of the topic.
+func consumeRecords(t testing.TB, cluster *kfake.Cluster, topic string, n int) []*kgo.Record {
+	t.Helper()
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var records []*kgo.Record
+	for len(records) < n {
+		fetches := client.PollFetches(ctx)
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	return records
+}
@@ -0,0 +1,98 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// defaultDialTimeout matches the franz-go default dial timeout.
+const defaultDialTimeout = 10 * time.Second
+
+// ReconnectBackoff defines the time waited before dialing a broker again
+// after a failed connection attempt. The backoff doubles with each
+// consecutive failure to the same broker, starting at Min and up to Max, and
+// is reset once the broker is connected.
+type ReconnectBackoff struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (b ReconnectBackoff) validate() error {
+	var errs []error
+	if b.Min < 0 || b.Max < 0 {
+		errs = append(errs, errors.New("kafka: reconnect backoff cannot be negative"))
+	}
+	if b.Min > b.Max {
+		errs = append(errs, errors.New("kafka: reconnect backoff min cannot be greater than max"))
+	}
+	return errors.Join(errs...)
+}
+
+// opt returns the client option which applies the backoff, or nil if it
+// isn't set.
+func (b ReconnectBackoff) opt() kgo.Opt {
+	if b.Max == 0 {
+		return nil
+	}
+	return kgo.Dialer(newReconnectDialer(b).DialContext)
+}
+
+// reconnectDialer delays the dials to the brokers which failed to connect.
+type reconnectDialer struct {
+	backoff ExponentialBackoff
+	dial    func(ctx context.Context, network, host string) (net.Conn, error)
+
+	mu sync.Mutex
+	// failures holds the consecutive dial failures, keyed by host.
+	failures map[string]int
+}
+
+func newReconnectDialer(b ReconnectBackoff) *reconnectDialer {
+	return &reconnectDialer{
+		backoff:  ExponentialBackoff{Min: b.Min, Max: b.Max},
+		dial:     (&net.Dialer{Timeout: defaultDialTimeout}).DialContext,
+		failures: make(map[string]int),
+	}
+}
+
+// DialContext dials the host, waiting for the backoff first if the previous
+// dials to the host failed.
+func (d *reconnectDialer) DialContext(ctx context.Context, network, host string) (net.Conn, error) {
+	d.mu.Lock()
+	failures := d.failures[host]
+	d.mu.Unlock()
+	if failures > 0 && !wait(ctx, d.backoff, failures) {
+		return nil, ctx.Err()
+	}
+	conn, err := d.dial(ctx, network, host)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.failures[host]++
+	} else {
+		delete(d.failures, host)
+	}
+	return conn, err
+}
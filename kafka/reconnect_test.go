@@ -0,0 +1,139 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestReconnectDialer(t *testing.T) {
+	dialer := newReconnectDialer(ReconnectBackoff{Min: 10 * time.Millisecond, Max: 40 * time.Millisecond})
+	var dials []time.Time
+	fail := true
+	dialer.dial = func(context.Context, string, string) (net.Conn, error) {
+		dials = append(dials, time.Now())
+		if fail {
+			return nil, errors.New("connection refused")
+		}
+		return nil, nil
+	}
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, err := dialer.DialContext(ctx, "tcp", "broker:9092")
+		require.Error(t, err)
+	}
+	// The first dial isn't delayed, then the backoff doubles up to Max.
+	for i, min := range []time.Duration{10, 20, 40, 40} {
+		assert.GreaterOrEqual(t, dials[i+1].Sub(dials[i]), min*time.Millisecond)
+	}
+	// Other hosts aren't delayed.
+	fail = false
+	_, err := dialer.DialContext(ctx, "tcp", "other:9092")
+	require.NoError(t, err)
+	assert.Less(t, time.Since(dials[len(dials)-1]), 10*time.Millisecond)
+
+	// A successful dial resets the backoff.
+	_, err = dialer.DialContext(ctx, "tcp", "broker:9092")
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = dialer.DialContext(ctx, "tcp", "broker:9092")
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 10*time.Millisecond)
+
+	// The backoff wait is interrupted by the context.
+	fail = true
+	dialer.DialContext(ctx, "tcp", "broker:9092")
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = dialer.DialContext(canceled, "tcp", "broker:9092")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestProducerReconnectBackoff(t *testing.T) {
+	topic := "reconnect-backoff"
+	// Reserve a port for the broker, which starts down.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	const minBackoff = 50 * time.Millisecond
+	var mu sync.Mutex
+	var failures []time.Time
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:              []string{addr},
+		Topic:                topic,
+		Logger:               zaptest.NewLogger(t),
+		CompactedTopicCheck:  CompactedTopicCheckDisabled,
+		Backoff:              ConstantBackoff(time.Millisecond),
+		ConnReconnectBackoff: ReconnectBackoff{Min: minBackoff, Max: 4 * minBackoff},
+		OnBrokerConnect: func(_ string, err error) {
+			if err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				failures = append(failures, time.Now())
+			}
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	produced := make(chan error, 1)
+	go func() {
+		batch := model.Batch{{Trace: model.Trace{ID: "a"}}}
+		produced <- producer.ProcessBatch(ctx, &batch)
+	}()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(failures) >= 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Bring the broker up, the producer reconnects and produces the event.
+	cluster, err := kfake.NewCluster(
+		kfake.NumBrokers(1),
+		kfake.Ports(port),
+		kfake.SeedTopics(1, topic),
+	)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	require.NoError(t, <-produced)
+	assert.Len(t, consumeRecords(t, cluster, topic, 1), 1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 1; i < len(failures); i++ {
+		assert.GreaterOrEqual(t, failures[i].Sub(failures[i-1]), minBackoff)
+	}
+}
@@ -0,0 +1,214 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// reorderBuffer holds the fetched records for the reorder window, releasing
+// the records of each key in the order of their timestamps.
+type reorderBuffer struct {
+	key    func(RawRecord) []byte
+	window time.Duration
+	// arrivals holds the buffered records in the order they were fetched.
+	arrivals []*reorderEntry
+	// keys holds the buffered records of each key, sorted by timestamp.
+	keys map[string][]*reorderEntry
+}
+
+type reorderEntry struct {
+	msg      *kgo.Record
+	decoded  decodedRecord
+	key      string
+	fetched  time.Time
+	released bool
+}
+
+func newReorderBuffer(key func(RawRecord) []byte, window time.Duration) *reorderBuffer {
+	if key == nil || window <= 0 {
+		return nil
+	}
+	return &reorderBuffer{
+		key:    key,
+		window: window,
+		keys:   make(map[string][]*reorderEntry),
+	}
+}
+
+// add buffers a record fetched at now.
+func (b *reorderBuffer) add(msg *kgo.Record, decoded decodedRecord, now time.Time) {
+	e := &reorderEntry{
+		msg:     msg,
+		decoded: decoded,
+		key:     string(b.key(newRawRecord(msg))),
+		fetched: now,
+	}
+	b.arrivals = append(b.arrivals, e)
+	entries := b.keys[e.key]
+	// Records with the same timestamp keep their fetch order.
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].msg.Timestamp.After(msg.Timestamp)
+	})
+	entries = append(entries, nil)
+	copy(entries[i+1:], entries[i:])
+	entries[i] = e
+	b.keys[e.key] = entries
+}
+
+// release returns the records which have been buffered for the window at
+// now, preceded by the records of their key with an earlier timestamp.
+func (b *reorderBuffer) release(now time.Time) []*reorderEntry {
+	var released []*reorderEntry
+	for len(b.arrivals) > 0 {
+		head := b.arrivals[0]
+		if head.released {
+			b.arrivals = b.arrivals[1:]
+			continue
+		}
+		if now.Sub(head.fetched) < b.window {
+			break
+		}
+		entries := b.keys[head.key]
+		var n int
+		for n < len(entries) && !entries[n].msg.Timestamp.After(head.msg.Timestamp) {
+			entries[n].released = true
+			n++
+		}
+		released = append(released, entries[:n]...)
+		if n == len(entries) {
+			delete(b.keys, head.key)
+		} else {
+			b.keys[head.key] = entries[n:]
+		}
+	}
+	return released
+}
+
+// next returns the time at which the oldest buffered record is released.
+func (b *reorderBuffer) next() (time.Time, bool) {
+	if b == nil {
+		return time.Time{}, false
+	}
+	for _, e := range b.arrivals {
+		if !e.released {
+			return e.fetched.Add(b.window), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// drop discards the buffered records of the topic partition, returning them.
+func (b *reorderBuffer) drop(topic string, partition int32) []*reorderEntry {
+	if b == nil {
+		return nil
+	}
+	var dropped []*reorderEntry
+	for key, entries := range b.keys {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.msg.Topic == topic && e.msg.Partition == partition {
+				e.released = true
+				dropped = append(dropped, e)
+				continue
+			}
+			kept = append(kept, e)
+		}
+		if len(kept) == 0 {
+			delete(b.keys, key)
+		} else {
+			b.keys[key] = kept
+		}
+	}
+	return dropped
+}
+
+// committable splits the processed records into the ones which can be
+// committed and the ones which are held, since their partition still has
+// buffered records with a lower offset.
+func (b *reorderBuffer) committable(pending []*kgo.Record) (commit, held []*kgo.Record) {
+	if b == nil {
+		return pending, nil
+	}
+	lowest := make(map[string]map[int32]int64)
+	for _, e := range b.arrivals {
+		if e.released {
+			continue
+		}
+		partitions := lowest[e.msg.Topic]
+		if partitions == nil {
+			partitions = make(map[int32]int64)
+			lowest[e.msg.Topic] = partitions
+		}
+		if offset, ok := partitions[e.msg.Partition]; !ok || e.msg.Offset < offset {
+			partitions[e.msg.Partition] = e.msg.Offset
+		}
+	}
+	for _, msg := range pending {
+		if offset, ok := lowest[msg.Topic][msg.Partition]; ok && msg.Offset >= offset {
+			held = append(held, msg)
+			continue
+		}
+		commit = append(commit, msg)
+	}
+	return commit, held
+}
+
+// reorderRecords buffers the fetched records and processes the records
+// released by the reorder buffer. When a released record has to be retried,
+// the buffered and processed records following it in its partition are
+// discarded, since the partition is fetched again from the record.
+func (c *Consumer) reorderRecords(ctx context.Context,
+	records []*kgo.Record, decoded []decodedRecord,
+	rewind map[string]map[int32]kgo.EpochOffset,
+) {
+	now := c.cfg.clock.Now()
+	for i, msg := range records {
+		if decoded[i].skipped {
+			// Committed without being processed.
+			c.pending = append(c.pending, msg)
+			c.buffered.processed(msg)
+			continue
+		}
+		c.reorder.add(msg, decoded[i], now)
+	}
+	for _, e := range c.reorder.release(now) {
+		_, rewound := rewind[e.msg.Topic][e.msg.Partition]
+		c.handleRecord(ctx, e.msg, e.decoded, rewind)
+		c.release(&e.decoded)
+		if _, ok := rewind[e.msg.Topic][e.msg.Partition]; rewound || !ok {
+			continue
+		}
+		for _, dropped := range c.reorder.drop(e.msg.Topic, e.msg.Partition) {
+			c.buffered.processed(dropped.msg)
+			c.release(&dropped.decoded)
+		}
+		pending := c.pending[:0]
+		for _, msg := range c.pending {
+			if msg.Topic == e.msg.Topic && msg.Partition == e.msg.Partition && msg.Offset > e.msg.Offset {
+				continue
+			}
+			pending = append(pending, msg)
+		}
+		c.pending = pending
+	}
+}
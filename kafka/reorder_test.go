@@ -0,0 +1,275 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestConsumerReorderWindow(t *testing.T) {
+	topic := "reorder-window"
+	cluster := newFakeCluster(t, 2, topic)
+	// The records of the key are spread across the partitions, each of them
+	// holding every other timestamp.
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	var records []*kgo.Record
+	for i := 0; i < 6; i++ {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: fmt.Sprint(i)}})
+		require.NoError(t, err)
+		records = append(records, &kgo.Record{
+			Topic:     topic,
+			Partition: int32(i % 2),
+			Key:       []byte("key"),
+			Value:     event,
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+		})
+	}
+	// Records of another key aren't held back by the key's records.
+	event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: "other"}})
+	require.NoError(t, err)
+	records = append(records, &kgo.Record{
+		Topic: topic, Key: []byte("other"), Value: event, Timestamp: start,
+	})
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+	// Produce the partitions one after the other, so they aren't fetched
+	// in timestamp order.
+	for _, partition := range []int32{1, 0} {
+		for _, r := range records {
+			if r.Partition == partition {
+				require.NoError(t, client.ProduceSync(context.Background(), r).FirstErr())
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	var processed []string
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topics:  []string{topic},
+		GroupID: "group",
+		Logger:  zaptest.NewLogger(t),
+		ReorderKey: func(r RawRecord) []byte {
+			return r.Key
+		},
+		ReorderWindow: 500 * time.Millisecond,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, event := range *b {
+				processed = append(processed, event.Trace.ID)
+			}
+			if len(processed) == len(records) {
+				cancel()
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	go consumer.Run(ctx)
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the records to be processed")
+	}
+	require.NoError(t, consumer.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	var keyed []string
+	for _, id := range processed {
+		if id != "other" {
+			keyed = append(keyed, id)
+		}
+	}
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "5"}, keyed)
+	assert.Contains(t, processed, "other")
+}
+
+func TestConsumerReorderWindowRebalance(t *testing.T) {
+	const perPartition = 2
+	topic := "reorder-window-rebalance"
+	cluster := newFakeCluster(t, 2, topic)
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	var produced int
+	produce := func(partitions ...int32) {
+		var records []*kgo.Record
+		for _, partition := range partitions {
+			for i := 0; i < perPartition; i++ {
+				event, err := json.Marshal(model.APMEvent{Trace: model.Trace{
+					ID: fmt.Sprint(partition),
+				}})
+				require.NoError(t, err)
+				records = append(records, &kgo.Record{
+					Topic: topic, Partition: partition, Value: event,
+					Key: []byte(fmt.Sprint(produced)),
+				})
+				produced++
+			}
+		}
+		require.NoError(t, client.ProduceSync(context.Background(), records...).FirstErr())
+	}
+	committed := func() map[int32]int64 {
+		offsets, err := kadm.NewClient(client).FetchOffsets(context.Background(), "group")
+		require.NoError(t, err)
+		m := make(map[int32]int64)
+		offsets.Each(func(o kadm.OffsetResponse) { m[o.Partition] = o.At })
+		return m
+	}
+	produce(0, 1)
+
+	var mu sync.Mutex
+	var stopped []int32
+	// processed holds the partitions of the records processed by each
+	// consumer.
+	processed := make(map[string][]string)
+	processedBy := func(name string) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), processed[name]...)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	newConsumer := func(name string, modify func(*ConsumerConfig)) *Consumer {
+		cfg := ConsumerConfig{
+			Brokers: cluster.ListenAddrs(),
+			Topics:  []string{topic},
+			GroupID: "group",
+			Logger:  zaptest.NewLogger(t),
+			OnPartitionStop: func(_ context.Context, _ string, partition int32) {
+				mu.Lock()
+				defer mu.Unlock()
+				if name == "a" {
+					stopped = append(stopped, partition)
+				}
+			},
+			Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, event := range *b {
+					processed[name] = append(processed[name], event.Trace.ID)
+				}
+				return nil
+			}),
+		}
+		modify(&cfg)
+		consumer, err := NewConsumer(cfg)
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consumer.Run(ctx)
+		}()
+		return consumer
+	}
+
+	// a buffers all the records for the window, which only passes once its
+	// clock is advanced.
+	clock := newFakeClock(time.Now())
+	a := newConsumer("a", func(cfg *ConsumerConfig) {
+		cfg.ReorderKey = func(r RawRecord) []byte { return r.Key }
+		cfg.ReorderWindow = time.Hour
+		cfg.withClock(clock)
+	})
+	assert.Eventually(t, func() bool {
+		return a.QueueDepth() == 2*perPartition
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// The buffered records of the partition revoked from a when b joins are
+	// dropped, and b processes and commits them, and the ones produced next.
+	b := newConsumer("b", func(*ConsumerConfig) {})
+	t.Cleanup(func() {
+		cancel()
+		a.Close()
+		b.Close()
+		wg.Wait()
+	})
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(stopped) == 1
+	}, 15*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	moved, kept := stopped[0], 1-stopped[0]
+	mu.Unlock()
+	assert.Equal(t, perPartition, a.QueueDepth())
+	produce(moved)
+	assert.Eventually(t, func() bool {
+		return committed()[moved] == 2*perPartition
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// a only releases the records of the partition it kept, and doesn't
+	// move the committed offset of the revoked partition backwards.
+	clock.Advance(time.Hour)
+	produce(kept) // Wakes a up, buffered for the next window.
+	assert.Eventually(t, func() bool {
+		return committed()[kept] == perPartition
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{fmt.Sprint(kept), fmt.Sprint(kept)}, processedBy("a"))
+	assert.Equal(t, int64(2*perPartition), committed()[moved])
+	assert.Len(t, processedBy("b"), 2*perPartition)
+}
+
+func TestReorderBufferCommittable(t *testing.T) {
+	b := newReorderBuffer(func(r RawRecord) []byte { return r.Key }, time.Minute)
+	now := time.Now()
+	b.add(&kgo.Record{Topic: "t", Partition: 0, Offset: 2, Key: []byte("a")}, decodedRecord{}, now)
+	b.add(&kgo.Record{Topic: "t", Partition: 1, Offset: 7, Key: []byte("a")}, decodedRecord{}, now)
+	assert.Empty(t, b.release(now))
+
+	pending := []*kgo.Record{
+		{Topic: "t", Partition: 0, Offset: 1},
+		{Topic: "t", Partition: 0, Offset: 3},
+		{Topic: "t", Partition: 1, Offset: 6},
+		{Topic: "t", Partition: 2, Offset: 9},
+	}
+	commit, held := b.committable(pending)
+	assert.Equal(t, []*kgo.Record{pending[0], pending[2], pending[3]}, commit)
+	assert.Equal(t, []*kgo.Record{pending[1]}, held)
+
+	next, ok := b.next()
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Minute), next)
+	assert.Len(t, b.release(next), 2)
+	_, ok = b.next()
+	assert.False(t, ok)
+}
@@ -0,0 +1,177 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// routeKey identifies the records delivered together: the records routed to
+// the same processor, with the same project.
+type routeKey struct {
+	// route is the route returned by ProcessorRouter, or the topic of the
+	// Processors entry, and is empty for Processor.
+	route string
+	// router is set for the processors selected by ProcessorRouter, and
+	// routed for the ones selected by ProcessorRouter or Processors.
+	router  bool
+	routed  bool
+	project string
+}
+
+// routedGroup holds the records delivered together to a processor, and
+// their events, in the records order.
+type routedGroup struct {
+	key       routeKey
+	processor model.BatchProcessor
+	// records holds the indexes of the records, and bounds the end of the
+	// events of each record.
+	records []int
+	bounds  []int
+	events  model.Batch
+}
+
+// processRouted processes the records with the processors selected by
+// ProcessorRouter and Processors, delivering the events of the records
+// routed to each processor in a single batch. The records are then settled
+// in order, like handleRecord does, so when a routed processor fails, its
+// records' partitions are rewound to the first failed record.
+func (c *Consumer) processRouted(ctx context.Context, records []*kgo.Record, decoded []decodedRecord, rewind map[string]map[int32]kgo.EpochOffset) {
+	dispositions := make([]RecordDisposition, len(records))
+	var groups []*routedGroup
+	index := make(map[routeKey]*routedGroup)
+	for i, msg := range records {
+		if decoded[i].skipped {
+			continue
+		}
+		processor, key := c.deliverable(ctx, msg, decoded[i])
+		if processor == nil {
+			continue
+		}
+		key.project = recordProject(msg)
+		group, ok := index[key]
+		if !ok {
+			group = &routedGroup{key: key, processor: processor}
+			index[key] = group
+			groups = append(groups, group)
+		}
+		group.events = append(group.events, decoded[i].events...)
+		group.records = append(group.records, i)
+		group.bounds = append(group.bounds, len(group.events))
+	}
+	for _, group := range groups {
+		c.processGroup(ctx, records, group, dispositions)
+	}
+	for i, msg := range records {
+		c.buffered.processed(msg)
+		if _, ok := rewind[msg.Topic][msg.Partition]; ok {
+			continue
+		}
+		if decoded[i].skipped {
+			// Committed without being processed.
+			c.pending = append(c.pending, msg)
+			continue
+		}
+		disposition := dispositions[i]
+		if disposition == DeadLetter {
+			disposition = c.deadLetter(ctx, msg)
+		}
+		c.settleRecord(ctx, msg, decoded[i], disposition, rewind)
+	}
+}
+
+// processGroup delivers the group's events to its processor, setting the
+// disposition of each of the group's records.
+func (c *Consumer) processGroup(ctx context.Context, records []*kgo.Record, group *routedGroup, dispositions []RecordDisposition) {
+	processCtx := ctx
+	if group.key.project != "" {
+		processCtx = queuecontext.WithProject(processCtx, group.key.project)
+	}
+	// The outcome of each record is recorded with its span context, like
+	// processRecord does.
+	recordCtxs := make([]context.Context, len(group.records))
+	spans := make([]trace.Span, len(group.records))
+	for i, r := range group.records {
+		recordCtxs[i], spans[i] = c.tracer.WithProcessSpan(records[r])
+		spans[i].SetAttributes(messageIDAttr(records[r]))
+	}
+	batch := group.events
+	events := batch[:len(batch):len(batch)]
+	var err error
+	var eventDispositions []RecordDisposition
+	// retry is set when all the group's records have to be retried.
+	var retry bool
+	if dp, ok := group.processor.(DispositionProcessor); ok {
+		eventDispositions = dp.ProcessBatchDisposition(processCtx, &batch)
+		if len(eventDispositions) != len(events) {
+			c.cfg.Logger.Error("processor returned an unexpected number of dispositions",
+				zap.Int("dispositions", len(eventDispositions)),
+				zap.Int("events", len(events)),
+			)
+			eventDispositions, retry = nil, true
+		}
+	} else if err = group.processor.ProcessBatch(processCtx, &batch); err != nil {
+		c.cfg.Logger.Error("unable to process events",
+			zap.Error(err),
+			zap.Int("events", len(events)),
+		)
+		// ProcessorRouter and Processors records are committed once
+		// processed successfully.
+		retry = group.key.routed
+	}
+	start := 0
+	for i, r := range group.records {
+		msg, end := records[r], group.bounds[i]
+		disposition := Ack
+		if eventDispositions != nil {
+			disposition = recordDisposition(eventDispositions[start:end])
+		} else if retry {
+			disposition = Retry
+		}
+		if err != nil {
+			c.processingError(msg, err)
+			spans[i].RecordError(err)
+			spans[i].SetStatus(codes.Error, err.Error())
+		}
+		dispositions[r] = disposition
+		c.metrics.recordOutcome(recordCtxs[i], msg.Topic, err != nil || disposition != Ack)
+		for _, event := range events[start:end] {
+			c.metrics.recordDelay(recordCtxs[i], msg.Topic, event.Timestamp)
+		}
+		spans[i].End()
+		start = end
+	}
+}
+
+// recordProject returns the value of the record's project_id header.
+func recordProject(msg *kgo.Record) string {
+	for _, h := range msg.Headers {
+		if h.Key == "project_id" {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+// SequenceStore stores the last sequence stamped by a producer on the
+// records, so a restarted producer continues the sequence instead of
+// starting over.
+type SequenceStore interface {
+	// SaveSequence stores the sequence, replacing the stored one.
+	SaveSequence(ctx context.Context, sequence uint64) error
+	// LoadSequence returns the stored sequence, or zero when none has been
+	// stored.
+	LoadSequence(ctx context.Context) (uint64, error)
+}
+
+// loadSequence returns the sequence stored in the SequenceStore, if any.
+func loadSequence(cfg ProducerConfig) (uint64, error) {
+	if cfg.SequenceStore == nil {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resumeTimeout)
+	defer cancel()
+	sequence, err := cfg.SequenceStore.LoadSequence(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("kafka: failed to load sequence: %w", err)
+	}
+	return sequence, nil
+}
+
+// stampSequence adds the SequenceHeader holding the next sequence to the
+// record, when SequenceHeader is set.
+func (p *Producer) stampSequence(r *kgo.Record) {
+	if p.cfg.SequenceHeader == "" {
+		return
+	}
+	sequence := p.sequence.Add(1)
+	// The headers are shared by the records of a batch.
+	r.Headers = append(r.Headers[:len(r.Headers):len(r.Headers)], kgo.RecordHeader{
+		Key: p.cfg.SequenceHeader, Value: strconv.AppendUint(nil, sequence, 10),
+	})
+}
+
+// saveSequence stores the last stamped sequence in the SequenceStore, unless
+// a later one has already been stored.
+func (p *Producer) saveSequence(ctx context.Context) {
+	if p.cfg.SequenceStore == nil {
+		return
+	}
+	p.sequenceMu.Lock()
+	defer p.sequenceMu.Unlock()
+	sequence := p.sequence.Load()
+	if sequence <= p.savedSequence {
+		return
+	}
+	if err := p.cfg.SequenceStore.SaveSequence(ctx, sequence); err != nil {
+		p.cfg.Logger.Error("unable to save sequence", zap.Error(err))
+		return
+	}
+	p.savedSequence = sequence
+}
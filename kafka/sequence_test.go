@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// memorySequenceStore is an in-memory SequenceStore.
+type memorySequenceStore struct {
+	mu       sync.Mutex
+	sequence uint64
+}
+
+func (s *memorySequenceStore) SaveSequence(_ context.Context, sequence uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sequence = sequence
+	return nil
+}
+
+func (s *memorySequenceStore) LoadSequence(context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sequence, nil
+}
+
+func TestProducerSequenceHeader(t *testing.T) {
+	topic := "sequence-header"
+	cluster := newFakeCluster(t, 4, topic)
+	store := new(memorySequenceStore)
+	newProducer := func() *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers:        cluster.ListenAddrs(),
+			Topic:          topic,
+			Logger:         zaptest.NewLogger(t),
+			SequenceHeader: "sequence",
+			SequenceStore:  store,
+			DefaultHeaders: map[string]string{"service": "test"},
+		})
+		require.NoError(t, err)
+		return producer
+	}
+	producer := newProducer()
+	ctx := context.Background()
+	batch := model.Batch{{}, {}, {}, {}, {}}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	single := batch[:1]
+	_, err := producer.ProcessBatchAsync(ctx, &single)[0].Wait(ctx)
+	require.NoError(t, err)
+	require.NoError(t, producer.Close())
+	assert.Equal(t, uint64(6), store.sequence)
+
+	// The restarted producer continues the stored sequence.
+	producer = newProducer()
+	t.Cleanup(func() { producer.Close() })
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	var sequences []uint64
+	for _, record := range consumeRecords(t, cluster, topic, 11) {
+		var values []string
+		for _, h := range record.Headers {
+			if h.Key == "sequence" {
+				values = append(values, string(h.Value))
+			}
+		}
+		require.Len(t, values, 1)
+		sequence, err := strconv.ParseUint(values[0], 10, 64)
+		require.NoError(t, err)
+		sequences = append(sequences, sequence)
+	}
+	// The records are consumed across partitions, in any order.
+	assert.ElementsMatch(t, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, sequences)
+	assert.Equal(t, uint64(11), store.sequence)
+}
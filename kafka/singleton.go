@@ -0,0 +1,214 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/plugin/kzap"
+	"go.uber.org/zap"
+)
+
+// SingletonConsumerConfig defines the configuration for the Kafka
+// SingletonConsumer.
+type SingletonConsumerConfig struct {
+	// Consumer configures the consumer which is run by the elected instance.
+	Consumer ConsumerConfig
+	// ElectionTopic is the single partition topic used to elect the
+	// instance which runs the consumer. The instance assigned its partition
+	// is elected. No records are produced to or consumed from it.
+	ElectionTopic string
+	// ElectionGroupID is the consumer group used for the election. Defaults
+	// to the Consumer GroupID with an "-election" suffix.
+	ElectionGroupID string
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg SingletonConsumerConfig) Validate() error {
+	var errs []error
+	if cfg.ElectionTopic == "" {
+		errs = append(errs, errors.New("kafka: election topic must be set"))
+	}
+	if containsString(cfg.Consumer.Topics, cfg.ElectionTopic) {
+		errs = append(errs, errors.New("kafka: election topic cannot be consumed"))
+	}
+	if err := cfg.Consumer.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// SingletonConsumer runs a Consumer in only one of the instances sharing the
+// same configuration. The instances join the election consumer group and
+// the one assigned the ElectionTopic partition runs the consumer. When the
+// elected instance stops or crashes, the partition is reassigned to another
+// instance, which takes over once the group rebalances.
+type SingletonConsumer struct {
+	cfg      SingletonConsumerConfig
+	election *kgo.Client
+	// errs receives the errors of the elected consumer.
+	errs chan error
+
+	mu       sync.Mutex
+	consumer *Consumer
+	cancel   context.CancelFunc
+	done     chan struct{}
+	closed   bool
+}
+
+// NewSingletonConsumer creates a new instance of a SingletonConsumer. The
+// instance joins the election on creation.
+func NewSingletonConsumer(cfg SingletonConsumerConfig) (*SingletonConsumer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.ElectionGroupID == "" {
+		cfg.ElectionGroupID = cfg.Consumer.GroupID + "-election"
+	}
+	s := &SingletonConsumer{cfg: cfg, errs: make(chan error, 1)}
+	onRevoked := func(_ context.Context, _ *kgo.Client, revoked map[string][]int32) {
+		if len(revoked[cfg.ElectionTopic]) > 0 {
+			s.stop()
+		}
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Consumer.Brokers...),
+		kgo.WithLogger(kzap.New(cfg.Consumer.Logger)),
+		kgo.ConsumerGroup(cfg.ElectionGroupID),
+		kgo.ConsumeTopics(cfg.ElectionTopic),
+		kgo.DisableAutoCommit(),
+		kgo.OnPartitionsAssigned(func(_ context.Context, _ *kgo.Client, assigned map[string][]int32) {
+			if len(assigned[cfg.ElectionTopic]) > 0 {
+				s.start()
+			}
+		}),
+		// The elected consumer is stopped before the rebalance completes, so
+		// the next elected instance doesn't run concurrently.
+		kgo.OnPartitionsRevoked(onRevoked),
+		kgo.OnPartitionsLost(onRevoked),
+	}
+	if len(cfg.Consumer.SASL) > 0 {
+		opts = append(opts, kgo.SASL(cfg.Consumer.SASL...))
+	}
+	if opt := dialOpt(cfg.Consumer.TLS, cfg.Consumer.ConnReconnectBackoff); opt != nil {
+		opts = append(opts, opt)
+	}
+	if cfg.Consumer.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.Consumer.ClientID))
+	}
+	election, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.election = election
+	return s, nil
+}
+
+// start creates and runs the consumer, once the instance is elected.
+func (s *SingletonConsumer) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.consumer != nil || s.closed {
+		return
+	}
+	consumer, err := NewConsumer(s.cfg.Consumer)
+	if err != nil {
+		s.fail(fmt.Errorf("kafka: failed to create elected consumer: %w", err))
+		return
+	}
+	s.cfg.Consumer.Logger.Info("elected to run the consumer",
+		zap.String("group", s.cfg.ElectionGroupID),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.consumer, s.cancel, s.done = consumer, cancel, make(chan struct{})
+	go func(done chan struct{}) {
+		defer close(done)
+		if err := consumer.Run(ctx); err != nil && ctx.Err() == nil {
+			s.fail(err)
+		}
+	}(s.done)
+}
+
+// stop stops and closes the consumer, if it's running, waiting for the
+// records being processed.
+func (s *SingletonConsumer) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.consumer == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+	if err := s.consumer.Close(); err != nil {
+		s.cfg.Consumer.Logger.Error("failed to close the elected consumer", zap.Error(err))
+	}
+	s.cfg.Consumer.Logger.Info("stopped running the consumer",
+		zap.String("group", s.cfg.ElectionGroupID),
+	)
+	s.consumer = nil
+}
+
+// fail reports the error to Run, keeping only the first one.
+func (s *SingletonConsumer) fail(err error) {
+	select {
+	case s.errs <- err:
+	default:
+	}
+}
+
+// Elected returns true while the instance is running the consumer.
+func (s *SingletonConsumer) Elected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.consumer != nil
+}
+
+// Run participates in the election in a blocking manner, running the
+// consumer while the instance is elected. It returns when the context is
+// done or the elected consumer fails.
+func (s *SingletonConsumer) Run(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-s.errs:
+		return err
+	}
+}
+
+// Close stops the consumer, if the instance is elected, and leaves the
+// election, so another instance takes over.
+func (s *SingletonConsumer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.stop()
+	s.election.Close()
+	return nil
+}
+
+// Healthy returns an error if the Kafka active broker length dips below 1.
+func (s *SingletonConsumer) Healthy() error {
+	if brokers := s.election.DiscoveredBrokers(); len(brokers) < 1 {
+		return fmt.Errorf("number of brokers below 1")
+	}
+	return nil
+}
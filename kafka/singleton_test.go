@@ -0,0 +1,114 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestSingletonConsumerConfigValidate(t *testing.T) {
+	cfg := SingletonConsumerConfig{
+		Consumer: ConsumerConfig{
+			Brokers:   []string{"localhost:9092"},
+			Topics:    []string{"topic"},
+			GroupID:   "group",
+			Logger:    zaptest.NewLogger(t),
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+		},
+	}
+	assert.EqualError(t, cfg.Validate(), "kafka: election topic must be set")
+	cfg.ElectionTopic = "topic"
+	assert.EqualError(t, cfg.Validate(), "kafka: election topic cannot be consumed")
+	cfg.ElectionTopic = "election"
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestSingletonConsumer(t *testing.T) {
+	topic, election := "singleton", "singleton-election"
+	cluster := newFakeCluster(t, 1, topic, election)
+	produce := func(id string) {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: id}})
+		require.NoError(t, err)
+		produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+	}
+
+	var active atomic.Int64
+	var mu sync.Mutex
+	processed := make(map[string][]string)
+	newInstance := func(name string) *SingletonConsumer {
+		s, err := NewSingletonConsumer(SingletonConsumerConfig{
+			ElectionTopic: election,
+			Consumer: ConsumerConfig{
+				Brokers: cluster.ListenAddrs(),
+				Topics:  []string{topic},
+				GroupID: "group",
+				Logger:  zaptest.NewLogger(t).Named(name),
+				Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+					assert.Equal(t, int64(1), active.Add(1), "processing concurrently")
+					defer active.Add(-1)
+					mu.Lock()
+					defer mu.Unlock()
+					processed[name] = append(processed[name], (*b)[0].Trace.ID)
+					return nil
+				}),
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go s.Run(ctx)
+		return s
+	}
+	processedBy := func(name string, n int) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(processed[name]) == n
+		}
+	}
+
+	first := newInstance("first")
+	require.Eventually(t, first.Elected, 10*time.Second, 10*time.Millisecond)
+	second := newInstance("second")
+	produce("a")
+	require.Eventually(t, processedBy("first", 1), 10*time.Second, 10*time.Millisecond)
+	assert.False(t, second.Elected())
+
+	// The second instance takes over once the first stops.
+	require.NoError(t, first.Close())
+	require.Eventually(t, second.Elected, 10*time.Second, 10*time.Millisecond)
+	produce("b")
+	require.Eventually(t, processedBy("second", 1), 10*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string][]string{"first": {"a"}, "second": {"b"}}, processed)
+}
@@ -0,0 +1,151 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// SinkConfig holds the configuration for ConsumeToSink.
+type SinkConfig struct {
+	// Consumer configures the consumer which reads the records. Its
+	// Processor and ProcessorRouter are ignored, the records are processed
+	// by Sink, and it can't set Processors, StreamProcessor or
+	// EnrichedProcessor. Records which exhaust their attempts are produced to the
+	// Consumer DeadLetterTopic when set, otherwise they're logged and
+	// dropped.
+	Consumer ConsumerConfig
+	// Sink processes the consumed events, e.g. writing them in bulk.
+	Sink model.BatchProcessor
+	// MaxAttempts is the maximum number of times the Sink is called for an
+	// event, including the first one. Defaults to 1.
+	MaxAttempts int
+	// Backoff defines the time waited between the attempts. When nil, the
+	// events are retried right away.
+	Backoff Backoff
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg SinkConfig) Validate() error {
+	var errs []error
+	if cfg.Sink == nil {
+		errs = append(errs, errors.New("kafka: sink must be set"))
+	}
+	if cfg.MaxAttempts < 0 {
+		errs = append(errs, errors.New("kafka: sink max attempts cannot be negative"))
+	}
+	if len(cfg.Consumer.Processors) > 0 {
+		errs = append(errs, errors.New("kafka: sink consumer processors cannot be set"))
+	}
+	if cfg.Consumer.StreamProcessor != nil {
+		errs = append(errs, errors.New("kafka: sink consumer stream processor cannot be set"))
+	}
+	if cfg.Consumer.EnrichedProcessor != nil {
+		errs = append(errs, errors.New("kafka: sink consumer enriched processor cannot be set"))
+	}
+	return errors.Join(errs...)
+}
+
+// ConsumeToSink consumes the records and processes them with the Sink,
+// retrying the failed events and dead lettering the ones which exhaust their
+// attempts. The consumer runs until the returned function is called, which
+// stops it and returns any error that made it stop early.
+func ConsumeToSink(cfg SinkConfig) (func() error, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	consumerCfg := cfg.Consumer
+	consumerCfg.ProcessorRouter = nil
+	consumerCfg.Processor = sinkProcessor{cfg: cfg, logger: consumerCfg.Logger, stop: ctx}
+	consumer, err := NewConsumer(consumerCfg)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	var runErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := consumer.Run(ctx); !errors.Is(err, context.Canceled) {
+			runErr = err
+		}
+	}()
+	return func() error {
+		cancel()
+		wg.Wait()
+		return errors.Join(runErr, consumer.Close())
+	}, nil
+}
+
+// sinkProcessor retries the events on the Sink, dead lettering them once
+// their attempts are exhausted.
+type sinkProcessor struct {
+	cfg    SinkConfig
+	logger *zap.Logger
+	// stop is the context the consumer runs with, done once it's stopped.
+	stop context.Context
+}
+
+// ProcessBatch processes the batch on the Sink, without retries.
+func (p sinkProcessor) ProcessBatch(ctx context.Context, b *model.Batch) error {
+	return p.cfg.Sink.ProcessBatch(ctx, b)
+}
+
+// ProcessBatchDisposition processes the batch on the Sink, retrying it until
+// it succeeds or MaxAttempts is reached. The events are retried by the
+// consumer if it's stopped while waiting for an attempt.
+func (p sinkProcessor) ProcessBatchDisposition(ctx context.Context, b *model.Batch) []RecordDisposition {
+	dispositions := make([]RecordDisposition, len(*b))
+	if p.cfg.Backoff != nil {
+		p.cfg.Backoff.Reset()
+	}
+	for attempt := 1; ; attempt++ {
+		err := p.cfg.Sink.ProcessBatch(ctx, b)
+		if err == nil {
+			return dispositions
+		}
+		if attempt >= p.cfg.MaxAttempts {
+			p.logger.Error("sink failed, dead lettering events",
+				zap.Error(err), zap.Int("attempts", attempt),
+			)
+			break
+		}
+		p.logger.Warn("sink failed, retrying", zap.Error(err), zap.Int("attempt", attempt))
+		if !wait(p.stop, p.cfg.Backoff, attempt) || ctx.Err() != nil {
+			for i := range dispositions {
+				dispositions[i] = Retry
+			}
+			return dispositions
+		}
+	}
+	for i := range dispositions {
+		dispositions[i] = DeadLetter
+	}
+	return dispositions
+}
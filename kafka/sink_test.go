@@ -0,0 +1,134 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestSinkConfigValidate(t *testing.T) {
+	assert.EqualError(t, SinkConfig{MaxAttempts: -1}.Validate(),
+		"kafka: sink must be set\n"+
+			"kafka: sink max attempts cannot be negative",
+	)
+	noop := model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil })
+	assert.EqualError(t, SinkConfig{Sink: noop, Consumer: ConsumerConfig{
+		Processors:        map[string]model.BatchProcessor{"topic": noop},
+		StreamProcessor:   StreamProcessorFunc(func(context.Context, RawRecord) error { return nil }),
+		EnrichedProcessor: func(context.Context, []EnrichedRecord) error { return nil },
+	}}.Validate(),
+		"kafka: sink consumer processors cannot be set\n"+
+			"kafka: sink consumer stream processor cannot be set\n"+
+			"kafka: sink consumer enriched processor cannot be set",
+	)
+}
+
+func TestConsumeToSink(t *testing.T) {
+	topic, dlqTopic := "sink", "sink-dlq"
+	cluster := newFakeCluster(t, 1, topic, dlqTopic)
+	for _, id := range []string{"flaky", "broken"} {
+		event, err := json.Marshal(model.APMEvent{Trace: model.Trace{ID: id}})
+		require.NoError(t, err)
+		produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+	}
+
+	// The flaky event succeeds on its third attempt, the broken one never
+	// does.
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	var written []string
+	sink := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+		mu.Lock()
+		defer mu.Unlock()
+		id := (*b)[0].Trace.ID
+		attempts[id]++
+		if id == "broken" || attempts[id] < 3 {
+			return errors.New("sink unavailable")
+		}
+		written = append(written, id)
+		return nil
+	})
+	closeSink, err := ConsumeToSink(SinkConfig{
+		Consumer: ConsumerConfig{
+			Brokers:         cluster.ListenAddrs(),
+			Topics:          []string{topic},
+			GroupID:         "group",
+			Logger:          zaptest.NewLogger(t),
+			DeadLetterTopic: dlqTopic,
+		},
+		Sink:        sink,
+		MaxAttempts: 3,
+		Backoff:     ConstantBackoff(time.Millisecond),
+	})
+	require.NoError(t, err)
+
+	dlq := consumeRecords(t, cluster, dlqTopic, 1)
+	require.NoError(t, closeSink())
+	var event model.APMEvent
+	require.NoError(t, json.Unmarshal(dlq[0].Value, &event))
+	assert.Equal(t, "broken", event.Trace.ID)
+	assert.Equal(t, []string{"flaky"}, written)
+	assert.Equal(t, map[string]int{"flaky": 3, "broken": 3}, attempts)
+}
+
+func TestConsumeToSinkStop(t *testing.T) {
+	topic := "sink-stop"
+	cluster := newFakeCluster(t, 1, topic)
+	event, err := json.Marshal(model.APMEvent{})
+	require.NoError(t, err)
+	produceRecords(t, cluster, &kgo.Record{Topic: topic, Value: event})
+
+	failed := make(chan struct{}, 1)
+	closeSink, err := ConsumeToSink(SinkConfig{
+		Consumer: ConsumerConfig{
+			Brokers: cluster.ListenAddrs(),
+			Topics:  []string{topic},
+			GroupID: "group",
+			Logger:  zaptest.NewLogger(t),
+		},
+		Sink: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			select {
+			case failed <- struct{}{}:
+			default:
+			}
+			return errors.New("sink unavailable")
+		}),
+		MaxAttempts: 3,
+		Backoff:     ConstantBackoff(time.Hour),
+	})
+	require.NoError(t, err)
+
+	// Stopping interrupts the backoff between the attempts of the failing
+	// sink.
+	<-failed
+	start := time.Now()
+	require.NoError(t, closeSink())
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
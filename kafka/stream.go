@@ -0,0 +1,112 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// RawRecord is a consumed record, before it's decoded.
+type RawRecord struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   map[string][]byte
+	Timestamp time.Time
+}
+
+// StreamProcessor processes the consumed records one at a time, without
+// decoding them.
+type StreamProcessor interface {
+	// ProcessRecord processes a single record. When it returns nil, the
+	// record offset is committed. Otherwise, the record is redelivered.
+	ProcessRecord(ctx context.Context, record RawRecord) error
+}
+
+// StreamProcessorFunc is a function type that implements StreamProcessor.
+type StreamProcessorFunc func(context.Context, RawRecord) error
+
+// ProcessRecord calls f(ctx, record).
+func (f StreamProcessorFunc) ProcessRecord(ctx context.Context, record RawRecord) error {
+	return f(ctx, record)
+}
+
+func newRawRecord(msg *kgo.Record) RawRecord {
+	record := RawRecord{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Headers:   make(map[string][]byte, len(msg.Headers)),
+		Timestamp: msg.Timestamp,
+	}
+	for _, h := range msg.Headers {
+		record.Headers[h.Key] = h.Value
+	}
+	return record
+}
+
+// waitStreamRetry waits for the StreamRetryBackoff of the record's failed
+// attempts, if any, returning false if ctx is done first.
+func (c *Consumer) waitStreamRetry(ctx context.Context, msg *kgo.Record) bool {
+	attempts := c.poison.attempts(msg)
+	if attempts == 0 {
+		return ctx.Err() == nil
+	}
+	return wait(ctx, c.cfg.StreamRetryBackoff, attempts)
+}
+
+// processStreamRecord passes the record to the StreamProcessor, returning
+// Retry if it fails. The record is processed with ctx, within its process
+// span.
+func (c *Consumer) processStreamRecord(ctx context.Context, msg *kgo.Record) RecordDisposition {
+	_, span := c.tracer.WithProcessSpan(msg)
+	defer span.End()
+	span.SetAttributes(messageIDAttr(msg))
+	processCtx := trace.ContextWithSpan(ctx, span)
+	record := newRawRecord(msg)
+	if project, ok := record.Headers["project_id"]; ok {
+		processCtx = queuecontext.WithProject(processCtx, string(project))
+	}
+	err := c.cfg.StreamProcessor.ProcessRecord(processCtx, record)
+	c.metrics.recordOutcome(processCtx, msg.Topic, err != nil)
+	if err != nil {
+		c.processingError(msg, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		c.cfg.Logger.Error("unable to process record, redelivering it",
+			zap.Error(err),
+			zap.String("topic", msg.Topic),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", int32(msg.Partition)),
+		)
+		return Retry
+	}
+	return Ack
+}
@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// TLS configures the TLS connections to the brokers.
+type TLS struct {
+	// Config is the base TLS configuration, such as the root CAs and the
+	// client certificates. Defaults to an empty configuration, which
+	// verifies the brokers against the system roots.
+	Config *tls.Config
+	// ServerNameOverride, when set, is the server name presented in the
+	// SNI extension and verified against the broker certificates, instead
+	// of the host of each broker address. This is useful when the brokers
+	// are reached through a load balancer whose hostname differs from the
+	// broker certificates.
+	ServerNameOverride string
+}
+
+// config returns the TLS configuration used to connect to the host.
+func (t *TLS) config(host string) (*tls.Config, error) {
+	var cfg *tls.Config
+	if t.Config != nil {
+		cfg = t.Config.Clone()
+	} else {
+		cfg = new(tls.Config)
+	}
+	switch {
+	case t.ServerNameOverride != "":
+		cfg.ServerName = t.ServerNameOverride
+	case cfg.ServerName == "":
+		server, _, err := net.SplitHostPort(host)
+		if err != nil {
+			return nil, fmt.Errorf("kafka: unable to split host %q: %w", host, err)
+		}
+		cfg.ServerName = server
+	}
+	return cfg, nil
+}
+
+// dialOpt returns the client option which dials the brokers with the TLS
+// configuration and the reconnect backoff, or nil if neither is set.
+func dialOpt(t *TLS, reconnect ReconnectBackoff) kgo.Opt {
+	if t == nil {
+		return reconnect.opt()
+	}
+	d := newReconnectDialer(reconnect)
+	d.dial = t.dialer(d.dial)
+	if reconnect.Max == 0 {
+		return kgo.Dialer(d.dial)
+	}
+	return kgo.Dialer(d.DialContext)
+}
+
+// dialer wraps the dial function, so the dialed connections complete the
+// TLS handshake before they're returned.
+func (t *TLS) dialer(
+	dial func(ctx context.Context, network, host string) (net.Conn, error),
+) func(ctx context.Context, network, host string) (net.Conn, error) {
+	return func(ctx context.Context, network, host string) (net.Conn, error) {
+		cfg, err := t.config(host)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, network, host)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
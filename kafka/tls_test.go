@@ -0,0 +1,161 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestTLSConfig(t *testing.T) {
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	cfg, err := (&TLS{Config: base}).config("broker-0.internal:9093")
+	require.NoError(t, err)
+	assert.Equal(t, "broker-0.internal", cfg.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+
+	cfg, err = (&TLS{Config: base, ServerNameOverride: "kafka.example"}).config("lb.internal:9093")
+	require.NoError(t, err)
+	assert.Equal(t, "kafka.example", cfg.ServerName)
+	assert.Empty(t, base.ServerName, "base config must not be modified")
+
+	cfg, err = (&TLS{Config: &tls.Config{ServerName: "kafka.example"}}).config("lb.internal:9093")
+	require.NoError(t, err)
+	assert.Equal(t, "kafka.example", cfg.ServerName)
+
+	_, err = (&TLS{}).config("invalid")
+	assert.Error(t, err)
+}
+
+func TestProducerTLSServerNameOverride(t *testing.T) {
+	const serverName = "kafka.example"
+	cert, roots := newTestCertificate(t, serverName)
+	topic := "tls"
+	cluster, err := kfake.NewCluster(
+		kfake.NumBrokers(1),
+		kfake.SeedTopics(1, topic),
+		kfake.TLS(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+
+	produce := func(t *testing.T, cfg *TLS) error {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers: cluster.ListenAddrs(),
+			Topic:   topic,
+			Logger:  zaptest.NewLogger(t),
+			TLS:     cfg,
+		})
+		require.NoError(t, err)
+		defer producer.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		return producer.ProcessBatch(ctx, &model.Batch{{}})
+	}
+	t.Run("override", func(t *testing.T) {
+		assert.NoError(t, produce(t, &TLS{
+			Config:             &tls.Config{RootCAs: roots},
+			ServerNameOverride: serverName,
+		}))
+	})
+	t.Run("broker_host", func(t *testing.T) {
+		// The certificate isn't valid for the broker addresses.
+		assert.Error(t, produce(t, &TLS{Config: &tls.Config{RootCAs: roots}}))
+	})
+}
+
+func TestTLSClients(t *testing.T) {
+	const serverName = "kafka.example"
+	cert, roots := newTestCertificate(t, serverName)
+	topic := "tls-clients"
+	cluster, err := kfake.NewCluster(
+		kfake.NumBrokers(1),
+		kfake.SeedTopics(1, topic),
+		kfake.TLS(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	cfg := &TLS{Config: &tls.Config{RootCAs: roots}, ServerNameOverride: serverName}
+
+	t.Run("require_existing_group", func(t *testing.T) {
+		// The group is described by a separate client before joining it.
+		_, err := NewConsumer(ConsumerConfig{
+			Brokers:              cluster.ListenAddrs(),
+			Topics:               []string{topic},
+			GroupID:              "group",
+			Logger:               zaptest.NewLogger(t),
+			TLS:                  cfg,
+			RequireExistingGroup: true,
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				return nil
+			}),
+		})
+		assert.ErrorIs(t, err, ErrGroupNotFound)
+	})
+	t.Run("import", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		imported, err := ImportTopic(ctx, topic, bytes.NewBufferString(`{}`), ImportConfig{
+			Brokers: cluster.ListenAddrs(),
+			Logger:  zaptest.NewLogger(t),
+			TLS:     cfg,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), imported)
+	})
+}
+
+// newTestCertificate returns a self-signed certificate for the server name,
+// and the pool which trusts it.
+func newTestCertificate(t testing.TB, serverName string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
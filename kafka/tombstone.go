@@ -0,0 +1,78 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// ProcessTombstones produces a tombstone, a record with a nil value, for each
+// of the keys to the topic, waiting until they have been acknowledged by the
+// brokers. Once a compacted topic is compacted, the records with the keys are
+// deleted. When the topic is empty, the producer Topic is used. Tombstones
+// aren't mirrored.
+func (p *Producer) ProcessTombstones(ctx context.Context, topic string, keys [][]byte) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	select {
+	case <-p.closed:
+		return errProducerClosed
+	default:
+	}
+	for _, key := range keys {
+		if key == nil {
+			return errors.New("kafka: tombstone key cannot be nil")
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	headers, err := p.recordHeaders(ctx, p.cfg.clock.Now())
+	if err != nil {
+		return err
+	}
+	if topic == "" {
+		topic = p.cfg.Topic
+	}
+	records := make([]*kgo.Record, len(keys))
+	for i, key := range keys {
+		records[i] = &kgo.Record{Topic: topic, Key: key, Headers: headers}
+		p.stampSequence(records[i])
+	}
+	p.saveSequence(ctx)
+	var errs []error
+	if p.cfg.DryRun {
+		for _, record := range records {
+			if err := p.produceError(record, p.dryRun.produce(ctx, record, topic)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+	epoch := p.flush.add(len(records))
+	defer p.flush.done(epoch, len(records))
+	for _, res := range p.client.ProduceSync(ctx, records...) {
+		if err := p.produceError(res.Record, res.Err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,59 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestProducerProcessTombstones(t *testing.T) {
+	topic, other := "tombstones", "tombstones-other"
+	cluster := newFakeCluster(t, 1, topic, other)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: cluster.ListenAddrs(),
+		Topic:   topic,
+		Logger:  zaptest.NewLogger(t),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+
+	ctx := context.Background()
+	require.NoError(t, producer.ProcessTombstones(ctx, "", [][]byte{[]byte("a")}))
+	require.NoError(t, producer.ProcessTombstones(ctx, other, [][]byte{[]byte("b"), []byte("c")}))
+	assert.EqualError(t,
+		producer.ProcessTombstones(ctx, "", [][]byte{nil}),
+		"kafka: tombstone key cannot be nil",
+	)
+
+	records := consumeRecords(t, cluster, topic, 1)
+	require.Len(t, records, 1)
+	assert.Equal(t, []byte("a"), records[0].Key)
+	assert.Nil(t, records[0].Value)
+
+	records = consumeRecords(t, cluster, other, 2)
+	require.Len(t, records, 2)
+	for i, key := range []string{"b", "c"} {
+		assert.Equal(t, []byte(key), records[i].Key)
+		assert.Nil(t, records[i].Value)
+	}
+}
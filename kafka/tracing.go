@@ -0,0 +1,65 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/plugin/kotel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.18.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTracer returns a kotel tracer which creates spans following the OTel
+// messaging semantic conventions. A nil tp uses the global tracer provider.
+func newTracer(tp trace.TracerProvider, opts ...kotel.TracerOpt) *kotel.Tracer {
+	if tp != nil {
+		opts = append(opts, kotel.TracerProvider(tp))
+	}
+	return kotel.NewTracer(opts...)
+}
+
+// messageIDHook sets the message ID attribute on the publish span once the
+// record has been produced. It must run before the kotel tracer hook, which
+// ends the span.
+type messageIDHook struct{}
+
+func (messageIDHook) OnProduceRecordUnbuffered(r *kgo.Record, err error) {
+	if err != nil {
+		return
+	}
+	trace.SpanFromContext(r.Context).SetAttributes(messageIDAttr(r))
+}
+
+// messageIDAttr returns the message ID attribute for a record, which is its
+// offset within the partition.
+func messageIDAttr(r *kgo.Record) attribute.KeyValue {
+	return semconv.MessagingMessageID(strconv.FormatInt(r.Offset, 10))
+}
+
+// recordSpanError records the error as an exception event on the span of
+// the context, and sets the span status to error.
+func recordSpanError(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,232 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/plugin/kzap"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+// TransactProcessor processes the events consumed by a TransactConsumer,
+// returning the events to produce in the same transaction. When it returns
+// an error, the transaction is aborted and the events are consumed again.
+type TransactProcessor func(ctx context.Context, batch model.Batch) (model.Batch, error)
+
+// TransactConsumerConfig defines the configuration for the TransactConsumer.
+type TransactConsumerConfig struct {
+	// Brokers is the list of kafka brokers used to seed the Kafka client.
+	Brokers []string
+	// Topics that the consumer will consume messages from.
+	Topics []string
+	// GroupID to join as part of the consumer group.
+	GroupID string
+	// TransactionalID identifies the transactional producer. It must be
+	// unique to each consumer instance and stable across its restarts, so
+	// the transactions of a previous instance are fenced.
+	TransactionalID string
+	// OutputTopic is the topic the events returned by Processor are
+	// produced to.
+	OutputTopic string
+	// ClientID to use when connecting to Kafka.
+	ClientID string
+	// SASL mechanisms to authenticate with, in order of preference.
+	SASL []sasl.Mechanism
+	// TLS, when set, makes the client connect to the brokers over TLS.
+	TLS *TLS
+	// Logger to use for any errors.
+	Logger *zap.Logger
+	// Decoder decodes the record values into events, defaults to JSON.
+	Decoder Decoder
+	// Encoder encodes the produced events, defaults to JSON.
+	Encoder Encoder
+	// Processor processes the events of each fetch.
+	Processor TransactProcessor
+}
+
+// Validate ensures the configuration is valid, otherwise, returns an error.
+func (cfg TransactConsumerConfig) Validate() error {
+	var errs []error
+	if len(cfg.Brokers) == 0 {
+		errs = append(errs, errors.New("kafka: at least one broker must be set"))
+	}
+	if len(cfg.Topics) == 0 {
+		errs = append(errs, errors.New("kafka: at least one topic must be set"))
+	}
+	if cfg.GroupID == "" {
+		errs = append(errs, errors.New("kafka: consumer GroupID must be set"))
+	}
+	if cfg.TransactionalID == "" {
+		errs = append(errs, errors.New("kafka: transactional ID must be set"))
+	}
+	if cfg.OutputTopic == "" {
+		errs = append(errs, errors.New("kafka: output topic must be set"))
+	}
+	if cfg.Logger == nil {
+		errs = append(errs, errors.New("kafka: logger must be set"))
+	}
+	if cfg.Processor == nil {
+		errs = append(errs, errors.New("kafka: processor must be set"))
+	}
+	return errors.Join(errs...)
+}
+
+// TransactConsumer consumes records in a consumer group and produces the
+// processed events in transactions which also commit the consumed offsets,
+// so the produced events and the offsets are committed atomically. The
+// consumers reading the output should use the read committed isolation
+// level.
+type TransactConsumer struct {
+	cfg     TransactConsumerConfig
+	session *kgo.GroupTransactSession
+}
+
+// NewTransactConsumer creates a new instance of a TransactConsumer.
+func NewTransactConsumer(cfg TransactConsumerConfig) (*TransactConsumer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Decoder == nil {
+		cfg.Decoder = json.JSON{}
+	}
+	if cfg.Encoder == nil {
+		cfg.Encoder = json.JSON{}
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.ConsumerGroup(cfg.GroupID),
+		kgo.ConsumeTopics(cfg.Topics...),
+		kgo.TransactionalID(cfg.TransactionalID),
+		kgo.DefaultProduceTopic(cfg.OutputTopic),
+		kgo.FetchIsolationLevel(kgo.ReadCommitted()),
+		kgo.WithLogger(kzap.New(cfg.Logger)),
+	}
+	if len(cfg.SASL) > 0 {
+		opts = append(opts, kgo.SASL(cfg.SASL...))
+	}
+	if opt := dialOpt(cfg.TLS, ReconnectBackoff{}); opt != nil {
+		opts = append(opts, opt)
+	}
+	if cfg.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.ClientID))
+	}
+	session, err := kgo.NewGroupTransactSession(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed to create transact session: %w", err)
+	}
+	return &TransactConsumer{cfg: cfg, session: session}, nil
+}
+
+// Close closes the consumer, aborting the ongoing transaction, if any.
+func (c *TransactConsumer) Close() error {
+	c.session.Close()
+	return nil
+}
+
+// Run executes the consumer in a blocking manner, processing each fetch in
+// a transaction, until the context is done or a transaction fails to end.
+func (c *TransactConsumer) Run(ctx context.Context) error {
+	for {
+		fetches := c.session.PollFetches(ctx)
+		if fetches.IsClientClosed() {
+			return context.Canceled // Client closed.
+		}
+		if err := ctx.Err(); err != nil {
+			return err // Context cancelled or deadline exceeded.
+		}
+		fetches.EachError(func(t string, p int32, err error) {
+			c.cfg.Logger.Error("consumer fetches returned error",
+				zap.Error(err), zap.String("topic", t), zap.Int32("partition", p),
+			)
+		})
+		if fetches.NumRecords() == 0 {
+			continue
+		}
+		if err := c.transact(ctx, fetches.Records()); err != nil {
+			return err
+		}
+	}
+}
+
+// transact processes the records and produces the output in a transaction,
+// which commits the offsets of the records. When the transaction is aborted,
+// the session rewinds to the last committed offsets, so the records are
+// consumed again.
+func (c *TransactConsumer) transact(ctx context.Context, records []*kgo.Record) error {
+	if err := c.session.Begin(); err != nil {
+		return fmt.Errorf("kafka: failed to begin transaction: %w", err)
+	}
+	commit := kgo.TryCommit
+	if err := c.produce(ctx, records); err != nil {
+		c.cfg.Logger.Warn("aborting transaction", zap.Error(err))
+		commit = kgo.TryAbort
+	}
+	committed, err := c.session.End(ctx, commit)
+	if err != nil {
+		return fmt.Errorf("kafka: failed to end transaction: %w", err)
+	}
+	if commit == kgo.TryCommit && !committed {
+		c.cfg.Logger.Warn("transaction aborted by a rebalance")
+	}
+	return nil
+}
+
+// produce processes the records, producing the output events.
+func (c *TransactConsumer) produce(ctx context.Context, records []*kgo.Record) error {
+	batch := make(model.Batch, 0, len(records))
+	for _, msg := range records {
+		var event model.APMEvent
+		if err := c.cfg.Decoder.Decode(msg.Value, &event); err != nil {
+			c.cfg.Logger.Error("unable to decode the record into model.APMEvent",
+				zap.Error(err),
+				zap.String("topic", msg.Topic),
+				zap.Int64("offset", msg.Offset),
+				zap.Int32("partition", msg.Partition),
+			)
+			continue
+		}
+		batch = append(batch, event)
+	}
+	output, err := c.cfg.Processor(ctx, batch)
+	if err != nil {
+		return fmt.Errorf("kafka: failed to process batch: %w", err)
+	}
+	if len(output) == 0 {
+		return nil
+	}
+	produce := make([]*kgo.Record, 0, len(output))
+	for _, event := range output {
+		encoded, err := c.cfg.Encoder.Encode(event)
+		if err != nil {
+			return fmt.Errorf("kafka: failed to encode event: %w", err)
+		}
+		produce = append(produce, &kgo.Record{Value: encoded})
+	}
+	if err := c.session.ProduceSync(ctx, produce...).FirstErr(); err != nil {
+		return fmt.Errorf("kafka: failed to produce records: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestTransactConsumer(t *testing.T) {
+	input, output := "transact-input", "transact-output"
+	cluster := newFakeCluster(t, 1, input, output)
+	txns := newFakeTransactions(t, cluster)
+	// The offsets of the first transaction fail to commit, so it's
+	// aborted after its events have been produced.
+	txns.failOffsetCommits.Store(1)
+
+	records := make([]*kgo.Record, 10)
+	for i := range records {
+		records[i] = &kgo.Record{Topic: input, Value: []byte(`{}`)}
+	}
+	produceRecords(t, cluster, records...)
+
+	var processed atomic.Int64
+	consumer, err := NewTransactConsumer(TransactConsumerConfig{
+		Brokers:         cluster.ListenAddrs(),
+		Topics:          []string{input},
+		GroupID:         "group",
+		TransactionalID: "transact",
+		OutputTopic:     output,
+		Logger:          zaptest.NewLogger(t),
+		Processor: func(_ context.Context, batch model.Batch) (model.Batch, error) {
+			processed.Add(int64(len(batch)))
+			return batch, nil
+		},
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- consumer.Run(ctx) }()
+
+	assert.Eventually(t, func() bool {
+		txns.mu.Lock()
+		defer txns.mu.Unlock()
+		return len(txns.ended) > 0 && txns.ended[len(txns.ended)-1].commit
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	require.NoError(t, consumer.Close())
+
+	txns.mu.Lock()
+	ended, committed := txns.ended, txns.committed
+	txns.mu.Unlock()
+	require.Len(t, ended, 2)
+	// Neither the output nor the offsets advanced with the aborted
+	// transaction, and the records were consumed again.
+	assert.Equal(t, fakeTransaction{records: len(records)}, ended[0])
+	assert.Equal(t, fakeTransaction{
+		commit:  true,
+		records: len(records),
+		offsets: map[string]map[int32]int64{input: {0: int64(len(records))}},
+	}, ended[1])
+	assert.Equal(t, int64(2*len(records)), processed.Load())
+	assert.Equal(t, len(records), committed)
+
+	// The offsets are only committed through the transaction.
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	offsets, err := kadm.NewClient(client).FetchOffsets(context.Background(), "group")
+	if err == nil {
+		assert.Empty(t, offsets, "offsets committed outside of the transaction")
+	} else {
+		assert.True(t, errors.Is(err, kerr.GroupIDNotFound), err)
+	}
+}
+
+func TestTransactConsumerConfigValidate(t *testing.T) {
+	err := TransactConsumerConfig{}.Validate()
+	for _, msg := range []string{
+		"kafka: at least one broker must be set",
+		"kafka: at least one topic must be set",
+		"kafka: consumer GroupID must be set",
+		"kafka: transactional ID must be set",
+		"kafka: output topic must be set",
+		"kafka: logger must be set",
+		"kafka: processor must be set",
+	} {
+		assert.ErrorContains(t, err, msg)
+	}
+}
+
+// fakeTransaction is a transaction ended by the fakeTransactions.
+type fakeTransaction struct {
+	commit  bool
+	records int
+	offsets map[string]map[int32]int64
+}
+
+// fakeTransactions emulates the transaction coordinator, which kfake lacks.
+// The transactional records and offset commits are staged, and counted or
+// committed only when their transaction ends with a commit.
+type fakeTransactions struct {
+	// failOffsetCommits is the number of transactional offset commits to
+	// fail with an error that makes the client abort the transaction.
+	failOffsetCommits atomic.Int64
+
+	mu        sync.Mutex
+	staged    fakeTransaction
+	ended     []fakeTransaction
+	committed int
+	// next is the offset of the next transactional record.
+	next int64
+}
+
+func newFakeTransactions(t testing.TB, cluster *kfake.Cluster) *fakeTransactions {
+	t.Helper()
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	versions, err := kmsg.NewPtrApiVersionsRequest().RequestWith(context.Background(), client)
+	client.Close()
+	require.NoError(t, err)
+	keys := versions.ApiKeys
+	for _, key := range []kmsg.Key{
+		kmsg.AddPartitionsToTxn, kmsg.AddOffsetsToTxn, kmsg.EndTxn, kmsg.TxnOffsetCommit,
+	} {
+		keys = append(keys, kmsg.ApiVersionsResponseApiKey{
+			ApiKey: int16(key), MaxVersion: 3,
+		})
+	}
+
+	txns := new(fakeTransactions)
+	control := func(key kmsg.Key, fn func(kmsg.Request) kmsg.Response) {
+		cluster.ControlKey(int16(key), func(req kmsg.Request) (kmsg.Response, error, bool) {
+			cluster.KeepControl()
+			txns.mu.Lock()
+			defer txns.mu.Unlock()
+			if resp := fn(req); resp != nil {
+				return resp, nil, true
+			}
+			return nil, nil, false
+		})
+	}
+	control(kmsg.ApiVersions, func(kreq kmsg.Request) kmsg.Response {
+		resp := kreq.ResponseKind().(*kmsg.ApiVersionsResponse)
+		resp.ApiKeys = keys
+		return resp
+	})
+	control(kmsg.InitProducerID, func(kreq kmsg.Request) kmsg.Response {
+		if kreq.(*kmsg.InitProducerIDRequest).TransactionalID == nil {
+			return nil
+		}
+		resp := kreq.ResponseKind().(*kmsg.InitProducerIDResponse)
+		resp.ProducerID = 1
+		return resp
+	})
+	control(kmsg.AddPartitionsToTxn, func(kreq kmsg.Request) kmsg.Response {
+		req := kreq.(*kmsg.AddPartitionsToTxnRequest)
+		resp := req.ResponseKind().(*kmsg.AddPartitionsToTxnResponse)
+		for _, rt := range req.Topics {
+			st := kmsg.NewAddPartitionsToTxnResponseTopic()
+			st.Topic = rt.Topic
+			for _, p := range rt.Partitions {
+				sp := kmsg.NewAddPartitionsToTxnResponseTopicPartition()
+				sp.Partition = p
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp
+	})
+	control(kmsg.AddOffsetsToTxn, func(kreq kmsg.Request) kmsg.Response {
+		return kreq.ResponseKind()
+	})
+	control(kmsg.Produce, func(kreq kmsg.Request) kmsg.Response {
+		req := kreq.(*kmsg.ProduceRequest)
+		if req.TransactionID == nil {
+			return nil
+		}
+		resp := req.ResponseKind().(*kmsg.ProduceResponse)
+		for _, rt := range req.Topics {
+			st := kmsg.NewProduceResponseTopic()
+			st.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				var batch kmsg.RecordBatch
+				if err := batch.ReadFrom(rp.Records); err != nil {
+					t.Error(err)
+				}
+				sp := kmsg.NewProduceResponseTopicPartition()
+				sp.Partition = rp.Partition
+				sp.BaseOffset = txns.next
+				txns.next += int64(batch.NumRecords)
+				txns.staged.records += int(batch.NumRecords)
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp
+	})
+	control(kmsg.TxnOffsetCommit, func(kreq kmsg.Request) kmsg.Response {
+		req := kreq.(*kmsg.TxnOffsetCommitRequest)
+		resp := req.ResponseKind().(*kmsg.TxnOffsetCommitResponse)
+		var code int16
+		if txns.failOffsetCommits.Add(-1) >= 0 {
+			code = kerr.ConcurrentTransactions.Code
+		}
+		for _, rt := range req.Topics {
+			st := kmsg.NewTxnOffsetCommitResponseTopic()
+			st.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				sp := kmsg.NewTxnOffsetCommitResponseTopicPartition()
+				sp.Partition = rp.Partition
+				sp.ErrorCode = code
+				st.Partitions = append(st.Partitions, sp)
+				if code != 0 {
+					continue
+				}
+				if txns.staged.offsets == nil {
+					txns.staged.offsets = make(map[string]map[int32]int64)
+				}
+				if txns.staged.offsets[rt.Topic] == nil {
+					txns.staged.offsets[rt.Topic] = make(map[int32]int64)
+				}
+				txns.staged.offsets[rt.Topic][rp.Partition] = rp.Offset
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp
+	})
+	control(kmsg.EndTxn, func(kreq kmsg.Request) kmsg.Response {
+		txn := txns.staged
+		txn.commit = kreq.(*kmsg.EndTxnRequest).Commit
+		if txn.commit {
+			txns.committed += txn.records
+		}
+		txns.ended = append(txns.ended, txn)
+		txns.staged = fakeTransaction{}
+		return kreq.ResponseKind()
+	})
+	return txns
+}
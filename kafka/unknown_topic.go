@@ -0,0 +1,123 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap"
+)
+
+// unknownPartitions tracks the topics whose fetches failed with unknown
+// topic or partition errors.
+type unknownPartitions struct {
+	// attempts is the number of consecutive fetches which failed.
+	attempts int
+	// deleted holds the topics which were found not to exist, until they
+	// are recreated.
+	deleted map[string]struct{}
+}
+
+// handleUnknownPartitions refreshes the metadata while the fetches fail with
+// unknown topic or partition errors. Once a topic which was deleted exists
+// again, it's consumed again from the start of its partitions: the client
+// keeps fetching the deleted topic otherwise, and the committed offsets
+// belong to the deleted topic.
+func (c *Consumer) handleUnknownPartitions(ctx context.Context, failed []string) {
+	u := &c.unknown
+	if len(failed) > 0 {
+		u.attempts++
+		c.client.ForceMetadataRefresh()
+	} else if u.attempts > 0 {
+		u.attempts = 0
+		c.cfg.UnknownTopicBackoff.Reset()
+	}
+	if len(failed) == 0 && len(u.deleted) == 0 {
+		return
+	}
+	topics := append([]string(nil), failed...)
+	for topic := range u.deleted {
+		if !containsString(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	listed, err := kadm.NewClient(c.client).ListStartOffsets(ctx, topics...)
+	if err != nil {
+		c.cfg.Logger.Debug("unable to list start offsets of unknown topics", zap.Error(err))
+		return
+	}
+	for _, topic := range topics {
+		partitions, exists := existingPartitions(listed, topic)
+		_, deleted := u.deleted[topic]
+		switch {
+		case !exists && !deleted:
+			if u.deleted == nil {
+				u.deleted = make(map[string]struct{})
+			}
+			u.deleted[topic] = struct{}{}
+			c.cfg.Logger.Warn("consumed topic was deleted", zap.String("topic", topic))
+		case exists && deleted:
+			delete(u.deleted, topic)
+			c.consumeRecreatedTopic(ctx, topic, partitions)
+		}
+	}
+}
+
+// existingPartitions returns the start offsets of the topic partitions,
+// keyed by partition, and whether the topic exists.
+func existingPartitions(listed kadm.ListedOffsets, topic string) (map[int32]kgo.EpochOffset, bool) {
+	partitions := make(map[int32]kgo.EpochOffset)
+	for partition, o := range listed[topic] {
+		if o.Err != nil {
+			return nil, false
+		}
+		partitions[partition] = kgo.EpochOffset{Epoch: -1, Offset: o.Offset}
+	}
+	return partitions, len(partitions) > 0
+}
+
+// consumeRecreatedTopic commits the start offsets of the recreated topic
+// partitions and subscribes to the topic again, so it's consumed from its
+// start with the new topic metadata.
+func (c *Consumer) consumeRecreatedTopic(ctx context.Context, topic string, start map[int32]kgo.EpochOffset) {
+	c.cfg.Logger.Info("consuming recreated topic from its start", zap.String("topic", topic))
+	// The offsets of the deleted topic records don't apply anymore.
+	pending := c.pending[:0]
+	for _, r := range c.pending {
+		if r.Topic != topic {
+			pending = append(pending, r)
+		}
+	}
+	c.pending = pending
+	var commitErr error
+	c.client.CommitOffsetsSync(ctx, map[string]map[int32]kgo.EpochOffset{topic: start},
+		func(_ *kgo.Client, _ *kmsg.OffsetCommitRequest, _ *kmsg.OffsetCommitResponse, err error) {
+			commitErr = err
+		},
+	)
+	if commitErr != nil {
+		c.cfg.Logger.Error("unable to commit the start offsets of recreated topic",
+			zap.Error(commitErr), zap.String("topic", topic),
+		)
+	}
+	c.client.PurgeTopicsFromClient(topic)
+	c.client.AddConsumeTopics(topic)
+}
@@ -0,0 +1,81 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/elastic/apm-data/model"
+)
+
+const (
+	// ValidationDropInvalid fails the invalid events, the valid events of
+	// the batch are produced.
+	ValidationDropInvalid ValidationPolicy = iota
+	// ValidationFailBatch fails the whole batch when any of its events is
+	// invalid, none of the events are produced.
+	ValidationFailBatch
+)
+
+// ValidationPolicy defines what the producer does with a batch which has
+// events rejected by ValidateEvent.
+type ValidationPolicy uint8
+
+// ErrValidation is wrapped by the ValidationError of the events rejected by
+// ValidateEvent.
+var ErrValidation = errors.New("kafka: event validation failed")
+
+// ValidationError describes an event rejected by ValidateEvent.
+type ValidationError struct {
+	// Index of the event in the batch.
+	Index int
+	// Err is the error returned by ValidateEvent.
+	Err error
+}
+
+// Error implements the error interface.
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%v: event %d: %v", ErrValidation, e.Index, e.Err)
+}
+
+// Unwrap returns ErrValidation and the ValidateEvent error.
+func (e ValidationError) Unwrap() []error {
+	return []error{ErrValidation, e.Err}
+}
+
+// validateBatch returns the ValidationError of each of the events in the
+// batch rejected by ValidateEvent, indexed as the batch, or nil when all the
+// events are valid.
+func (p *Producer) validateBatch(batch model.Batch) []error {
+	if p.cfg.ValidateEvent == nil {
+		return nil
+	}
+	var invalid []error
+	for i, event := range batch {
+		err := p.cfg.ValidateEvent(event)
+		if err == nil {
+			continue
+		}
+		if invalid == nil {
+			invalid = make([]error, len(batch))
+		}
+		invalid[i] = ValidationError{Index: i, Err: err}
+	}
+	return invalid
+}
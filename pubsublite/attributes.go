@@ -0,0 +1,63 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"strings"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+// DefaultMetadataAttributePrefix is the default prefix of the message
+// attributes which hold the queuecontext metadata.
+const DefaultMetadataAttributePrefix = "metadata."
+
+// messageAttributes returns the attributes of the message for the event:
+// the project ID, the processor and the context metadata, each metadata key
+// prefixed with prefix.
+func messageAttributes(ctx context.Context, projectID, prefix string, event model.APMEvent) map[string]string {
+	metadata, _ := queuecontext.MetadataFromContext(ctx)
+	attrs := make(map[string]string, len(metadata)+2)
+	for k, v := range metadata {
+		attrs[prefix+k] = v
+	}
+	attrs["project_id"] = projectID
+	attrs["processor"] = event.Processor.Event
+	return attrs
+}
+
+// messageContext returns a copy of ctx holding the project ID and the
+// metadata restored from the message attributes.
+func messageContext(ctx context.Context, attrs map[string]string, prefix string) context.Context {
+	ctx = queuecontext.WithProject(ctx, attrs["project_id"])
+	var metadata map[string]string
+	for k, v := range attrs {
+		if key := strings.TrimPrefix(k, prefix); key != k {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			metadata[key] = v
+		}
+	}
+	if metadata != nil {
+		ctx = queuecontext.WithMetadata(ctx, metadata)
+	}
+	return ctx
+}
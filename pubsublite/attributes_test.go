@@ -0,0 +1,56 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pubsublite
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queuecontext"
+)
+
+func TestMetadataAttributesRoundTrip(t *testing.T) {
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{
+		"tenant": "a",
+		"region": "eu",
+	})
+	event := model.APMEvent{Processor: model.TransactionProcessor}
+	attrs := messageAttributes(ctx, "project", DefaultMetadataAttributePrefix, event)
+	assert.Equal(t, map[string]string{
+		"project_id":      "project",
+		"processor":       "transaction",
+		"metadata.tenant": "a",
+		"metadata.region": "eu",
+	}, attrs)
+
+	restored := messageContext(context.Background(), attrs, DefaultMetadataAttributePrefix)
+	project, ok := queuecontext.ProjectFromContext(restored)
+	assert.True(t, ok)
+	assert.Equal(t, "project", project)
+	metadata, ok := queuecontext.MetadataFromContext(restored)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"tenant": "a", "region": "eu"}, metadata)
+
+	// Messages without metadata attributes don't restore any metadata.
+	restored = messageContext(context.Background(), map[string]string{"project_id": "project"}, "meta_")
+	_, ok = queuecontext.MetadataFromContext(restored)
+	assert.False(t, ok)
+}
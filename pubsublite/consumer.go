@@ -30,7 +30,6 @@ import (
 	"google.golang.org/api/option"
 
 	"github.com/elastic/apm-data/model"
-	"github.com/elastic/apm-queue/queuecontext"
 )
 
 // ConsumerConfig defines the configuration for the Kafka consumer.
@@ -47,6 +46,10 @@ type ConsumerConfig struct {
 	// Processor that will be used to process each event individually.
 	Processor  model.BatchProcessor
 	ClientOpts []option.ClientOption
+	// MetadataAttributePrefix is the prefix of the message attributes which
+	// are restored as the queuecontext metadata. Defaults to
+	// DefaultMetadataAttributePrefix.
+	MetadataAttributePrefix string
 }
 
 // Validate ensures the configuration is valid, otherwise, returns an error.
@@ -92,6 +95,9 @@ func NewConsumer(ctx context.Context, cfg ConsumerConfig) (*Consumer, error) {
 		return nil, err
 	}
 	cfg.Logger = cfg.Logger.With(zap.String("subscription", cfg.SubscriptionID))
+	if cfg.MetadataAttributePrefix == "" {
+		cfg.MetadataAttributePrefix = DefaultMetadataAttributePrefix
+	}
 	return &Consumer{
 		cfg:      cfg,
 		consumer: consumer,
@@ -117,7 +123,7 @@ func (c *Consumer) Run(ctx context.Context) error {
 	c.mu.Unlock()
 	return c.consumer.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
 		projectID := msg.Attributes["project_id"]
-		ctx = queuecontext.WithProject(ctx, projectID)
+		ctx = messageContext(ctx, msg.Attributes, c.cfg.MetadataAttributePrefix)
 		var event model.APMEvent
 		if err := json.Unmarshal(msg.Data, &event); err != nil {
 			defer msg.Nack()
@@ -22,9 +22,60 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
 )
 
 func TestNewConsumer(t *testing.T) {
 	_, err := NewConsumer(context.Background(), ConsumerConfig{})
 	assert.Error(t, err)
 }
+
+func TestConsumerConfigValidate(t *testing.T) {
+	valid := func() ConsumerConfig {
+		return ConsumerConfig{
+			Project:        "project",
+			Region:         "region",
+			SubscriptionID: "subscription",
+			Logger:         zap.NewNop(),
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				return nil
+			}),
+		}
+	}
+	for name, tc := range map[string]struct {
+		modify func(*ConsumerConfig)
+		err    string
+	}{
+		"subscription": {
+			modify: func(cfg *ConsumerConfig) { cfg.SubscriptionID = "" },
+			err:    "pubsublite: subscriptionID must be set",
+		},
+		"project": {
+			modify: func(cfg *ConsumerConfig) { cfg.Project = "" },
+			err:    "pubsublite: project must be set",
+		},
+		"region": {
+			modify: func(cfg *ConsumerConfig) { cfg.Region = "" },
+			err:    "pubsublite: region must be set",
+		},
+		"logger": {
+			modify: func(cfg *ConsumerConfig) { cfg.Logger = nil },
+			err:    "pubsublite: logger must be set",
+		},
+		"processor": {
+			modify: func(cfg *ConsumerConfig) { cfg.Processor = nil },
+			err:    "pubsublite: processor must be set",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid()
+			tc.modify(&cfg)
+			assert.EqualError(t, cfg.Validate(), tc.err)
+		})
+	}
+	t.Run("valid", func(t *testing.T) {
+		assert.NoError(t, valid().Validate())
+	})
+}
@@ -30,6 +30,7 @@ import (
 	"google.golang.org/api/option"
 
 	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/queueconfig"
 	"github.com/elastic/apm-queue/queuecontext"
 )
 
@@ -44,6 +45,13 @@ type ProducerConfig struct {
 	// Logger for the producer.
 	Logger     *zap.Logger
 	ClientOpts []option.ClientOption
+	// ProducerBatching maps Linger to the publish DelayThreshold and
+	// MaxBatchBytes to the publish ByteThreshold.
+	queueconfig.ProducerBatching
+	// MetadataAttributePrefix is prepended to the keys of the queuecontext
+	// metadata, which is published as message attributes. Defaults to
+	// DefaultMetadataAttributePrefix.
+	MetadataAttributePrefix string
 }
 
 // Validate ensures the configuration is valid, otherwise, returns an error.
@@ -61,6 +69,12 @@ func (cfg ProducerConfig) Validate() error {
 	if cfg.Logger == nil {
 		errs = append(errs, errors.New("pubsublite: logger must be set"))
 	}
+	if cfg.Linger < 0 {
+		errs = append(errs, errors.New("pubsublite: linger cannot be negative"))
+	}
+	if cfg.MaxBatchBytes < 0 || cfg.MaxBatchBytes > pscompat.MaxPublishRequestBytes {
+		errs = append(errs, fmt.Errorf("pubsublite: max batch bytes must be between 0 and %d", pscompat.MaxPublishRequestBytes))
+	}
 	return errors.Join(errs...)
 }
 
@@ -83,12 +97,16 @@ func NewProducer(ctx context.Context, cfg ProducerConfig) (*Producer, error) {
 	)
 	// TODO(marclop) connection pools:
 	// https://pkg.go.dev/cloud.google.com/go/pubsublite#hdr-gRPC_Connection_Pools
-	// TODO(marclop) tune settings using NewPublisherClientWithSettings.
-	publisher, err := pscompat.NewPublisherClient(ctx, topic, cfg.ClientOpts...)
+	publisher, err := pscompat.NewPublisherClientWithSettings(
+		ctx, topic, publishSettings(cfg.ProducerBatching), cfg.ClientOpts...,
+	)
 	if err != nil {
 		return nil, err
 	}
 	cfg.Logger = cfg.Logger.With(zap.String("topic", cfg.Topic))
+	if cfg.MetadataAttributePrefix == "" {
+		cfg.MetadataAttributePrefix = DefaultMetadataAttributePrefix
+	}
 	return &Producer{
 		cfg:      cfg,
 		producer: publisher,
@@ -96,6 +114,19 @@ func NewProducer(ctx context.Context, cfg ProducerConfig) (*Producer, error) {
 	}, nil
 }
 
+// publishSettings returns the default publish settings, overridden by the
+// batching settings which are set.
+func publishSettings(batching queueconfig.ProducerBatching) pscompat.PublishSettings {
+	settings := pscompat.DefaultPublishSettings
+	if batching.Linger > 0 {
+		settings.DelayThreshold = batching.Linger
+	}
+	if batching.MaxBatchBytes > 0 {
+		settings.ByteThreshold = batching.MaxBatchBytes
+	}
+	return settings
+}
+
 // Close stops the producer
 func (p *Producer) Close() error {
 	p.mu.Lock()
@@ -125,11 +156,8 @@ func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 			return err
 		}
 		responses = append(responses, p.producer.Publish(ctx, &pubsub.Message{
-			Attributes: map[string]string{
-				"project_id": projectID,
-				"processor":  event.Processor.Event,
-			},
-			Data: encoded,
+			Attributes: messageAttributes(ctx, projectID, p.cfg.MetadataAttributePrefix, event),
+			Data:       encoded,
 		}))
 	}
 	// NOTE(marclop) should the error be returned to the client? Does it care?
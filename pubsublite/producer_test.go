@@ -20,11 +20,77 @@ package pubsublite
 import (
 	"context"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/pubsublite/pscompat"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-queue/queueconfig"
 )
 
 func TestNewProducer(t *testing.T) {
 	_, err := NewProducer(context.Background(), ProducerConfig{})
 	assert.Error(t, err)
 }
+
+func TestProducerConfigValidate(t *testing.T) {
+	valid := func() ProducerConfig {
+		return ProducerConfig{
+			Topic:   "topic",
+			Project: "project",
+			Region:  "region",
+			Logger:  zap.NewNop(),
+		}
+	}
+	for name, tc := range map[string]struct {
+		modify func(*ProducerConfig)
+		err    string
+	}{
+		"topic": {
+			modify: func(cfg *ProducerConfig) { cfg.Topic = "" },
+			err:    "pubsublite: topic must be set",
+		},
+		"project": {
+			modify: func(cfg *ProducerConfig) { cfg.Project = "" },
+			err:    "pubsublite: project must be set",
+		},
+		"region": {
+			modify: func(cfg *ProducerConfig) { cfg.Region = "" },
+			err:    "pubsublite: region must be set",
+		},
+		"logger": {
+			modify: func(cfg *ProducerConfig) { cfg.Logger = nil },
+			err:    "pubsublite: logger must be set",
+		},
+		"linger": {
+			modify: func(cfg *ProducerConfig) { cfg.Linger = -time.Second },
+			err:    "pubsublite: linger cannot be negative",
+		},
+		"max_batch_bytes": {
+			modify: func(cfg *ProducerConfig) { cfg.MaxBatchBytes = pscompat.MaxPublishRequestBytes + 1 },
+			err:    "pubsublite: max batch bytes must be between 0 and 3670016",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid()
+			tc.modify(&cfg)
+			assert.EqualError(t, cfg.Validate(), tc.err)
+		})
+	}
+	t.Run("valid", func(t *testing.T) {
+		assert.NoError(t, valid().Validate())
+	})
+}
+
+func TestPublishSettings(t *testing.T) {
+	assert.Equal(t, pscompat.DefaultPublishSettings, publishSettings(queueconfig.ProducerBatching{}))
+
+	expected := pscompat.DefaultPublishSettings
+	expected.DelayThreshold = 50 * time.Millisecond
+	expected.ByteThreshold = 1 << 20
+	assert.Equal(t, expected, publishSettings(queueconfig.ProducerBatching{
+		Linger:        50 * time.Millisecond,
+		MaxBatchBytes: 1 << 20,
+	}))
+}
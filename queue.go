@@ -107,7 +107,7 @@ func NewConsumer(cfg ConsumerConfig) (Consumer, error) {
 // ProducerConfig wraps the different adapter producer configs
 type ProducerConfig struct {
 	Type       QueueType
-	Kafka      any // TODO(marclop)
+	Kafka      kafka.ProducerConfig
 	PubSubLite pubsublite.ProducerConfig
 }
 
@@ -115,7 +115,7 @@ type ProducerConfig struct {
 func NewProducer(cfg ProducerConfig) (Producer, error) {
 	switch cfg.Type {
 	case QueueTypeKafka:
-		// return kafka.NewProducer(cfg.Kafka)
+		return kafka.NewProducer(cfg.Kafka)
 	case QueueTypePubSubLite:
 		return pubsublite.NewProducer(context.Background(), cfg.PubSubLite)
 	}
@@ -0,0 +1,33 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package queueconfig holds the configuration shared by the queue backends,
+// so they behave alike when switching from one to the other.
+package queueconfig
+
+import "time"
+
+// ProducerBatching controls how the producers batch the events before they
+// are sent. It is embedded in the producer configs of the backends and mapped
+// to their native options. The zero values keep the backend defaults.
+type ProducerBatching struct {
+	// Linger is the time a producer waits for more events before sending a
+	// batch which isn't full.
+	Linger time.Duration
+	// MaxBatchBytes is the size in bytes at which a batch is sent.
+	MaxBatchBytes int
+}
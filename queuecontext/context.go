@@ -37,3 +37,38 @@ func ProjectFromContext(ctx context.Context) (string, bool) {
 	}
 	return "", false
 }
+
+type metadataKey struct{}
+
+// WithMetadata returns a copy of ctx holding the metadata, which producers
+// propagate alongside the events, such as Pub/Sub Lite message attributes.
+func WithMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	return context.WithValue(ctx, metadataKey{}, metadata)
+}
+
+// MetadataFromContext returns the metadata held by ctx, if any.
+func MetadataFromContext(ctx context.Context) (map[string]string, bool) {
+	if v := ctx.Value(metadataKey{}); v != nil {
+		metadata, ok := v.(map[string]string)
+		return metadata, ok
+	}
+	return nil, false
+}
+
+type compressionKey struct{}
+
+// WithCompression returns a copy of ctx which overrides the compression codec
+// of the records produced with it, such as "gzip" or "zstd". The supported
+// codecs depend on the producer.
+func WithCompression(ctx context.Context, codec string) context.Context {
+	return context.WithValue(ctx, compressionKey{}, codec)
+}
+
+// CompressionFromContext returns the compression codec held by ctx, if any.
+func CompressionFromContext(ctx context.Context) (string, bool) {
+	if v := ctx.Value(compressionKey{}); v != nil {
+		codec, ok := v.(string)
+		return codec, ok
+	}
+	return "", false
+}